@@ -5,10 +5,12 @@ import (
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/dynamodb"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ecs"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
 	"github.com/pulumi/pulumi-awsx/sdk/v2/go/awsx/awsx"
 	ecsx "github.com/pulumi/pulumi-awsx/sdk/v2/go/awsx/ecs"
 	"github.com/pulumi/pulumi-awsx/sdk/v2/go/awsx/lb"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 	"os"
 )
 
@@ -19,6 +21,9 @@ func main() {
 	imageName := fmt.Sprintf("%s.dkr.ecr.us-west-2.amazonaws.com/messaging-system-app:1.0.15", awsAccount)
 
 	pulumi.Run(func(ctx *pulumi.Context) error {
+		// secret used by the service to sign authentication tokens, shared by all instances
+		authSecret := config.New(ctx, "").RequireSecret("authSecret")
+
 		// Create required DynamoDB tables
 		_, err := dynamodb.NewTable(ctx, "messagesTable", &dynamodb.TableArgs{
 			Attributes: dynamodb.TableAttributeArray{
@@ -27,12 +32,48 @@ func main() {
 					Type: pulumi.String("S"),
 				},
 				&dynamodb.TableAttributeArgs{
-					Name: pulumi.String("Timestamp"),
+					Name: pulumi.String("MessageId"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ChangeId"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ConversationKey"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ThreadKey"),
 					Type: pulumi.String("S"),
 				},
 			},
-			HashKey:        pulumi.String("RecipientId"),
-			RangeKey:       pulumi.String("Timestamp"),
+			HashKey:  pulumi.String("RecipientId"),
+			RangeKey: pulumi.String("MessageId"),
+			// messages are polled by change, so that edits and deletions are returned after they happen
+			LocalSecondaryIndexes: dynamodb.TableLocalSecondaryIndexArray{
+				&dynamodb.TableLocalSecondaryIndexArgs{
+					Name:           pulumi.String("ChangeIdIndex"),
+					RangeKey:       pulumi.String("ChangeId"),
+					ProjectionType: pulumi.String("ALL"),
+				},
+			},
+			// the history of a private conversation has the messages of both users, only private messages have a ConversationKey
+			// the replies of a thread are found across the recipients, only stored replies have a ThreadKey
+			GlobalSecondaryIndexes: dynamodb.TableGlobalSecondaryIndexArray{
+				&dynamodb.TableGlobalSecondaryIndexArgs{
+					Name:           pulumi.String("ConversationIndex"),
+					HashKey:        pulumi.String("ConversationKey"),
+					RangeKey:       pulumi.String("MessageId"),
+					ProjectionType: pulumi.String("ALL"),
+				},
+				&dynamodb.TableGlobalSecondaryIndexArgs{
+					Name:           pulumi.String("ThreadIndex"),
+					HashKey:        pulumi.String("ThreadKey"),
+					RangeKey:       pulumi.String("MessageId"),
+					ProjectionType: pulumi.String("ALL"),
+				},
+			},
 			BillingMode:    pulumi.String("PAY_PER_REQUEST"),
 			StreamEnabled:  pulumi.Bool(true),
 			StreamViewType: pulumi.String("NEW_AND_OLD_IMAGES"),
@@ -77,6 +118,175 @@ func main() {
 			return err
 		}
 
+		_, err = dynamodb.NewTable(ctx, "invitesTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("Token"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("GroupId"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey: pulumi.String("Token"),
+			// list the invites of a group
+			GlobalSecondaryIndexes: dynamodb.TableGlobalSecondaryIndexArray{
+				&dynamodb.TableGlobalSecondaryIndexArgs{
+					Name:           pulumi.String("GroupIdIndex"),
+					HashKey:        pulumi.String("GroupId"),
+					ProjectionType: pulumi.String("ALL"),
+				},
+			},
+			// expired invites are removed by DynamoDB, invites without expiry have no ExpiresAt attribute
+			Ttl: &dynamodb.TableTtlArgs{
+				AttributeName: pulumi.String("ExpiresAt"),
+				Enabled:       pulumi.Bool(true),
+			},
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("invitesTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = dynamodb.NewTable(ctx, "conversationsTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("UserId"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ConversationId"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:     pulumi.String("UserId"),
+			RangeKey:    pulumi.String("ConversationId"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("conversationsTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		// progress of the user deletions running in the background
+		_, err = dynamodb.NewTable(ctx, "userDeletionsTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("UserId"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:     pulumi.String("UserId"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("userDeletionsTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		// attachment metadata, the contents are in the attachments bucket
+		_, err = dynamodb.NewTable(ctx, "attachmentsTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("AttachmentId"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:     pulumi.String("AttachmentId"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("attachmentsTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		// inverted index of the message texts, the postings of a term in the messages of a user or group
+		_, err = dynamodb.NewTable(ctx, "searchIndexTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ScopeTerm"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("MessageId"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:     pulumi.String("ScopeTerm"),
+			RangeKey:    pulumi.String("MessageId"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("searchIndexTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the reactions of the users to a message, counted by emoji on the message
+		_, err = dynamodb.NewTable(ctx, "reactionsTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("MessageKey"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ReactionKey"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:     pulumi.String("MessageKey"),
+			RangeKey:    pulumi.String("ReactionKey"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("reactionsTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the messages scheduled to be sent later, by sender
+		_, err = dynamodb.NewTable(ctx, "scheduledMessagesTable", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("SenderId"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ScheduleId"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("DueKey"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("SendAt"),
+					Type: pulumi.String("S"),
+				},
+			},
+			HashKey:  pulumi.String("SenderId"),
+			RangeKey: pulumi.String("ScheduleId"),
+			// the pending messages by send time, the schedulers query the due ones
+			GlobalSecondaryIndexes: dynamodb.TableGlobalSecondaryIndexArray{
+				&dynamodb.TableGlobalSecondaryIndexArgs{
+					Name:           pulumi.String("DueIndex"),
+					HashKey:        pulumi.String("DueKey"),
+					RangeKey:       pulumi.String("SendAt"),
+					ProjectionType: pulumi.String("ALL"),
+				},
+			},
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Name:        pulumi.String("scheduledMessagesTable"),
+		})
+		if err != nil {
+			return err
+		}
+
+		attachmentsBucket, err := s3.NewBucketV2(ctx, "attachments", nil)
+		if err != nil {
+			return err
+		}
+
 		lb, err := lb.NewApplicationLoadBalancer(ctx, "lb", nil)
 		if err != nil {
 			return err
@@ -107,9 +317,8 @@ func main() {
 		}
 
 		policy, err := iam.NewPolicy(ctx, "taskPolicy", &iam.PolicyArgs{
-			Description: pulumi.String("Policy for Fargate task to access DynamoDB"),
-			Policy: pulumi.String(
-				fmt.Sprintf(`{
+			Description: pulumi.String("Policy for Fargate task to access DynamoDB and the attachments bucket"),
+			Policy: pulumi.Sprintf(`{
 					"Version": "2012-10-17",
 					"Statement": [
 						{
@@ -121,14 +330,23 @@ func main() {
 								"dynamodb:GetItem",
 								"dynamodb:PutItem",
 								"dynamodb:UpdateItem",
-								"dynamodb:DeleteItem"
+								"dynamodb:DeleteItem",
+								"dynamodb:BatchWriteItem"
 							],
 							
 							"Resource": "*"
+						},
+						{
+							"Effect": "Allow",
+							"Action": [
+								"s3:GetObject",
+								"s3:PutObject",
+								"s3:DeleteObject"
+							],
+							"Resource": "%s/*"
 						}
 					]
-				}`),
-			),
+				}`, attachmentsBucket.Arn),
 		})
 		if err != nil {
 			return err
@@ -156,6 +374,20 @@ func main() {
 					Cpu:       pulumi.Int(128),
 					Memory:    pulumi.Int(512),
 					Essential: pulumi.Bool(true),
+					Environment: ecsx.TaskDefinitionKeyValuePairArray{
+						&ecsx.TaskDefinitionKeyValuePairArgs{
+							Name:  pulumi.String("AUTH_SECRET"),
+							Value: authSecret,
+						},
+						&ecsx.TaskDefinitionKeyValuePairArgs{
+							Name:  pulumi.String("BLOB_STORE"),
+							Value: pulumi.String("s3"),
+						},
+						&ecsx.TaskDefinitionKeyValuePairArgs{
+							Name:  pulumi.String("S3_BUCKET"),
+							Value: attachmentsBucket.Bucket,
+						},
+					},
 					PortMappings: ecsx.TaskDefinitionPortMappingArray{
 						&ecsx.TaskDefinitionPortMappingArgs{
 							ContainerPort: pulumi.Int(80),
@@ -0,0 +1,150 @@
+package attachments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"io"
+	. "server/common"
+	"server/db"
+	"time"
+)
+
+const (
+	// MaxAttachmentSize is the largest file accepted, in bytes
+	MaxAttachmentSize  = 25 << 20
+	defaultContentType = "application/octet-stream"
+)
+
+type UploadRequest struct {
+	FileName    string
+	ContentType string // MIME type, application/octet-stream if empty
+	Size        int64
+	Content     io.Reader
+}
+
+type HandlerInterface interface {
+	Upload(ctx context.Context, userId string, req UploadRequest) (*Attachment, error)
+	Download(ctx context.Context, userId string, attachmentId string) (*Attachment, io.ReadCloser, error)
+}
+
+type Handler struct {
+	DBClient db.DynamoDBClientInterface
+	Store    BlobStore
+}
+
+/*
+Upload a file, the attachment can then be sent with a single message of the uploader
+The content is stored in the blob store under the attachment ID, then the metadata with its checksum in the database
+*/
+func (handler *Handler) Upload(ctx context.Context, userId string, req UploadRequest) (*Attachment, error) {
+	if req.FileName == "" {
+		slog.Error("fileName is required")
+		return nil, &BadRequestError{Message: "fileName is required"}
+	}
+	if req.Size <= 0 || req.Size > MaxAttachmentSize {
+		slog.Error(fmt.Sprintf("Invalid attachment size %d", req.Size))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Attachment size must be between 1 and %d bytes", MaxAttachmentSize)}
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	attachmentId := fmt.Sprintf("attachment-%s", uuid.New().String())
+	checksum := sha256.New()
+	err := handler.Store.Put(ctx, attachmentId, io.TeeReader(req.Content, checksum), req.Size, contentType)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing content of attachment %s: %v", attachmentId, err))
+		return nil, &InternalServerError{Message: "Error storing attachment"}
+	}
+
+	attachment := Attachment{
+		AttachmentId: attachmentId,
+		UploaderId:   userId,
+		FileName:     req.FileName,
+		ContentType:  contentType,
+		Size:         req.Size,
+		Checksum:     hex.EncodeToString(checksum.Sum(nil)),
+		CreatedAt:    time.Now().Format(time.RFC3339),
+	}
+	err = handler.DBClient.StoreAttachment(ctx, attachment)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing attachment %s: %v", attachmentId, err))
+		// the content is not referenced without its metadata
+		if err = handler.Store.Delete(ctx, attachmentId); err != nil {
+			slog.Error(fmt.Sprintf("Error deleting content of attachment %s: %v", attachmentId, err))
+		}
+		return nil, &InternalServerError{Message: "Error storing attachment"}
+	}
+
+	slog.Info(fmt.Sprintf("Attachment %s of %d bytes uploaded by user %s", attachmentId, req.Size, userId))
+	return &attachment, nil
+}
+
+/*
+Download an attachment, the content is to be closed by the caller
+Allowed to the uploader, and once sent to the recipient of the private message or to the members of the group,
+except to the members that hide or collapse the messages of the uploader
+*/
+func (handler *Handler) Download(ctx context.Context, userId string, attachmentId string) (*Attachment, io.ReadCloser, error) {
+	attachment, err := handler.DBClient.GetAttachment(ctx, attachmentId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting attachment %s: %v", attachmentId, err))
+		return nil, nil, &InternalServerError{Message: "Error getting attachment"}
+	}
+	if attachment == nil {
+		slog.Error(fmt.Sprintf("Attachment not found: %v", attachmentId))
+		return nil, nil, &NotFoundError{Message: "Attachment not found"}
+	}
+	allowed, err := handler.canDownload(ctx, userId, attachment)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		slog.Error(fmt.Sprintf("User %s can not download attachment %s", userId, attachmentId))
+		return nil, nil, &ForbiddenError{Message: "Only the recipients of the message can download the attachment"}
+	}
+
+	content, err := handler.Store.Get(ctx, attachmentId)
+	if errors.Is(err, ErrBlobNotFound) {
+		slog.Error(fmt.Sprintf("Content of attachment %s not found", attachmentId))
+		return nil, nil, &NotFoundError{Message: "Attachment not found"}
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting content of attachment %s: %v", attachmentId, err))
+		return nil, nil, &InternalServerError{Message: "Error getting attachment"}
+	}
+	return attachment, content, nil
+}
+
+// canDownload returns true if the user is the uploader or a recipient of the message the attachment was sent with.
+func (handler *Handler) canDownload(ctx context.Context, userId string, attachment *Attachment) (bool, error) {
+	if attachment.UploaderId == userId || attachment.RecipientId == userId {
+		return true, nil
+	}
+	if attachment.RecipientId == "" {
+		// not sent yet
+		return false, nil
+	}
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return false, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User not found: %v", userId))
+		return false, &NotFoundError{Message: "User not found"}
+	}
+	// a private recipient is never in the groups of the user
+	if !user.Groups[attachment.RecipientId] {
+		return false, nil
+	}
+	// the attachments of a blocked sender are withheld with the text of their messages
+	viewed, visible := NewMessageView(*user).Apply(Message{RecipientId: attachment.RecipientId, SenderId: attachment.UploaderId})
+	return visible && !viewed.Collapsed, nil
+}
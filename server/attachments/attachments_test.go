@@ -0,0 +1,178 @@
+package attachments
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	. "server/common"
+	"server/db"
+	"strings"
+	"testing"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	store, err := NewLocalBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	return &Handler{DBClient: db.NewMockDBClient(), Store: store}
+}
+
+func upload(ctx context.Context, handler *Handler, userId string, content string) (*Attachment, error) {
+	return handler.Upload(ctx, userId, UploadRequest{
+		FileName:    "hello.txt",
+		ContentType: "text/plain",
+		Size:        int64(len(content)),
+		Content:     strings.NewReader(content),
+	})
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestHandler(t)
+
+	t.Run("Upload attachment successfully", func(t *testing.T) {
+		attachment, err := upload(ctx, handler, "test-user-1", "hello")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-user-1", attachment.UploaderId)
+		assert.Equal(t, "text/plain", attachment.ContentType)
+		assert.Equal(t, int64(5), attachment.Size)
+		assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", attachment.Checksum)
+		assert.Equal(t, *attachment, handler.DBClient.(*db.MockDBClient).Attachments[attachment.AttachmentId])
+
+		content, err := handler.Store.Get(ctx, attachment.AttachmentId)
+		assert.NoError(t, err)
+		defer content.Close()
+		data, _ := io.ReadAll(content)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("Content type defaults to binary", func(t *testing.T) {
+		attachment, err := handler.Upload(ctx, "test-user-1", UploadRequest{FileName: "data", Size: 5, Content: strings.NewReader("hello")})
+		assert.NoError(t, err)
+		assert.Equal(t, "application/octet-stream", attachment.ContentType)
+	})
+
+	t.Run("Invalid uploads", func(t *testing.T) {
+		for _, req := range []UploadRequest{
+			{Size: 5, Content: strings.NewReader("hello")},
+			{FileName: "empty.txt", Size: 0, Content: strings.NewReader("")},
+			{FileName: "large.bin", Size: MaxAttachmentSize + 1, Content: strings.NewReader("hello")},
+		} {
+			_, err := handler.Upload(ctx, "test-user-1", req)
+			assert.IsType(t, &BadRequestError{}, err)
+		}
+	})
+
+	t.Run("Content shorter than the size", func(t *testing.T) {
+		_, err := handler.Upload(ctx, "test-user-1", UploadRequest{FileName: "short.txt", Size: 10, Content: strings.NewReader("hello")})
+		assert.IsType(t, &InternalServerError{}, err)
+	})
+
+	t.Run("Content is deleted if the metadata is not stored", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := NewLocalBlobStore(dir)
+		dbClient := db.NewMockDBClient()
+		dbClient.Error = fmt.Errorf("db error")
+		handler := &Handler{DBClient: dbClient, Store: store}
+		_, err := upload(ctx, handler, "test-user-1", "hello")
+		assert.IsType(t, &InternalServerError{}, err)
+		files, _ := os.ReadDir(dir)
+		assert.Empty(t, files)
+	})
+}
+
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestHandler(t)
+
+	uploader := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	member := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	for _, user := range []User{uploader, recipient, member, other} {
+		handler.DBClient.StoreUser(ctx, user)
+	}
+	group := Group{GroupId: "test-group-1", Members: map[string]bool{}}
+	otherGroup := Group{GroupId: "test-group-2", Members: map[string]bool{}}
+	handler.DBClient.StoreGroup(ctx, group)
+	handler.DBClient.StoreGroup(ctx, otherGroup)
+	handler.DBClient.AddUserToGroup(ctx, group, uploader)
+	handler.DBClient.AddUserToGroup(ctx, group, member)
+	handler.DBClient.AddUserToGroup(ctx, otherGroup, other)
+
+	download := func(userId string, attachmentId string) (string, error) {
+		_, content, err := handler.Download(ctx, userId, attachmentId)
+		if err != nil {
+			return "", err
+		}
+		defer content.Close()
+		data, _ := io.ReadAll(content)
+		return string(data), nil
+	}
+
+	t.Run("Uploader downloads attachment not sent yet", func(t *testing.T) {
+		attachment, _ := upload(ctx, handler, uploader.UserId, "hello")
+		data, err := download(uploader.UserId, attachment.AttachmentId)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", data)
+
+		_, err = download(recipient.UserId, attachment.AttachmentId)
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Private recipient downloads attachment", func(t *testing.T) {
+		attachment, _ := upload(ctx, handler, uploader.UserId, "hello")
+		handler.DBClient.SendAttachment(ctx, attachment.AttachmentId, recipient.UserId, "test-message-1")
+
+		data, err := download(recipient.UserId, attachment.AttachmentId)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", data)
+
+		_, err = download(member.UserId, attachment.AttachmentId)
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Group members download attachment", func(t *testing.T) {
+		attachment, _ := upload(ctx, handler, uploader.UserId, "hello")
+		handler.DBClient.SendAttachment(ctx, attachment.AttachmentId, "test-group-1", "test-message-2")
+
+		data, err := download(member.UserId, attachment.AttachmentId)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", data)
+
+		_, err = download(other.UserId, attachment.AttachmentId)
+		assert.IsType(t, &ForbiddenError{}, err)
+		_, err = download(recipient.UserId, attachment.AttachmentId)
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Members that collapse or hide the messages of the uploader", func(t *testing.T) {
+		attachment, _ := upload(ctx, handler, uploader.UserId, "hello")
+		handler.DBClient.SendAttachment(ctx, attachment.AttachmentId, "test-group-1", "test-message-3")
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, blocking)
+		handler.DBClient.AddUserToGroup(ctx, group, blocking)
+		handler.DBClient.BlockUser(ctx, blocking, uploader.UserId)
+
+		_, err := download(blocking.UserId, attachment.AttachmentId)
+		assert.NoError(t, err)
+		for _, setting := range []string{BlockedMessagesCollapse, BlockedMessagesHide} {
+			handler.DBClient.SetBlockedGroupMessages(ctx, blocking, setting)
+			_, err = download(blocking.UserId, attachment.AttachmentId)
+			assert.IsType(t, &ForbiddenError{}, err, setting)
+		}
+	})
+
+	t.Run("Attachment not found", func(t *testing.T) {
+		_, err := download(uploader.UserId, "attachment-missing")
+		assert.IsType(t, &NotFoundError{}, err)
+
+		// metadata without content
+		attachment, _ := upload(ctx, handler, uploader.UserId, "hello")
+		handler.Store.Delete(ctx, attachment.AttachmentId)
+		_, err = download(uploader.UserId, attachment.AttachmentId)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+}
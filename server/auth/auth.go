@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+const DefaultTokenTTL = 24 * time.Hour
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Authenticator issues and validates HMAC signed JWTs, the token subject is the user ID.
+type Authenticator struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewAuthenticator(secret []byte, ttl time.Duration) *Authenticator {
+	return &Authenticator{secret: secret, ttl: ttl}
+}
+
+// IssueToken returns a signed token for the user and its expiration time.
+func (a *Authenticator) IssueToken(userId string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   userId,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	})
+	signed, err := token.SignedString(a.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseToken validates the token signature and expiration and returns the user ID it was issued for.
+func (a *Authenticator) ParseToken(token string) (string, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return claims.Subject, nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	authenticator := NewAuthenticator([]byte("test-secret"), time.Hour)
+
+	t.Run("issue and parse token", func(t *testing.T) {
+		token, expiresAt, err := authenticator.IssueToken("test-user-1")
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+		userId, err := authenticator.ParseToken(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "test-user-1", userId)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		token, _, err := NewAuthenticator([]byte("test-secret"), -time.Minute).IssueToken("test-user-1")
+		assert.NoError(t, err)
+
+		_, err = authenticator.ParseToken(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("token signed with another secret", func(t *testing.T) {
+		token, _, err := NewAuthenticator([]byte("other-secret"), time.Hour).IssueToken("test-user-1")
+		assert.NoError(t, err)
+
+		_, err = authenticator.ParseToken(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("malformed token", func(t *testing.T) {
+		_, err := authenticator.ParseToken("not-a-token")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestPasswords(t *testing.T) {
+	hash, err := HashPassword("secret-password")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "secret-password", hash)
+	assert.True(t, CheckPassword(hash, "secret-password"))
+	assert.False(t, CheckPassword(hash, "wrong-password"))
+	assert.False(t, CheckPassword("", "secret-password"))
+}
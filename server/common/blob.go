@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrBlobNotFound is returned when getting a blob that does not exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the content of attachments by key, the metadata is stored in the database.
+// Blobs are written once and never replaced, so that a stored checksum always matches its blob.
+type BlobStore interface {
+	// Put stores the size bytes read from the content under the key.
+	Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) error
+	// Get returns the content of the blob, to be closed by the caller, or ErrBlobNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes the blob, deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// localBlobStore keeps the blobs as files in a directory, for a single instance or a shared volume.
+type localBlobStore struct {
+	dir string
+}
+
+// NewLocalBlobStore returns a blob store in the directory, it is created if missing.
+func NewLocalBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+// path returns the file of the key, keys are file names so that a key can not point outside of the directory.
+func (s *localBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || filepath.Base(key) != key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a failed upload never leaves a partial blob
+	file, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	written, err := io.Copy(file, io.LimitReader(content, size+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("blob %s has %d bytes, expected %d", key, written, size)
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	t.Run("put and get blob", func(t *testing.T) {
+		assert.NoError(t, store.Put(ctx, "test-blob", strings.NewReader("hello"), 5, "text/plain"))
+		content, err := store.Get(ctx, "test-blob")
+		assert.NoError(t, err)
+		defer content.Close()
+		data, _ := io.ReadAll(content)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("blob not found", func(t *testing.T) {
+		_, err := store.Get(ctx, "test-missing")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("delete blob", func(t *testing.T) {
+		assert.NoError(t, store.Put(ctx, "test-deleted", strings.NewReader("hello"), 5, "text/plain"))
+		assert.NoError(t, store.Delete(ctx, "test-deleted"))
+		_, err := store.Get(ctx, "test-deleted")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+		// deleting again is not an error
+		assert.NoError(t, store.Delete(ctx, "test-deleted"))
+	})
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	testBlobStore(t, store)
+
+	t.Run("short content is not stored", func(t *testing.T) {
+		err := store.Put(context.Background(), "test-short", strings.NewReader("hel"), 5, "text/plain")
+		assert.Error(t, err)
+		_, err = store.Get(context.Background(), "test-short")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("keys outside of the directory", func(t *testing.T) {
+		for _, key := range []string{"", "..", "../test-blob", "dir/test-blob"} {
+			assert.Error(t, store.Put(context.Background(), key, strings.NewReader("hello"), 5, "text/plain"))
+		}
+	})
+}
+
+// fakeS3 serves the objects of one bucket by path, like S3 with path style addressing.
+// Without the list permission a missing object is forbidden, like S3 answers it.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	canList   bool
+	putHeader http.Header
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/test-bucket/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key], _ = io.ReadAll(r.Body)
+		f.putHeader = r.Header
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok && f.canList {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>AccessDenied</Code></Error>")
+			return
+		}
+		w.Write(object)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestS3BlobStore(server *httptest.Server, credentials aws.CredentialsProvider) *s3BlobStore {
+	client := s3.New(s3.Options{
+		Region:       "us-west-2",
+		Credentials:  credentials,
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		HTTPClient:   server.Client(),
+	})
+	return &s3BlobStore{client: client, bucket: "test-bucket"}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, canList: true}
+	// the content is streamed unsigned, which S3 accepts over HTTPS only
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	credentials := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "test-key", SecretAccessKey: "test-secret"}, nil
+	})
+	store := newTestS3BlobStore(server, credentials)
+	testBlobStore(t, store)
+
+	t.Run("content is streamed", func(t *testing.T) {
+		// a reader that can not be rewound, like an upload
+		content := io.MultiReader(strings.NewReader("hello"))
+		assert.NoError(t, store.Put(context.Background(), "test-streamed", content, 5, "text/plain"))
+		assert.Equal(t, "text/plain", fake.putHeader.Get("Content-Type"))
+		assert.Equal(t, "5", fake.putHeader.Get("Content-Length"))
+	})
+
+	t.Run("missing object without the list permission", func(t *testing.T) {
+		fake.canList = false
+		defer func() { fake.canList = true }()
+		_, err := store.Get(context.Background(), "test-missing")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+	})
+
+	t.Run("requests are signed", func(t *testing.T) {
+		unsigned := newTestS3BlobStore(server, aws.AnonymousCredentials{})
+		err := unsigned.Put(context.Background(), "test-blob", bytes.NewReader([]byte("hello")), 5, "text/plain")
+		assert.Error(t, err)
+	})
+}
@@ -1,135 +1,231 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/exp/slog"
-	"log"
+	"sort"
 	"time"
 )
 
 import lru "github.com/hashicorp/golang-lru"
 
-var cache *lru.Cache
+const (
+	// DefaultCacheTTL is how long a cached user or group is served, it bounds how stale a record cached by
+	// one instance can be after another instance changed it.
+	DefaultCacheTTL = 5 * time.Minute
+	// RecentMessagesWindow is how long group messages are cached, as usually users check for messages at least once a minute.
+	RecentMessagesWindow = time.Minute
+	// DefaultLRUCacheSize is the number of entries of the in-process cache.
+	DefaultLRUCacheSize = 1000
+)
 
 const (
 	groupCacheKeyPrefix   = "group-"
 	userCacheKeyPrefix    = "user-"
-	messageCacheKeyPrefix = "group-messages-"
+	messageCacheKeyPrefix = "messages-"
 )
 
 func getGroupCacheKey(groupId string) string   { return groupCacheKeyPrefix + groupId }
 func getUserCacheKey(userId string) string     { return userCacheKeyPrefix + userId }
 func getMessageCacheKey(groupId string) string { return messageCacheKeyPrefix + groupId }
 
-func init() {
-	var err error
-	cache, err = lru.New(1000) // 1000 items should be modified to a more reasonable number
+// Cache caches users, groups and the recent messages of groups in front of the database.
+// Users and groups are removed from the cache whenever they are written and cached again on the next read,
+// the recent messages of a group are shared by all of its members polling for them.
+// A cache never fails a request, errors are logged and handled as a cache miss.
+type Cache interface {
+	GetUser(ctx context.Context, userId string) (*User, bool)
+	StoreUser(ctx context.Context, user *User)
+	RemoveUser(ctx context.Context, userId string)
+	GetGroup(ctx context.Context, groupId string) (*Group, bool)
+	StoreGroup(ctx context.Context, group *Group)
+	RemoveGroup(ctx context.Context, groupId string)
+	// GetGroupMessages returns the cached messages of the group changed after the unix timestamp, ordered by change ID.
+	// It returns false if there are none, since the cache holds only the messages of the last RecentMessagesWindow.
+	GetGroupMessages(ctx context.Context, groupId string, timestamp int64) ([]Message, bool)
+	// StoreGroupMessages replaces the cached messages of the group, only messages of the last RecentMessagesWindow are stored.
+	StoreGroupMessages(ctx context.Context, groupId string, messages []Message)
+	// StoreMessage adds a new or changed message to the cached messages of its group, if the group messages are cached.
+	// A changed message replaces its previous version, so that the cache does not serve stale text.
+	StoreMessage(ctx context.Context, message Message)
+}
+
+// recentMessages returns the messages changed in the last RecentMessagesWindow.
+func recentMessages(messages []Message) []Message {
+	windowStart := MessageIdAfter(time.Now().Add(-RecentMessagesWindow).Unix())
+	var recent []Message
+	for _, msg := range messages {
+		if msg.ChangeId > windowStart {
+			recent = append(recent, msg)
+		}
+	}
+	return recent
+}
+
+// messagesChangedAfter returns the recent messages changed after the unix timestamp, ordered by change ID.
+func messagesChangedAfter(messages []Message, timestamp int64) []Message {
+	after := MessageIdAfter(timestamp)
+	var changed []Message
+	for _, msg := range recentMessages(messages) {
+		if msg.ChangeId > after {
+			changed = append(changed, msg)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].ChangeId < changed[j].ChangeId
+	})
+	return changed
+}
+
+// copyMap returns a copy of a set of IDs, nil stays nil.
+func copyMap(m map[string]bool) map[string]bool {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]bool, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// copyUser returns a copy of the user that shares no maps with it, so that a caller changing the user it got from
+// the cache, for example to write a new membership that then fails, does not change the cached user.
+func copyUser(user *User) *User {
+	copied := *user
+	copied.BlockedUsers = copyMap(user.BlockedUsers)
+	copied.Groups = copyMap(user.Groups)
+	copied.Muted = copyMap(user.Muted)
+	return &copied
+}
+
+// copyGroup returns a copy of the group that shares no maps with it, see copyUser.
+func copyGroup(group *Group) *Group {
+	copied := *group
+	copied.Admins = copyMap(group.Admins)
+	copied.Members = copyMap(group.Members)
+	copied.Banned = copyMap(group.Banned)
+	return &copied
+}
+
+// lruCache is an in-process cache, each instance of the service has its own.
+// Users and groups are copied in and out of the cache, as the other caches serialize them.
+type lruCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+}
+
+type lruEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// NewLRUCache returns an in-process cache of up to size entries, users and groups expire after ttl.
+// Since it is not shared, another instance of the service may serve a user or group changed here for up to ttl.
+func NewLRUCache(size int, ttl time.Duration) (Cache, error) {
+	cache, err := lru.New(size)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return &lruCache{cache: cache, ttl: ttl}, nil
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	val, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := val.(lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.cache.Remove(key)
+		return nil, false
 	}
+	return entry.value, true
+}
 
+func (c *lruCache) store(key string, value interface{}, ttl time.Duration) {
+	c.cache.Add(key, lruEntry{value: value, expiresAt: time.Now().Add(ttl)})
 }
 
-func GetUserFromCache(userId string) (*User, bool) {
-	key := getUserCacheKey(userId)
-	if val, ok := getItem(key); ok {
+func (c *lruCache) GetUser(ctx context.Context, userId string) (*User, bool) {
+	if val, ok := c.get(getUserCacheKey(userId)); ok {
 		slog.Info(fmt.Sprintf("User %s found in cache", userId))
-		return val.(*User), ok
+		return copyUser(val.(*User)), true
 	}
 	slog.Info(fmt.Sprintf("User %s not found in cache", userId))
 	return nil, false
 }
 
-func GetGroupFromCache(groupId string) (*Group, bool) {
-	key := getGroupCacheKey(groupId)
-	if val, ok := getItem(key); ok {
+func (c *lruCache) StoreUser(ctx context.Context, user *User) {
+	c.store(getUserCacheKey(user.UserId), copyUser(user), c.ttl)
+	slog.Info(fmt.Sprintf("User %s stored in cache", user.UserId))
+}
+
+func (c *lruCache) RemoveUser(ctx context.Context, userId string) {
+	c.cache.Remove(getUserCacheKey(userId))
+}
+
+func (c *lruCache) GetGroup(ctx context.Context, groupId string) (*Group, bool) {
+	if val, ok := c.get(getGroupCacheKey(groupId)); ok {
 		slog.Info(fmt.Sprintf("Group %s found in cache", groupId))
-		return val.(*Group), ok
+		return copyGroup(val.(*Group)), true
 	}
 	slog.Info(fmt.Sprintf("Group %s not found in cache", groupId))
 	return nil, false
 }
 
-func getItem(key string) (interface{}, bool) {
-	return cache.Get(key)
-}
-
-func StoreUserInCache(value *User) {
-	key := getUserCacheKey(value.UserId)
-	storeInCache(key, value)
-	slog.Info(fmt.Sprintf("User %s stored in cache", value.UserId))
+func (c *lruCache) StoreGroup(ctx context.Context, group *Group) {
+	c.store(getGroupCacheKey(group.GroupId), copyGroup(group), c.ttl)
+	slog.Info(fmt.Sprintf("Group %s stored in cache", group.GroupId))
 }
 
-func StoreGroupInCache(value *Group) {
-	key := getGroupCacheKey(value.GroupId)
-	storeInCache(key, value)
-	slog.Info(fmt.Sprintf("Group %s stored in cache", value.GroupId))
+func (c *lruCache) RemoveGroup(ctx context.Context, groupId string) {
+	c.cache.Remove(getGroupCacheKey(groupId))
 }
 
-func storeInCache(key string, value interface{}) {
-	cache.Add(key, value)
-
+func (c *lruCache) GetGroupMessages(ctx context.Context, groupId string, timestamp int64) ([]Message, bool) {
+	val, ok := c.get(getMessageCacheKey(groupId))
+	if !ok {
+		slog.Info(fmt.Sprintf("Messages for group %s not found in cache", groupId))
+		return nil, false
+	}
+	// return only the messages according to the requested timestamp
+	requestedMessages := messagesChangedAfter(val.([]Message), timestamp)
+	if len(requestedMessages) == 0 {
+		slog.Info(fmt.Sprintf("Valid messages for group %s not found in cache", groupId))
+		return nil, false
+	}
+	slog.Info(fmt.Sprintf("Messages for group %s found in cache", groupId))
+	return requestedMessages, true
 }
 
-// StoreMessagesInCache will only store last minute messages in cache to avoid memory issues.
-func StoreMessagesInCache(groupId string, messages []Message) {
-	key := getMessageCacheKey(groupId)
-	// only store messages from the last 1 minute
-	var validMessages []Message
-	for _, msg := range messages {
-		if msg.Timestamp > time.Now().Add(-1*time.Minute).Format(time.RFC3339) {
-			validMessages = append(validMessages, msg)
-		}
-	}
-	if len(validMessages) > 0 {
-		storeInCache(key, validMessages)
+func (c *lruCache) StoreGroupMessages(ctx context.Context, groupId string, messages []Message) {
+	// only store messages from the last minute
+	if validMessages := recentMessages(messages); len(validMessages) > 0 {
+		c.store(getMessageCacheKey(groupId), validMessages, RecentMessagesWindow)
 		slog.Info(fmt.Sprintf("Messages for group %s stored in cache", groupId))
 	}
 }
-func StoreMessageInCache(message Message) {
+
+func (c *lruCache) StoreMessage(ctx context.Context, message Message) {
 	key := getMessageCacheKey(message.RecipientId)
 	// only store to the cache if the group already exists in cache
-	if val, ok := getItem(key); ok {
-		messages := val.([]Message)
-		messages = append(messages, message)
-		storeInCache(key, messages)
-		slog.Info(fmt.Sprintf("Message for group %s stored in cache", message.RecipientId))
+	val, ok := c.cache.Get(key)
+	if !ok {
+		return
 	}
-}
-
-func GetGroupMessagesFromCache(groupId string, timestamp int64) ([]Message, bool) {
-	key := getMessageCacheKey(groupId)
-	if val, ok := getItem(key); ok {
-		allMessages := val.([]Message)
-		var requestedMessages []Message
-		// we only want messages that are newer than the timestamp additionally we want to evict all messages older than 1 minutes
-		for i, msg := range allMessages {
-			if msg.Timestamp > time.Unix(timestamp, 0).Format(time.RFC3339) {
-				requestedMessages = append(requestedMessages, msg)
-			}
-			if msg.Timestamp < time.Now().Add(-1*time.Minute).Format(time.RFC3339) {
-				// evict message
-				allMessages = append(allMessages[:i], allMessages[i+1:]...)
-			}
-		}
-		// store the updated messages back in the cache
-		if len(allMessages) > 0 {
-			storeInCache(key, allMessages)
-			slog.Info(fmt.Sprintf("Messages for group %s stored in cache", groupId))
-		} else {
-			// evict group from cache if no items left
-			slog.Info(fmt.Sprintf("Evicting group %s from cache as all messeges are old", groupId))
-			cache.Remove(key)
+	entry := val.(lruEntry)
+	cached := entry.value.([]Message)
+	// copy, the cached slice may be in use by readers
+	messages := make([]Message, 0, len(cached)+1)
+	for _, msg := range recentMessages(cached) {
+		if msg.MessageId != message.MessageId {
+			messages = append(messages, msg)
 		}
-		// return only the messages according to the requested timestamp
-		if len(requestedMessages) > 0 {
-			slog.Info(fmt.Sprintf("Messages for group %s found in cache", groupId))
-			return requestedMessages, true
-		}
-		slog.Info(fmt.Sprintf("Valid messages for group %s not found in cache", groupId))
-		return nil, false
 	}
-	slog.Info(fmt.Sprintf("Messages for group %s not found in cache", groupId))
-	return nil, false
-
+	messages = append(messages, message)
+	// the messages expire with the ones that were cached before
+	c.cache.Add(key, lruEntry{value: messages, expiresAt: entry.expiresAt})
+	slog.Info(fmt.Sprintf("Message for group %s stored in cache", message.RecipientId))
 }
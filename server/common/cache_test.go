@@ -0,0 +1,192 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRedisCache(t *testing.T, server *miniredis.Miniredis, ttl time.Duration) Cache {
+	cache, err := NewRedisCache(context.Background(), server.Addr(), ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func newTestMessage(groupId string, changedAt time.Time, text string) Message {
+	id := NewMessageId(changedAt)
+	return Message{RecipientId: groupId, MessageId: id, ChangeId: id, Timestamp: changedAt.Format(time.RFC3339), SenderId: "test-sender", Message: text}
+}
+
+// testCache runs the behaviour every cache implementation shares.
+func testCache(t *testing.T, cache Cache) {
+	ctx := context.Background()
+
+	t.Run("users are cached until removed", func(t *testing.T) {
+		user := &User{UserId: "test-user", UserName: "test", Groups: map[string]bool{"test-group": true}}
+		_, ok := cache.GetUser(ctx, user.UserId)
+		assert.False(t, ok)
+
+		cache.StoreUser(ctx, user)
+		cached, ok := cache.GetUser(ctx, user.UserId)
+		assert.True(t, ok)
+		assert.Equal(t, user, cached)
+
+		// changing the user does not change the cached user
+		cached.Groups["test-group-other"] = true
+		user.Groups["test-group-other"] = true
+		cached, _ = cache.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-group": true}, cached.Groups)
+
+		cache.RemoveUser(ctx, user.UserId)
+		_, ok = cache.GetUser(ctx, user.UserId)
+		assert.False(t, ok)
+	})
+
+	t.Run("groups are cached until removed", func(t *testing.T) {
+		group := &Group{GroupId: "test-group", OwnerId: "test-owner", Members: map[string]bool{"test-owner": true}, Banned: map[string]bool{"test-banned": true}}
+		cache.StoreGroup(ctx, group)
+		cached, ok := cache.GetGroup(ctx, group.GroupId)
+		assert.True(t, ok)
+		assert.Equal(t, group, cached)
+
+		cached.Members["test-user"] = true
+		delete(cached.Banned, "test-banned")
+		cached, _ = cache.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, map[string]bool{"test-owner": true}, cached.Members)
+		assert.Equal(t, map[string]bool{"test-banned": true}, cached.Banned)
+
+		cache.RemoveGroup(ctx, group.GroupId)
+		_, ok = cache.GetGroup(ctx, group.GroupId)
+		assert.False(t, ok)
+	})
+
+	t.Run("recent group messages", func(t *testing.T) {
+		now := time.Now()
+		old := newTestMessage("test-group-messages", now.Add(-time.Hour), "old")
+		first := newTestMessage("test-group-messages", now.Add(-10*time.Second), "first")
+		second := newTestMessage("test-group-messages", now, "second")
+
+		// a message is not cached for a group without cached messages
+		cache.StoreMessage(ctx, first)
+		_, ok := cache.GetGroupMessages(ctx, first.RecipientId, now.Add(-time.Minute).Unix())
+		assert.False(t, ok)
+
+		cache.StoreGroupMessages(ctx, first.RecipientId, []Message{old, first})
+		cache.StoreMessage(ctx, second)
+		messages, ok := cache.GetGroupMessages(ctx, first.RecipientId, now.Add(-time.Minute).Unix())
+		assert.True(t, ok)
+		assert.Equal(t, []Message{first, second}, messages)
+
+		// a change replaces the cached message
+		edited := first
+		edited.Message = "edited"
+		edited.ChangeId = NewMessageId(now.Add(time.Second))
+		cache.StoreMessage(ctx, edited)
+		messages, ok = cache.GetGroupMessages(ctx, first.RecipientId, now.Add(-time.Minute).Unix())
+		assert.True(t, ok)
+		assert.Equal(t, []Message{second, edited}, messages)
+
+		// nothing changed after the timestamp
+		_, ok = cache.GetGroupMessages(ctx, first.RecipientId, now.Add(time.Minute).Unix())
+		assert.False(t, ok)
+	})
+}
+
+func TestLRUCache(t *testing.T) {
+	cache, err := NewLRUCache(DefaultLRUCacheSize, DefaultCacheTTL)
+	assert.NoError(t, err)
+	testCache(t, cache)
+
+	t.Run("users expire after the TTL", func(t *testing.T) {
+		cache, _ := NewLRUCache(DefaultLRUCacheSize, time.Millisecond)
+		cache.StoreUser(context.Background(), &User{UserId: "test-user"})
+		time.Sleep(5 * time.Millisecond)
+		_, ok := cache.GetUser(context.Background(), "test-user")
+		assert.False(t, ok)
+	})
+
+	t.Run("cached users are not changed by concurrent updates", func(t *testing.T) {
+		ctx := context.Background()
+		cache, _ := NewLRUCache(DefaultLRUCacheSize, DefaultCacheTTL)
+		cache.StoreUser(ctx, &User{UserId: "test-user", Muted: map[string]bool{"test-peer": true}})
+
+		// like MuteConversation, which changes the user it read while other requests read it, run with -race
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				user, _ := cache.GetUser(ctx, "test-user")
+				user.Muted[fmt.Sprintf("test-group-%d", i)] = true
+				delete(user.Muted, "test-peer")
+			}(i)
+			go func() {
+				defer wg.Done()
+				user, _ := cache.GetUser(ctx, "test-user")
+				assert.True(t, user.Muted["test-peer"])
+			}()
+		}
+		wg.Wait()
+		cached, _ := cache.GetUser(ctx, "test-user")
+		assert.Equal(t, map[string]bool{"test-peer": true}, cached.Muted)
+	})
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	testCache(t, newTestRedisCache(t, server, DefaultCacheTTL))
+
+	t.Run("cache is shared by all instances", func(t *testing.T) {
+		instance1 := newTestRedisCache(t, server, DefaultCacheTTL)
+		instance2 := newTestRedisCache(t, server, DefaultCacheTTL)
+		instance1.StoreGroup(ctx, &Group{GroupId: "test-group-shared", Members: map[string]bool{"test-owner": true}})
+		_, ok := instance2.GetGroup(ctx, "test-group-shared")
+		assert.True(t, ok)
+
+		// a write on one instance invalidates the group for the other
+		instance2.RemoveGroup(ctx, "test-group-shared")
+		_, ok = instance1.GetGroup(ctx, "test-group-shared")
+		assert.False(t, ok)
+	})
+
+	t.Run("users expire after the TTL", func(t *testing.T) {
+		cache := newTestRedisCache(t, server, time.Minute)
+		cache.StoreUser(ctx, &User{UserId: "test-user-expiring"})
+		assert.Equal(t, time.Minute, server.TTL(getUserCacheKey("test-user-expiring")))
+
+		server.FastForward(time.Minute)
+		_, ok := cache.GetUser(ctx, "test-user-expiring")
+		assert.False(t, ok)
+	})
+
+	t.Run("group messages expire after the recent messages window", func(t *testing.T) {
+		cache := newTestRedisCache(t, server, DefaultCacheTTL)
+		cache.StoreGroupMessages(ctx, "test-group-expiring", []Message{newTestMessage("test-group-expiring", time.Now(), "hello")})
+		assert.Equal(t, RecentMessagesWindow, server.TTL(getMessageCacheKey("test-group-expiring")))
+	})
+
+	t.Run("unavailable server is a cache miss", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		cache := newTestRedisCache(t, server, DefaultCacheTTL)
+		server.Close()
+
+		cache.StoreUser(ctx, &User{UserId: "test-user"})
+		_, ok := cache.GetUser(ctx, "test-user")
+		assert.False(t, ok)
+	})
+
+	t.Run("no server", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		addr := server.Addr()
+		server.Close()
+		_, err := NewRedisCache(ctx, addr, DefaultCacheTTL)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,31 @@
+package common
+
+// Policies for the messages of deleted users, selected per deployment
+const (
+	// DeletedMessagesDelete deletes the messages of the private conversations of the user, sent and received,
+	// and the messages the user sent to groups, as tombstones like a deletion by the sender
+	DeletedMessagesDelete = "delete"
+	// DeletedMessagesAnonymize keeps the messages, the messages sent by the user are attributed to DeletedUserId
+	DeletedMessagesAnonymize = "anonymize"
+)
+
+// DeletedUserId is the sender of the messages of deleted users under the DeletedMessagesAnonymize policy.
+const DeletedUserId = "deleted-user"
+
+// UserDeletion is the progress of deleting a user account. The user record is deleted right away, the rest is
+// cleaned up in the background one conversation at a time, and the progress is stored after every step,
+// so that an interrupted deletion resumes where it stopped. Every step can be repeated safely.
+type UserDeletion struct {
+	UserId        string `json:"userId"`
+	MessagePolicy string `json:"messagePolicy"` // DeletedMessagesDelete or DeletedMessagesAnonymize
+	RequestedAt   string `json:"requestedAt"`   // RFC3339
+	// ConversationsListed is set once the private conversations and read group conversations of the user were added
+	// to Peers and Groups
+	ConversationsListed bool `json:"conversationsListed,omitempty"`
+	// Peers and Groups are the private and group conversations still to be cleaned up, each is removed once done
+	Peers  []string `json:"peers,omitempty" dynamodbav:",omitempty"`
+	Groups []string `json:"groups,omitempty" dynamodbav:",omitempty"`
+	// BlockCursor is the position of the scan for users that blocked the deleted user, BlocksRemoved is set once it finished
+	BlockCursor   string `json:"blockCursor,omitempty"`
+	BlocksRemoved bool   `json:"blocksRemoved,omitempty"`
+}
@@ -0,0 +1,29 @@
+package common
+
+// Delivery modes of group messages, selected per deployment
+const (
+	// DeliveryFanOutOnRead stores a group message once, a poll queries every group of the user
+	DeliveryFanOutOnRead = "read"
+	// DeliveryFanOutOnWrite also copies a group message to the inbox of every member, so that a poll is a single query
+	DeliveryFanOutOnWrite = "write"
+	// DeliveryBySize fans out on write for groups of up to MaxInboxGroupSize members, and on read for larger groups
+	DeliveryBySize = "size"
+)
+
+// DeliveryPolicy decides how the messages of a group are delivered to its members.
+type DeliveryPolicy struct {
+	Mode              string
+	MaxInboxGroupSize int
+}
+
+// FanOutOnWrite returns true if the messages of a group with the given number of members are copied to the member inboxes.
+func (p DeliveryPolicy) FanOutOnWrite(members int) bool {
+	switch p.Mode {
+	case DeliveryFanOutOnWrite:
+		return true
+	case DeliveryBySize:
+		return members <= p.MaxInboxGroupSize
+	default:
+		return false
+	}
+}
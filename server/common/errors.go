@@ -29,6 +29,14 @@ func (e *NotFoundError) Error() string {
 	return e.Message
 }
 
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.Message
+}
+
 type ForbiddenError struct {
 	Message string
 }
@@ -45,6 +53,8 @@ func HandleError(err error, c *gin.Context) {
 		c.String(http.StatusBadRequest, err.Error())
 	case *NotFoundError:
 		c.String(http.StatusNotFound, err.Error())
+	case *UnauthorizedError:
+		c.String(http.StatusUnauthorized, err.Error())
 	case *ForbiddenError:
 		c.String(http.StatusForbidden, err.Error())
 	default:
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"github.com/oklog/ulid/v2"
+	"time"
+)
+
+// NewMessageId generates a ULID for a message created at the given time.
+// ULIDs sort lexicographically by creation time and are monotonic within the same millisecond,
+// so they are unique even for messages sent to the same recipient in the same second.
+func NewMessageId(t time.Time) string {
+	return ulid.MustNew(ulid.Timestamp(t), ulid.DefaultEntropy()).String()
+}
+
+// MessageIdAfter returns the greatest message ID that can be generated within the given unix timestamp (seconds).
+// Every message created after the timestamp has a greater ID, the same holds for change IDs, which are generated
+// with NewMessageId as well.
+func MessageIdAfter(timestamp int64) string {
+	var id ulid.ULID
+	_ = id.SetTime(uint64(timestamp+1)*1000 - 1)
+	for i := 6; i < len(id); i++ {
+		id[i] = 0xff
+	}
+	return id.String()
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxReactionLength is the longest reaction, in runes, enough for emojis joined from several code points, like families.
+const MaxReactionLength = 16
+
+// MaxReactionEmojis is the largest number of different emojis a message can be reacted with.
+const MaxReactionEmojis = 20
+
+// Reaction is the reaction of a user to a message with an emoji, a user can react to a message with several emojis.
+// The message counts its reactions by emoji, see Message.Reactions.
+type Reaction struct {
+	RecipientId string `json:"recipientId"`
+	MessageId   string `json:"messageId"`
+	UserId      string `json:"userId"`
+	Emoji       string `json:"emoji"`
+	CreatedAt   string `json:"createdAt"` // RFC3339
+}
+
+// ValidReaction returns true if the reaction is an emoji, a symbol with optional modifiers, joiners and keycaps.
+// Text is not a reaction, letters, spaces and control characters are not accepted.
+func ValidReaction(emoji string) bool {
+	if emoji == "" || len([]rune(emoji)) > MaxReactionLength {
+		return false
+	}
+	if strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return false
+	}
+	// keycaps, like 1️⃣, are a digit enclosed by a combining mark
+	return strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.Is(unicode.So, r) || unicode.Is(unicode.Me, r)
+	}) >= 0
+}
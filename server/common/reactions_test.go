@@ -0,0 +1,16 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidReaction(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "👨‍👩‍👧‍👦", "1️⃣", "🇫🇷"} {
+		assert.True(t, ValidReaction(emoji), emoji)
+	}
+	for _, emoji := range []string{"", "ok", "👍 ", "a👍", "+1", "\n", strings.Repeat("👍", MaxReactionLength+1)} {
+		assert.False(t, ValidReaction(emoji), emoji)
+	}
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+// storeMessageScript adds the message to the hash of cached group messages only if the hash exists,
+// in one step, so that a message is never cached for a group whose other recent messages are not.
+var storeMessageScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// redisCache is a cache shared by all instances of the service, in Redis or any server speaking its protocol.
+// Users and groups are stored as JSON strings, the recent messages of a group as a hash from message ID to JSON message.
+type redisCache struct {
+	client redis.UniversalClient
+	ttl    time.Duration
+}
+
+// NewRedisCache returns a cache on the Redis server at addr, users and groups expire after ttl.
+func NewRedisCache(ctx context.Context, addr string, ttl time.Duration) (Cache, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisCache{client: client, ttl: ttl}, nil
+}
+
+// getJSON reads the JSON value of the key into value and returns false if the key does not exist or can not be read.
+func (c *redisCache) getJSON(ctx context.Context, key string, value interface{}) bool {
+	data, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal(data, value)
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error reading %s from cache: %v", key, err))
+		return false
+	}
+	return true
+}
+
+func (c *redisCache) setJSON(ctx context.Context, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = c.client.Set(ctx, key, data, c.ttl).Err()
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing %s in cache: %v", key, err))
+	}
+}
+
+func (c *redisCache) remove(ctx context.Context, key string) {
+	if err := c.client.Del(ctx, key).Err(); err != nil {
+		slog.Error(fmt.Sprintf("Error removing %s from cache: %v", key, err))
+	}
+}
+
+func (c *redisCache) GetUser(ctx context.Context, userId string) (*User, bool) {
+	var user User
+	if !c.getJSON(ctx, getUserCacheKey(userId), &user) {
+		slog.Info(fmt.Sprintf("User %s not found in cache", userId))
+		return nil, false
+	}
+	slog.Info(fmt.Sprintf("User %s found in cache", userId))
+	return &user, true
+}
+
+func (c *redisCache) StoreUser(ctx context.Context, user *User) {
+	c.setJSON(ctx, getUserCacheKey(user.UserId), user)
+}
+
+func (c *redisCache) RemoveUser(ctx context.Context, userId string) {
+	c.remove(ctx, getUserCacheKey(userId))
+}
+
+func (c *redisCache) GetGroup(ctx context.Context, groupId string) (*Group, bool) {
+	var group Group
+	if !c.getJSON(ctx, getGroupCacheKey(groupId), &group) {
+		slog.Info(fmt.Sprintf("Group %s not found in cache", groupId))
+		return nil, false
+	}
+	slog.Info(fmt.Sprintf("Group %s found in cache", groupId))
+	return &group, true
+}
+
+func (c *redisCache) StoreGroup(ctx context.Context, group *Group) {
+	c.setJSON(ctx, getGroupCacheKey(group.GroupId), group)
+}
+
+func (c *redisCache) RemoveGroup(ctx context.Context, groupId string) {
+	c.remove(ctx, getGroupCacheKey(groupId))
+}
+
+func (c *redisCache) GetGroupMessages(ctx context.Context, groupId string, timestamp int64) ([]Message, bool) {
+	key := getMessageCacheKey(groupId)
+	fields, err := c.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error reading %s from cache: %v", key, err))
+		return nil, false
+	}
+	messages := make([]Message, 0, len(fields))
+	for _, data := range fields {
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			slog.Error(fmt.Sprintf("Error reading %s from cache: %v", key, err))
+			return nil, false
+		}
+		messages = append(messages, msg)
+	}
+	requestedMessages := messagesChangedAfter(messages, timestamp)
+	if len(requestedMessages) == 0 {
+		slog.Info(fmt.Sprintf("Messages for group %s not found in cache", groupId))
+		return nil, false
+	}
+	slog.Info(fmt.Sprintf("Messages for group %s found in cache", groupId))
+	return requestedMessages, true
+}
+
+func (c *redisCache) StoreGroupMessages(ctx context.Context, groupId string, messages []Message) {
+	validMessages := recentMessages(messages)
+	if len(validMessages) == 0 {
+		return
+	}
+	key := getMessageCacheKey(groupId)
+	fields := make([]interface{}, 0, 2*len(validMessages))
+	for _, msg := range validMessages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error storing %s in cache: %v", key, err))
+			return
+		}
+		fields = append(fields, msg.MessageId, data)
+	}
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields...)
+		pipe.Expire(ctx, key, RecentMessagesWindow)
+		return nil
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing %s in cache: %v", key, err))
+	}
+}
+
+func (c *redisCache) StoreMessage(ctx context.Context, message Message) {
+	key := getMessageCacheKey(message.RecipientId)
+	data, err := json.Marshal(message)
+	if err == nil {
+		err = storeMessageScript.Run(ctx, c.client, []string{key}, message.MessageId, data).Err()
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing message %s in cache: %v", message.MessageId, err))
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/http"
+)
+
+// s3BlobStore keeps the blobs as objects of an S3 bucket, or of any store speaking the S3 API.
+// The content is streamed with an unsigned payload over HTTPS, S3 does not check it against the attachment checksum.
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3BlobStore returns a blob store in the bucket, with the credentials of the default AWS configuration.
+// The endpoint overrides the AWS endpoint of the region, for S3 compatible stores, it is empty for S3.
+// Objects of an S3 compatible store are addressed by path, bucket first, which every such store supports.
+func NewS3BlobStore(ctx context.Context, endpoint string, bucket string, region string) (BlobStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &s3BlobStore{client: client, bucket: bucket}, nil
+}
+
+// responseStatus returns the HTTP status of a failed request, 0 if the request got no response.
+func responseStatus(err error) int {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+	return 0
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          io.LimitReader(content, size),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	})
+	return err
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	// without the s3:ListBucket permission, which the service is not granted, S3 answers 403 for a missing object
+	if status := responseStatus(err); status == http.StatusNotFound || status == http.StatusForbidden {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return object.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	// S3 answers 204 also for missing objects, other stores may answer 404
+	if responseStatus(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package common
+
+// Statuses of a scheduled message. A delivered or canceled message is deleted, a failed message is kept, so that
+// its sender can see why it was not delivered, until they cancel it.
+const (
+	ScheduledPending = "pending"
+	ScheduledFailed  = "failed"
+)
+
+// ScheduledMessage is a message to be sent at a later time. It is sent by the scheduler like a message sent by its
+// sender at that time, so blocks and group membership are checked again when it is due.
+type ScheduledMessage struct {
+	SenderId      string   `json:"senderId"`
+	ScheduleId    string   `json:"scheduleId"`  // ULID, sortable by creation time
+	Type          string   `json:"type"`        // ConversationPrivate or ConversationGroup
+	RecipientId   string   `json:"recipientId"` // user or group ID
+	Message       string   `json:"message"`
+	AttachmentIds []string `json:"attachmentIds,omitempty" dynamodbav:",omitempty"`
+	ReplyTo       string   `json:"replyTo,omitempty" dynamodbav:",omitempty"`
+	SendAt        string   `json:"sendAt"`    // RFC3339 in UTC, so that the times sort as strings
+	CreatedAt     string   `json:"createdAt"` // RFC3339
+	Status        string   `json:"status"`    // ScheduledPending or ScheduledFailed
+	// Error is why a failed message was not delivered
+	Error string `json:"error,omitempty" dynamodbav:",omitempty"`
+	// ClaimedUntil is set while a scheduler instance sends the message, RFC3339 in UTC. Other instances skip the
+	// message until then, so that it is sent once, and the message can no longer be canceled.
+	ClaimedUntil string `json:"claimedUntil,omitempty" dynamodbav:",omitempty"`
+	// MessageId is the ID of the sent message, chosen by the first claim and kept by later ones, so that a
+	// delivery interrupted after the message was stored is not sent again.
+	MessageId string `json:"messageId,omitempty" dynamodbav:",omitempty"`
+}
+
+// Claimed returns true if a scheduler instance is sending the message at the given time, RFC3339 in UTC.
+func (s ScheduledMessage) Claimed(now string) bool {
+	return s.ClaimedUntil != "" && s.ClaimedUntil > now
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxSearchTermLength is the longest term in the search index, in runes, longer words are not indexed.
+const MaxSearchTermLength = 64
+
+// SearchKey is a term of the messages of a scope in the inverted message index.
+// A scope is a user, for the private messages they received and all messages they sent, or a group.
+type SearchKey struct {
+	Scope string
+	Term  string
+}
+
+func (k SearchKey) String() string {
+	// terms are letters and digits only, so the separator never appears in a term
+	return k.Scope + "#" + k.Term
+}
+
+// SearchPosting records where a term appears in a message, an entry of the inverted message index.
+type SearchPosting struct {
+	Scope       string `json:"-" dynamodbav:"-"`
+	Term        string `json:"-" dynamodbav:"-"`
+	MessageId   string
+	RecipientId string
+	SenderId    string
+	Positions   []int // positions of the term among the terms of the message, for phrase queries
+	Length      int   // number of terms of the message
+}
+
+// Tokenize splits the text into lower case terms of letters and digits, in order.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) <= MaxSearchTermLength {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// SearchScopes returns the scopes the message is indexed in, the recipient and the sender.
+// Deleted messages and the inbox copies of messages, which are indexed with the message, are not indexed.
+func SearchScopes(msg Message) []string {
+	if msg.Deleted || msg.IsInboxCopy() {
+		return nil
+	}
+	if msg.SenderId == msg.RecipientId {
+		return []string{msg.RecipientId}
+	}
+	return []string{msg.RecipientId, msg.SenderId}
+}
+
+// SearchPostings returns the index entries of the message, a posting per term in each of its scopes.
+func SearchPostings(msg Message) map[SearchKey]SearchPosting {
+	scopes := SearchScopes(msg)
+	if len(scopes) == 0 {
+		return nil
+	}
+	terms := Tokenize(msg.Message)
+	positions := make(map[string][]int, len(terms))
+	for i, term := range terms {
+		positions[term] = append(positions[term], i)
+	}
+	postings := make(map[SearchKey]SearchPosting, len(scopes)*len(positions))
+	for _, scope := range scopes {
+		for term, termPositions := range positions {
+			postings[SearchKey{Scope: scope, Term: term}] = SearchPosting{
+				Scope:       scope,
+				Term:        term,
+				MessageId:   msg.MessageId,
+				RecipientId: msg.RecipientId,
+				SenderId:    msg.SenderId,
+				Positions:   termPositions,
+				Length:      len(terms),
+			}
+		}
+	}
+	return postings
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"lunch", "at", "12", "café", "e", "mail"}, Tokenize("Lunch at 12? Café, e-mail!"))
+	assert.Empty(t, Tokenize(" -- "))
+	// words too long to be terms are not indexed
+	assert.Equal(t, []string{"short"}, Tokenize(strings.Repeat("x", MaxSearchTermLength+1)+" short"))
+}
+
+func TestSearchPostings(t *testing.T) {
+	msg := Message{RecipientId: "test-group-1", MessageId: "message-1", SenderId: "test-user-1", Message: "lunch, lunch at noon"}
+
+	t.Run("indexed in the recipient and sender scopes", func(t *testing.T) {
+		postings := SearchPostings(msg)
+		assert.Len(t, postings, 6)
+		assert.Equal(t, SearchPosting{
+			Scope: "test-user-1", Term: "lunch", MessageId: "message-1", RecipientId: "test-group-1", SenderId: "test-user-1",
+			Positions: []int{0, 1}, Length: 4,
+		}, postings[SearchKey{Scope: "test-user-1", Term: "lunch"}])
+		assert.Equal(t, []int{3}, postings[SearchKey{Scope: "test-group-1", Term: "noon"}].Positions)
+	})
+
+	t.Run("messages to self are indexed once", func(t *testing.T) {
+		self := msg
+		self.RecipientId = self.SenderId
+		assert.Len(t, SearchPostings(self), 3)
+	})
+
+	t.Run("deleted messages and inbox copies are not indexed", func(t *testing.T) {
+		deleted := msg
+		deleted.Deleted = true
+		assert.Empty(t, SearchPostings(deleted))
+		inbox := msg
+		inbox.InboxGroupId, inbox.RecipientId = msg.RecipientId, "test-user-2"
+		assert.Empty(t, SearchPostings(inbox))
+		sent := msg
+		sent.InboxPeerId, sent.RecipientId = "test-user-2", msg.SenderId
+		assert.Empty(t, SearchPostings(sent))
+	})
+}
@@ -1,21 +1,192 @@
 package common
 
+import "time"
+
 type User struct {
 	UserId       string          `json:"userId"`
 	UserName     string          `json:"userName"`
+	PasswordHash string          `json:"passwordHash,omitempty"` // bcrypt hash, never returned by the API
 	BlockedUsers map[string]bool `json:"blockedUsers"`
 	Groups       map[string]bool `json:"groups"`
+	// Muted are the conversations the user muted, peer user IDs and group IDs, their messages are delivered marked as muted
+	Muted map[string]bool `json:"muted,omitempty"`
+	// BlockedGroupMessages is how the group messages of blocked users are delivered, see BlockedMessagesShow, empty shows them
+	BlockedGroupMessages string `json:"blockedGroupMessages,omitempty" dynamodbav:",omitempty"`
+	Version              int64  `json:"version"` // incremented by every write, a write fails if the user changed since it was read
 }
 
 type Group struct {
 	GroupId   string          `json:"groupId"`
 	GroupName string          `json:"groupName"`
+	OwnerId   string          `json:"ownerId"` // the group creator, also a member
+	Admins    map[string]bool `json:"admins"`  // members promoted by the owner, the owner is not listed
 	Members   map[string]bool `json:"members"`
+	// FanOutOnWrite is set while the group messages are copied to the member inboxes, see DeliveryPolicy.
+	// A group that outgrows the policy switches to fan-out-on-read for good.
+	FanOutOnWrite bool   `json:"fanOutOnWrite,omitempty"`
+	InboxUntil    string `json:"inboxUntil,omitempty"` // change ID up to which the messages were copied to the member inboxes
+	// Banned users were removed by an admin and can not be added again or join with an invite until unbanned
+	Banned  map[string]bool `json:"banned,omitempty"`
+	Version int64           `json:"version"` // incremented by every write, a write fails if the group changed since it was read
 }
 
 type Message struct {
 	RecipientId string `json:"recipientId"` // can be user or group id
+	MessageId   string `json:"messageId"`   // ULID, unique and sortable by creation time
+	ChangeId    string `json:"changeId"`    // ULID of the last change (creation, edit or deletion), sortable by change time
 	Timestamp   string `json:"timestamp"`   // RFC3339
 	SenderId    string `json:"senderId"`
-	Message     string `json:"message"`
+	Message     string `json:"message"`            // empty once deleted
+	EditedAt    string `json:"editedAt,omitempty"` // RFC3339, time of the last edit or deletion
+	Deleted     bool   `json:"deleted,omitempty"`  // tombstone, the message text was removed by the sender
+	// ConversationKey is set on private messages to index them by conversation, see PrivateConversationKey
+	ConversationKey string `json:"-" dynamodbav:",omitempty"`
+	// InboxGroupId is set on the copies of group messages in the member inboxes, stored under the member ID
+	InboxGroupId string `json:"inboxGroupId,omitempty" dynamodbav:",omitempty"`
+	// InboxPeerId is set on the copies of changed private messages in the inbox of their sender, stored under the sender ID,
+	// so that the sender polls the changes of their messages, like reactions. It is the recipient of the message.
+	InboxPeerId string `json:"inboxPeerId,omitempty" dynamodbav:",omitempty"`
+	// Muted is set on the messages returned to a user that muted their conversation, it is not stored
+	Muted bool `json:"muted,omitempty" dynamodbav:"-"`
+	// Collapsed is set on the group messages of blocked senders returned without their text, it is not stored
+	Collapsed bool `json:"collapsed,omitempty" dynamodbav:"-"`
+	// Attachments are the files sent with the message, removed once deleted
+	Attachments []AttachmentRef `json:"attachments,omitempty" dynamodbav:",omitempty"`
+	// ReplyTo is the ID of the message of the same conversation this message replies to, quoted by Quote
+	ReplyTo string `json:"replyTo,omitempty" dynamodbav:",omitempty"`
+	// ThreadId is the ID of the first message of the thread of a reply, the replies to a reply are in the same thread
+	ThreadId string `json:"threadId,omitempty" dynamodbav:",omitempty"`
+	// ThreadKey is the ThreadId of stored replies to index them by thread, it is not set on inbox copies
+	ThreadKey string `json:"-" dynamodbav:",omitempty"`
+	Quote     *Quote `json:"quote,omitempty" dynamodbav:",omitempty"`
+	// ReplyCount is the number of replies of the first message of a thread, deleted replies are not counted
+	ReplyCount int `json:"replyCount,omitempty" dynamodbav:",omitempty"`
+	// Reactions counts the reactions to the message by emoji, see Reaction
+	Reactions map[string]int `json:"reactions,omitempty" dynamodbav:",omitempty"`
+}
+
+// Quote is the snippet of the message a reply replies to. It is refreshed when that message is edited, deleted or anonymized.
+type Quote struct {
+	SenderId string `json:"senderId"`
+	Message  string `json:"message"` // up to MessagePreviewLength characters, empty once deleted
+	Deleted  bool   `json:"deleted,omitempty"`
+	// Collapsed is set on the quotes of blocked senders returned without their text, see MessageView
+	Collapsed bool `json:"collapsed,omitempty"`
+}
+
+// NewQuote returns the quote of the message in its replies.
+func NewQuote(msg Message) *Quote {
+	return &Quote{SenderId: msg.SenderId, Message: msg.Preview().Message, Deleted: msg.Deleted}
+}
+
+// Attachment is a file uploaded to the BlobStore, stored under its attachment ID.
+type Attachment struct {
+	AttachmentId string `json:"attachmentId"`
+	UploaderId   string `json:"uploaderId"`
+	FileName     string `json:"fileName"`
+	ContentType  string `json:"contentType"` // MIME type
+	Size         int64  `json:"size"`        // bytes
+	Checksum     string `json:"checksum"`    // hex SHA-256 of the content
+	CreatedAt    string `json:"createdAt"`   // RFC3339
+	// RecipientId and MessageId are set once the attachment was sent, an attachment is sent with a single message
+	RecipientId string `json:"recipientId,omitempty" dynamodbav:",omitempty"`
+	MessageId   string `json:"messageId,omitempty" dynamodbav:",omitempty"`
+}
+
+// AttachmentRef is an attachment as referenced by its message.
+type AttachmentRef struct {
+	AttachmentId string `json:"attachmentId"`
+	FileName     string `json:"fileName"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum"`
+}
+
+func (a Attachment) Ref() AttachmentRef {
+	return AttachmentRef{AttachmentId: a.AttachmentId, FileName: a.FileName, ContentType: a.ContentType, Size: a.Size, Checksum: a.Checksum}
+}
+
+// ConversationId returns the ID of the conversation of the message as seen by the user,
+// the group ID of group messages, including their inbox copies, and the peer user ID of private messages.
+func (m Message) ConversationId(userId string) string {
+	switch {
+	case m.InboxGroupId != "":
+		return m.InboxGroupId
+	case m.InboxPeerId != "":
+		return m.InboxPeerId
+	case m.RecipientId == userId:
+		return m.SenderId
+	default:
+		// sent by the user, or to a group of the user
+		return m.RecipientId
+	}
+}
+
+// IsGroupMessage returns true if the message was sent to a group, also for its copy in the inbox of the user.
+func (m Message) IsGroupMessage(userId string) bool {
+	return m.InboxGroupId != "" || (m.RecipientId != userId && m.SenderId != userId)
+}
+
+// IsInboxCopy returns true if the message is the copy of a message in the inbox of a user, see InboxGroupId and InboxPeerId.
+func (m Message) IsInboxCopy() bool {
+	return m.InboxGroupId != "" || m.InboxPeerId != ""
+}
+
+// PrivateConversationKey returns the key of the private conversation between two users, the same in both directions.
+func PrivateConversationKey(userId string, peerId string) string {
+	if peerId < userId {
+		userId, peerId = peerId, userId
+	}
+	return userId + "#" + peerId
+}
+
+const (
+	ConversationPrivate = "private"
+	ConversationGroup   = "group"
+)
+
+// Conversation is the state of a private or group conversation as seen by one of its users.
+type Conversation struct {
+	UserId            string   `json:"userId"`
+	ConversationId    string   `json:"conversationId"`              // the peer user ID for private conversations, the group ID for group conversations
+	Type              string   `json:"type"`                        // ConversationPrivate or ConversationGroup
+	LastReadMessageId string   `json:"lastReadMessageId,omitempty"` // the user read the messages up to this message ID
+	ReadAt            string   `json:"readAt,omitempty"`            // RFC3339
+	LastMessage       *Message `json:"lastMessage,omitempty"`       // preview of the latest message of the conversation
+	LastActivity      string   `json:"lastActivity,omitempty"`      // RFC3339, the time of the latest message
+	// UnreadCount is the number of unread messages of a private conversation, kept up to date by the message writes
+	// and the read marker, group conversations are counted on read instead
+	UnreadCount int `json:"unreadCount,omitempty" dynamodbav:",omitempty"`
+}
+
+// MessagePreviewLength is the maximal number of characters of a message preview.
+const MessagePreviewLength = 100
+
+// Preview returns the message with its text cut to MessagePreviewLength characters.
+func (m Message) Preview() Message {
+	if text := []rune(m.Message); len(text) > MessagePreviewLength {
+		m.Message = string(text[:MessagePreviewLength])
+	}
+	return m
+}
+
+// GroupInvite lets users join a group without an admin adding them.
+type GroupInvite struct {
+	Token     string `json:"token"`
+	GroupId   string `json:"groupId"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`                                   // RFC3339
+	ExpiresAt int64  `json:"expiresAt,omitempty" dynamodbav:",omitempty"` // unix timestamp (seconds), 0 never expires
+	MaxUses   int    `json:"maxUses,omitempty"`                           // 0 is unlimited
+	Uses      int    `json:"uses"`
+}
+
+// Expired returns true if the invite can no longer be used at the given time.
+func (i *GroupInvite) Expired(now time.Time) bool {
+	return i.ExpiresAt > 0 && now.Unix() >= i.ExpiresAt
+}
+
+// UsedUp returns true if the invite reached its maximal number of uses.
+func (i *GroupInvite) UsedUp() bool {
+	return i.MaxUses > 0 && i.Uses >= i.MaxUses
 }
@@ -0,0 +1,77 @@
+package common
+
+// Settings for the group messages of blocked senders, selected per user
+const (
+	// BlockedMessagesShow delivers the group messages of blocked senders like any other, the default
+	BlockedMessagesShow = "show"
+	// BlockedMessagesHide leaves the group messages of blocked senders out
+	BlockedMessagesHide = "hide"
+	// BlockedMessagesCollapse delivers the group messages of blocked senders without their text and attachments, marked as collapsed
+	BlockedMessagesCollapse = "collapse"
+)
+
+// ValidBlockedMessages returns true if the setting is one of the blocked messages settings.
+func ValidBlockedMessages(setting string) bool {
+	return setting == BlockedMessagesShow || setting == BlockedMessagesHide || setting == BlockedMessagesCollapse
+}
+
+// MessageView applies the settings of a user to the messages delivered to them, by polling and streaming,
+// including the group messages served from the cache.
+type MessageView struct {
+	UserId               string
+	Muted                map[string]bool
+	BlockedUsers         map[string]bool
+	BlockedGroupMessages string
+}
+
+func NewMessageView(user User) MessageView {
+	return MessageView{
+		UserId:               user.UserId,
+		Muted:                user.Muted,
+		BlockedUsers:         user.BlockedUsers,
+		BlockedGroupMessages: user.BlockedGroupMessages,
+	}
+}
+
+// Apply returns the message as delivered to the user, marked as muted or collapsed, and false if it is hidden.
+// The message is a copy, the cached messages shared by the group members are not changed.
+func (v MessageView) Apply(msg Message) (Message, bool) {
+	msg.Muted = v.Muted[msg.ConversationId(v.UserId)]
+	// private messages of blocked users are not delivered in the first place
+	if !msg.IsGroupMessage(v.UserId) {
+		return msg, true
+	}
+	if msg.Quote != nil && v.BlockedUsers[msg.Quote.SenderId] && v.hidesBlocked() {
+		// the reply is shown, the quoted text of the blocked sender is not
+		msg.Quote = &Quote{SenderId: msg.Quote.SenderId, Deleted: msg.Quote.Deleted, Collapsed: true}
+	}
+	if !v.BlockedUsers[msg.SenderId] {
+		return msg, true
+	}
+	switch v.BlockedGroupMessages {
+	case BlockedMessagesHide:
+		return msg, false
+	case BlockedMessagesCollapse:
+		// the attachments are withheld with the text, so that they can not be downloaded either
+		msg.Message = ""
+		msg.Attachments = nil
+		msg.Collapsed = true
+	}
+	return msg, true
+}
+
+// hidesBlocked returns true if the group messages of blocked senders are not shown with their text.
+func (v MessageView) hidesBlocked() bool {
+	return v.BlockedGroupMessages == BlockedMessagesHide || v.BlockedGroupMessages == BlockedMessagesCollapse
+}
+
+// ApplyAll applies the view to the messages, the hidden messages are left out.
+func (v MessageView) ApplyAll(messages []Message) []Message {
+	viewed := messages[:0:0]
+	for _, msg := range messages {
+		if msg, ok := v.Apply(msg); ok {
+			viewed = append(viewed, msg)
+		}
+	}
+	return viewed
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMessageView(t *testing.T) {
+	user := User{
+		UserId:       "test-user",
+		BlockedUsers: map[string]bool{"test-blocked": true},
+		Muted:        map[string]bool{"test-muted-group": true},
+	}
+	groupMessage := Message{RecipientId: "test-group", SenderId: "test-blocked", Message: "hello",
+		Attachments: []AttachmentRef{{AttachmentId: "test-attachment", FileName: "photo.png", ContentType: "image/png"}}}
+	privateMessage := Message{RecipientId: "test-user", SenderId: "test-blocked", Message: "hello"}
+
+	t.Run("blocked group messages are shown by default", func(t *testing.T) {
+		msg, ok := NewMessageView(user).Apply(groupMessage)
+		assert.True(t, ok)
+		assert.Equal(t, groupMessage, msg)
+	})
+
+	t.Run("hide", func(t *testing.T) {
+		user := user
+		user.BlockedGroupMessages = BlockedMessagesHide
+		_, ok := NewMessageView(user).Apply(groupMessage)
+		assert.False(t, ok)
+		// also the copy in the inbox of the user
+		_, ok = NewMessageView(user).Apply(Message{RecipientId: "test-user", InboxGroupId: "test-group", SenderId: "test-blocked"})
+		assert.False(t, ok)
+		// private messages are sent before the block
+		_, ok = NewMessageView(user).Apply(privateMessage)
+		assert.True(t, ok)
+	})
+
+	t.Run("collapse", func(t *testing.T) {
+		user := user
+		user.BlockedGroupMessages = BlockedMessagesCollapse
+		view := NewMessageView(user)
+		msg, ok := view.Apply(groupMessage)
+		assert.True(t, ok)
+		assert.True(t, msg.Collapsed)
+		assert.Empty(t, msg.Message)
+		assert.Empty(t, msg.Attachments)
+		assert.Equal(t, "test-blocked", msg.SenderId)
+
+		// the given messages are not changed
+		messages := []Message{groupMessage, privateMessage}
+		viewed := view.ApplyAll(messages)
+		assert.Equal(t, "hello", messages[0].Message)
+		assert.Len(t, messages[0].Attachments, 1)
+		assert.True(t, viewed[0].Collapsed)
+		assert.False(t, viewed[1].Collapsed)
+	})
+
+	t.Run("quotes of blocked senders", func(t *testing.T) {
+		reply := Message{RecipientId: "test-group", SenderId: "test-other", Message: "me too", Quote: NewQuote(groupMessage)}
+		msg, _ := NewMessageView(user).Apply(reply)
+		assert.Equal(t, "hello", msg.Quote.Message)
+
+		for _, setting := range []string{BlockedMessagesHide, BlockedMessagesCollapse} {
+			user := user
+			user.BlockedGroupMessages = setting
+			msg, ok := NewMessageView(user).Apply(reply)
+			assert.True(t, ok)
+			assert.Equal(t, "me too", msg.Message)
+			assert.Equal(t, &Quote{SenderId: "test-blocked", Collapsed: true}, msg.Quote)
+			// the quote of the given message is not changed
+			assert.Equal(t, "hello", reply.Quote.Message)
+		}
+	})
+
+	t.Run("muted", func(t *testing.T) {
+		msg, _ := NewMessageView(user).Apply(Message{RecipientId: "test-muted-group", SenderId: "test-other"})
+		assert.True(t, msg.Muted)
+		msg, _ = NewMessageView(user).Apply(privateMessage)
+		assert.False(t, msg.Muted)
+	})
+}
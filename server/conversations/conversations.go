@@ -0,0 +1,302 @@
+package conversations
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+	"sort"
+	"time"
+)
+
+type MarkReadRequest struct {
+	MessageId string `json:"messageId"` // optional, the last read message, defaults to every message up to now
+}
+
+type UnreadCount struct {
+	ConversationId    string `json:"conversationId"`
+	Type              string `json:"type"`
+	UnreadCount       int    `json:"unreadCount"`
+	LastReadMessageId string `json:"lastReadMessageId,omitempty"`
+	Muted             bool   `json:"muted,omitempty"`
+}
+
+type UnreadCountsResponse struct {
+	Conversations []UnreadCount `json:"conversations"`
+	Total         int           `json:"total"`
+}
+
+// ConversationSummary is an entry of the conversation list of a user.
+type ConversationSummary struct {
+	ConversationId    string   `json:"conversationId"`
+	Type              string   `json:"type"`
+	LastMessage       *Message `json:"lastMessage,omitempty"`
+	LastActivity      string   `json:"lastActivity,omitempty"`
+	UnreadCount       int      `json:"unreadCount"`
+	LastReadMessageId string   `json:"lastReadMessageId,omitempty"`
+	Muted             bool     `json:"muted,omitempty"`
+}
+
+type ConversationsResponse struct {
+	Conversations []ConversationSummary `json:"conversations"`
+}
+
+type HandlerInterface interface {
+	MarkRead(ctx context.Context, userId string, conversationId string, req MarkReadRequest) (*Conversation, error)
+	GetReadMarker(ctx context.Context, userId string, peerId string) (*Conversation, error)
+	GetUnreadCounts(ctx context.Context, userId string) (*UnreadCountsResponse, error)
+	GetConversations(ctx context.Context, userId string) (*ConversationsResponse, error)
+	GetPrivateHistory(ctx context.Context, userId string, peerId string, req HistoryRequest) (*HistoryResponse, error)
+	GetGroupHistory(ctx context.Context, userId string, groupId string, req HistoryRequest) (*HistoryResponse, error)
+}
+
+type Handler struct {
+	DBClient db.DynamoDBClientInterface
+}
+
+func (handler *Handler) getUser(ctx context.Context, userId string) (*User, error) {
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user %s: %v", userId, err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User %s not found", userId))
+		return nil, &NotFoundError{Message: "User not found"}
+	}
+	return user, nil
+}
+
+// conversationType returns the type of the conversation of the user, a group the user is a member of or a private peer.
+func (handler *Handler) conversationType(ctx context.Context, user *User, conversationId string) (string, error) {
+	if user.Groups[conversationId] {
+		return ConversationGroup, nil
+	}
+
+	group, err := handler.DBClient.GetGroup(ctx, conversationId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group %s: %v", conversationId, err))
+		return "", &InternalServerError{Message: "Error getting group"}
+	}
+	if group != nil {
+		slog.Error(fmt.Sprintf("User %s is not a member of group %s", user.UserId, conversationId))
+		return "", &ForbiddenError{Message: "User is not a member of the group"}
+	}
+
+	peer, err := handler.DBClient.GetUser(ctx, conversationId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user %s: %v", conversationId, err))
+		return "", &InternalServerError{Message: "Error getting user"}
+	}
+	if peer == nil {
+		slog.Error(fmt.Sprintf("Conversation %s of user %s not found", conversationId, user.UserId))
+		return "", &NotFoundError{Message: "Conversation not found"}
+	}
+	return ConversationPrivate, nil
+}
+
+/*
+Mark the messages of a conversation as read up to and including the given message
+The conversation ID is the peer user ID for private conversations or the group ID
+The read marker only moves forward, marking an older message does not make newer messages unread
+*/
+func (handler *Handler) MarkRead(ctx context.Context, userId string, conversationId string, req MarkReadRequest) (*Conversation, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	conversationType, err := handler.conversationType(ctx, user, conversationId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	lastRead := req.MessageId
+	if lastRead == "" {
+		lastRead = MessageIdAfter(now.Unix())
+	}
+
+	err = handler.DBClient.SetReadMarker(ctx, Conversation{
+		UserId:            userId,
+		ConversationId:    conversationId,
+		Type:              conversationType,
+		LastReadMessageId: lastRead,
+		ReadAt:            now.Format(time.RFC3339),
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error setting read marker of user %s in conversation %s: %v", userId, conversationId, err))
+		return nil, &InternalServerError{Message: "Error setting read marker"}
+	}
+
+	// the stored marker may be further than the requested one
+	conversation, err := handler.DBClient.GetConversation(ctx, userId, conversationId)
+	if err != nil || conversation == nil {
+		slog.Error(fmt.Sprintf("Error getting conversation %s of user %s: %v", conversationId, userId, err))
+		return nil, &InternalServerError{Message: "Error getting conversation"}
+	}
+	slog.Info(fmt.Sprintf("User %s read conversation %s up to %s", userId, conversationId, conversation.LastReadMessageId))
+
+	return conversation, nil
+}
+
+/*
+Get the read marker of the peer in the private conversation with the user
+The sender of a private message has read receipts by comparing the message ID with the peer read marker
+*/
+func (handler *Handler) GetReadMarker(ctx context.Context, userId string, peerId string) (*Conversation, error) {
+	if _, err := handler.getUser(ctx, peerId); err != nil {
+		return nil, err
+	}
+
+	conversation, err := handler.DBClient.GetConversation(ctx, peerId, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting conversation %s of user %s: %v", userId, peerId, err))
+		return nil, &InternalServerError{Message: "Error getting conversation"}
+	}
+	if conversation == nil {
+		// the peer has not read anything yet
+		conversation = &Conversation{UserId: peerId, ConversationId: userId, Type: ConversationPrivate}
+	}
+	return conversation, nil
+}
+
+// userConversations returns the private conversations of the user and a conversation for every group of the user,
+// with the user read markers.
+func (handler *Handler) userConversations(ctx context.Context, user *User) ([]Conversation, error) {
+	stored, err := handler.DBClient.GetConversations(ctx, user.UserId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting conversations of user %s: %v", user.UserId, err))
+		return nil, &InternalServerError{Message: "Error getting conversations"}
+	}
+
+	conversations := make([]Conversation, 0, len(stored)+len(user.Groups))
+	groupMarkers := map[string]Conversation{}
+	for _, conversation := range stored {
+		if conversation.Type == ConversationGroup {
+			groupMarkers[conversation.ConversationId] = conversation
+			continue
+		}
+		conversations = append(conversations, conversation)
+	}
+	// every group of the user has a conversation, even if it was never read; markers of left groups are ignored
+	for groupId, member := range user.Groups {
+		if !member {
+			continue
+		}
+		conversation, ok := groupMarkers[groupId]
+		if !ok {
+			conversation = Conversation{UserId: user.UserId, ConversationId: groupId, Type: ConversationGroup}
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+
+// countUnread counts the unread messages of the conversation, muted conversations have none.
+func (handler *Handler) countUnread(ctx context.Context, user *User, conversation Conversation) (int, error) {
+	if user.Muted[conversation.ConversationId] {
+		return 0, nil
+	}
+	count, err := handler.DBClient.CountUnreadMessages(ctx, conversation)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error counting unread messages of user %s in conversation %s: %v", conversation.UserId, conversation.ConversationId, err))
+		return 0, &InternalServerError{Message: "Error counting unread messages"}
+	}
+	return count, nil
+}
+
+/*
+Get the unread message counts of every private conversation and every group of the user
+Own and deleted messages are not counted, muted conversations are listed without unread messages
+*/
+func (handler *Handler) GetUnreadCounts(ctx context.Context, userId string) (*UnreadCountsResponse, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	conversations, err := handler.userConversations(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &UnreadCountsResponse{Conversations: make([]UnreadCount, 0, len(conversations))}
+	for _, conversation := range conversations {
+		count, err := handler.countUnread(ctx, user, conversation)
+		if err != nil {
+			return nil, err
+		}
+		resp.Conversations = append(resp.Conversations, UnreadCount{
+			ConversationId:    conversation.ConversationId,
+			Type:              conversation.Type,
+			UnreadCount:       count,
+			LastReadMessageId: conversation.LastReadMessageId,
+			Muted:             user.Muted[conversation.ConversationId],
+		})
+		resp.Total += count
+	}
+	return resp, nil
+}
+
+/*
+Get the conversations of the user, every private peer and every group, with the latest message and the unread count
+The conversations are sorted by recency, conversations without messages are last
+*/
+func (handler *Handler) GetConversations(ctx context.Context, userId string) (*ConversationsResponse, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	conversations, err := handler.userConversations(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	view := NewMessageView(*user)
+	resp := &ConversationsResponse{Conversations: make([]ConversationSummary, 0, len(conversations))}
+	for _, conversation := range conversations {
+		if conversation.Type == ConversationGroup {
+			// the latest group message is stored once for all the members under the group ID
+			group, err := handler.DBClient.GetConversation(ctx, conversation.ConversationId, conversation.ConversationId)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error getting conversation of group %s: %v", conversation.ConversationId, err))
+				return nil, &InternalServerError{Message: "Error getting conversations"}
+			}
+			if group != nil {
+				conversation.LastMessage = group.LastMessage
+				conversation.LastActivity = group.LastActivity
+			}
+		}
+		if conversation.LastMessage != nil {
+			// a hidden message of a blocked sender is not previewed, the conversation keeps its activity
+			if viewed, visible := view.Apply(*conversation.LastMessage); visible {
+				conversation.LastMessage = &viewed
+			} else {
+				conversation.LastMessage = nil
+			}
+		}
+		count, err := handler.countUnread(ctx, user, conversation)
+		if err != nil {
+			return nil, err
+		}
+		resp.Conversations = append(resp.Conversations, ConversationSummary{
+			ConversationId:    conversation.ConversationId,
+			Type:              conversation.Type,
+			LastMessage:       conversation.LastMessage,
+			LastActivity:      conversation.LastActivity,
+			UnreadCount:       count,
+			LastReadMessageId: conversation.LastReadMessageId,
+			Muted:             user.Muted[conversation.ConversationId],
+		})
+	}
+
+	// message IDs sort by creation time, more precisely than the activity timestamp
+	sort.SliceStable(resp.Conversations, func(i, j int) bool {
+		a, b := resp.Conversations[i].LastMessage, resp.Conversations[j].LastMessage
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.MessageId > b.MessageId
+	})
+	return resp, nil
+}
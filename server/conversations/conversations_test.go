@@ -0,0 +1,265 @@
+package conversations
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"server/common"
+	. "server/common"
+	"server/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+func storeTestMessage(ctx context.Context, dbClient db.DynamoDBClientInterface, senderId string, recipientId string) Message {
+	messageId := NewMessageId(time.Now())
+	msg := Message{RecipientId: recipientId, MessageId: messageId, ChangeId: messageId, SenderId: senderId, Message: "hello"}
+	if group, _ := dbClient.GetGroup(ctx, recipientId); group == nil {
+		// private messages are counted as unread by their conversation key, like the messages handler sets it
+		msg.ConversationKey = PrivateConversationKey(senderId, recipientId)
+	}
+	dbClient.StoreMessage(ctx, msg)
+	return msg
+}
+
+func TestMarkRead(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	dbClient.StoreUser(ctx, peer)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, user)
+
+	t.Run("mark private conversation read", func(t *testing.T) {
+		msg := storeTestMessage(ctx, dbClient, peer.UserId, user.UserId)
+		conversation, err := handler.MarkRead(ctx, user.UserId, peer.UserId, MarkReadRequest{MessageId: msg.MessageId})
+		assert.NoError(t, err)
+		assert.Equal(t, ConversationPrivate, conversation.Type)
+		assert.Equal(t, msg.MessageId, conversation.LastReadMessageId)
+		assert.NotEmpty(t, conversation.ReadAt)
+	})
+
+	t.Run("mark older message keeps the marker", func(t *testing.T) {
+		conversation, err := handler.MarkRead(ctx, user.UserId, peer.UserId, MarkReadRequest{MessageId: MessageIdAfter(0)})
+		assert.NoError(t, err)
+		assert.NotEqual(t, MessageIdAfter(0), conversation.LastReadMessageId)
+	})
+
+	t.Run("mark group read up to now", func(t *testing.T) {
+		msg := storeTestMessage(ctx, dbClient, peer.UserId, group.GroupId)
+		conversation, err := handler.MarkRead(ctx, user.UserId, group.GroupId, MarkReadRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, ConversationGroup, conversation.Type)
+		assert.Greater(t, conversation.LastReadMessageId, msg.MessageId)
+	})
+
+	t.Run("group the user is not a member of", func(t *testing.T) {
+		_, err := handler.MarkRead(ctx, peer.UserId, group.GroupId, MarkReadRequest{})
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("conversation not found", func(t *testing.T) {
+		_, err := handler.MarkRead(ctx, user.UserId, "test-user-missing", MarkReadRequest{})
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
+
+func TestGetReadMarker(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, sender)
+	dbClient.StoreUser(ctx, recipient)
+
+	t.Run("recipient has not read", func(t *testing.T) {
+		conversation, err := handler.GetReadMarker(ctx, sender.UserId, recipient.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, recipient.UserId, conversation.UserId)
+		assert.Empty(t, conversation.LastReadMessageId)
+	})
+
+	t.Run("recipient read the message", func(t *testing.T) {
+		msg := storeTestMessage(ctx, dbClient, sender.UserId, recipient.UserId)
+		_, err := handler.MarkRead(ctx, recipient.UserId, sender.UserId, MarkReadRequest{MessageId: msg.MessageId})
+		assert.NoError(t, err)
+
+		conversation, err := handler.GetReadMarker(ctx, sender.UserId, recipient.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, msg.MessageId, conversation.LastReadMessageId)
+	})
+
+	t.Run("peer not found", func(t *testing.T) {
+		_, err := handler.GetReadMarker(ctx, sender.UserId, "test-user-missing")
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
+
+func TestGetUnreadCounts(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	dbClient.StoreUser(ctx, peer)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, user)
+
+	read := storeTestMessage(ctx, dbClient, peer.UserId, user.UserId)
+	dbClient.UpdateConversations(ctx, read, ConversationPrivate)
+	storeTestMessage(ctx, dbClient, peer.UserId, user.UserId)
+	storeTestMessage(ctx, dbClient, peer.UserId, group.GroupId)
+	storeTestMessage(ctx, dbClient, user.UserId, group.GroupId)
+	_, err := handler.MarkRead(ctx, user.UserId, peer.UserId, MarkReadRequest{MessageId: read.MessageId})
+	assert.NoError(t, err)
+
+	t.Run("counts per conversation", func(t *testing.T) {
+		resp, err := handler.GetUnreadCounts(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []UnreadCount{
+			{ConversationId: peer.UserId, Type: ConversationPrivate, UnreadCount: 1, LastReadMessageId: read.MessageId},
+			{ConversationId: group.GroupId, Type: ConversationGroup, UnreadCount: 1},
+		}, resp.Conversations)
+		assert.Equal(t, 2, resp.Total)
+	})
+
+	t.Run("own messages are not unread", func(t *testing.T) {
+		resp, err := handler.GetUnreadCounts(ctx, peer.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []UnreadCount{{ConversationId: user.UserId, Type: ConversationPrivate}}, resp.Conversations)
+		assert.Equal(t, 0, resp.Total)
+	})
+
+	t.Run("muted conversations are not counted", func(t *testing.T) {
+		stored, _ := dbClient.GetUser(ctx, user.UserId)
+		assert.NoError(t, dbClient.MuteConversation(ctx, *stored, group.GroupId))
+		defer func() {
+			stored, _ := dbClient.GetUser(ctx, user.UserId)
+			dbClient.UnmuteConversation(ctx, *stored, group.GroupId)
+		}()
+
+		resp, err := handler.GetUnreadCounts(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []UnreadCount{
+			{ConversationId: peer.UserId, Type: ConversationPrivate, UnreadCount: 1, LastReadMessageId: read.MessageId},
+			{ConversationId: group.GroupId, Type: ConversationGroup, Muted: true},
+		}, resp.Conversations)
+		assert.Equal(t, 1, resp.Total)
+
+		summaries, err := handler.GetConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		for _, summary := range summaries.Conversations {
+			if summary.ConversationId == group.GroupId {
+				assert.True(t, summary.Muted)
+				assert.Equal(t, 0, summary.UnreadCount)
+			}
+		}
+	})
+
+	t.Run("db error", func(t *testing.T) {
+		dbClient.Error = fmt.Errorf("test error")
+		defer func() { dbClient.Error = nil }()
+		_, err := handler.GetUnreadCounts(ctx, user.UserId)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetConversations(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	dbClient.StoreUser(ctx, peer)
+	dbClient.StoreUser(ctx, other)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	quiet := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	for _, g := range []Group{group, quiet} {
+		dbClient.StoreGroup(ctx, g)
+		dbClient.AddUserToGroup(ctx, g, user)
+	}
+
+	send := func(senderId string, recipientId string, conversationType string) Message {
+		msg := storeTestMessage(ctx, dbClient, senderId, recipientId)
+		dbClient.UpdateConversations(ctx, msg, conversationType)
+		return msg
+	}
+	send(peer.UserId, user.UserId, ConversationPrivate)
+	fromOther := send(other.UserId, user.UserId, ConversationPrivate)
+	toGroup := send(peer.UserId, group.GroupId, ConversationGroup)
+	fromPeer := send(peer.UserId, user.UserId, ConversationPrivate)
+
+	t.Run("sorted by recency", func(t *testing.T) {
+		resp, err := handler.GetConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Len(t, resp.Conversations, 4)
+
+		assert.Equal(t, ConversationSummary{ConversationId: peer.UserId, Type: ConversationPrivate, LastMessage: &fromPeer, UnreadCount: 2}, resp.Conversations[0])
+		assert.Equal(t, ConversationSummary{ConversationId: group.GroupId, Type: ConversationGroup, LastMessage: &toGroup, UnreadCount: 1}, resp.Conversations[1])
+		assert.Equal(t, ConversationSummary{ConversationId: other.UserId, Type: ConversationPrivate, LastMessage: &fromOther, UnreadCount: 1}, resp.Conversations[2])
+		// groups without messages are last
+		assert.Equal(t, ConversationSummary{ConversationId: quiet.GroupId, Type: ConversationGroup}, resp.Conversations[3])
+	})
+
+	t.Run("group read marker of the user", func(t *testing.T) {
+		_, err := handler.MarkRead(ctx, user.UserId, group.GroupId, MarkReadRequest{MessageId: toGroup.MessageId})
+		assert.NoError(t, err)
+
+		resp, err := handler.GetConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, ConversationSummary{ConversationId: group.GroupId, Type: ConversationGroup, LastMessage: &toGroup, LastReadMessageId: toGroup.MessageId}, resp.Conversations[1])
+	})
+
+	t.Run("long messages are cut in the preview", func(t *testing.T) {
+		msg := storeTestMessage(ctx, dbClient, other.UserId, user.UserId)
+		msg.Message = strings.Repeat("a", MessagePreviewLength+1)
+		dbClient.UpdateConversations(ctx, msg, ConversationPrivate)
+
+		resp, err := handler.GetConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, other.UserId, resp.Conversations[0].ConversationId)
+		assert.Len(t, resp.Conversations[0].LastMessage.Message, MessagePreviewLength)
+	})
+
+	t.Run("latest group message of a blocked sender", func(t *testing.T) {
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocking)
+		dbClient.AddUserToGroup(ctx, group, blocking)
+		dbClient.BlockUser(ctx, blocking, peer.UserId)
+		groupConversation := func() ConversationSummary {
+			resp, err := handler.GetConversations(ctx, blocking.UserId)
+			assert.NoError(t, err)
+			assert.Len(t, resp.Conversations, 1)
+			return resp.Conversations[0]
+		}
+
+		dbClient.SetBlockedGroupMessages(ctx, blocking, BlockedMessagesCollapse)
+		collapsed := toGroup
+		collapsed.Message = ""
+		collapsed.Collapsed = true
+		assert.Equal(t, &collapsed, groupConversation().LastMessage)
+
+		dbClient.SetBlockedGroupMessages(ctx, blocking, BlockedMessagesHide)
+		assert.Nil(t, groupConversation().LastMessage)
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		_, err := handler.GetConversations(ctx, "test-user-missing")
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
@@ -0,0 +1,90 @@
+package conversations
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+)
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 1000
+)
+
+type HistoryRequest struct {
+	Before string // message ID, only older messages are returned
+	After  string // message ID, only newer messages are returned
+	Limit  int    // page size, DefaultHistoryLimit if not provided
+}
+
+type HistoryResponse struct {
+	Messages []Message `json:"messages"` // ordered by message ID, oldest first
+	HasMore  bool      `json:"hasMore"`  // there are more messages in the paging direction
+}
+
+/*
+Get the messages of the private conversation between the user and the peer, in both directions
+Without cursors the latest messages are returned, before pages back to older messages and after pages forward to newer ones
+*/
+func (handler *Handler) GetPrivateHistory(ctx context.Context, userId string, peerId string, req HistoryRequest) (*HistoryResponse, error) {
+	if _, err := handler.getUser(ctx, peerId); err != nil {
+		return nil, err
+	}
+	return handler.getHistory(ctx, userId, db.HistoryQuery{Type: ConversationPrivate, ConversationId: PrivateConversationKey(userId, peerId)}, req)
+}
+
+/*
+Get the messages of a group, only the group members can read the group history
+Without cursors the latest messages are returned, before pages back to older messages and after pages forward to newer ones
+*/
+func (handler *Handler) GetGroupHistory(ctx context.Context, userId string, groupId string, req HistoryRequest) (*HistoryResponse, error) {
+	group, err := handler.DBClient.GetGroup(ctx, groupId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group %s: %v", groupId, err))
+		return nil, &InternalServerError{Message: "Error getting group"}
+	}
+	if group == nil {
+		slog.Error(fmt.Sprintf("Group %s not found", groupId))
+		return nil, &NotFoundError{Message: "Group not found"}
+	}
+	if !group.Members[userId] {
+		slog.Error(fmt.Sprintf("User %s is not a member of group %s", userId, groupId))
+		return nil, &ForbiddenError{Message: "User is not a member of the group"}
+	}
+	return handler.getHistory(ctx, userId, db.HistoryQuery{Type: ConversationGroup, ConversationId: groupId}, req)
+}
+
+func (handler *Handler) getHistory(ctx context.Context, userId string, query db.HistoryQuery, req HistoryRequest) (*HistoryResponse, error) {
+	if req.Limit <= 0 {
+		req.Limit = DefaultHistoryLimit
+	}
+	if req.Limit > MaxHistoryLimit {
+		slog.Error(fmt.Sprintf("Invalid limit: %d", req.Limit))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Limit must not exceed %d", MaxHistoryLimit)}
+	}
+	if req.Before != "" && req.After != "" && req.Before <= req.After {
+		slog.Error(fmt.Sprintf("Invalid cursors before %s after %s", req.Before, req.After))
+		return nil, &BadRequestError{Message: "before must be greater than after"}
+	}
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	query.Before = req.Before
+	query.After = req.After
+	query.Limit = req.Limit
+
+	page, err := handler.DBClient.GetConversationMessages(ctx, query)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting history of conversation %s for user %s: %v", query.ConversationId, userId, err))
+		return nil, &InternalServerError{Message: "Error getting messages"}
+	}
+	// the group messages of blocked senders are hidden or collapsed, so a page may be shorter than the limit
+	messages := NewMessageView(*user).ApplyAll(page.Messages)
+	if messages == nil {
+		messages = []Message{}
+	}
+	return &HistoryResponse{Messages: messages, HasMore: page.HasMore}, nil
+}
@@ -0,0 +1,149 @@
+package conversations
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"server/common"
+	. "server/common"
+	"server/db"
+	"testing"
+	"time"
+)
+
+func TestGetPrivateHistory(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	dbClient.StoreUser(ctx, peer)
+	dbClient.StoreUser(ctx, other)
+
+	send := func(senderId string, recipientId string) Message {
+		messageId := NewMessageId(time.Now())
+		msg := Message{RecipientId: recipientId, MessageId: messageId, ChangeId: messageId, SenderId: senderId, Message: "hello",
+			ConversationKey: PrivateConversationKey(senderId, recipientId)}
+		dbClient.StoreMessage(ctx, msg)
+		return msg
+	}
+	first := send(user.UserId, peer.UserId)
+	second := send(peer.UserId, user.UserId)
+	send(other.UserId, user.UserId)
+	third := send(user.UserId, peer.UserId)
+
+	t.Run("both directions, oldest first", func(t *testing.T) {
+		resp, err := handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{first, second, third}, resp.Messages)
+		assert.False(t, resp.HasMore)
+
+		// the same history for the peer
+		resp, err = handler.GetPrivateHistory(ctx, peer.UserId, user.UserId, HistoryRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{first, second, third}, resp.Messages)
+	})
+
+	t.Run("latest page and scroll back", func(t *testing.T) {
+		resp, err := handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{second, third}, resp.Messages)
+		assert.True(t, resp.HasMore)
+
+		resp, err = handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{Before: second.MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{first}, resp.Messages)
+		assert.False(t, resp.HasMore)
+	})
+
+	t.Run("page forward", func(t *testing.T) {
+		resp, err := handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{After: first.MessageId, Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{second}, resp.Messages)
+		assert.True(t, resp.HasMore)
+
+		resp, err = handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{After: first.MessageId, Before: third.MessageId})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{second}, resp.Messages)
+		assert.False(t, resp.HasMore)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		_, err := handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{Limit: MaxHistoryLimit + 1})
+		assert.IsType(t, &common.BadRequestError{}, err)
+
+		_, err = handler.GetPrivateHistory(ctx, user.UserId, peer.UserId, HistoryRequest{After: third.MessageId, Before: first.MessageId})
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("peer not found", func(t *testing.T) {
+		_, err := handler.GetPrivateHistory(ctx, user.UserId, "test-user-missing", HistoryRequest{})
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
+
+func TestGetGroupHistory(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	member := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	outsider := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, member)
+	dbClient.StoreUser(ctx, outsider)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, member)
+	msg := storeTestMessage(ctx, dbClient, member.UserId, group.GroupId)
+
+	t.Run("member reads the history", func(t *testing.T) {
+		resp, err := handler.GetGroupHistory(ctx, member.UserId, group.GroupId, HistoryRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{msg}, resp.Messages)
+	})
+
+	t.Run("empty history", func(t *testing.T) {
+		resp, err := handler.GetGroupHistory(ctx, member.UserId, group.GroupId, HistoryRequest{After: msg.MessageId})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{}, resp.Messages)
+	})
+
+	t.Run("messages of blocked senders", func(t *testing.T) {
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocking)
+		dbClient.AddUserToGroup(ctx, group, blocking)
+		dbClient.BlockUser(ctx, blocking, member.UserId)
+
+		dbClient.SetBlockedGroupMessages(ctx, blocking, BlockedMessagesCollapse)
+		resp, err := handler.GetGroupHistory(ctx, blocking.UserId, group.GroupId, HistoryRequest{})
+		assert.NoError(t, err)
+		collapsed := msg
+		collapsed.Message = ""
+		collapsed.Collapsed = true
+		assert.Equal(t, []Message{collapsed}, resp.Messages)
+
+		dbClient.SetBlockedGroupMessages(ctx, blocking, BlockedMessagesHide)
+		resp, err = handler.GetGroupHistory(ctx, blocking.UserId, group.GroupId, HistoryRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{}, resp.Messages)
+
+		// the other members still read the message
+		resp, err = handler.GetGroupHistory(ctx, member.UserId, group.GroupId, HistoryRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{msg}, resp.Messages)
+	})
+
+	t.Run("not a member", func(t *testing.T) {
+		_, err := handler.GetGroupHistory(ctx, outsider.UserId, group.GroupId, HistoryRequest{})
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("group not found", func(t *testing.T) {
+		_, err := handler.GetGroupHistory(ctx, member.UserId, "test-group-missing", HistoryRequest{})
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "server/common"
+)
+
+// ErrAttachmentSent is returned when sending an attachment that was already sent with another message.
+var ErrAttachmentSent = errors.New("attachment was already sent")
+
+func attachmentKey(attachmentId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{AttachmentPrimaryKey: &types.AttributeValueMemberS{Value: attachmentId}}
+}
+
+func (d *dynamoDBClient) StoreAttachment(ctx context.Context, attachment Attachment) error {
+	item, err := attributevalue.MarshalMap(attachment)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(AttachmentsTableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoDBClient) GetAttachment(ctx context.Context, attachmentId string) (*Attachment, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(AttachmentsTableName),
+		Key:       attachmentKey(attachmentId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, no attachment with the provided ID exists
+	if result.Item == nil {
+		return nil, nil
+	}
+	var attachment Attachment
+	err = attributevalue.UnmarshalMap(result.Item, &attachment)
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (d *dynamoDBClient) SendAttachment(ctx context.Context, attachmentId string, recipientId string, messageId string) error {
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(AttachmentsTableName),
+		Key:              attachmentKey(attachmentId),
+		UpdateExpression: aws.String("SET #recipientId = :recipientId, #messageId = :messageId"),
+		// only once, and never recreate an attachment that does not exist
+		ConditionExpression: aws.String("attribute_exists(#attachmentId) AND attribute_not_exists(#messageId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#attachmentId": AttachmentPrimaryKey,
+			"#recipientId":  "RecipientId",
+			"#messageId":    "MessageId",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":recipientId": &types.AttributeValueMemberS{Value: recipientId},
+			":messageId":   &types.AttributeValueMemberS{Value: messageId},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrAttachmentSent
+	}
+	return err
+}
+
+func (d *dynamoDBClient) ReleaseAttachment(ctx context.Context, attachmentId string, messageId string) error {
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(AttachmentsTableName),
+		Key:                 attachmentKey(attachmentId),
+		UpdateExpression:    aws.String("REMOVE #recipientId, #messageId"),
+		ConditionExpression: aws.String("#messageId = :messageId"),
+		ExpressionAttributeNames: map[string]string{
+			"#recipientId": "RecipientId",
+			"#messageId":   "MessageId",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":messageId": &types.AttributeValueMemberS{Value: messageId},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// not sent with the message
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,1011 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"time"
+)
+
+// boltDBClient is an embedded, file backed implementation of DynamoDBClientInterface.
+// It is meant for running the server locally and in CI without AWS.
+// Users and groups are stored as JSON documents keyed by their ID, messages are stored in a nested bucket
+// per recipient keyed by message ID. A second nested bucket per recipient indexes the message IDs by change ID,
+// like the ChangeIdIndex of the DynamoDB table, so that change time range queries are a cursor seek over the sorted keys.
+type boltDBClient struct {
+	db *bolt.DB
+}
+
+var (
+	usersBucket    = []byte(UsersTableName)
+	groupsBucket   = []byte(GroupsTableName)
+	messagesBucket = []byte(MessagesTableName)
+	changesBucket  = []byte(MessagesTableName + "-" + ChangeIdIndex)
+	invitesBucket  = []byte(InvitesTableName)
+	// nested bucket per user, keyed by conversation ID
+	conversationsBucket = []byte(ConversationsTableName)
+	// nested bucket per private conversation key, mapping message IDs to the recipient the message is stored under
+	conversationIndexBucket = []byte(MessagesTableName + "-" + ConversationIndex)
+	userDeletionsBucket     = []byte(UserDeletionsTableName)
+	attachmentsBucket       = []byte(AttachmentsTableName)
+	// postings keyed by scope, term and message ID, see searchIndexKey
+	searchIndexBucket = []byte(SearchIndexTableName)
+	// nested bucket per thread key, mapping the message IDs of the replies to the recipient the reply is stored under
+	threadIndexBucket = []byte(MessagesTableName + "-" + ThreadIndex)
+	// nested bucket per message key, keyed by reaction key, see reactionKeys
+	reactionsBucket = []byte(ReactionsTableName)
+	// nested bucket per sender, keyed by schedule ID
+	scheduledBucket = []byte(ScheduledTableName)
+)
+
+func NewBoltDBClient(path string) (DynamoDBClientInterface, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error opening bolt database %s: %v", path, err))
+		return nil, err
+	}
+	// create all top level buckets up front so that read transactions can assume they exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, groupsBucket, messagesBucket, changesBucket, invitesBucket, conversationsBucket, conversationIndexBucket, threadIndexBucket, userDeletionsBucket, attachmentsBucket, searchIndexBucket, reactionsBucket, scheduledBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDBClient{db: db}, nil
+}
+
+func (b *boltDBClient) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltDBClient) StoreUser(ctx context.Context, user User) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored User
+		bucket := tx.Bucket(usersBucket)
+		found, err := getItem(bucket, user.UserId, &stored)
+		if err != nil {
+			return err
+		}
+		if found && stored.Version != user.Version {
+			return ErrVersionConflict
+		}
+		return putUser(bucket, user)
+	})
+}
+
+// putUser writes the user with the next version. Updates read the user in the same transaction, so they never conflict.
+func putUser(bucket *bolt.Bucket, user User) error {
+	return putItem(bucket, user.UserId, nextUserVersion(user))
+}
+
+// putGroup writes the group with the next version, see putUser.
+func putGroup(bucket *bolt.Bucket, group Group) error {
+	return putItem(bucket, group.GroupId, nextGroupVersion(group))
+}
+
+func (b *boltDBClient) BlockUser(ctx context.Context, user User, blockedUserId string) error {
+	return b.updateUser(user.UserId, func(user *User) {
+		if user.BlockedUsers == nil {
+			user.BlockedUsers = make(map[string]bool)
+		}
+		user.BlockedUsers[blockedUserId] = true
+	})
+}
+
+func (b *boltDBClient) UnBlockUser(ctx context.Context, user User, unBlockedUserId string) error {
+	return b.updateUser(user.UserId, func(user *User) {
+		delete(user.BlockedUsers, unBlockedUserId)
+	})
+}
+
+func (b *boltDBClient) MuteConversation(ctx context.Context, user User, conversationId string) error {
+	return b.updateUser(user.UserId, func(user *User) {
+		if user.Muted == nil {
+			user.Muted = make(map[string]bool)
+		}
+		user.Muted[conversationId] = true
+	})
+}
+
+func (b *boltDBClient) SetBlockedGroupMessages(ctx context.Context, user User, setting string) error {
+	return b.updateUser(user.UserId, func(user *User) {
+		user.BlockedGroupMessages = setting
+	})
+}
+
+func (b *boltDBClient) UnmuteConversation(ctx context.Context, user User, conversationId string) error {
+	return b.updateUser(user.UserId, func(user *User) {
+		delete(user.Muted, conversationId)
+	})
+}
+
+// updateUser applies the update to the stored user record inside a single transaction,
+// so that concurrent updates of different fields are not lost.
+func (b *boltDBClient) updateUser(userId string, update func(user *User)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var user User
+		bucket := tx.Bucket(usersBucket)
+		found, err := getItem(bucket, userId, &user)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("user %s not found", userId)
+		}
+		update(&user)
+		return putUser(bucket, user)
+	})
+}
+
+func (b *boltDBClient) GetUser(ctx context.Context, userId string) (*User, error) {
+	var user User
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getItem(tx.Bucket(usersBucket), userId, &user)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (b *boltDBClient) DeleteUser(ctx context.Context, userId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Delete([]byte(userId))
+	})
+}
+
+func (b *boltDBClient) GetBlockingUsers(ctx context.Context, userId string, cursor string) ([]string, string, error) {
+	var userIds []string
+	next := ""
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usersBucket).Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			// continue after the last user of the previous page
+			if k, v = c.Seek([]byte(cursor)); string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+		for scanned := 0; k != nil; k, v = c.Next() {
+			if scanned == blockingUsersPageSize {
+				next = cursor
+				return nil
+			}
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if user.BlockedUsers[userId] {
+				userIds = append(userIds, user.UserId)
+			}
+			cursor = string(k)
+			scanned++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return userIds, next, nil
+}
+
+func (b *boltDBClient) StoreUserDeletion(ctx context.Context, deletion UserDeletion) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putItem(tx.Bucket(userDeletionsBucket), deletion.UserId, deletion)
+	})
+}
+
+func (b *boltDBClient) GetUserDeletion(ctx context.Context, userId string) (*UserDeletion, error) {
+	var deletion UserDeletion
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getItem(tx.Bucket(userDeletionsBucket), userId, &deletion)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+func (b *boltDBClient) GetUserDeletions(ctx context.Context) ([]UserDeletion, error) {
+	var deletions []UserDeletion
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userDeletionsBucket).ForEach(func(k, v []byte) error {
+			var deletion UserDeletion
+			if err := json.Unmarshal(v, &deletion); err != nil {
+				return err
+			}
+			deletions = append(deletions, deletion)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletions, nil
+}
+
+func (b *boltDBClient) DeleteUserDeletion(ctx context.Context, userId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(userDeletionsBucket).Delete([]byte(userId))
+	})
+}
+
+func (b *boltDBClient) StoreGroup(ctx context.Context, group Group) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		bucket := tx.Bucket(groupsBucket)
+		found, err := getItem(bucket, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if found && stored.Version != group.Version {
+			return ErrVersionConflict
+		}
+		return putGroup(bucket, group)
+	})
+}
+
+func (b *boltDBClient) GetGroup(ctx context.Context, groupId string) (*Group, error) {
+	var group Group
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getItem(tx.Bucket(groupsBucket), groupId, &group)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (b *boltDBClient) AddUserToGroup(ctx context.Context, group Group, user User) error {
+	return b.updateMembership(group.GroupId, user.UserId, addMember)
+}
+
+// addMember adds the member, banned users are not added, also if they were banned after the group was read.
+func addMember(group *Group, user *User) error {
+	if group.Banned[user.UserId] {
+		return nil
+	}
+	if group.Members == nil {
+		group.Members = make(map[string]bool)
+	}
+	group.Members[user.UserId] = true
+	if user.Groups == nil {
+		user.Groups = make(map[string]bool)
+	}
+	user.Groups[group.GroupId] = true
+	return nil
+}
+
+func (b *boltDBClient) RemoveUserFromGroup(ctx context.Context, group Group, user User) error {
+	return b.updateMembership(group.GroupId, user.UserId, removeMember)
+}
+
+// removeMember removes the member, removed members are no longer admins.
+func removeMember(group *Group, user *User) error {
+	delete(group.Members, user.UserId)
+	delete(group.Admins, user.UserId)
+	delete(user.Groups, group.GroupId)
+	return nil
+}
+
+func (b *boltDBClient) BanUserFromGroup(ctx context.Context, group Group, user User) error {
+	return b.updateMembership(group.GroupId, user.UserId, banMember)
+}
+
+// banMember removes the member and bans them from the group.
+func banMember(group *Group, user *User) error {
+	removeMember(group, user)
+	if group.Banned == nil {
+		group.Banned = make(map[string]bool)
+	}
+	group.Banned[user.UserId] = true
+	return nil
+}
+
+// joinMember adds the member with an invite, it returns ErrUserBanned for a banned user, so that the use of the invite
+// is not counted, also if they were banned after the group was read.
+func joinMember(group *Group, user *User) error {
+	if group.Banned[user.UserId] {
+		return ErrUserBanned
+	}
+	return addMember(group, user)
+}
+
+func (b *boltDBClient) UnbanUserFromGroup(ctx context.Context, group Group, userId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		delete(stored.Banned, userId)
+		return putGroup(groups, stored)
+	})
+}
+
+func (b *boltDBClient) SetGroupAdmin(ctx context.Context, group Group, userId string, admin bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		if stored.Admins == nil {
+			stored.Admins = make(map[string]bool)
+		}
+		if admin {
+			stored.Admins[userId] = true
+		} else {
+			delete(stored.Admins, userId)
+		}
+		return putGroup(groups, stored)
+	})
+}
+
+func (b *boltDBClient) RemoveDeletedUserFromGroup(ctx context.Context, group Group, userId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		removeDeletedMember(&stored, userId)
+		return putGroup(groups, stored)
+	})
+}
+
+func (b *boltDBClient) SetGroupOwner(ctx context.Context, group Group, ownerId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		if stored.OwnerId != "" {
+			return nil
+		}
+		stored.OwnerId = ownerId
+		return putGroup(groups, stored)
+	})
+}
+
+func (b *boltDBClient) SetGroupFanOutOnRead(ctx context.Context, group Group, inboxUntil string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		stored.FanOutOnWrite = false
+		stored.InboxUntil = inboxUntil
+		return putGroup(groups, stored)
+	})
+}
+
+// DeleteGroup removes the group from all of its members and deletes the group record in one transaction.
+// Messages sent to the group are kept, as in the DynamoDB implementation.
+func (b *boltDBClient) DeleteGroup(ctx context.Context, group Group) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Group
+		groups := tx.Bucket(groupsBucket)
+		users := tx.Bucket(usersBucket)
+		found, err := getItem(groups, group.GroupId, &stored)
+		if err != nil || !found {
+			return err
+		}
+		for userId := range stored.Members {
+			var user User
+			found, err = getItem(users, userId, &user)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			delete(user.Groups, group.GroupId)
+			if err = putUser(users, user); err != nil {
+				return err
+			}
+		}
+		return groups.Delete([]byte(group.GroupId))
+	})
+}
+
+// updateMembership reads the stored group and user, applies the update and writes both back in one transaction.
+func (b *boltDBClient) updateMembership(groupId string, userId string, update func(group *Group, user *User) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return updateMembershipTx(tx, groupId, userId, update)
+	})
+}
+
+func updateMembershipTx(tx *bolt.Tx, groupId string, userId string, update func(group *Group, user *User) error) error {
+	var group Group
+	var user User
+	groups := tx.Bucket(groupsBucket)
+	users := tx.Bucket(usersBucket)
+
+	found, err := getItem(groups, groupId, &group)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("group %s not found", groupId)
+	}
+	found, err = getItem(users, userId, &user)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %s not found", userId)
+	}
+
+	if err = update(&group, &user); err != nil {
+		return err
+	}
+
+	if err = putGroup(groups, group); err != nil {
+		return err
+	}
+	return putUser(users, user)
+}
+
+func (b *boltDBClient) StoreInvite(ctx context.Context, invite GroupInvite) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putItem(tx.Bucket(invitesBucket), invite.Token, invite)
+	})
+}
+
+func (b *boltDBClient) GetInvite(ctx context.Context, token string) (*GroupInvite, error) {
+	var invite GroupInvite
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getItem(tx.Bucket(invitesBucket), token, &invite)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// GetGroupInvites scans all invites, groups have only a few active invites and this backend is not meant for large deployments.
+func (b *boltDBClient) GetGroupInvites(ctx context.Context, groupId string) ([]GroupInvite, error) {
+	var invites []GroupInvite
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).ForEach(func(k, v []byte) error {
+			var invite GroupInvite
+			if err := json.Unmarshal(v, &invite); err != nil {
+				return err
+			}
+			if invite.GroupId == groupId {
+				invites = append(invites, invite)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (b *boltDBClient) DeleteInvite(ctx context.Context, token string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).Delete([]byte(token))
+	})
+}
+
+func (b *boltDBClient) JoinGroupWithInvite(ctx context.Context, invite GroupInvite, group Group, user User) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored GroupInvite
+		invites := tx.Bucket(invitesBucket)
+		found, err := getItem(invites, invite.Token, &stored)
+		if err != nil {
+			return err
+		}
+		if !found || stored.Expired(time.Now()) || stored.UsedUp() {
+			return ErrInviteUnavailable
+		}
+		stored.Uses++
+		if err = putItem(invites, invite.Token, stored); err != nil {
+			return err
+		}
+		return updateMembershipTx(tx, group.GroupId, user.UserId, joinMember)
+	})
+}
+
+func (b *boltDBClient) StoreAttachment(ctx context.Context, attachment Attachment) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putItem(tx.Bucket(attachmentsBucket), attachment.AttachmentId, attachment)
+	})
+}
+
+func (b *boltDBClient) GetAttachment(ctx context.Context, attachmentId string) (*Attachment, error) {
+	var attachment Attachment
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getItem(tx.Bucket(attachmentsBucket), attachmentId, &attachment)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (b *boltDBClient) SendAttachment(ctx context.Context, attachmentId string, recipientId string, messageId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Attachment
+		attachments := tx.Bucket(attachmentsBucket)
+		found, err := getItem(attachments, attachmentId, &stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("attachment %s not found", attachmentId)
+		}
+		if stored.MessageId != "" {
+			return ErrAttachmentSent
+		}
+		stored.RecipientId = recipientId
+		stored.MessageId = messageId
+		return putItem(attachments, attachmentId, stored)
+	})
+}
+
+func (b *boltDBClient) ReleaseAttachment(ctx context.Context, attachmentId string, messageId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var stored Attachment
+		attachments := tx.Bucket(attachmentsBucket)
+		found, err := getItem(attachments, attachmentId, &stored)
+		if err != nil || !found || stored.MessageId != messageId {
+			return err
+		}
+		stored.RecipientId = ""
+		stored.MessageId = ""
+		return putItem(attachments, attachmentId, stored)
+	})
+}
+
+func (b *boltDBClient) StoreMessage(ctx context.Context, message Message) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putMessage(tx, message)
+	})
+}
+
+func (b *boltDBClient) GetMessage(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	var message Message
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(recipientId))
+		if bucket == nil {
+			return nil
+		}
+		var err error
+		found, err = getItem(bucket, messageId, &message)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// GetMessageConsistent is GetMessage, a bolt read always sees the latest write.
+func (b *boltDBClient) GetMessageConsistent(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	return b.GetMessage(ctx, recipientId, messageId)
+}
+
+func (b *boltDBClient) UpdateMessage(ctx context.Context, message Message) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(message.RecipientId))
+		var previous Message
+		found := false
+		if bucket != nil {
+			var err error
+			if found, err = getItem(bucket, message.MessageId, &previous); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("message %s of recipient %s not found", message.MessageId, message.RecipientId)
+		}
+		message.ReplyCount, message.Reactions = previous.ReplyCount, previous.Reactions
+		return putMessage(tx, message)
+	})
+}
+
+// putMessage stores the message and moves its change index entry to the message change ID.
+func putMessage(tx *bolt.Tx, message Message) error {
+	bucket, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(message.RecipientId))
+	if err != nil {
+		return err
+	}
+	changes, err := tx.Bucket(changesBucket).CreateBucketIfNotExists([]byte(message.RecipientId))
+	if err != nil {
+		return err
+	}
+
+	var previous Message
+	found, err := getItem(bucket, message.MessageId, &previous)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err = changes.Delete([]byte(previous.ChangeId)); err != nil {
+			return err
+		}
+		// the conversation key is not stored with the message, a private message is in the conversation index
+		key := PrivateConversationKey(previous.SenderId, previous.RecipientId)
+		if index := tx.Bucket(conversationIndexBucket).Bucket([]byte(key)); index != nil && index.Get([]byte(previous.MessageId)) != nil {
+			previous.ConversationKey = key
+		}
+		if err = updateSearchIndex(tx, &previous, message); err == nil {
+			err = updateUnreadCount(tx, message, unreadDelta(&previous, message))
+		}
+	} else if err = updateSearchIndex(tx, nil, message); err == nil {
+		err = updateUnreadCount(tx, message, unreadDelta(nil, message))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = putItem(bucket, message.MessageId, message); err != nil {
+		return err
+	}
+	if message.ConversationKey != "" {
+		conversation, err := tx.Bucket(conversationIndexBucket).CreateBucketIfNotExists([]byte(message.ConversationKey))
+		if err != nil {
+			return err
+		}
+		if err = conversation.Put([]byte(message.MessageId), []byte(message.RecipientId)); err != nil {
+			return err
+		}
+	}
+	if message.ThreadKey != "" {
+		thread, err := tx.Bucket(threadIndexBucket).CreateBucketIfNotExists([]byte(message.ThreadKey))
+		if err != nil {
+			return err
+		}
+		if err = thread.Put([]byte(message.MessageId), []byte(message.RecipientId)); err != nil {
+			return err
+		}
+	}
+	return changes.Put([]byte(message.ChangeId), []byte(message.MessageId))
+}
+
+func (b *boltDBClient) GetConversationMessages(ctx context.Context, query HistoryQuery) (*HistoryPage, error) {
+	var messages []Message
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// group messages are stored under the group ID, private messages of both directions are found by the conversation index
+		var bucket *bolt.Bucket
+		if query.Type == ConversationGroup {
+			bucket = tx.Bucket(messagesBucket).Bucket([]byte(query.ConversationId))
+		} else {
+			bucket = tx.Bucket(conversationIndexBucket).Bucket([]byte(query.ConversationId))
+		}
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		var k, v []byte
+		switch {
+		case query.forward():
+			k, v = c.Seek([]byte(query.After))
+		case query.Before != "":
+			if k, v = c.Seek([]byte(query.Before)); k == nil {
+				k, v = c.Last()
+			}
+		default:
+			k, v = c.Last()
+		}
+		// fetch one more than the page size, so that we know if there are more messages
+		for ; k != nil && len(messages) <= query.Limit; k, v = stepCursor(c, query.forward()) {
+			if !query.includes(string(k)) {
+				if query.forward() && query.Before != "" && string(k) >= query.Before {
+					break
+				}
+				continue
+			}
+			var message Message
+			if query.Type == ConversationGroup {
+				if err := json.Unmarshal(v, &message); err != nil {
+					return err
+				}
+			} else {
+				// the index points to the recipient the message is stored under
+				found, err := getItem(tx.Bucket(messagesBucket).Bucket(v), string(k), &message)
+				if err != nil {
+					return err
+				}
+				if !found {
+					continue
+				}
+			}
+			messages = append(messages, message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newHistoryPage(query, messages), nil
+}
+
+func stepCursor(c *bolt.Cursor, forward bool) ([]byte, []byte) {
+	if forward {
+		return c.Next()
+	}
+	return c.Prev()
+}
+
+func (b *boltDBClient) StoreInboxMessages(ctx context.Context, message Message, userIds []string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, userId := range userIds {
+			if err := putMessage(tx, toInbox(message, userId)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDBClient) StoreSenderInboxMessage(ctx context.Context, message Message) error {
+	return b.StoreMessage(ctx, toSenderInbox(message))
+}
+
+func (b *boltDBClient) GetMessages(ctx context.Context, user User, query MessagesQuery) (*MessagesPage, error) {
+	recipientIds := append(query.groupIds(user), user.UserId)
+
+	var messages []Message
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, recipientId := range recipientIds {
+			recipientMsgs, err := getRecipientMessagesAfter(tx, recipientId, query.after(recipientId), query.fetchLimit())
+			if err != nil {
+				return err
+			}
+			messages = append(messages, recipientMsgs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fromInbox(user, newMessagesPage(query, messages)), nil
+}
+
+func (b *boltDBClient) UpdateConversations(ctx context.Context, message Message, conversationType string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for userId, conversationId := range conversationUserIds(message, conversationType) {
+			err := updateConversation(tx, userId, conversationId, func(conversation *Conversation) {
+				setLastMessage(conversation, message, conversationType)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDBClient) GetConversation(ctx context.Context, userId string, conversationId string) (*Conversation, error) {
+	var conversation Conversation
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conversationsBucket).Bucket([]byte(userId))
+		if bucket == nil {
+			return nil
+		}
+		var err error
+		found, err = getItem(bucket, conversationId, &conversation)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (b *boltDBClient) GetConversations(ctx context.Context, userId string) ([]Conversation, error) {
+	var conversations []Conversation
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conversationsBucket).Bucket([]byte(userId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var conversation Conversation
+			if err := json.Unmarshal(v, &conversation); err != nil {
+				return err
+			}
+			conversations = append(conversations, conversation)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+func (b *boltDBClient) DeleteConversation(ctx context.Context, userId string, conversationId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conversationsBucket).Bucket([]byte(userId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(conversationId))
+	})
+}
+
+func (b *boltDBClient) SetReadMarker(ctx context.Context, conversation Conversation) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var countErr error
+		err := updateConversation(tx, conversation.UserId, conversation.ConversationId, func(stored *Conversation) {
+			stored.Type = conversation.Type
+			if conversation.LastReadMessageId > stored.LastReadMessageId {
+				stored.LastReadMessageId = conversation.LastReadMessageId
+				stored.ReadAt = conversation.ReadAt
+				if stored.Type != ConversationGroup {
+					stored.UnreadCount, countErr = countUnread(tx, *stored, 0)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return countErr
+	})
+}
+
+func (b *boltDBClient) CountUnreadMessages(ctx context.Context, conversation Conversation) (int, error) {
+	if conversation.Type != ConversationGroup {
+		return conversation.UnreadCount, nil
+	}
+	count := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		count, err = countUnread(tx, conversation, MaxUnreadCount)
+		return err
+	})
+	return count, err
+}
+
+// countUnread counts the unread messages of the conversation after its read marker, up to limit messages,
+// 0 means no limit.
+func countUnread(tx *bolt.Tx, conversation Conversation, limit int) (int, error) {
+	bucket := tx.Bucket(messagesBucket).Bucket([]byte(unreadRecipientId(conversation)))
+	if bucket == nil {
+		return 0, nil
+	}
+	count := 0
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(conversation.LastReadMessageId)); k != nil && (limit == 0 || count < limit); k, v = c.Next() {
+		var message Message
+		if err := json.Unmarshal(v, &message); err != nil {
+			return 0, err
+		}
+		if isUnread(conversation, message) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// updateUnreadCount adds the unread delta of the message to the conversation of its recipient with its sender.
+func updateUnreadCount(tx *bolt.Tx, message Message, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	if delta < 0 {
+		// a deleted message never creates a conversation
+		bucket := tx.Bucket(conversationsBucket).Bucket([]byte(message.RecipientId))
+		if bucket == nil || bucket.Get([]byte(message.SenderId)) == nil {
+			return nil
+		}
+	}
+	return updateConversation(tx, message.RecipientId, message.SenderId, func(conversation *Conversation) {
+		addUnread(conversation, message.MessageId, delta)
+	})
+}
+
+// updateConversation applies the update to the conversation of the user, creating it if it does not exist.
+func updateConversation(tx *bolt.Tx, userId string, conversationId string, update func(conversation *Conversation)) error {
+	bucket, err := tx.Bucket(conversationsBucket).CreateBucketIfNotExists([]byte(userId))
+	if err != nil {
+		return err
+	}
+	conversation := Conversation{UserId: userId, ConversationId: conversationId}
+	if _, err = getItem(bucket, conversationId, &conversation); err != nil {
+		return err
+	}
+	update(&conversation)
+	return putItem(bucket, conversationId, conversation)
+}
+
+// getRecipientMessagesAfter returns up to limit recipient messages with a change ID greater than after,
+// in change ID order. limit 0 means no limit.
+func getRecipientMessagesAfter(tx *bolt.Tx, recipientId string, after string, limit int) ([]Message, error) {
+	bucket := tx.Bucket(messagesBucket).Bucket([]byte(recipientId))
+	changes := tx.Bucket(changesBucket).Bucket([]byte(recipientId))
+	if bucket == nil || changes == nil {
+		return nil, nil
+	}
+	var messages []Message
+	c := changes.Cursor()
+	for k, v := c.Seek([]byte(after)); k != nil; k, v = c.Next() {
+		if limit > 0 && len(messages) == limit {
+			break
+		}
+		if string(k) <= after {
+			continue
+		}
+		var message Message
+		found, err := getItem(bucket, string(v), &message)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func putItem(bucket *bolt.Bucket, key string, item interface{}) error {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+func getItem(bucket *bolt.Bucket, key string, item interface{}) (bool, error) {
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, item)
+}
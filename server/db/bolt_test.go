@@ -0,0 +1,1258 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	. "server/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBoltDBClient(t *testing.T) *boltDBClient {
+	client, err := NewBoltDBClient(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { client.(*boltDBClient).Close() })
+	return client.(*boltDBClient)
+}
+
+func newTestUser() User {
+	return User{
+		UserId:       fmt.Sprintf("test-user-%s", uuid.New().String()),
+		BlockedUsers: map[string]bool{},
+		Groups:       map[string]bool{},
+	}
+}
+
+func newTestGroup() Group {
+	return Group{
+		GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()),
+		Members: map[string]bool{},
+	}
+}
+
+func newTestMessage(recipientId string, t time.Time, text string) Message {
+	messageId := NewMessageId(t)
+	return Message{RecipientId: recipientId, MessageId: messageId, ChangeId: messageId, SenderId: "test-user-1", Message: text}
+}
+
+func TestBoltUsers(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	t.Run("store and get user", func(t *testing.T) {
+		user := newTestUser()
+		user.UserName = "test-user"
+		assert.NoError(t, client.StoreUser(ctx, user))
+
+		stored, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		user.Version = 1
+		assert.Equal(t, user, *stored)
+	})
+
+	t.Run("store stale user", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, client.BlockUser(ctx, *stored, "test-user-1"))
+
+		// the user changed since it was read
+		stored.UserName = "test-user"
+		assert.ErrorIs(t, client.StoreUser(ctx, *stored), ErrVersionConflict)
+		stored, _ = client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-1": true}, stored.BlockedUsers)
+		assert.Equal(t, int64(2), stored.Version)
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		stored, err := client.GetUser(ctx, "test-user-missing")
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("block and unblock user", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+
+		assert.NoError(t, client.BlockUser(ctx, user, "test-user-1"))
+		assert.NoError(t, client.BlockUser(ctx, user, "test-user-2"))
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-1": true, "test-user-2": true}, stored.BlockedUsers)
+
+		assert.NoError(t, client.UnBlockUser(ctx, user, "test-user-1"))
+		stored, _ = client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-2": true}, stored.BlockedUsers)
+	})
+
+	t.Run("mute and unmute conversation", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+
+		assert.NoError(t, client.MuteConversation(ctx, user, "test-user-1"))
+		assert.NoError(t, client.MuteConversation(ctx, user, "test-group-1"))
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-1": true, "test-group-1": true}, stored.Muted)
+
+		assert.NoError(t, client.UnmuteConversation(ctx, user, "test-user-1"))
+		stored, _ = client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-group-1": true}, stored.Muted)
+	})
+}
+
+func TestBoltGroupMembership(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	t.Run("add and remove user", func(t *testing.T) {
+		user := newTestUser()
+		group := newTestGroup()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		assert.NoError(t, client.StoreGroup(ctx, group))
+
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+		storedUser, _ := client.GetUser(ctx, user.UserId)
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.True(t, storedUser.Groups[group.GroupId])
+		assert.True(t, storedGroup.Members[user.UserId])
+
+		assert.NoError(t, client.RemoveUserFromGroup(ctx, group, user))
+		storedUser, _ = client.GetUser(ctx, user.UserId)
+		storedGroup, _ = client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, storedUser.Groups)
+		assert.Empty(t, storedGroup.Members)
+	})
+
+	t.Run("membership changes keep other members", func(t *testing.T) {
+		user1 := newTestUser()
+		user2 := newTestUser()
+		group := newTestGroup()
+		client.StoreUser(ctx, user1)
+		client.StoreUser(ctx, user2)
+		client.StoreGroup(ctx, group)
+
+		// both calls pass the same stale copy of the group
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user1))
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user2))
+
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, map[string]bool{user1.UserId: true, user2.UserId: true}, storedGroup.Members)
+	})
+
+	t.Run("missing user fails without changing the group", func(t *testing.T) {
+		group := newTestGroup()
+		client.StoreGroup(ctx, group)
+
+		err := client.AddUserToGroup(ctx, group, newTestUser())
+		assert.Error(t, err)
+
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, storedGroup.Members)
+	})
+
+	t.Run("promote, demote and remove admin", func(t *testing.T) {
+		user := newTestUser()
+		group := newTestGroup()
+		client.StoreUser(ctx, user)
+		client.StoreGroup(ctx, group)
+		client.AddUserToGroup(ctx, group, user)
+
+		assert.NoError(t, client.SetGroupAdmin(ctx, group, user.UserId, true))
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, map[string]bool{user.UserId: true}, storedGroup.Admins)
+		assert.Equal(t, map[string]bool{user.UserId: true}, storedGroup.Members)
+
+		assert.NoError(t, client.SetGroupAdmin(ctx, group, user.UserId, false))
+		storedGroup, _ = client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, storedGroup.Admins)
+
+		client.SetGroupAdmin(ctx, group, user.UserId, true)
+		assert.NoError(t, client.RemoveUserFromGroup(ctx, group, user))
+		storedGroup, _ = client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, storedGroup.Admins)
+	})
+
+	t.Run("owner of a legacy group", func(t *testing.T) {
+		// created before owners were recorded
+		group := newTestGroup()
+		client.StoreGroup(ctx, group)
+
+		assert.NoError(t, client.SetGroupOwner(ctx, group, "test-user-a"))
+		// an owner is only recorded once
+		assert.NoError(t, client.SetGroupOwner(ctx, group, "test-user-b"))
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, "test-user-a", storedGroup.OwnerId)
+	})
+
+	t.Run("ban and unban user", func(t *testing.T) {
+		group := newTestGroup()
+		user := newTestUser()
+		assert.NoError(t, client.StoreGroup(ctx, group))
+		assert.NoError(t, client.StoreUser(ctx, user))
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+
+		assert.NoError(t, client.BanUserFromGroup(ctx, group, user))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, stored.Members)
+		assert.Equal(t, map[string]bool{user.UserId: true}, stored.Banned)
+		storedUser, _ := client.GetUser(ctx, user.UserId)
+		assert.Empty(t, storedUser.Groups)
+
+		// a banned user is not added, also with a group read before the ban
+		assert.NoError(t, client.AddUserToGroup(ctx, *stored, user))
+		stored, _ = client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, stored.Members)
+
+		assert.NoError(t, client.UnbanUserFromGroup(ctx, group, user.UserId))
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+		stored, _ = client.GetGroup(ctx, group.GroupId)
+		assert.Empty(t, stored.Banned)
+		assert.Equal(t, map[string]bool{user.UserId: true}, stored.Members)
+	})
+
+	t.Run("delete group", func(t *testing.T) {
+		user1 := newTestUser()
+		user2 := newTestUser()
+		group := newTestGroup()
+		other := newTestGroup()
+		client.StoreUser(ctx, user1)
+		client.StoreUser(ctx, user2)
+		client.StoreGroup(ctx, group)
+		client.StoreGroup(ctx, other)
+		client.AddUserToGroup(ctx, group, user1)
+		client.AddUserToGroup(ctx, group, user2)
+		client.AddUserToGroup(ctx, other, user1)
+
+		assert.NoError(t, client.DeleteGroup(ctx, group))
+		storedGroup, err := client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.Nil(t, storedGroup)
+		storedUser, _ := client.GetUser(ctx, user1.UserId)
+		assert.Equal(t, map[string]bool{other.GroupId: true}, storedUser.Groups)
+		storedUser, _ = client.GetUser(ctx, user2.UserId)
+		assert.Empty(t, storedUser.Groups)
+	})
+}
+
+// testConcurrentMembershipChanges adds and removes n members of one group concurrently, every call passing the same
+// stale copy of the group, and checks that no change is lost.
+func testConcurrentMembershipChanges(t *testing.T, client DynamoDBClientInterface, n int) {
+	ctx := context.Background()
+	group := newTestGroup()
+	assert.NoError(t, client.StoreGroup(ctx, group))
+	var joining, leaving []User
+	for i := 0; i < n; i++ {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		joining = append(joining, user)
+	}
+	for i := 0; i < n; i++ {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		storedUser, _ := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, client.AddUserToGroup(ctx, *stored, *storedUser))
+		leaving = append(leaving, user)
+	}
+	stale, _ := client.GetGroup(ctx, group.GroupId)
+
+	var wg sync.WaitGroup
+	for i := range joining {
+		wg.Add(2)
+		go func(user User) {
+			defer wg.Done()
+			assert.NoError(t, client.AddUserToGroup(ctx, *stale, user))
+		}(joining[i])
+		go func(user User) {
+			defer wg.Done()
+			user.Groups = map[string]bool{group.GroupId: true}
+			assert.NoError(t, client.RemoveUserFromGroup(ctx, *stale, user))
+		}(leaving[i])
+	}
+	wg.Wait()
+
+	expected := map[string]bool{}
+	for _, user := range joining {
+		expected[user.UserId] = true
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{group.GroupId: true}, stored.Groups)
+	}
+	stored, _ := client.GetGroup(ctx, group.GroupId)
+	assert.Equal(t, expected, stored.Members)
+	// every write counts: the group was stored, joined by the leaving members, then joined and left n times each
+	assert.Equal(t, int64(1+3*n), stored.Version)
+}
+
+func TestBoltConcurrentMembershipChanges(t *testing.T) {
+	testConcurrentMembershipChanges(t, newTestBoltDBClient(t), 10)
+}
+
+// testUserDeletions covers the storage of user deletions and the cleanup steps of a deleted user.
+func testUserDeletions(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+
+	t.Run("delete user", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		assert.NoError(t, client.DeleteUser(ctx, user.UserId))
+		stored, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("blocking users are scanned page by page", func(t *testing.T) {
+		deleted := newTestUser()
+		var expected []string
+		for i := 0; i < blockingUsersPageSize+50; i++ {
+			user := newTestUser()
+			if i%3 == 0 {
+				user.BlockedUsers[deleted.UserId] = true
+				expected = append(expected, user.UserId)
+			}
+			assert.NoError(t, client.StoreUser(ctx, user))
+		}
+
+		var blocking []string
+		pages := 0
+		for cursor := ""; pages == 0 || cursor != ""; pages++ {
+			userIds, next, err := client.GetBlockingUsers(ctx, deleted.UserId, cursor)
+			assert.NoError(t, err)
+			blocking = append(blocking, userIds...)
+			cursor = next
+		}
+		assert.ElementsMatch(t, expected, blocking)
+		assert.Greater(t, pages, 1)
+	})
+
+	t.Run("group of a deleted owner passes to the first admin", func(t *testing.T) {
+		group := newTestGroup()
+		group.OwnerId = "test-user-a"
+		group.Admins = map[string]bool{"test-user-c": true, "test-user-b": true}
+		group.Members = map[string]bool{"test-user-a": true, "test-user-b": true, "test-user-c": true, "test-user-d": true}
+		assert.NoError(t, client.StoreGroup(ctx, group))
+
+		assert.NoError(t, client.RemoveDeletedUserFromGroup(ctx, group, "test-user-a"))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, "test-user-b", stored.OwnerId)
+		assert.Equal(t, map[string]bool{"test-user-c": true}, stored.Admins)
+		assert.Equal(t, map[string]bool{"test-user-b": true, "test-user-c": true, "test-user-d": true}, stored.Members)
+	})
+
+	t.Run("group of a deleted owner passes to the first member without admins", func(t *testing.T) {
+		group := newTestGroup()
+		group.OwnerId = "test-user-a"
+		group.Members = map[string]bool{"test-user-a": true, "test-user-d": true, "test-user-c": true}
+		assert.NoError(t, client.StoreGroup(ctx, group))
+
+		assert.NoError(t, client.RemoveDeletedUserFromGroup(ctx, group, "test-user-a"))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, "test-user-c", stored.OwnerId)
+		assert.Equal(t, map[string]bool{"test-user-c": true, "test-user-d": true}, stored.Members)
+	})
+
+	t.Run("deleted member", func(t *testing.T) {
+		group := newTestGroup()
+		group.OwnerId = "test-user-a"
+		group.Admins = map[string]bool{"test-user-b": true}
+		group.Members = map[string]bool{"test-user-a": true, "test-user-b": true}
+		assert.NoError(t, client.StoreGroup(ctx, group))
+
+		assert.NoError(t, client.RemoveDeletedUserFromGroup(ctx, group, "test-user-b"))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, "test-user-a", stored.OwnerId)
+		assert.Empty(t, stored.Admins)
+		assert.Equal(t, map[string]bool{"test-user-a": true}, stored.Members)
+	})
+
+	t.Run("delete conversation", func(t *testing.T) {
+		user, peer := newTestUser(), newTestUser()
+		msg := newTestMessage(peer.UserId, time.Now(), "hello")
+		msg.SenderId = user.UserId
+		assert.NoError(t, client.UpdateConversations(ctx, msg, ConversationPrivate))
+
+		assert.NoError(t, client.DeleteConversation(ctx, user.UserId, peer.UserId))
+		conversation, err := client.GetConversation(ctx, user.UserId, peer.UserId)
+		assert.NoError(t, err)
+		assert.Nil(t, conversation)
+		// the conversation of the peer is kept
+		conversation, _ = client.GetConversation(ctx, peer.UserId, user.UserId)
+		assert.NotNil(t, conversation)
+	})
+
+	t.Run("store, list and remove user deletions", func(t *testing.T) {
+		deletion := UserDeletion{
+			UserId:        newTestUser().UserId,
+			MessagePolicy: DeletedMessagesDelete,
+			RequestedAt:   time.Now().Format(time.RFC3339),
+			Groups:        []string{"test-group-a", "test-group-b"},
+		}
+		assert.NoError(t, client.StoreUserDeletion(ctx, deletion))
+		deletion.Groups = deletion.Groups[1:]
+		deletion.ConversationsListed = true
+		assert.NoError(t, client.StoreUserDeletion(ctx, deletion))
+
+		stored, err := client.GetUserDeletion(ctx, deletion.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, deletion, *stored)
+		deletions, err := client.GetUserDeletions(ctx)
+		assert.NoError(t, err)
+		assert.Contains(t, deletions, deletion)
+
+		assert.NoError(t, client.DeleteUserDeletion(ctx, deletion.UserId))
+		stored, err = client.GetUserDeletion(ctx, deletion.UserId)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+}
+
+func TestBoltUserDeletions(t *testing.T) {
+	testUserDeletions(t, newTestBoltDBClient(t))
+}
+
+func testAttachments(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	attachment := Attachment{
+		AttachmentId: fmt.Sprintf("test-attachment-%s", uuid.New().String()),
+		UploaderId:   "test-user-1",
+		FileName:     "photo.png",
+		ContentType:  "image/png",
+		Size:         5,
+		Checksum:     "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	assert.NoError(t, client.StoreAttachment(ctx, attachment))
+
+	t.Run("get attachment", func(t *testing.T) {
+		stored, err := client.GetAttachment(ctx, attachment.AttachmentId)
+		assert.NoError(t, err)
+		assert.Equal(t, &attachment, stored)
+
+		missing, err := client.GetAttachment(ctx, "test-attachment-missing")
+		assert.NoError(t, err)
+		assert.Nil(t, missing)
+	})
+
+	t.Run("send attachment once", func(t *testing.T) {
+		assert.NoError(t, client.SendAttachment(ctx, attachment.AttachmentId, "test-user-2", "test-message-1"))
+		stored, _ := client.GetAttachment(ctx, attachment.AttachmentId)
+		assert.Equal(t, "test-user-2", stored.RecipientId)
+		assert.Equal(t, "test-message-1", stored.MessageId)
+
+		err := client.SendAttachment(ctx, attachment.AttachmentId, "test-user-3", "test-message-2")
+		assert.ErrorIs(t, err, ErrAttachmentSent)
+		stored, _ = client.GetAttachment(ctx, attachment.AttachmentId)
+		assert.Equal(t, "test-user-2", stored.RecipientId)
+	})
+
+	t.Run("release attachment of a message that was not stored", func(t *testing.T) {
+		// only the message it was sent with releases it
+		assert.NoError(t, client.ReleaseAttachment(ctx, attachment.AttachmentId, "test-message-2"))
+		stored, _ := client.GetAttachment(ctx, attachment.AttachmentId)
+		assert.Equal(t, "test-message-1", stored.MessageId)
+
+		assert.NoError(t, client.ReleaseAttachment(ctx, attachment.AttachmentId, "test-message-1"))
+		stored, _ = client.GetAttachment(ctx, attachment.AttachmentId)
+		assert.Equal(t, &attachment, stored)
+		assert.NoError(t, client.SendAttachment(ctx, attachment.AttachmentId, "test-user-3", "test-message-2"))
+	})
+
+	t.Run("send missing attachment", func(t *testing.T) {
+		assert.Error(t, client.SendAttachment(ctx, "test-attachment-missing", "test-user-2", "test-message-1"))
+		missing, _ := client.GetAttachment(ctx, "test-attachment-missing")
+		assert.Nil(t, missing)
+	})
+}
+
+func TestBoltAttachments(t *testing.T) {
+	testAttachments(t, newTestBoltDBClient(t))
+}
+
+func testSearchIndex(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	sender, recipient := newTestUser(), newTestUser()
+	group := newTestGroup()
+	now := time.Now()
+
+	private := newTestMessage(recipient.UserId, now.Add(-time.Hour), "Lunch at noon? lunch!")
+	private.SenderId = sender.UserId
+	groupMessage := newTestMessage(group.GroupId, now, "lunch is ready")
+	groupMessage.SenderId = sender.UserId
+	assert.NoError(t, client.StoreMessage(ctx, private))
+	assert.NoError(t, client.StoreMessage(ctx, groupMessage))
+	// inbox copies are found through their group
+	assert.NoError(t, client.StoreInboxMessages(ctx, groupMessage, []string{recipient.UserId}))
+
+	postingIds := func(query SearchQuery) []string {
+		postings, err := client.GetSearchPostings(ctx, query)
+		assert.NoError(t, err)
+		ids := []string{}
+		for _, posting := range postings {
+			ids = append(ids, posting.Scope+"/"+posting.MessageId)
+		}
+		return ids
+	}
+
+	t.Run("postings of the scopes", func(t *testing.T) {
+		postings, err := client.GetSearchPostings(ctx, SearchQuery{Scopes: []string{recipient.UserId}, Terms: []string{"lunch"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []SearchPosting{{
+			Scope: recipient.UserId, Term: "lunch", MessageId: private.MessageId, RecipientId: recipient.UserId, SenderId: sender.UserId,
+			Positions: []int{0, 3}, Length: 4,
+		}}, postings)
+
+		// the sender finds both messages they sent
+		assert.ElementsMatch(t, []string{sender.UserId + "/" + private.MessageId, sender.UserId + "/" + groupMessage.MessageId},
+			postingIds(SearchQuery{Scopes: []string{sender.UserId}, Terms: []string{"lunch"}}))
+		assert.ElementsMatch(t, []string{group.GroupId + "/" + groupMessage.MessageId, recipient.UserId + "/" + private.MessageId},
+			postingIds(SearchQuery{Scopes: []string{recipient.UserId, group.GroupId}, Terms: []string{"lunch", "missing"}}))
+	})
+
+	t.Run("postings within bounds", func(t *testing.T) {
+		query := SearchQuery{Scopes: []string{sender.UserId}, Terms: []string{"lunch"}, After: MessageIdAfter(now.Add(-time.Minute).Unix())}
+		assert.Equal(t, []string{sender.UserId + "/" + groupMessage.MessageId}, postingIds(query))
+		query = SearchQuery{Scopes: []string{sender.UserId}, Terms: []string{"lunch"}, Before: groupMessage.MessageId}
+		assert.Equal(t, []string{sender.UserId + "/" + private.MessageId}, postingIds(query))
+	})
+
+	t.Run("newest postings up to the limit", func(t *testing.T) {
+		query := SearchQuery{Scopes: []string{sender.UserId}, Terms: []string{"lunch"}, Limit: 1}
+		assert.Equal(t, []string{sender.UserId + "/" + groupMessage.MessageId}, postingIds(query))
+		query.Before = groupMessage.MessageId
+		assert.Equal(t, []string{sender.UserId + "/" + private.MessageId}, postingIds(query))
+		// per term and scope
+		query = SearchQuery{Scopes: []string{sender.UserId, group.GroupId}, Terms: []string{"lunch", "ready"}, Limit: 1}
+		assert.ElementsMatch(t, []string{sender.UserId + "/" + groupMessage.MessageId, sender.UserId + "/" + groupMessage.MessageId,
+			group.GroupId + "/" + groupMessage.MessageId, group.GroupId + "/" + groupMessage.MessageId}, postingIds(query))
+	})
+
+	t.Run("edited and deleted messages", func(t *testing.T) {
+		edited := private
+		edited.Message = "dinner at noon"
+		assert.NoError(t, client.UpdateMessage(ctx, edited))
+		// the group message still has the removed term
+		assert.Equal(t, []string{sender.UserId + "/" + groupMessage.MessageId},
+			postingIds(SearchQuery{Scopes: []string{recipient.UserId, sender.UserId}, Terms: []string{"lunch"}}))
+		assert.ElementsMatch(t, []string{recipient.UserId + "/" + private.MessageId, sender.UserId + "/" + private.MessageId},
+			postingIds(SearchQuery{Scopes: []string{recipient.UserId, sender.UserId}, Terms: []string{"dinner"}}))
+
+		deleted := edited
+		deleted.Message = ""
+		deleted.Deleted = true
+		assert.NoError(t, client.UpdateMessage(ctx, deleted))
+		assert.Empty(t, postingIds(SearchQuery{Scopes: []string{recipient.UserId, sender.UserId}, Terms: []string{"dinner", "noon"}}))
+	})
+}
+
+func TestBoltSearchIndex(t *testing.T) {
+	testSearchIndex(t, newTestBoltDBClient(t))
+}
+
+func testThreads(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	group := newTestGroup()
+	now := time.Now()
+	thread := newTestMessage(group.GroupId, now.Add(-time.Hour), "Lunch?")
+	assert.NoError(t, client.StoreMessage(ctx, thread))
+	var replies []Message
+	for i, text := range []string{"Sure", "Noon", "Can't"} {
+		reply := newTestMessage(group.GroupId, now.Add(time.Duration(i-3)*time.Minute), text)
+		reply.ReplyTo, reply.ThreadId, reply.ThreadKey = thread.MessageId, thread.MessageId, thread.MessageId
+		reply.Quote = NewQuote(thread)
+		assert.NoError(t, client.StoreMessage(ctx, reply))
+		replies = append(replies, reply)
+	}
+	// inbox copies are not indexed by thread
+	assert.NoError(t, client.StoreInboxMessages(ctx, replies[0], []string{"test-user-2"}))
+
+	texts := func(page *HistoryPage) []string {
+		var texts []string
+		for _, msg := range page.Messages {
+			texts = append(texts, msg.Message)
+		}
+		return texts
+	}
+
+	t.Run("get thread messages", func(t *testing.T) {
+		page, err := client.GetThreadMessages(ctx, ThreadQuery{ThreadId: thread.MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Sure", "Noon"}, texts(page))
+		assert.Equal(t, NewQuote(thread), page.Messages[0].Quote)
+		assert.True(t, page.HasMore)
+
+		page, err = client.GetThreadMessages(ctx, ThreadQuery{ThreadId: thread.MessageId, After: replies[1].MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Can't"}, texts(page))
+		assert.False(t, page.HasMore)
+
+		page, err = client.GetThreadMessages(ctx, ThreadQuery{ThreadId: replies[0].MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Messages)
+	})
+
+	t.Run("update reply count", func(t *testing.T) {
+		changeId := NewMessageId(now)
+		updated, err := client.UpdateReplyCount(ctx, group.GroupId, thread.MessageId, 3, changeId)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, updated.ReplyCount)
+		assert.Equal(t, changeId, updated.ChangeId)
+		assert.Equal(t, "Lunch?", updated.Message)
+
+		updated, err = client.UpdateReplyCount(ctx, group.GroupId, thread.MessageId, -1, NewMessageId(now))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, updated.ReplyCount)
+
+		// the thread is polled as a change
+		page, err := client.GetMessages(ctx, User{UserId: "test-user-1", Groups: map[string]bool{group.GroupId: true}}, MessagesQuery{Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, thread.MessageId, page.Messages[len(page.Messages)-1].MessageId)
+
+		_, err = client.UpdateReplyCount(ctx, group.GroupId, "missing", 1, NewMessageId(now))
+		assert.Error(t, err)
+	})
+
+	t.Run("update message keeps the reply count", func(t *testing.T) {
+		// read before the replies were counted
+		thread.Message = "Lunch at noon?"
+		thread.ChangeId = NewMessageId(time.Now())
+		assert.NoError(t, client.UpdateMessage(ctx, thread))
+		stored, err := client.GetMessage(ctx, group.GroupId, thread.MessageId)
+		assert.NoError(t, err)
+		assert.Equal(t, "Lunch at noon?", stored.Message)
+		assert.Equal(t, 2, stored.ReplyCount)
+	})
+}
+
+func TestBoltThreads(t *testing.T) {
+	testThreads(t, newTestBoltDBClient(t))
+}
+
+func testReactions(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	group := newTestGroup()
+	now := time.Now()
+	msg := newTestMessage(group.GroupId, now.Add(-time.Hour), "Lunch?")
+	msg.Quote = &Quote{SenderId: "test-user-2", Message: "Hungry?"}
+	assert.NoError(t, client.StoreMessage(ctx, msg))
+	reaction := func(userId string, emoji string) Reaction {
+		return Reaction{RecipientId: group.GroupId, MessageId: msg.MessageId, UserId: userId, Emoji: emoji, CreatedAt: now.Format(time.RFC3339)}
+	}
+
+	t.Run("add reactions", func(t *testing.T) {
+		changeId := NewMessageId(now)
+		updated, err := client.AddReaction(ctx, reaction("test-user-1", "👍"), changeId)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 1}, updated.Reactions)
+		assert.Equal(t, changeId, updated.ChangeId)
+		assert.Equal(t, "Lunch?", updated.Message)
+
+		_, err = client.AddReaction(ctx, reaction("test-user-2", "👍"), NewMessageId(now))
+		assert.NoError(t, err)
+		updated, err = client.AddReaction(ctx, reaction("test-user-1", "🎉"), NewMessageId(now))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 2, "🎉": 1}, updated.Reactions)
+
+		_, err = client.AddReaction(ctx, reaction("test-user-1", "👍"), NewMessageId(now))
+		assert.ErrorIs(t, err, ErrReactionExists)
+
+		// the message is polled as a change
+		member := newTestUser()
+		member.Groups[group.GroupId] = true
+		page, err := client.GetMessages(ctx, member, MessagesQuery{Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, page.Messages, 1)
+		assert.Equal(t, updated.ChangeId, page.Messages[len(page.Messages)-1].ChangeId)
+		assert.Equal(t, updated.Reactions, page.Messages[len(page.Messages)-1].Reactions)
+	})
+
+	t.Run("remove reactions", func(t *testing.T) {
+		updated, err := client.RemoveReaction(ctx, reaction("test-user-1", "🎉"), NewMessageId(now))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 2}, updated.Reactions)
+
+		_, err = client.RemoveReaction(ctx, reaction("test-user-1", "🎉"), NewMessageId(now))
+		assert.ErrorIs(t, err, ErrReactionNotFound)
+		_, err = client.RemoveReaction(ctx, reaction("test-user-3", "👍"), NewMessageId(now))
+		assert.ErrorIs(t, err, ErrReactionNotFound)
+	})
+
+	t.Run("update message keeps the reactions", func(t *testing.T) {
+		// read before the reactions were added
+		msg.Message = ""
+		msg.Quote = nil
+		msg.Deleted = true
+		msg.ChangeId = NewMessageId(time.Now())
+		assert.NoError(t, client.UpdateMessage(ctx, msg))
+		stored, err := client.GetMessage(ctx, group.GroupId, msg.MessageId)
+		assert.NoError(t, err)
+		assert.True(t, stored.Deleted)
+		assert.Nil(t, stored.Quote)
+		assert.Equal(t, map[string]int{"👍": 2}, stored.Reactions)
+	})
+
+	t.Run("sender inbox copies", func(t *testing.T) {
+		sender, recipient := newTestUser(), newTestUser()
+		private := newTestMessage(recipient.UserId, now, "Dinner?")
+		private.SenderId = sender.UserId
+		private.ConversationKey = PrivateConversationKey(sender.UserId, recipient.UserId)
+		assert.NoError(t, client.StoreMessage(ctx, private))
+		updated, err := client.AddReaction(ctx, Reaction{RecipientId: recipient.UserId, MessageId: private.MessageId, UserId: recipient.UserId, Emoji: "👍"}, NewMessageId(time.Now()))
+		assert.NoError(t, err)
+		assert.NoError(t, client.StoreSenderInboxMessage(ctx, *updated))
+
+		// the sender polls the copy as the message they sent
+		page, err := client.GetMessages(ctx, sender, MessagesQuery{Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, page.Messages, 1)
+		assert.Equal(t, recipient.UserId, page.Messages[0].RecipientId)
+		assert.Equal(t, map[string]int{"👍": 1}, page.Messages[0].Reactions)
+
+		// the copy is not in the conversation history
+		history, err := client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: private.ConversationKey, Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, history.Messages, 1)
+	})
+}
+
+func TestBoltReactions(t *testing.T) {
+	testReactions(t, newTestBoltDBClient(t))
+}
+
+func testScheduledMessages(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	senderId := newTestUser().UserId
+	now := time.Now().UTC()
+	newScheduled := func(sendAt time.Time) ScheduledMessage {
+		return ScheduledMessage{
+			SenderId:    senderId,
+			ScheduleId:  NewMessageId(time.Now()),
+			Type:        ConversationPrivate,
+			RecipientId: "test-user-2",
+			Message:     "later",
+			SendAt:      sendAt.Format(time.RFC3339),
+			CreatedAt:   now.Format(time.RFC3339),
+			Status:      ScheduledPending,
+		}
+	}
+	// dueOfSender returns the due messages of the test sender, other tests may share the table
+	dueOfSender := func(at time.Time) []ScheduledMessage {
+		due, err := client.GetDueScheduledMessages(ctx, at.Format(time.RFC3339), 100)
+		assert.NoError(t, err)
+		var own []ScheduledMessage
+		for _, scheduled := range due {
+			if scheduled.SenderId == senderId {
+				own = append(own, scheduled)
+			}
+		}
+		return own
+	}
+	first := newScheduled(now.Add(time.Hour))
+	second := newScheduled(now.Add(time.Minute))
+	for _, scheduled := range []ScheduledMessage{first, second} {
+		assert.NoError(t, client.StoreScheduledMessage(ctx, scheduled))
+	}
+
+	t.Run("get scheduled messages", func(t *testing.T) {
+		stored, err := client.GetScheduledMessage(ctx, senderId, first.ScheduleId)
+		assert.NoError(t, err)
+		assert.Equal(t, &first, stored)
+
+		scheduled, err := client.GetScheduledMessages(ctx, senderId)
+		assert.NoError(t, err)
+		assert.Equal(t, []ScheduledMessage{first, second}, scheduled)
+
+		missing, err := client.GetScheduledMessage(ctx, senderId, "missing")
+		assert.NoError(t, err)
+		assert.Nil(t, missing)
+	})
+
+	t.Run("get due messages earliest first", func(t *testing.T) {
+		assert.Empty(t, dueOfSender(now))
+		assert.Equal(t, []ScheduledMessage{second}, dueOfSender(now.Add(time.Minute)))
+		assert.Equal(t, []ScheduledMessage{second, first}, dueOfSender(now.Add(2*time.Hour)))
+	})
+
+	t.Run("claim once until the claim expires", func(t *testing.T) {
+		at := now.Add(time.Minute)
+		claimedUntil := at.Add(time.Minute).Format(time.RFC3339)
+		claimed, err := client.ClaimScheduledMessage(ctx, second, at.Format(time.RFC3339), claimedUntil, "test-message-1")
+		assert.NoError(t, err)
+		assert.Equal(t, claimedUntil, claimed.ClaimedUntil)
+		assert.Equal(t, "test-message-1", claimed.MessageId)
+
+		_, err = client.ClaimScheduledMessage(ctx, second, at.Format(time.RFC3339), claimedUntil, "test-message-2")
+		assert.ErrorIs(t, err, ErrScheduleUnavailable)
+		assert.ErrorIs(t, client.CancelScheduledMessage(ctx, second, at.Format(time.RFC3339)), ErrScheduleUnavailable)
+
+		// the message ID of the first claim is kept
+		later := at.Add(2 * time.Minute)
+		reclaimed, err := client.ClaimScheduledMessage(ctx, second, later.Format(time.RFC3339), later.Add(time.Minute).Format(time.RFC3339), "test-message-2")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-message-1", reclaimed.MessageId)
+
+		// the expired claim can no longer release the message
+		assert.NoError(t, client.ReleaseScheduledMessage(ctx, *claimed))
+		stored, _ := client.GetScheduledMessage(ctx, senderId, second.ScheduleId)
+		assert.Equal(t, reclaimed.ClaimedUntil, stored.ClaimedUntil)
+
+		assert.NoError(t, client.ReleaseScheduledMessage(ctx, *reclaimed))
+		stored, _ = client.GetScheduledMessage(ctx, senderId, second.ScheduleId)
+		assert.Empty(t, stored.ClaimedUntil)
+		assert.Equal(t, ScheduledPending, stored.Status)
+	})
+
+	t.Run("failed messages are no longer due", func(t *testing.T) {
+		at := now.Add(time.Minute)
+		claimed, err := client.ClaimScheduledMessage(ctx, second, at.Format(time.RFC3339), at.Add(time.Minute).Format(time.RFC3339), "test-message-3")
+		assert.NoError(t, err)
+		assert.NoError(t, client.FailScheduledMessage(ctx, *claimed, "Recipient has blocked the sender"))
+
+		stored, _ := client.GetScheduledMessage(ctx, senderId, second.ScheduleId)
+		assert.Equal(t, ScheduledFailed, stored.Status)
+		assert.Equal(t, "Recipient has blocked the sender", stored.Error)
+		assert.Empty(t, stored.ClaimedUntil)
+		assert.Equal(t, []ScheduledMessage{first}, dueOfSender(now.Add(2*time.Hour)))
+		_, err = client.ClaimScheduledMessage(ctx, second, at.Format(time.RFC3339), at.Add(time.Minute).Format(time.RFC3339), "test-message-3")
+		assert.ErrorIs(t, err, ErrScheduleUnavailable)
+	})
+
+	t.Run("cancel and delete", func(t *testing.T) {
+		assert.NoError(t, client.CancelScheduledMessage(ctx, second, now.Format(time.RFC3339)))
+		assert.ErrorIs(t, client.CancelScheduledMessage(ctx, second, now.Format(time.RFC3339)), ErrScheduleUnavailable)
+		assert.NoError(t, client.DeleteScheduledMessage(ctx, senderId, first.ScheduleId))
+
+		scheduled, err := client.GetScheduledMessages(ctx, senderId)
+		assert.NoError(t, err)
+		assert.Empty(t, scheduled)
+		assert.Empty(t, dueOfSender(now.Add(2*time.Hour)))
+	})
+}
+
+func TestBoltScheduledMessages(t *testing.T) {
+	testScheduledMessages(t, newTestBoltDBClient(t))
+}
+
+func TestBoltInvites(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	group := newTestGroup()
+	client.StoreGroup(ctx, group)
+	invite := GroupInvite{Token: uuid.New().String(), GroupId: group.GroupId, MaxUses: 1}
+	expired := GroupInvite{Token: uuid.New().String(), GroupId: group.GroupId, ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	assert.NoError(t, client.StoreInvite(ctx, invite))
+	assert.NoError(t, client.StoreInvite(ctx, expired))
+	assert.NoError(t, client.StoreInvite(ctx, GroupInvite{Token: uuid.New().String(), GroupId: "test-group-other"}))
+
+	t.Run("get group invites", func(t *testing.T) {
+		invites, err := client.GetGroupInvites(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []GroupInvite{invite, expired}, invites)
+	})
+
+	t.Run("join counts uses", func(t *testing.T) {
+		user := newTestUser()
+		client.StoreUser(ctx, user)
+		assert.NoError(t, client.JoinGroupWithInvite(ctx, invite, group, user))
+
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.True(t, storedGroup.Members[user.UserId])
+		stored, _ := client.GetInvite(ctx, invite.Token)
+		assert.Equal(t, 1, stored.Uses)
+
+		// the invite is used up
+		other := newTestUser()
+		client.StoreUser(ctx, other)
+		assert.ErrorIs(t, client.JoinGroupWithInvite(ctx, invite, group, other), ErrInviteUnavailable)
+		storedGroup, _ = client.GetGroup(ctx, group.GroupId)
+		assert.False(t, storedGroup.Members[other.UserId])
+	})
+
+	t.Run("banned user does not use the invite", func(t *testing.T) {
+		unlimited := GroupInvite{Token: uuid.New().String(), GroupId: group.GroupId}
+		assert.NoError(t, client.StoreInvite(ctx, unlimited))
+		user := newTestUser()
+		client.StoreUser(ctx, user)
+		// the group was read before the ban
+		read, _ := client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, client.BanUserFromGroup(ctx, *read, user))
+
+		assert.ErrorIs(t, client.JoinGroupWithInvite(ctx, unlimited, *read, user), ErrUserBanned)
+		stored, _ := client.GetInvite(ctx, unlimited.Token)
+		assert.Zero(t, stored.Uses)
+		storedGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.False(t, storedGroup.Members[user.UserId])
+	})
+
+	t.Run("join with expired or revoked invite", func(t *testing.T) {
+		user := newTestUser()
+		client.StoreUser(ctx, user)
+		assert.ErrorIs(t, client.JoinGroupWithInvite(ctx, expired, group, user), ErrInviteUnavailable)
+
+		assert.NoError(t, client.DeleteInvite(ctx, expired.Token))
+		stored, err := client.GetInvite(ctx, expired.Token)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+		assert.ErrorIs(t, client.JoinGroupWithInvite(ctx, expired, group, user), ErrInviteUnavailable)
+	})
+}
+
+func TestBoltMessages(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	user := newTestUser()
+	group := newTestGroup()
+	client.StoreUser(ctx, user)
+	client.StoreGroup(ctx, group)
+	client.AddUserToGroup(ctx, group, user)
+	user.Groups[group.GroupId] = true
+
+	hourAgo := time.Now().Add(-time.Hour)
+	old := newTestMessage(user.UserId, hourAgo, "old")
+	first := newTestMessage(group.GroupId, time.Now(), "first")
+	second := newTestMessage(user.UserId, time.Now(), "second")
+	for _, msg := range []Message{second, old, first} {
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+	}
+
+	t.Run("all messages in change id order", func(t *testing.T) {
+		page, err := client.GetMessages(ctx, user, MessagesQuery{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{old, first, second}, page.Messages)
+		assert.Nil(t, page.Cursor)
+	})
+
+	t.Run("messages after timestamp", func(t *testing.T) {
+		page, err := client.GetMessages(ctx, user, MessagesQuery{Timestamp: hourAgo.Unix()})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{first, second}, page.Messages)
+	})
+
+	t.Run("messages from groups the user is not part of", func(t *testing.T) {
+		other := newTestUser()
+		page, err := client.GetMessages(ctx, other, MessagesQuery{})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Messages)
+	})
+
+	t.Run("pages across recipients", func(t *testing.T) {
+		page, err := client.GetMessages(ctx, user, MessagesQuery{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{old, first}, page.Messages)
+		assert.Equal(t, map[string]string{user.UserId: old.ChangeId, group.GroupId: first.ChangeId}, page.Cursor)
+
+		page, err = client.GetMessages(ctx, user, MessagesQuery{Limit: 2, Cursor: page.Cursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{second}, page.Messages)
+		assert.Nil(t, page.Cursor)
+	})
+}
+
+func TestBoltUpdateMessage(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	user := newTestUser()
+	hourAgo := time.Now().Add(-time.Hour)
+	edited := newTestMessage(user.UserId, hourAgo, "hello")
+	other := newTestMessage(user.UserId, hourAgo, "other")
+	client.StoreMessage(ctx, edited)
+	client.StoreMessage(ctx, other)
+
+	t.Run("get message", func(t *testing.T) {
+		stored, err := client.GetMessage(ctx, user.UserId, edited.MessageId)
+		assert.NoError(t, err)
+		assert.Equal(t, edited, *stored)
+
+		stored, err = client.GetMessage(ctx, "test-user-missing", edited.MessageId)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("edited message is returned as a change", func(t *testing.T) {
+		edited.Message = "edited"
+		edited.ChangeId = NewMessageId(time.Now())
+		assert.NoError(t, client.UpdateMessage(ctx, edited))
+
+		page, err := client.GetMessages(ctx, user, MessagesQuery{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{other, edited}, page.Messages)
+
+		page, err = client.GetMessages(ctx, user, MessagesQuery{Timestamp: hourAgo.Unix()})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{edited}, page.Messages)
+	})
+
+	t.Run("update missing message", func(t *testing.T) {
+		missing := newTestMessage(user.UserId, time.Now(), "missing")
+		assert.Error(t, client.UpdateMessage(ctx, missing))
+	})
+}
+
+func TestBoltConversations(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	user := newTestUser()
+	peer := newTestUser()
+	group := newTestGroup()
+	hourAgo := time.Now().Add(-time.Hour)
+
+	fromPeer := newTestMessage(user.UserId, hourAgo, "hello")
+	fromPeer.SenderId = peer.UserId
+	fromOther := newTestMessage(user.UserId, hourAgo, "other")
+	toGroup := newTestMessage(group.GroupId, hourAgo, "group")
+	fromUser := newTestMessage(group.GroupId, hourAgo, "own")
+	fromUser.SenderId = user.UserId
+	for _, msg := range []Message{fromPeer, fromOther, toGroup, fromUser} {
+		client.StoreMessage(ctx, msg)
+	}
+
+	t.Run("private conversations of both users", func(t *testing.T) {
+		assert.NoError(t, client.UpdateConversations(ctx, fromPeer, ConversationPrivate))
+
+		conversation, err := client.GetConversation(ctx, user.UserId, peer.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, Conversation{UserId: user.UserId, ConversationId: peer.UserId, Type: ConversationPrivate, LastMessage: &fromPeer}, *conversation)
+
+		conversations, err := client.GetConversations(ctx, peer.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []Conversation{{UserId: peer.UserId, ConversationId: user.UserId, Type: ConversationPrivate, LastMessage: &fromPeer}}, conversations)
+
+		conversation, err = client.GetConversation(ctx, user.UserId, "test-user-missing")
+		assert.NoError(t, err)
+		assert.Nil(t, conversation)
+	})
+
+	t.Run("count unread messages", func(t *testing.T) {
+		// a private conversation keeps its count
+		private := Conversation{UserId: user.UserId, ConversationId: peer.UserId, Type: ConversationPrivate, UnreadCount: 3}
+		count, err := client.CountUnreadMessages(ctx, private)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+
+		groupConversation := Conversation{UserId: user.UserId, ConversationId: group.GroupId, Type: ConversationGroup}
+		count, err = client.CountUnreadMessages(ctx, groupConversation)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		groupConversation.LastReadMessageId = toGroup.MessageId
+		count, err = client.CountUnreadMessages(ctx, groupConversation)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("read marker only moves forward", func(t *testing.T) {
+		read := Conversation{UserId: user.UserId, ConversationId: peer.UserId, Type: ConversationPrivate, LastReadMessageId: fromPeer.MessageId, ReadAt: "now", LastMessage: &fromPeer}
+		assert.NoError(t, client.SetReadMarker(ctx, read))
+		older := Conversation{UserId: user.UserId, ConversationId: peer.UserId, Type: ConversationPrivate, LastReadMessageId: MessageIdAfter(0), ReadAt: "later"}
+		assert.NoError(t, client.SetReadMarker(ctx, older))
+
+		conversation, err := client.GetConversation(ctx, user.UserId, peer.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, read, *conversation)
+
+		count, err := client.CountUnreadMessages(ctx, *conversation)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("latest group message is stored once", func(t *testing.T) {
+		assert.NoError(t, client.UpdateConversations(ctx, fromUser, ConversationGroup))
+		// an older message does not replace the latest one
+		assert.NoError(t, client.UpdateConversations(ctx, toGroup, ConversationGroup))
+
+		conversation, err := client.GetConversation(ctx, group.GroupId, group.GroupId)
+		assert.NoError(t, err)
+		assert.Equal(t, ConversationGroup, conversation.Type)
+		assert.Equal(t, fromUser, *conversation.LastMessage)
+
+		conversation, err = client.GetConversation(ctx, user.UserId, group.GroupId)
+		assert.NoError(t, err)
+		assert.Nil(t, conversation)
+	})
+}
+
+// testUnreadCounts keeps the unread count of a private conversation among the messages of other conversations.
+func testUnreadCounts(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	user, peer, other := newTestUser(), newTestUser(), newTestUser()
+	group := newTestGroup()
+	hourAgo := time.Now().Add(-time.Hour)
+
+	private := func(senderId string, recipientId string, sentAt time.Time) Message {
+		msg := newTestMessage(recipientId, sentAt, "hello")
+		msg.SenderId = senderId
+		msg.ConversationKey = PrivateConversationKey(senderId, recipientId)
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+		return msg
+	}
+	unread := func(userId string, peerId string) int {
+		conversation, err := client.GetConversation(ctx, userId, peerId)
+		assert.NoError(t, err)
+		if conversation == nil {
+			return 0
+		}
+		count, err := client.CountUnreadMessages(ctx, *conversation)
+		assert.NoError(t, err)
+		return count
+	}
+	first := private(peer.UserId, user.UserId, hourAgo)
+	private(user.UserId, peer.UserId, hourAgo.Add(time.Minute))
+	private(peer.UserId, user.UserId, hourAgo.Add(2*time.Minute))
+	private(other.UserId, user.UserId, hourAgo.Add(3*time.Minute))
+	deleted := private(peer.UserId, user.UserId, hourAgo.Add(4*time.Minute))
+	deleted.Deleted = true
+	deleted.ChangeId = NewMessageId(hourAgo.Add(5 * time.Minute))
+	assert.NoError(t, client.UpdateMessage(ctx, deleted))
+	// a group message of the peer copied to the user inbox is counted in its group
+	groupMessage := newTestMessage(group.GroupId, hourAgo.Add(6*time.Minute), "group")
+	groupMessage.SenderId = peer.UserId
+	assert.NoError(t, client.StoreMessage(ctx, groupMessage))
+	assert.NoError(t, client.StoreInboxMessages(ctx, groupMessage, []string{user.UserId}))
+
+	assert.Equal(t, 2, unread(user.UserId, peer.UserId))
+	// the peer sees no unread messages of their own
+	assert.Equal(t, 1, unread(peer.UserId, user.UserId))
+
+	// the messages after the new marker are counted again
+	read := Conversation{UserId: user.UserId, ConversationId: peer.UserId, Type: ConversationPrivate, LastReadMessageId: first.MessageId, ReadAt: "now"}
+	assert.NoError(t, client.SetReadMarker(ctx, read))
+	assert.Equal(t, 1, unread(user.UserId, peer.UserId))
+
+	// a message up to the marker is read already, deleting it does not change the count
+	first.Deleted = true
+	first.ChangeId = NewMessageId(hourAgo.Add(7 * time.Minute))
+	assert.NoError(t, client.UpdateMessage(ctx, first))
+	assert.Equal(t, 1, unread(user.UserId, peer.UserId))
+
+	read.LastReadMessageId = MessageIdAfter(time.Now().Unix())
+	assert.NoError(t, client.SetReadMarker(ctx, read))
+	assert.Equal(t, 0, unread(user.UserId, peer.UserId))
+	private(peer.UserId, user.UserId, time.Now().Add(time.Minute))
+	assert.Equal(t, 1, unread(user.UserId, peer.UserId))
+}
+
+// testGroupUnreadCount counts the unread messages of a group up to MaxUnreadCount.
+func testGroupUnreadCount(t *testing.T, client DynamoDBClientInterface) {
+	ctx := context.Background()
+	user := newTestUser()
+	group := newTestGroup()
+	hourAgo := time.Now().Add(-time.Hour)
+	var messages []Message
+	for i := 0; i <= MaxUnreadCount; i++ {
+		msg := newTestMessage(group.GroupId, hourAgo.Add(time.Duration(i)*time.Second), "group")
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+		messages = append(messages, msg)
+	}
+
+	conversation := Conversation{UserId: user.UserId, ConversationId: group.GroupId, Type: ConversationGroup}
+	count, err := client.CountUnreadMessages(ctx, conversation)
+	assert.NoError(t, err)
+	assert.Equal(t, MaxUnreadCount, count)
+
+	conversation.LastReadMessageId = messages[MaxUnreadCount-2].MessageId
+	count, err = client.CountUnreadMessages(ctx, conversation)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestBoltUnreadCounts(t *testing.T) {
+	testUnreadCounts(t, newTestBoltDBClient(t))
+}
+
+func TestBoltGroupUnreadCount(t *testing.T) {
+	testGroupUnreadCount(t, newTestBoltDBClient(t))
+}
+
+func TestBoltConversationMessages(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	user := newTestUser()
+	peer := newTestUser()
+	group := newTestGroup()
+	key := PrivateConversationKey(user.UserId, peer.UserId)
+	now := time.Now()
+
+	var private []Message
+	for i, recipientId := range []string{peer.UserId, user.UserId, peer.UserId, user.UserId} {
+		msg := newTestMessage(recipientId, now, fmt.Sprintf("message %d", i))
+		msg.ConversationKey = key
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+		// the key only indexes the message
+		msg.ConversationKey = ""
+		private = append(private, msg)
+	}
+	other := newTestMessage(user.UserId, now, "other")
+	other.ConversationKey = PrivateConversationKey(user.UserId, "test-user-other")
+	toGroup := newTestMessage(group.GroupId, now, "group")
+	client.StoreMessage(ctx, other)
+	client.StoreMessage(ctx, toGroup)
+
+	t.Run("latest private messages of both directions", func(t *testing.T) {
+		page, err := client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: key, Limit: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, private[1:], page.Messages)
+		assert.True(t, page.HasMore)
+	})
+
+	t.Run("page back and forward", func(t *testing.T) {
+		page, err := client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: key, Before: private[2].MessageId, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, private[:2], page.Messages)
+		assert.False(t, page.HasMore)
+
+		page, err = client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: key, After: private[0].MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, private[1:3], page.Messages)
+		assert.True(t, page.HasMore)
+
+		page, err = client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: key, After: private[0].MessageId, Before: private[3].MessageId, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, private[1:3], page.Messages)
+		assert.False(t, page.HasMore)
+	})
+
+	t.Run("edited message keeps its place", func(t *testing.T) {
+		edited := private[1]
+		edited.Message = "edited"
+		edited.ChangeId = NewMessageId(time.Now())
+		assert.NoError(t, client.UpdateMessage(ctx, edited))
+
+		page, err := client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationPrivate, ConversationId: key, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{private[0], edited, private[2], private[3]}, page.Messages)
+	})
+
+	t.Run("group messages", func(t *testing.T) {
+		page, err := client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationGroup, ConversationId: group.GroupId, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{toGroup}, page.Messages)
+
+		page, err = client.GetConversationMessages(ctx, HistoryQuery{Type: ConversationGroup, ConversationId: "test-group-missing", Limit: 10})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Messages)
+	})
+}
+
+func TestBoltPersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	client, err := NewBoltDBClient(path)
+	assert.NoError(t, err)
+	user := newTestUser()
+	assert.NoError(t, client.StoreUser(ctx, user))
+	assert.NoError(t, client.(*boltDBClient).Close())
+
+	client, err = NewBoltDBClient(path)
+	assert.NoError(t, err)
+	defer client.(*boltDBClient).Close()
+	stored, err := client.GetUser(ctx, user.UserId)
+	assert.NoError(t, err)
+	assert.Equal(t, user.UserId, stored.UserId)
+}
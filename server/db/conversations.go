@@ -0,0 +1,390 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"strconv"
+)
+
+func conversationKey(userId string, conversationId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		UserPrimaryKey:        &types.AttributeValueMemberS{Value: userId},
+		ConversationIdSortKey: &types.AttributeValueMemberS{Value: conversationId},
+	}
+}
+
+// unreadRecipientId returns the recipient of the conversation messages.
+func unreadRecipientId(conversation Conversation) string {
+	if conversation.Type == ConversationGroup {
+		return conversation.ConversationId
+	}
+	// private messages from the peer are in the user inbox
+	return conversation.UserId
+}
+
+// isUnread returns true if the message of the conversation recipient is counted as unread, see CountUnreadMessages.
+func isUnread(conversation Conversation, message Message) bool {
+	if message.MessageId <= conversation.LastReadMessageId || message.SenderId == conversation.UserId || message.Deleted {
+		return false
+	}
+	if conversation.Type == ConversationGroup {
+		return true
+	}
+	// group messages copied to the user inbox are counted in their group
+	return message.SenderId == conversation.ConversationId && message.InboxGroupId == ""
+}
+
+// MaxUnreadCount is the highest unread count of a group conversation. Groups are counted on read up to this count,
+// so that a member who has not read a busy group for a long time does not read its whole history on every request.
+const MaxUnreadCount = 100
+
+// unreadDelta returns how storing the message over its previous version changes the unread count of its recipient in
+// the private conversation with its sender: a new private message is unread, a deleted one is not anymore.
+// Group messages and their inbox copies are counted in their group instead.
+func unreadDelta(previous *Message, message Message) int {
+	counted := func(m Message) bool {
+		return m.ConversationKey != "" && !m.IsInboxCopy() && !m.Deleted && m.SenderId != m.RecipientId
+	}
+	switch {
+	case previous == nil && counted(message):
+		return 1
+	case previous != nil && counted(*previous) && message.Deleted:
+		return -1
+	}
+	return 0
+}
+
+// addUnread adds the unread delta of the message to the private conversation, unless the message was already read.
+func addUnread(conversation *Conversation, messageId string, delta int) {
+	if messageId <= conversation.LastReadMessageId {
+		return
+	}
+	conversation.Type = ConversationPrivate
+	conversation.UnreadCount += delta
+	if conversation.UnreadCount < 0 {
+		conversation.UnreadCount = 0
+	}
+}
+
+// conversationUserIds returns the user IDs of the conversations the message is recorded in, by conversation ID.
+// A group conversation is stored once under the group ID instead of once per member, so that sending a group message
+// is a single write regardless of the group size. The members read markers are stored in their own conversations.
+func conversationUserIds(message Message, conversationType string) map[string]string {
+	if conversationType == ConversationGroup {
+		return map[string]string{message.RecipientId: message.RecipientId}
+	}
+	return map[string]string{
+		message.RecipientId: message.SenderId,
+		message.SenderId:    message.RecipientId,
+	}
+}
+
+// setLastMessage records the message as the latest message of the conversation, unless it already has a newer one.
+func setLastMessage(conversation *Conversation, message Message, conversationType string) {
+	conversation.Type = conversationType
+	if conversation.LastMessage != nil && conversation.LastMessage.MessageId > message.MessageId {
+		return
+	}
+	preview := message.Preview()
+	conversation.LastMessage = &preview
+	conversation.LastActivity = message.Timestamp
+}
+
+func (d *dynamoDBClient) UpdateConversations(ctx context.Context, message Message, conversationType string) error {
+	preview, err := attributevalue.Marshal(message.Preview())
+	if err != nil {
+		return err
+	}
+	for userId, conversationId := range conversationUserIds(message, conversationType) {
+		_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(ConversationsTableName),
+			Key:              conversationKey(userId, conversationId),
+			UpdateExpression: aws.String("SET #type = :type, #lastMessage = :lastMessage, #lastActivity = :lastActivity"),
+			// creates the conversation if it does not exist yet, keeping the read marker of an existing one
+			ConditionExpression: aws.String("attribute_not_exists(#lastMessage) OR #lastMessage.#messageId <= :messageId"),
+			ExpressionAttributeNames: map[string]string{
+				"#type":         "Type",
+				"#lastMessage":  "LastMessage",
+				"#lastActivity": "LastActivity",
+				"#messageId":    MessageIdSortKey,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":type":         &types.AttributeValueMemberS{Value: conversationType},
+				":lastMessage":  preview,
+				":lastActivity": &types.AttributeValueMemberS{Value: message.Timestamp},
+				":messageId":    &types.AttributeValueMemberS{Value: message.MessageId},
+			},
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			// the conversation already has a newer message
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dynamoDBClient) GetConversation(ctx context.Context, userId string, conversationId string) (*Conversation, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ConversationsTableName),
+		Key:       conversationKey(userId, conversationId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, the user has no state for this conversation
+	if result.Item == nil {
+		return nil, nil
+	}
+	var conversation Conversation
+	err = attributevalue.UnmarshalMap(result.Item, &conversation)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (d *dynamoDBClient) GetConversations(ctx context.Context, userId string) ([]Conversation, error) {
+	var conversations []Conversation
+	var startKey map[string]types.AttributeValue
+	for {
+		results, err := d.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(ConversationsTableName),
+			KeyConditionExpression: aws.String("#userId = :userId"),
+			ExpressionAttributeNames: map[string]string{
+				"#userId": UserPrimaryKey,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":userId": &types.AttributeValueMemberS{Value: userId},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Items {
+			var conversation Conversation
+			err = attributevalue.UnmarshalMap(item, &conversation)
+			if err != nil {
+				return nil, err
+			}
+			conversations = append(conversations, conversation)
+		}
+		startKey = results.LastEvaluatedKey
+		if len(startKey) == 0 {
+			return conversations, nil
+		}
+	}
+}
+
+func (d *dynamoDBClient) DeleteConversation(ctx context.Context, userId string, conversationId string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ConversationsTableName),
+		Key:       conversationKey(userId, conversationId),
+	})
+	return err
+}
+
+func (d *dynamoDBClient) SetReadMarker(ctx context.Context, conversation Conversation) error {
+	if conversation.Type != ConversationGroup {
+		return d.setPrivateReadMarker(ctx, conversation)
+	}
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ConversationsTableName),
+		Key:                 conversationKey(conversation.UserId, conversation.ConversationId),
+		UpdateExpression:    aws.String("SET #type = :type, #lastRead = :lastRead, #readAt = :readAt"),
+		ConditionExpression: aws.String("attribute_not_exists(#lastRead) OR #lastRead < :lastRead"),
+		ExpressionAttributeNames: map[string]string{
+			"#type":     "Type",
+			"#lastRead": "LastReadMessageId",
+			"#readAt":   "ReadAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type":     &types.AttributeValueMemberS{Value: conversation.Type},
+			":lastRead": &types.AttributeValueMemberS{Value: conversation.LastReadMessageId},
+			":readAt":   &types.AttributeValueMemberS{Value: conversation.ReadAt},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// the conversation was already read further
+		return nil
+	}
+	return err
+}
+
+// setPrivateReadMarker moves the read marker of a private conversation and stores the count of its messages after the
+// new marker, conditional on the marker and the count not having changed since they were read, so that a message
+// counted by StoreMessage in between is not lost. The count also corrects a missed update of the counter.
+func (d *dynamoDBClient) setPrivateReadMarker(ctx context.Context, conversation Conversation) error {
+	for attempt := 0; ; attempt++ {
+		result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(ConversationsTableName),
+			Key:            conversationKey(conversation.UserId, conversation.ConversationId),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		var stored Conversation
+		if err = attributevalue.UnmarshalMap(result.Item, &stored); err != nil {
+			return err
+		}
+		if conversation.LastReadMessageId <= stored.LastReadMessageId {
+			// the conversation was already read further
+			return nil
+		}
+		count, err := d.countUnread(ctx, conversation, 0)
+		if err != nil {
+			return err
+		}
+
+		values := map[string]types.AttributeValue{
+			":type":       &types.AttributeValueMemberS{Value: conversation.Type},
+			":lastRead":   &types.AttributeValueMemberS{Value: conversation.LastReadMessageId},
+			":readAt":     &types.AttributeValueMemberS{Value: conversation.ReadAt},
+			":unread":     &types.AttributeValueMemberN{Value: strconv.Itoa(count)},
+			":readUnread": &types.AttributeValueMemberN{Value: strconv.Itoa(stored.UnreadCount)},
+		}
+		condition := "attribute_not_exists(#lastRead)"
+		if stored.LastReadMessageId != "" {
+			condition = "#lastRead = :readLastRead"
+			values[":readLastRead"] = &types.AttributeValueMemberS{Value: stored.LastReadMessageId}
+		}
+		_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(ConversationsTableName),
+			Key:                 conversationKey(conversation.UserId, conversation.ConversationId),
+			UpdateExpression:    aws.String("SET #type = :type, #lastRead = :lastRead, #readAt = :readAt, #unread = :unread"),
+			ConditionExpression: aws.String(condition + " AND (attribute_not_exists(#unread) OR #unread = :readUnread)"),
+			ExpressionAttributeNames: map[string]string{
+				"#type":     "Type",
+				"#lastRead": "LastReadMessageId",
+				"#readAt":   "ReadAt",
+				"#unread":   "UnreadCount",
+			},
+			ExpressionAttributeValues: values,
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionErr) {
+			return err
+		}
+		if attempt == maxVersionConflictRetries {
+			return ErrVersionConflict
+		}
+		if err = waitBeforeRetry(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// updateUnreadCount adds the unread delta of the message to the conversation of its recipient with its sender.
+// Like the search index, the count is updated after the message was stored, a failed update is logged,
+// and corrected when the recipient reads the conversation.
+func (d *dynamoDBClient) updateUnreadCount(ctx context.Context, message Message, delta int) {
+	if delta == 0 {
+		return
+	}
+	values := map[string]types.AttributeValue{
+		":type":      &types.AttributeValueMemberS{Value: ConversationPrivate},
+		":delta":     &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+		":messageId": &types.AttributeValueMemberS{Value: message.MessageId},
+	}
+	// a read message is not counted
+	condition := "(attribute_not_exists(#lastRead) OR #lastRead < :messageId)"
+	if delta < 0 {
+		// a deleted message never creates a conversation nor counts below zero
+		values[":zero"] = &types.AttributeValueMemberN{Value: "0"}
+		condition += " AND #unread > :zero"
+	}
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ConversationsTableName),
+		Key:                 conversationKey(message.RecipientId, message.SenderId),
+		UpdateExpression:    aws.String("SET #type = :type ADD #unread :delta"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#type":     "Type",
+			"#lastRead": "LastReadMessageId",
+			"#unread":   "UnreadCount",
+		},
+		ExpressionAttributeValues: values,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionErr) {
+		slog.Error(fmt.Sprintf("Error counting message %s as unread for user %s: %v", message.MessageId, message.RecipientId, err))
+	}
+}
+
+// CountUnreadMessages returns the count kept on a private conversation, and counts the messages of a group in the
+// group partition, so that counting the conversations of a user reads a few messages per group, not the user inbox.
+func (d *dynamoDBClient) CountUnreadMessages(ctx context.Context, conversation Conversation) (int, error) {
+	if conversation.Type != ConversationGroup {
+		return conversation.UnreadCount, nil
+	}
+	return d.countUnread(ctx, conversation, MaxUnreadCount)
+}
+
+// countUnread counts the messages of a group in the group partition, and the messages of a private conversation in
+// ConversationIndex, after the read marker of the conversation, up to limit messages, 0 means no limit.
+func (d *dynamoDBClient) countUnread(ctx context.Context, conversation Conversation, limit int) (int, error) {
+	names := map[string]string{
+		"#conversationId": RecipientIdKey,
+		"#senderId":       "SenderId",
+		"#deleted":        "Deleted",
+	}
+	values := map[string]types.AttributeValue{
+		":conversationId": &types.AttributeValueMemberS{Value: conversation.ConversationId},
+		":userId":         &types.AttributeValueMemberS{Value: conversation.UserId},
+		":false":          &types.AttributeValueMemberBOOL{Value: false},
+	}
+	keyCondition := "#conversationId = :conversationId"
+	filter := "#senderId <> :userId AND (attribute_not_exists(#deleted) OR #deleted = :false)"
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(MessagesTableName),
+		Select:    types.SelectCount,
+	}
+	if conversation.Type != ConversationGroup {
+		// both directions of the conversation, the messages of the user are filtered out
+		names["#conversationId"] = ConversationKey
+		values[":conversationId"] = &types.AttributeValueMemberS{Value: PrivateConversationKey(conversation.UserId, conversation.ConversationId)}
+		input.IndexName = aws.String(ConversationIndex)
+	}
+	if conversation.LastReadMessageId != "" {
+		names["#messageId"] = MessageIdSortKey
+		values[":lastRead"] = &types.AttributeValueMemberS{Value: conversation.LastReadMessageId}
+		keyCondition += " AND #messageId > :lastRead"
+	}
+	if limit > 0 {
+		// a page never counts more than the messages it evaluates
+		input.Limit = aws.Int32(int32(limit))
+	}
+	input.KeyConditionExpression = aws.String(keyCondition)
+	input.FilterExpression = aws.String(filter)
+	input.ExpressionAttributeNames = names
+	input.ExpressionAttributeValues = values
+
+	count := 0
+	for {
+		results, err := d.client.Query(ctx, input)
+		if err != nil {
+			return 0, err
+		}
+		count += int(results.Count)
+		if limit > 0 && count >= limit {
+			return limit, nil
+		}
+		input.ExclusiveStartKey = results.LastEvaluatedKey
+		if len(input.ExclusiveStartKey) == 0 {
+			return count, nil
+		}
+	}
+}
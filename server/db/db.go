@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -9,7 +10,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"golang.org/x/exp/slog"
+	"reflect"
 	. "server/common"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,88 +22,252 @@ type DynamoDBClientInterface interface {
 	BlockUser(ctx context.Context, user User, blockedUserId string) error
 	UnBlockUser(ctx context.Context, user User, unBlockedUserId string) error
 	GetUser(ctx context.Context, userId string) (*User, error)
+	MuteConversation(ctx context.Context, user User, conversationId string) error
+	UnmuteConversation(ctx context.Context, user User, conversationId string) error
+	SetBlockedGroupMessages(ctx context.Context, user User, setting string) error
+	// DeleteUser deletes the user record, the memberships, blocks and messages of the user are cleaned up by the user deletion.
+	DeleteUser(ctx context.Context, userId string) error
+	// GetBlockingUsers returns a page of the IDs of the users that blocked the user, starting after the cursor of the
+	// previous page, and the cursor of the next page, empty after the last page. A page can be empty while there are more.
+	GetBlockingUsers(ctx context.Context, userId string, cursor string) ([]string, string, error)
+
+	// StoreUserDeletion stores the progress of a user deletion, see UserDeletion.
+	StoreUserDeletion(ctx context.Context, deletion UserDeletion) error
+	GetUserDeletion(ctx context.Context, userId string) (*UserDeletion, error)
+	// GetUserDeletions returns the user deletions in progress.
+	GetUserDeletions(ctx context.Context) ([]UserDeletion, error)
+	DeleteUserDeletion(ctx context.Context, userId string) error
 
 	StoreGroup(ctx context.Context, group Group) error
 	GetGroup(ctx context.Context, groupId string) (*Group, error)
 	AddUserToGroup(ctx context.Context, group Group, user User) error
 	RemoveUserFromGroup(ctx context.Context, group Group, user User) error
+	SetGroupAdmin(ctx context.Context, group Group, userId string, admin bool) error
+	// BanUserFromGroup removes the user from the group, if a member, and bans them in one transaction
+	BanUserFromGroup(ctx context.Context, group Group, user User) error
+	UnbanUserFromGroup(ctx context.Context, group Group, userId string) error
+	DeleteGroup(ctx context.Context, group Group) error
+	// RemoveDeletedUserFromGroup removes a deleted user from the group members and admins, the user record is not written.
+	// The group of a deleted owner passes to its first admin, or to its first member if it has no admins.
+	RemoveDeletedUserFromGroup(ctx context.Context, group Group, userId string) error
+	// SetGroupOwner records the owner of a group created before owners were recorded, a group with an owner keeps it.
+	SetGroupOwner(ctx context.Context, group Group, ownerId string) error
+	// SetGroupFanOutOnRead stops copying the group messages to the member inboxes, the messages up to inboxUntil stay there.
+	SetGroupFanOutOnRead(ctx context.Context, group Group, inboxUntil string) error
+
+	StoreInvite(ctx context.Context, invite GroupInvite) error
+	GetInvite(ctx context.Context, token string) (*GroupInvite, error)
+	GetGroupInvites(ctx context.Context, groupId string) ([]GroupInvite, error)
+	DeleteInvite(ctx context.Context, token string) error
+	// JoinGroupWithInvite adds the user to the group and counts the invite use in one transaction,
+	// it returns ErrInviteUnavailable if the invite was revoked, expired or used up in the meantime, and ErrUserBanned
+	// if the user is banned from the group, also if they were banned after the group was read.
+	JoinGroupWithInvite(ctx context.Context, invite GroupInvite, group Group, user User) error
+
+	StoreAttachment(ctx context.Context, attachment Attachment) error
+	GetAttachment(ctx context.Context, attachmentId string) (*Attachment, error)
+	// SendAttachment records the message the attachment was sent with, it returns ErrAttachmentSent if the attachment
+	// was already sent, also by a concurrent request.
+	SendAttachment(ctx context.Context, attachmentId string, recipientId string, messageId string) error
+	// ReleaseAttachment undoes SendAttachment when the message was not stored, so that the attachment can be sent again.
+	// An attachment sent with another message is left as is.
+	ReleaseAttachment(ctx context.Context, attachmentId string, messageId string) error
+
+	StoreScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error
+	GetScheduledMessage(ctx context.Context, senderId string, scheduleId string) (*ScheduledMessage, error)
+	// GetScheduledMessages returns the pending and failed scheduled messages of the sender, by schedule ID.
+	GetScheduledMessages(ctx context.Context, senderId string) ([]ScheduledMessage, error)
+	// GetDueScheduledMessages returns up to limit pending messages to be sent at or before now, RFC3339 in UTC, earliest
+	// first. Messages claimed by another instance may be included, ClaimScheduledMessage skips them.
+	GetDueScheduledMessages(ctx context.Context, now string, limit int) ([]ScheduledMessage, error)
+	// ClaimScheduledMessage claims a pending message for sending until claimedUntil, and gives it the message ID unless
+	// an earlier claim did. It returns the claimed message, or ErrScheduleUnavailable if the message was canceled,
+	// failed, or is claimed by another instance at now.
+	ClaimScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string, claimedUntil string, messageId string) (*ScheduledMessage, error)
+	// ReleaseScheduledMessage ends the claim of a message that could not be sent yet, so that it is sent again with the
+	// next due messages. FailScheduledMessage ends the claim of a message that can not be sent, with the reason.
+	// Both do nothing if the claim expired and the message was claimed again.
+	ReleaseScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error
+	FailScheduledMessage(ctx context.Context, scheduled ScheduledMessage, reason string) error
+	// CancelScheduledMessage deletes a scheduled message, it returns ErrScheduleUnavailable if it is being sent at now.
+	CancelScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string) error
+	// DeleteScheduledMessage deletes a scheduled message once sent.
+	DeleteScheduledMessage(ctx context.Context, senderId string, scheduleId string) error
+
+	// GetSearchPostings returns the postings of the terms in the scopes, of the messages within the bounds of the query,
+	// up to its limit of the newest postings per term and scope.
+	// StoreMessage and UpdateMessage keep the index up to date, see SearchPostings.
+	GetSearchPostings(ctx context.Context, query SearchQuery) ([]SearchPosting, error)
 
 	StoreMessage(ctx context.Context, message Message) error
-	GetMessages(ctx context.Context, user User, timestamp int64) ([]Message, error)
+	GetMessage(ctx context.Context, recipientId string, messageId string) (*Message, error)
+	// GetMessageConsistent reads the message like GetMessage, and also returns a message stored right before.
+	GetMessageConsistent(ctx context.Context, recipientId string, messageId string) (*Message, error)
+	// UpdateMessage replaces a stored message, the message must have a new change ID.
+	// The reply count and the reactions of the stored message are kept, they are only changed by UpdateReplyCount,
+	// AddReaction and RemoveReaction.
+	UpdateMessage(ctx context.Context, message Message) error
+	// UpdateReplyCount adds delta to the reply count of the message and gives it the change ID, it returns the updated message.
+	UpdateReplyCount(ctx context.Context, recipientId string, messageId string, delta int, changeId string) (*Message, error)
+	// AddReaction stores the reaction and counts it on its message with the change ID, in one transaction, it returns the
+	// updated message, or ErrReactionExists if the user already reacted to the message with the emoji.
+	AddReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error)
+	// RemoveReaction deletes the reaction and uncounts it on its message with the change ID, in one transaction, it returns
+	// the updated message, or ErrReactionNotFound if the user did not react to the message with the emoji.
+	RemoveReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error)
+	// GetThreadMessages returns a page of the replies of a thread by message ID, oldest first.
+	GetThreadMessages(ctx context.Context, query ThreadQuery) (*HistoryPage, error)
+	// StoreInboxMessages copies a group message to the inboxes of the users, replacing earlier copies of the message.
+	StoreInboxMessages(ctx context.Context, message Message, userIds []string) error
+	// StoreSenderInboxMessage copies a changed private message to the inbox of its sender, replacing an earlier copy.
+	StoreSenderInboxMessage(ctx context.Context, message Message) error
+	GetMessages(ctx context.Context, user User, query MessagesQuery) (*MessagesPage, error)
+	// GetConversationMessages returns a page of the messages of one private or group conversation by message ID.
+	GetConversationMessages(ctx context.Context, query HistoryQuery) (*HistoryPage, error)
+
+	// UpdateConversations records the message as the latest message of its conversation, for private messages in the
+	// conversations of the sender and the recipient, for group messages once in the group conversation, stored
+	// with the group ID as both the user ID and the conversation ID. The latest message only moves forward, an edited
+	// or deleted latest message replaces it.
+	UpdateConversations(ctx context.Context, message Message, conversationType string) error
+	GetConversation(ctx context.Context, userId string, conversationId string) (*Conversation, error)
+	GetConversations(ctx context.Context, userId string) ([]Conversation, error)
+	DeleteConversation(ctx context.Context, userId string, conversationId string) error
+	// SetReadMarker stores the read marker of the conversation, a marker never moves back to an older message.
+	// Moving the marker of a private conversation counts its messages after the new marker again, see UnreadCount.
+	SetReadMarker(ctx context.Context, conversation Conversation) error
+	// CountUnreadMessages returns the number of messages of the conversation after its read marker, that were not sent
+	// by the user and were not deleted. Private conversations keep their count, StoreMessage and UpdateMessage update it,
+	// groups are counted up to MaxUnreadCount.
+	CountUnreadMessages(ctx context.Context, conversation Conversation) (int, error)
 }
 
 type dynamoDBClient struct {
 	client *dynamodb.Client
+	cache  Cache
 }
 
-func NewDynamoDBClient() (DynamoDBClientInterface, error) {
-	dynamoClient := &dynamoDBClient{}
+// NewDynamoDBClient returns a client of the DynamoDB tables, users, groups and recent group messages are cached in the given cache.
+// The endpoint overrides the AWS endpoint, for a local DynamoDB, it is empty in deployment.
+func NewDynamoDBClient(cache Cache, endpoint string) (DynamoDBClientInterface, error) {
+	dynamoClient := &dynamoDBClient{cache: cache}
 	cfg, err := config.LoadDefaultConfig(context.Background(),
 		config.WithRegion("us-west-2"))
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error loading configuration: %v", err))
 		return nil, err
 	}
-	dbClient := dynamodb.NewFromConfig(cfg)
+	dbClient := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
 	dynamoClient.client = dbClient
 
 	return dynamoClient, nil
 }
 
 const (
-	UsersTableName    = "usersTable"
-	GroupsTableName   = "groupsTable"
-	MessagesTableName = "messagesTable"
-	UserPrimaryKey    = "UserId"
-	GroupPrimaryKey   = "GroupId"
-	TimestampSortKey  = "Timestamp"
-	RecipientIdKey    = "RecipientId"
+	UsersTableName         = "usersTable"
+	GroupsTableName        = "groupsTable"
+	MessagesTableName      = "messagesTable"
+	InvitesTableName       = "invitesTable"
+	ConversationsTableName = "conversationsTable"
+	UserDeletionsTableName = "userDeletionsTable"
+	AttachmentsTableName   = "attachmentsTable"
+	SearchIndexTableName   = "searchIndexTable"
+	ReactionsTableName     = "reactionsTable"
+	ScheduledTableName     = "scheduledMessagesTable"
+	UserPrimaryKey         = "UserId"
+	GroupPrimaryKey        = "GroupId"
+	InvitePrimaryKey       = "Token"
+	AttachmentPrimaryKey   = "AttachmentId"
+	InviteGroupIndex       = "GroupIdIndex"
+	ConversationIdSortKey  = "ConversationId"
+	MessageIdSortKey       = "MessageId"
+	ChangeIdSortKey        = "ChangeId"
+	ChangeIdIndex          = "ChangeIdIndex" // local secondary index of the messages table, ordering recipient messages by change ID
+	ConversationKey        = "ConversationKey"
+	ConversationIndex      = "ConversationIndex" // global secondary index of the messages table, ordering private conversation messages by message ID
+	ThreadKey              = "ThreadKey"
+	ThreadIndex            = "ThreadIndex" // global secondary index of the messages table, ordering the replies of a thread by message ID
+	ReplyCountAttribute    = "ReplyCount"
+	ReactionsAttribute     = "Reactions"
+	MessageKey             = "MessageKey"  // HashKey of the reactions table, the recipient and message ID of the reaction
+	ReactionKey            = "ReactionKey" // SortKey of the reactions table, the user ID and emoji of the reaction
+	RecipientIdKey         = "RecipientId"
+	SenderIdKey            = "SenderId" // HashKey of the scheduled messages table, with ScheduleIdSortKey
+	ScheduleIdSortKey      = "ScheduleId"
+	DueIndex               = "DueIndex"  // global secondary index of the scheduled messages table, ordering the pending messages by SendAt
+	DueKey                 = "DueKey"    // HashKey of DueIndex, set on pending messages only
+	VersionAttribute       = "Version"   // of user and group records, see ErrVersionConflict
+	SearchKeyAttribute     = "ScopeTerm" // HashKey of the search index table, the SearchKey of the posting, with MessageId as SortKey
 )
 
+// StoreUser writes the user, it returns ErrVersionConflict if the user changed since it was read.
 func (d *dynamoDBClient) StoreUser(ctx context.Context, user User) error {
+	// the next read, of any instance, gets the user from the database instead of a stale copy,
+	// also if the write failed, as it may have been applied nonetheless
+	defer d.cache.RemoveUser(ctx, user.UserId)
 
-	// Serialize the user into a map[string]AttributeValue
-	av, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		return err
-	}
-
-	// Create PutItem input
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(UsersTableName),
-		Item:      av,
-	}
-
-	// Write to DynamoDB
-	_, err = d.client.PutItem(ctx, input)
+	put, err := versionedPut(UsersTableName, nextUserVersion(user), user.Version)
 	if err != nil {
 		return err
 	}
-	StoreUserInCache(&user)
-	return nil
+	return d.putVersioned(ctx, put)
 }
 
 func (d *dynamoDBClient) BlockUser(ctx context.Context, user User, blockedUserId string) error {
-	// add the blocked user
-	user.BlockedUsers[blockedUserId] = true
-	// update user record
-	err := d.StoreUser(ctx, user)
-	return err
+	return d.updateUser(ctx, user, func(user *User) {
+		// add the blocked user
+		if user.BlockedUsers == nil {
+			user.BlockedUsers = make(map[string]bool)
+		}
+		user.BlockedUsers[blockedUserId] = true
+	})
 }
 
 func (d *dynamoDBClient) UnBlockUser(ctx context.Context, user User, unBlockedUserId string) error {
-	// add the blocked user
-	delete(user.BlockedUsers, unBlockedUserId)
-	// update user record
-	err := d.StoreUser(ctx, user)
-	return err
+	return d.updateUser(ctx, user, func(user *User) {
+		delete(user.BlockedUsers, unBlockedUserId)
+	})
+}
+
+func (d *dynamoDBClient) MuteConversation(ctx context.Context, user User, conversationId string) error {
+	return d.updateUser(ctx, user, func(user *User) {
+		if user.Muted == nil {
+			user.Muted = make(map[string]bool)
+		}
+		user.Muted[conversationId] = true
+	})
+}
+
+func (d *dynamoDBClient) UnmuteConversation(ctx context.Context, user User, conversationId string) error {
+	return d.updateUser(ctx, user, func(user *User) {
+		delete(user.Muted, conversationId)
+	})
+}
+
+func (d *dynamoDBClient) SetBlockedGroupMessages(ctx context.Context, user User, setting string) error {
+	return d.updateUser(ctx, user, func(user *User) {
+		user.BlockedGroupMessages = setting
+	})
 }
 
 func (d *dynamoDBClient) GetUser(ctx context.Context, userId string) (*User, error) {
-	if user, ok := GetUserFromCache(userId); ok {
+	if user, ok := d.cache.GetUser(ctx, userId); ok {
 		return user, nil
 	}
+	user, err := d.getUserItem(ctx, userId, false)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	d.cache.StoreUser(ctx, user)
+	return user, nil
+}
 
+// getUserItem reads the user from the table, a consistent read returns the latest write, to retry a conflicting update.
+func (d *dynamoDBClient) getUserItem(ctx context.Context, userId string, consistentRead bool) (*User, error) {
 	// Create GetItem input
 	id, err := attributevalue.Marshal(userId)
 	if err != nil {
@@ -107,8 +275,9 @@ func (d *dynamoDBClient) GetUser(ctx context.Context, userId string) (*User, err
 	}
 
 	input := &dynamodb.GetItemInput{
-		TableName: aws.String(UsersTableName),
-		Key:       map[string]types.AttributeValue{UserPrimaryKey: id},
+		TableName:      aws.String(UsersTableName),
+		Key:            map[string]types.AttributeValue{UserPrimaryKey: id},
+		ConsistentRead: aws.Bool(consistentRead),
 	}
 
 	// Get item from DynamoDB
@@ -129,31 +298,31 @@ func (d *dynamoDBClient) GetUser(ctx context.Context, userId string) (*User, err
 	return &user, nil
 }
 
+// StoreGroup writes the group, it returns ErrVersionConflict if the group changed since it was read.
 func (d *dynamoDBClient) StoreGroup(ctx context.Context, group Group) error {
-	// Serialize the group into a map[string]AttributeValue
-	av, err := attributevalue.MarshalMap(group)
-	if err != nil {
-		return err
-	}
-	// create PutItem input
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(GroupsTableName),
-		Item:      av,
-	}
-	// Write to DynamoDB
-	_, err = d.client.PutItem(ctx, input)
+	defer d.cache.RemoveGroup(ctx, group.GroupId)
+
+	put, err := versionedPut(GroupsTableName, nextGroupVersion(group), group.Version)
 	if err != nil {
 		return err
 	}
-	StoreGroupInCache(&group)
-	return nil
-
+	return d.putVersioned(ctx, put)
 }
 
 func (d *dynamoDBClient) GetGroup(ctx context.Context, groupId string) (*Group, error) {
-	if group, ok := GetGroupFromCache(groupId); ok {
+	if group, ok := d.cache.GetGroup(ctx, groupId); ok {
 		return group, nil
 	}
+	group, err := d.getGroupItem(ctx, groupId, false)
+	if err != nil || group == nil {
+		return nil, err
+	}
+	d.cache.StoreGroup(ctx, group)
+	return group, nil
+}
+
+// getGroupItem reads the group from the table, see getUserItem.
+func (d *dynamoDBClient) getGroupItem(ctx context.Context, groupId string, consistentRead bool) (*Group, error) {
 	// Create GetItem input
 	id, err := attributevalue.Marshal(groupId)
 	if err != nil {
@@ -161,8 +330,9 @@ func (d *dynamoDBClient) GetGroup(ctx context.Context, groupId string) (*Group,
 	}
 
 	input := &dynamodb.GetItemInput{
-		TableName: aws.String(GroupsTableName),
-		Key:       map[string]types.AttributeValue{GroupPrimaryKey: id},
+		TableName:      aws.String(GroupsTableName),
+		Key:            map[string]types.AttributeValue{GroupPrimaryKey: id},
+		ConsistentRead: aws.Bool(consistentRead),
 	}
 
 	// Get item from DynamoDB
@@ -184,85 +354,81 @@ func (d *dynamoDBClient) GetGroup(ctx context.Context, groupId string) (*Group,
 }
 
 func (d *dynamoDBClient) AddUserToGroup(ctx context.Context, group Group, user User) error {
+	// update in one transaction
+	return d.updateMembership(ctx, group, user, addMember)
+}
 
-	if group.Members == nil {
-		group.Members = make(map[string]bool)
-	}
-	group.Members[user.UserId] = true
-	if user.Groups == nil {
-		user.Groups = make(map[string]bool)
-	}
-	user.Groups[group.GroupId] = true
-
-	// Serialize to map[string]AttributeValue
-	dbUser, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		return err
-	}
+func (d *dynamoDBClient) RemoveUserFromGroup(ctx context.Context, group Group, user User) error {
+	return d.updateMembership(ctx, group, user, removeMember)
+}
 
-	dbGroup, err := attributevalue.MarshalMap(group)
-	if err != nil {
-		return err
-	}
+func (d *dynamoDBClient) BanUserFromGroup(ctx context.Context, group Group, user User) error {
+	return d.updateMembership(ctx, group, user, banMember)
+}
 
-	// update in one transaction
-	_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Put: &types.Put{
-					TableName: aws.String(UsersTableName),
-					Item:      dbUser,
-				},
-			},
-			{
-				Put: &types.Put{
-					TableName: aws.String(GroupsTableName),
-					Item:      dbGroup,
-				},
-			},
-		},
+func (d *dynamoDBClient) UnbanUserFromGroup(ctx context.Context, group Group, userId string) error {
+	return d.updateGroup(ctx, group, func(group *Group) {
+		delete(group.Banned, userId)
 	})
+}
 
-	return err
-
+func (d *dynamoDBClient) SetGroupAdmin(ctx context.Context, group Group, userId string, admin bool) error {
+	return d.updateGroup(ctx, group, func(group *Group) {
+		if group.Admins == nil {
+			group.Admins = make(map[string]bool)
+		}
+		if admin {
+			group.Admins[userId] = true
+		} else {
+			delete(group.Admins, userId)
+		}
+	})
 }
 
-func (d *dynamoDBClient) RemoveUserFromGroup(ctx context.Context, group Group, user User) error {
-	// remove the member
-	delete(group.Members, user.UserId)
-	delete(user.Groups, group.GroupId)
+func (d *dynamoDBClient) SetGroupOwner(ctx context.Context, group Group, ownerId string) error {
+	return d.updateGroup(ctx, group, func(group *Group) {
+		if group.OwnerId == "" {
+			group.OwnerId = ownerId
+		}
+	})
+}
 
-	// Serialize to map[string]AttributeValue
-	dbUser, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		return err
+// DeleteGroup removes the group from all of its members and then deletes the group record.
+// Members are updated one by one since a group can have more members than a single transaction allows,
+// the removal is idempotent, so a failed delete can be retried. Messages sent to the group are kept.
+func (d *dynamoDBClient) DeleteGroup(ctx context.Context, group Group) error {
+	defer d.cache.RemoveGroup(ctx, group.GroupId)
+	for userId := range group.Members {
+		id, err := attributevalue.Marshal(userId)
+		if err != nil {
+			return err
+		}
+		_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(UsersTableName),
+			Key:                      map[string]types.AttributeValue{UserPrimaryKey: id},
+			UpdateExpression:         aws.String("REMOVE #groups.#groupId ADD #version :one"),
+			ExpressionAttributeNames: map[string]string{"#groups": "Groups", "#groupId": group.GroupId, "#version": VersionAttribute},
+			// a concurrent read-modify-write of the user conflicts instead of adding the group back
+			ExpressionAttributeValues: map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}},
+			// do not create records for users that were deleted in the meantime
+			ConditionExpression: aws.String("attribute_exists(" + UserPrimaryKey + ")"),
+		})
+		d.cache.RemoveUser(ctx, userId)
+		var conditionErr *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &conditionErr) {
+			return err
+		}
 	}
 
-	dbGroup, err := attributevalue.MarshalMap(group)
+	id, err := attributevalue.Marshal(group.GroupId)
 	if err != nil {
 		return err
 	}
-
-	// update in one transaction
-	_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Put: &types.Put{
-					TableName: aws.String(UsersTableName),
-					Item:      dbUser,
-				},
-			},
-			{
-				Put: &types.Put{
-					TableName: aws.String(GroupsTableName),
-					Item:      dbGroup,
-				},
-			},
-		},
+	_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(GroupsTableName),
+		Key:       map[string]types.AttributeValue{GroupPrimaryKey: id},
 	})
-
 	return err
-
 }
 
 func (d *dynamoDBClient) StoreMessage(ctx context.Context, message Message) error {
@@ -281,106 +447,225 @@ func (d *dynamoDBClient) StoreMessage(ctx context.Context, message Message) erro
 	if err != nil {
 		return err
 	}
-	StoreMessageInCache(message)
+	d.cache.StoreMessage(ctx, message)
+	d.updateSearchIndex(ctx, nil, message)
+	d.updateUnreadCount(ctx, message, unreadDelta(nil, message))
 	return nil
 }
 
-func (d *dynamoDBClient) GetMessages(ctx context.Context, user User, timestamp int64) ([]Message, error) {
-	// convert user.Groups map to list
-	groupList := make([]string, 0, len(user.Groups))
-	for k := range user.Groups {
-		groupList = append(groupList, k)
+func (d *dynamoDBClient) GetMessage(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	return d.getMessageItem(ctx, recipientId, messageId, false)
+}
+
+func (d *dynamoDBClient) GetMessageConsistent(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	return d.getMessageItem(ctx, recipientId, messageId, true)
+}
+
+// getMessageItem reads the message, consistently to get the latest change before updating it.
+func (d *dynamoDBClient) getMessageItem(ctx context.Context, recipientId string, messageId string, consistent bool) (*Message, error) {
+	rid, err := attributevalue.Marshal(recipientId)
+	if err != nil {
+		return nil, err
+	}
+	mid, err := attributevalue.Marshal(messageId)
+	if err != nil {
+		return nil, err
 	}
 
-	// get all Messages
-	allMessages, err := d.getRecipientMessages(ctx, user.UserId, groupList, timestamp)
-	return allMessages, err
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(MessagesTableName),
+		Key:            map[string]types.AttributeValue{RecipientIdKey: rid, MessageIdSortKey: mid},
+		ConsistentRead: aws.Bool(consistent),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, no message with the provided ID exists
+	if result.Item == nil {
+		return nil, nil
+	}
+	var message Message
+	err = attributevalue.UnmarshalMap(result.Item, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
 }
 
-func (d *dynamoDBClient) getRecipientMessages(ctx context.Context, userId string, groupIds []string, timestamp int64) ([]Message, error) {
-	var messages []Message
+// messageAttributes are the attribute names of the stored messages.
+var messageAttributes = func() []string {
+	var names []string
+	messageType := reflect.TypeOf(Message{})
+	for i := 0; i < messageType.NumField(); i++ {
+		field := messageType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("dynamodbav"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}()
 
-	lessThenMinute := time.Now().Unix()-timestamp < 60
+// counterAttributes are the message attributes changed only by their own updates, they are never replaced by UpdateMessage.
+var counterAttributes = map[string]bool{ReplyCountAttribute: true, ReactionsAttribute: true}
 
-	checkCache := false
-	// should check in cache only if timestamp is in range of last minute
-	if timestamp > 0 && lessThenMinute {
-		checkCache = true
+func (d *dynamoDBClient) UpdateMessage(ctx context.Context, message Message) error {
+	av, err := attributevalue.MarshalMap(message)
+	if err != nil {
+		return err
+	}
+	// set the attributes of the message and remove the empty ones, except the key and the counters,
+	// so that counts of concurrent replies and reactions are not replaced by the ones read with the message
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	var set, remove []string
+	for i, name := range messageAttributes {
+		if name == RecipientIdKey || name == MessageIdSortKey || counterAttributes[name] {
+			continue
+		}
+		placeholder := "a" + strconv.Itoa(i)
+		names["#"+placeholder] = name
+		if value, ok := av[name]; ok {
+			values[":"+placeholder] = value
+			set = append(set, "#"+placeholder+" = :"+placeholder)
+		} else {
+			remove = append(remove, "#"+placeholder)
+		}
+	}
+	update := "SET " + strings.Join(set, ", ")
+	if len(remove) > 0 {
+		update += " REMOVE " + strings.Join(remove, ", ")
+	}
+	result, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(MessagesTableName),
+		Key: map[string]types.AttributeValue{
+			RecipientIdKey:   av[RecipientIdKey],
+			MessageIdSortKey: av[MessageIdSortKey],
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		// never recreate a message that does not exist
+		ConditionExpression: aws.String("attribute_exists(" + MessageIdSortKey + ")"),
+		// the previous version tells which search index entries to remove
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return err
 	}
+	var previous Message
+	if err = attributevalue.UnmarshalMap(result.Attributes, &previous); err != nil {
+		return err
+	}
+	d.updateSearchIndex(ctx, &previous, message)
+	d.updateUnreadCount(ctx, message, unreadDelta(&previous, message))
+	message.ReplyCount, message.Reactions = previous.ReplyCount, previous.Reactions
+	d.cache.StoreMessage(ctx, message)
+	return nil
+}
 
-	recipientIds := append(groupIds, userId)
-	for _, recipientId := range recipientIds {
-		isGroup := recipientId != userId
-		if checkCache && isGroup {
-			if val, ok := GetGroupMessagesFromCache(recipientId, timestamp); ok {
-				messages = append(messages, val...)
-				continue
-			}
+func (d *dynamoDBClient) GetMessages(ctx context.Context, user User, query MessagesQuery) (*MessagesPage, error) {
+	// get all Messages
+	allMessages, failed, err := queryRecipients(ctx, append(query.groupIds(user), user.UserId), func(ctx context.Context, recipientId string) ([]Message, error) {
+		return d.getRecipientMessages(ctx, recipientId, recipientId != user.UserId, query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	page := newMessagesPage(query, allMessages)
+	page.Failed = failed
+	return fromInbox(user, page), nil
+}
+
+// getRecipientMessages returns the messages of the user or one of their groups after the query position.
+// Recent group messages are served from the cache, as all members of the group poll for them.
+func (d *dynamoDBClient) getRecipientMessages(ctx context.Context, recipientId string, isGroup bool, query MessagesQuery) ([]Message, error) {
+	timestamp := query.Timestamp
+	fetchLimit := query.fetchLimit()
+	after := query.after(recipientId)
+
+	// should check in cache only if timestamp is in range of last minute
+	checkCache := timestamp > 0 && time.Since(time.Unix(timestamp, 0)) < RecentMessagesWindow
+	if checkCache && isGroup {
+		if val, ok := d.cache.GetGroupMessages(ctx, recipientId, timestamp); ok {
+			return filterMessagesAfter(val, after, fetchLimit), nil
 		}
 
-		id, err := attributevalue.Marshal(recipientId)
+		// check for messages of the last minute for caching purposes, the group has only a few of them, so no limit is needed
+		recipientMsgs, err := d.queryRecipientMessages(ctx, recipientId, MessageIdAfter(time.Now().Add(-RecentMessagesWindow).Unix()), 0)
 		if err != nil {
 			return nil, err
 		}
-		keyConditions := map[string]types.Condition{
-			RecipientIdKey: {
-				ComparisonOperator: types.ComparisonOperatorEq,
-				AttributeValueList: []types.AttributeValue{id},
-			},
+		if len(recipientMsgs) > 0 {
+			// add group msgs to cache
+			d.cache.StoreGroupMessages(ctx, recipientId, recipientMsgs)
 		}
-		if timestamp > 0 {
-			timeStampToCheck := time.Unix(timestamp, 0).Format(time.RFC3339)
-			// check for messages after the provided timestamp, but at least for 1 minute for caching purposes
-			if lessThenMinute && isGroup {
-				timeStampToCheck = time.Now().Add(-1 * time.Minute).Format(time.RFC3339)
-			}
-			keyConditions[TimestampSortKey] = types.Condition{
-				ComparisonOperator: types.ComparisonOperatorGt,
-				AttributeValueList: []types.AttributeValue{
-					&types.AttributeValueMemberS{Value: timeStampToCheck},
-				},
-			}
+		// filter out messages older then requested timestamp and cursor position
+		return filterMessagesAfter(recipientMsgs, after, fetchLimit), nil
+	}
+
+	// not cached, the messages after the cursor and up to the limit are not all the recent messages of the group,
+	// which the cache is taken for
+	return d.queryRecipientMessages(ctx, recipientId, after, fetchLimit)
+}
+
+// queryRecipientMessages returns up to limit messages of the recipient with a change ID greater than after, in change ID order.
+// It follows the DynamoDB pagination until the limit is reached or there are no more messages, limit 0 means no limit.
+func (d *dynamoDBClient) queryRecipientMessages(ctx context.Context, recipientId string, after string, limit int) ([]Message, error) {
+	id, err := attributevalue.Marshal(recipientId)
+	if err != nil {
+		return nil, err
+	}
+	keyConditions := map[string]types.Condition{
+		RecipientIdKey: {
+			ComparisonOperator: types.ComparisonOperatorEq,
+			AttributeValueList: []types.AttributeValue{id},
+		},
+	}
+	if after != "" {
+		keyConditions[ChangeIdSortKey] = types.Condition{
+			ComparisonOperator: types.ComparisonOperatorGt,
+			AttributeValueList: []types.AttributeValue{
+				&types.AttributeValueMemberS{Value: after},
+			},
 		}
+	}
 
-		// get all items with the recipientId in the list AND the timestamp greater than the provided timestamp
-		results, err := d.client.Query(ctx, &dynamodb.QueryInput{
-			TableName:     aws.String(MessagesTableName),
-			KeyConditions: keyConditions,
-		})
+	var messages []Message
+	var startKey map[string]types.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:         aws.String(MessagesTableName),
+			IndexName:         aws.String(ChangeIdIndex),
+			KeyConditions:     keyConditions,
+			ExclusiveStartKey: startKey,
+		}
+		if limit > 0 {
+			input.Limit = aws.Int32(int32(limit - len(messages)))
+		}
 
+		// get all items with the recipientId AND the change id greater than the provided one
+		results, err := d.client.Query(ctx, input)
 		if err != nil {
 			return nil, err
 		}
 
-		recipientMsgs := make([]Message, 0, len(results.Items))
-		for _, msg := range results.Items {
+		for _, item := range results.Items {
 			var message Message
-			err = attributevalue.UnmarshalMap(msg, &message)
+			err = attributevalue.UnmarshalMap(item, &message)
 			if err != nil {
 				return nil, err
 			}
-			recipientMsgs = append(recipientMsgs, message)
-		}
-
-		if recipientId != userId && len(recipientMsgs) > 0 {
-			// add group msgs to cache
-			StoreMessagesInCache(recipientId, recipientMsgs)
+			messages = append(messages, message)
 		}
 
-		if isGroup && lessThenMinute {
-			// filter out messages older then requested timestamp
-			var validMessages []Message
-			for _, msg := range recipientMsgs {
-				if msg.Timestamp > time.Unix(timestamp, 0).Format(time.RFC3339) {
-					validMessages = append(validMessages, msg)
-				}
-			}
-			messages = append(messages, validMessages...)
-		} else {
-			messages = append(messages, recipientMsgs...)
+		startKey = results.LastEvaluatedKey
+		if len(startKey) == 0 || (limit > 0 && len(messages) >= limit) {
+			return messages, nil
 		}
 	}
-
-	return messages, nil
-
 }
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "server/common"
+	"sort"
+)
+
+// blockingUsersPageSize is the number of users scanned for a page of GetBlockingUsers.
+const blockingUsersPageSize = 100
+
+// removeDeletedMember removes a deleted user from the group. The group of a deleted owner passes to NextOwnerId.
+func removeDeletedMember(group *Group, userId string) {
+	delete(group.Members, userId)
+	delete(group.Admins, userId)
+	if group.OwnerId != userId {
+		return
+	}
+	group.OwnerId = NextOwnerId(*group)
+	// the owner is not listed as an admin
+	delete(group.Admins, group.OwnerId)
+}
+
+// NextOwnerId returns the user a group without an owner passes to, the first admin, or the first member if there are
+// no admins, by user ID. It is empty if the group has no members.
+func NextOwnerId(group Group) string {
+	candidates := group.Admins
+	if len(candidates) == 0 {
+		candidates = group.Members
+	}
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	return ids[0]
+}
+
+func userKey(userId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{UserPrimaryKey: &types.AttributeValueMemberS{Value: userId}}
+}
+
+func (d *dynamoDBClient) DeleteUser(ctx context.Context, userId string) error {
+	defer d.cache.RemoveUser(ctx, userId)
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(UsersTableName),
+		Key:       userKey(userId),
+	})
+	return err
+}
+
+// GetBlockingUsers scans the users table, there is no index of the blocked users as it is only needed to delete a user.
+func (d *dynamoDBClient) GetBlockingUsers(ctx context.Context, userId string, cursor string) ([]string, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(UsersTableName),
+		FilterExpression:         aws.String("attribute_exists(#blockedUsers.#userId)"),
+		ProjectionExpression:     aws.String("#id"),
+		ExpressionAttributeNames: map[string]string{"#blockedUsers": "BlockedUsers", "#userId": userId, "#id": UserPrimaryKey},
+		Limit:                    aws.Int32(blockingUsersPageSize),
+	}
+	if cursor != "" {
+		input.ExclusiveStartKey = userKey(cursor)
+	}
+	results, err := d.client.Scan(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+	var userIds []string
+	for _, item := range results.Items {
+		var user User
+		if err = attributevalue.UnmarshalMap(item, &user); err != nil {
+			return nil, "", err
+		}
+		userIds = append(userIds, user.UserId)
+	}
+	next := ""
+	if id, ok := results.LastEvaluatedKey[UserPrimaryKey].(*types.AttributeValueMemberS); ok {
+		next = id.Value
+	}
+	return userIds, next, nil
+}
+
+func (d *dynamoDBClient) RemoveDeletedUserFromGroup(ctx context.Context, group Group, userId string) error {
+	return d.updateGroup(ctx, group, func(group *Group) {
+		removeDeletedMember(group, userId)
+	})
+}
+
+func (d *dynamoDBClient) StoreUserDeletion(ctx context.Context, deletion UserDeletion) error {
+	item, err := attributevalue.MarshalMap(deletion)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(UserDeletionsTableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoDBClient) GetUserDeletion(ctx context.Context, userId string) (*UserDeletion, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(UserDeletionsTableName),
+		Key:            userKey(userId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, the user is not being deleted
+	if result.Item == nil {
+		return nil, nil
+	}
+	var deletion UserDeletion
+	err = attributevalue.UnmarshalMap(result.Item, &deletion)
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// GetUserDeletions scans the user deletions table, it only holds the deletions in progress.
+func (d *dynamoDBClient) GetUserDeletions(ctx context.Context) ([]UserDeletion, error) {
+	var deletions []UserDeletion
+	var startKey map[string]types.AttributeValue
+	for {
+		results, err := d.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(UserDeletionsTableName),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Items {
+			var deletion UserDeletion
+			if err = attributevalue.UnmarshalMap(item, &deletion); err != nil {
+				return nil, err
+			}
+			deletions = append(deletions, deletion)
+		}
+		startKey = results.LastEvaluatedKey
+		if len(startKey) == 0 {
+			return deletions, nil
+		}
+	}
+}
+
+func (d *dynamoDBClient) DeleteUserDeletion(ctx context.Context, userId string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(UserDeletionsTableName),
+		Key:       userKey(userId),
+	})
+	return err
+}
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	. "server/common"
+	"testing"
+	"time"
+)
+
+// newTestDynamoDBClient returns a client of a local DynamoDB, such as DynamoDB Local, at DYNAMODB_ENDPOINT:
+//
+//	docker run -p 8000:8000 amazon/dynamodb-local
+//	DYNAMODB_ENDPOINT=http://localhost:8000 go test ./db -run Dynamo
+//
+// The tables are created if they do not exist. Without DYNAMODB_ENDPOINT the test is skipped, except in CI,
+// which runs DynamoDB Local next to the tests.
+func newTestDynamoDBClient(t *testing.T) *dynamoDBClient {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" && os.Getenv("CI") != "" {
+		t.Fatal("DYNAMODB_ENDPOINT is not set in CI")
+	}
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		// a local DynamoDB accepts any credentials
+		t.Setenv("AWS_ACCESS_KEY_ID", "local")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "local")
+	}
+	cache, err := NewLRUCache(DefaultLRUCacheSize, DefaultCacheTTL)
+	assert.NoError(t, err)
+	client, err := NewDynamoDBClient(cache, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := client.(*dynamoDBClient)
+	createTestTables(t, d.client)
+	return d
+}
+
+// createTestTables creates the tables with the keys and indexes of the deployment.
+func createTestTables(t *testing.T, client *dynamodb.Client) {
+	ctx := context.Background()
+	key := func(name string, keyType types.KeyType) types.KeySchemaElement {
+		return types.KeySchemaElement{AttributeName: aws.String(name), KeyType: keyType}
+	}
+	attribute := func(name string) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: types.ScalarAttributeTypeS}
+	}
+	all := &types.Projection{ProjectionType: types.ProjectionTypeAll}
+
+	tables := []dynamodb.CreateTableInput{
+		{
+			TableName:            aws.String(UsersTableName),
+			KeySchema:            []types.KeySchemaElement{key(UserPrimaryKey, types.KeyTypeHash)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(UserPrimaryKey)},
+		},
+		{
+			TableName:            aws.String(GroupsTableName),
+			KeySchema:            []types.KeySchemaElement{key(GroupPrimaryKey, types.KeyTypeHash)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(GroupPrimaryKey)},
+		},
+		{
+			TableName:            aws.String(MessagesTableName),
+			KeySchema:            []types.KeySchemaElement{key(RecipientIdKey, types.KeyTypeHash), key(MessageIdSortKey, types.KeyTypeRange)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(RecipientIdKey), attribute(MessageIdSortKey), attribute(ChangeIdSortKey), attribute(ConversationKey), attribute(ThreadKey)},
+			LocalSecondaryIndexes: []types.LocalSecondaryIndex{{
+				IndexName:  aws.String(ChangeIdIndex),
+				KeySchema:  []types.KeySchemaElement{key(RecipientIdKey, types.KeyTypeHash), key(ChangeIdSortKey, types.KeyTypeRange)},
+				Projection: all,
+			}},
+			GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{{
+				IndexName:  aws.String(ConversationIndex),
+				KeySchema:  []types.KeySchemaElement{key(ConversationKey, types.KeyTypeHash), key(MessageIdSortKey, types.KeyTypeRange)},
+				Projection: all,
+			}, {
+				IndexName:  aws.String(ThreadIndex),
+				KeySchema:  []types.KeySchemaElement{key(ThreadKey, types.KeyTypeHash), key(MessageIdSortKey, types.KeyTypeRange)},
+				Projection: all,
+			}},
+		},
+		{
+			TableName:            aws.String(InvitesTableName),
+			KeySchema:            []types.KeySchemaElement{key(InvitePrimaryKey, types.KeyTypeHash)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(InvitePrimaryKey), attribute(GroupPrimaryKey)},
+			GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{{
+				IndexName:  aws.String(InviteGroupIndex),
+				KeySchema:  []types.KeySchemaElement{key(GroupPrimaryKey, types.KeyTypeHash)},
+				Projection: all,
+			}},
+		},
+		{
+			TableName:            aws.String(ConversationsTableName),
+			KeySchema:            []types.KeySchemaElement{key(UserPrimaryKey, types.KeyTypeHash), key(ConversationIdSortKey, types.KeyTypeRange)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(UserPrimaryKey), attribute(ConversationIdSortKey)},
+		},
+		{
+			TableName:            aws.String(UserDeletionsTableName),
+			KeySchema:            []types.KeySchemaElement{key(UserPrimaryKey, types.KeyTypeHash)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(UserPrimaryKey)},
+		},
+		{
+			TableName:            aws.String(AttachmentsTableName),
+			KeySchema:            []types.KeySchemaElement{key(AttachmentPrimaryKey, types.KeyTypeHash)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(AttachmentPrimaryKey)},
+		},
+		{
+			TableName:            aws.String(SearchIndexTableName),
+			KeySchema:            []types.KeySchemaElement{key(SearchKeyAttribute, types.KeyTypeHash), key(MessageIdSortKey, types.KeyTypeRange)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(SearchKeyAttribute), attribute(MessageIdSortKey)},
+		},
+		{
+			TableName:            aws.String(ReactionsTableName),
+			KeySchema:            []types.KeySchemaElement{key(MessageKey, types.KeyTypeHash), key(ReactionKey, types.KeyTypeRange)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(MessageKey), attribute(ReactionKey)},
+		},
+		{
+			TableName:            aws.String(ScheduledTableName),
+			KeySchema:            []types.KeySchemaElement{key(SenderIdKey, types.KeyTypeHash), key(ScheduleIdSortKey, types.KeyTypeRange)},
+			AttributeDefinitions: []types.AttributeDefinition{attribute(SenderIdKey), attribute(ScheduleIdSortKey), attribute(DueKey), attribute("SendAt")},
+			GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{{
+				IndexName:  aws.String(DueIndex),
+				KeySchema:  []types.KeySchemaElement{key(DueKey, types.KeyTypeHash), key("SendAt", types.KeyTypeRange)},
+				Projection: all,
+			}},
+		},
+	}
+	for _, table := range tables {
+		table := table
+		table.BillingMode = types.BillingModePayPerRequest
+		_, err := client.CreateTable(ctx, &table)
+		var exists *types.ResourceInUseException
+		if err != nil && !errors.As(err, &exists) {
+			t.Fatalf("Error creating table %s: %v", aws.ToString(table.TableName), err)
+		}
+		waiter := dynamodb.NewTableExistsWaiter(client)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: table.TableName}, time.Minute)
+		if err != nil {
+			t.Fatalf("Error waiting for table %s: %v", aws.ToString(table.TableName), err)
+		}
+	}
+}
+
+func TestDynamoGroupMembershipCache(t *testing.T) {
+	ctx := context.Background()
+	client := newTestDynamoDBClient(t)
+
+	// storeAndCache stores the user and group and reads them, so that both are cached
+	storeAndCache := func(t *testing.T, user User, group Group) {
+		assert.NoError(t, client.StoreUser(ctx, user))
+		assert.NoError(t, client.StoreGroup(ctx, group))
+		_, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		_, err = client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+	}
+
+	t.Run("added member is seen right away", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+		gotUser, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.True(t, gotUser.Groups[group.GroupId])
+		gotGroup, err := client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.True(t, gotGroup.Members[user.UserId])
+
+		// the new group is polled
+		msg := newTestMessage(group.GroupId, time.Now(), "hello")
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+		page, err := client.GetMessages(ctx, *gotUser, MessagesQuery{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{msg}, page.Messages)
+	})
+
+	t.Run("removed member is seen right away", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+		gotUser, _ := client.GetUser(ctx, user.UserId)
+		gotGroup, _ := client.GetGroup(ctx, group.GroupId)
+
+		assert.NoError(t, client.RemoveUserFromGroup(ctx, *gotGroup, *gotUser))
+		gotUser, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotUser.Groups, group.GroupId)
+		gotGroup, err = client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotGroup.Members, user.UserId)
+	})
+
+	t.Run("joined member is seen right away", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		invite := GroupInvite{Token: "test-invite-" + user.UserId, GroupId: group.GroupId}
+		assert.NoError(t, client.StoreInvite(ctx, invite))
+
+		assert.NoError(t, client.JoinGroupWithInvite(ctx, invite, group, user))
+		gotGroup, err := client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.True(t, gotGroup.Members[user.UserId])
+	})
+
+	t.Run("failed join does not change the cached membership", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		invite := GroupInvite{Token: "test-invite-" + user.UserId, GroupId: group.GroupId, MaxUses: 1, Uses: 1}
+		assert.NoError(t, client.StoreInvite(ctx, invite))
+
+		gotUser, _ := client.GetUser(ctx, user.UserId)
+		gotGroup, _ := client.GetGroup(ctx, group.GroupId)
+		err := client.JoinGroupWithInvite(ctx, invite, *gotGroup, *gotUser)
+		assert.ErrorIs(t, err, ErrInviteUnavailable)
+		gotUser, err = client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotUser.Groups, group.GroupId)
+		gotGroup, err = client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotGroup.Members, user.UserId)
+	})
+
+	t.Run("user banned after the group was read does not use the invite", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		invite := GroupInvite{Token: "test-invite-" + user.UserId, GroupId: group.GroupId}
+		assert.NoError(t, client.StoreInvite(ctx, invite))
+
+		gotUser, _ := client.GetUser(ctx, user.UserId)
+		gotGroup, _ := client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, client.BanUserFromGroup(ctx, *gotGroup, *gotUser))
+		err := client.JoinGroupWithInvite(ctx, invite, *gotGroup, *gotUser)
+		assert.ErrorIs(t, err, ErrUserBanned)
+		stored, err := client.GetInvite(ctx, invite.Token)
+		assert.NoError(t, err)
+		assert.Zero(t, stored.Uses)
+		gotGroup, err = client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotGroup.Members, user.UserId)
+	})
+
+	t.Run("deleted group is removed from its members", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+		gotUser, _ := client.GetUser(ctx, user.UserId)
+		gotGroup, _ := client.GetGroup(ctx, group.GroupId)
+
+		assert.NoError(t, client.DeleteGroup(ctx, *gotGroup))
+		gotUser, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.NotContains(t, gotUser.Groups, group.GroupId)
+		gotGroup, err = client.GetGroup(ctx, group.GroupId)
+		assert.NoError(t, err)
+		assert.Nil(t, gotGroup)
+	})
+
+	t.Run("blocked user is seen right away", func(t *testing.T) {
+		user, group := newTestUser(), newTestGroup()
+		storeAndCache(t, user, group)
+		gotUser, _ := client.GetUser(ctx, user.UserId)
+
+		assert.NoError(t, client.BlockUser(ctx, *gotUser, "test-user-blocked"))
+		gotUser, err := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.True(t, gotUser.BlockedUsers["test-user-blocked"])
+	})
+}
+
+func TestDynamoRecentGroupMessagesCache(t *testing.T) {
+	ctx := context.Background()
+	client := newTestDynamoDBClient(t)
+	user, group := newTestUser(), newTestGroup()
+	assert.NoError(t, client.StoreUser(ctx, user))
+	assert.NoError(t, client.StoreGroup(ctx, group))
+	assert.NoError(t, client.AddUserToGroup(ctx, group, user))
+	member, _ := client.GetUser(ctx, user.UserId)
+	for i := 0; i < 3; i++ {
+		messageId := NewMessageId(time.Now())
+		assert.NoError(t, client.StoreMessage(ctx, Message{RecipientId: group.GroupId, MessageId: messageId, ChangeId: messageId, SenderId: user.UserId, Timestamp: time.Now().Format(time.RFC3339)}))
+	}
+
+	// a limited page of a poll from the start does not fill the cache
+	page, err := client.GetMessages(ctx, *member, MessagesQuery{Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, page.Messages, 1)
+
+	// a poll of the last minute gets all recent messages
+	page, err = client.GetMessages(ctx, *member, MessagesQuery{Timestamp: time.Now().Add(-10 * time.Second).Unix()})
+	assert.NoError(t, err)
+	assert.Len(t, page.Messages, 3)
+}
+
+func TestDynamoConcurrentMembershipChanges(t *testing.T) {
+	testConcurrentMembershipChanges(t, newTestDynamoDBClient(t), 4)
+}
+
+func TestDynamoUserDeletions(t *testing.T) {
+	testUserDeletions(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoUnreadCounts(t *testing.T) {
+	testUnreadCounts(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoGroupUnreadCount(t *testing.T) {
+	testGroupUnreadCount(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoAttachments(t *testing.T) {
+	testAttachments(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoSearchIndex(t *testing.T) {
+	testSearchIndex(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoThreads(t *testing.T) {
+	testThreads(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoReactions(t *testing.T) {
+	testReactions(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoScheduledMessages(t *testing.T) {
+	testScheduledMessages(t, newTestDynamoDBClient(t))
+}
+
+func TestDynamoVersions(t *testing.T) {
+	ctx := context.Background()
+	client := newTestDynamoDBClient(t)
+
+	t.Run("store stale user", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, client.BlockUser(ctx, *stored, "test-user-1"))
+
+		stored.UserName = "test-user"
+		assert.ErrorIs(t, client.StoreUser(ctx, *stored), ErrVersionConflict)
+		stored, _ = client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-1": true}, stored.BlockedUsers)
+		assert.Equal(t, int64(2), stored.Version)
+	})
+
+	t.Run("block with a stale user keeps other blocked users", func(t *testing.T) {
+		user := newTestUser()
+		assert.NoError(t, client.StoreUser(ctx, user))
+		stale, _ := client.GetUser(ctx, user.UserId)
+
+		assert.NoError(t, client.BlockUser(ctx, *stale, "test-user-1"))
+		assert.NoError(t, client.BlockUser(ctx, *stale, "test-user-2"))
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.Equal(t, map[string]bool{"test-user-1": true, "test-user-2": true}, stored.BlockedUsers)
+	})
+
+	t.Run("promote with a stale group keeps other admins", func(t *testing.T) {
+		group := newTestGroup()
+		assert.NoError(t, client.StoreGroup(ctx, group))
+		stale, _ := client.GetGroup(ctx, group.GroupId)
+
+		assert.NoError(t, client.SetGroupAdmin(ctx, *stale, "test-admin-1", true))
+		assert.NoError(t, client.SetGroupAdmin(ctx, *stale, "test-admin-2", true))
+		stored, _ := client.GetGroup(ctx, group.GroupId)
+		assert.Equal(t, map[string]bool{"test-admin-1": true, "test-admin-2": true}, stored.Admins)
+	})
+
+	t.Run("records without a version are updated", func(t *testing.T) {
+		user := newTestUser()
+		item, err := attributevalue.MarshalMap(user)
+		assert.NoError(t, err)
+		delete(item, VersionAttribute)
+		_, err = client.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(UsersTableName), Item: item})
+		assert.NoError(t, err)
+
+		stored, _ := client.GetUser(ctx, user.UserId)
+		assert.NoError(t, client.BlockUser(ctx, *stored, "test-user-1"))
+		stored, _ = client.GetUser(ctx, user.UserId)
+		assert.Equal(t, int64(1), stored.Version)
+	})
+}
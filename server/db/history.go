@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "server/common"
+)
+
+// HistoryQuery selects the messages of one conversation returned by GetConversationMessages.
+type HistoryQuery struct {
+	// Type is ConversationPrivate or ConversationGroup.
+	Type string
+	// ConversationId is the PrivateConversationKey of private conversations and the group ID of group conversations.
+	ConversationId string
+	// Before and After are exclusive message ID bounds, either can be empty.
+	// Without After the latest messages before Before are returned, otherwise the first messages after After.
+	Before string
+	After  string
+	// Limit is the maximal number of messages to return, it must be positive.
+	Limit int
+}
+
+// HistoryPage is a single page of conversation messages ordered by message ID.
+type HistoryPage struct {
+	Messages []Message
+	// HasMore is true if there are more messages in the direction of the query,
+	// older than the first message when paging back, newer than the last message when paging forward.
+	HasMore bool
+}
+
+// forward returns true if the messages are fetched from After onwards, otherwise back from Before.
+func (q HistoryQuery) forward() bool {
+	return q.After != ""
+}
+
+// includes returns true if the message ID is within the query bounds.
+func (q HistoryQuery) includes(messageId string) bool {
+	return messageId > q.After && (q.Before == "" || messageId < q.Before)
+}
+
+// newHistoryPage creates a page from up to Limit+1 messages fetched in the query direction.
+func newHistoryPage(query HistoryQuery, messages []Message) *HistoryPage {
+	page := &HistoryPage{Messages: messages}
+	if len(messages) > query.Limit {
+		page.Messages = messages[:query.Limit]
+		page.HasMore = true
+	}
+	if !query.forward() {
+		// fetched newest first
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	return page
+}
+
+func (d *dynamoDBClient) GetConversationMessages(ctx context.Context, query HistoryQuery) (*HistoryPage, error) {
+	names := map[string]string{"#messageId": MessageIdSortKey}
+	values := map[string]types.AttributeValue{
+		":conversationId": &types.AttributeValueMemberS{Value: query.ConversationId},
+	}
+	input := &dynamodb.QueryInput{
+		TableName:        aws.String(MessagesTableName),
+		ScanIndexForward: aws.Bool(query.forward()),
+	}
+	// group messages are stored under the group ID, private messages of both directions are found by the conversation index
+	if query.Type == ConversationGroup {
+		names["#conversationId"] = RecipientIdKey
+	} else {
+		names["#conversationId"] = ConversationKey
+		input.IndexName = aws.String(ConversationIndex)
+	}
+
+	keyCondition := "#conversationId = :conversationId"
+	switch {
+	case query.After != "" && query.Before != "":
+		// BETWEEN includes the bounds, they are filtered out below
+		keyCondition += " AND #messageId BETWEEN :after AND :before"
+		values[":after"] = &types.AttributeValueMemberS{Value: query.After}
+		values[":before"] = &types.AttributeValueMemberS{Value: query.Before}
+	case query.After != "":
+		keyCondition += " AND #messageId > :after"
+		values[":after"] = &types.AttributeValueMemberS{Value: query.After}
+	case query.Before != "":
+		keyCondition += " AND #messageId < :before"
+		values[":before"] = &types.AttributeValueMemberS{Value: query.Before}
+	}
+	input.KeyConditionExpression = aws.String(keyCondition)
+	input.ExpressionAttributeNames = names
+	input.ExpressionAttributeValues = values
+
+	var messages []Message
+	for len(messages) <= query.Limit {
+		// fetch one more than the page size, so that we know if there are more messages
+		input.Limit = aws.Int32(int32(query.Limit + 1 - len(messages)))
+		results, err := d.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Items {
+			var message Message
+			err = attributevalue.UnmarshalMap(item, &message)
+			if err != nil {
+				return nil, err
+			}
+			if query.includes(message.MessageId) {
+				messages = append(messages, message)
+			}
+		}
+		if len(results.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = results.LastEvaluatedKey
+	}
+	return newHistoryPage(query, messages), nil
+}
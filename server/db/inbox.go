@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "server/common"
+	"time"
+)
+
+// maxBatchWriteItems is the maximal number of items of a DynamoDB BatchWriteItem request.
+const maxBatchWriteItems = 25
+
+// toInbox returns the copy of a group message stored in the inbox of the user.
+// The inbox is the user partition of the messages table, so that a poll of private and inbox messages is a single query.
+func toInbox(message Message, userId string) Message {
+	message.InboxGroupId = message.RecipientId
+	message.RecipientId = userId
+	message.ConversationKey = ""
+	message.ThreadKey = ""
+	return message
+}
+
+// toSenderInbox returns the copy of a private message stored in the inbox of its sender.
+func toSenderInbox(message Message) Message {
+	message.InboxPeerId = message.RecipientId
+	message.RecipientId = message.SenderId
+	message.ConversationKey = ""
+	message.ThreadKey = ""
+	return message
+}
+
+// fromInbox returns the inbox copies of the page as the group and private messages they were copied from.
+// Copies of groups the user is not a member of anymore are dropped, as their messages are not returned after leaving,
+// and a message returned both from the inbox and from its group, while the group switched delivery, is returned once.
+// The page cursor is left as is, since it tracks the position in the user partition the copies were read from.
+func fromInbox(user User, page *MessagesPage) *MessagesPage {
+	messages := make([]Message, 0, len(page.Messages))
+	seen := make(map[string]int, len(page.Messages))
+	for _, msg := range page.Messages {
+		if msg.InboxGroupId != "" {
+			if !user.Groups[msg.InboxGroupId] {
+				continue
+			}
+			msg.RecipientId = msg.InboxGroupId
+			msg.InboxGroupId = ""
+		}
+		if msg.InboxPeerId != "" {
+			msg.RecipientId = msg.InboxPeerId
+			msg.InboxPeerId = ""
+		}
+		key := msg.RecipientId + "/" + msg.MessageId
+		if i, ok := seen[key]; ok {
+			// keep the latest change of the message
+			if msg.ChangeId > messages[i].ChangeId {
+				messages[i] = msg
+			}
+			continue
+		}
+		seen[key] = len(messages)
+		messages = append(messages, msg)
+	}
+	page.Messages = messages
+	return page
+}
+
+func (d *dynamoDBClient) SetGroupFanOutOnRead(ctx context.Context, group Group, inboxUntil string) error {
+	return d.updateGroup(ctx, group, func(group *Group) {
+		group.FanOutOnWrite = false
+		group.InboxUntil = inboxUntil
+	})
+}
+
+func (d *dynamoDBClient) StoreInboxMessages(ctx context.Context, message Message, userIds []string) error {
+	requests := make([]types.WriteRequest, 0, len(userIds))
+	for _, userId := range userIds {
+		av, err := attributevalue.MarshalMap(toInbox(message, userId))
+		if err != nil {
+			return err
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: av}})
+	}
+
+	return d.batchWrite(ctx, MessagesTableName, requests)
+}
+
+func (d *dynamoDBClient) StoreSenderInboxMessage(ctx context.Context, message Message) error {
+	return d.StoreMessage(ctx, toSenderInbox(message))
+}
+
+// batchWrite writes the requests to the table in batches of up to maxBatchWriteItems.
+func (d *dynamoDBClient) batchWrite(ctx context.Context, tableName string, requests []types.WriteRequest) error {
+	for len(requests) > 0 {
+		batch := requests
+		if len(batch) > maxBatchWriteItems {
+			batch = batch[:maxBatchWriteItems]
+		}
+		requests = requests[len(batch):]
+
+		result, err := d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{tableName: batch},
+		})
+		if err != nil {
+			return err
+		}
+		// throttled items are returned unprocessed, write them again with the next batch
+		requests = append(requests, result.UnprocessedItems[tableName]...)
+		if len(result.UnprocessedItems[tableName]) == len(batch) {
+			// nothing was written, back off before retrying
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"testing"
+	"time"
+)
+
+func TestBoltInbox(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBoltDBClient(t)
+
+	user := newTestUser()
+	inboxGroup := newTestGroup()
+	readGroup := newTestGroup()
+	user.Groups[inboxGroup.GroupId] = true
+	user.Groups[readGroup.GroupId] = true
+	hourAgo := time.Now().Add(-time.Hour)
+
+	private := newTestMessage(user.UserId, hourAgo, "private")
+	toInboxGroup := newTestMessage(inboxGroup.GroupId, hourAgo, "inbox")
+	toReadGroup := newTestMessage(readGroup.GroupId, hourAgo, "read")
+	for _, msg := range []Message{private, toInboxGroup, toReadGroup} {
+		assert.NoError(t, client.StoreMessage(ctx, msg))
+	}
+	assert.NoError(t, client.StoreInboxMessages(ctx, toInboxGroup, []string{user.UserId, "test-user-other"}))
+	query := MessagesQuery{InboxGroups: map[string]string{inboxGroup.GroupId: ""}}
+
+	t.Run("inbox copies are returned as group messages", func(t *testing.T) {
+		page, err := client.GetMessages(ctx, user, query)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{private, toInboxGroup, toReadGroup}, page.Messages)
+	})
+
+	t.Run("cursor tracks the inbox", func(t *testing.T) {
+		page, err := client.GetMessages(ctx, user, MessagesQuery{Limit: 2, InboxGroups: query.InboxGroups})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{private, toInboxGroup}, page.Messages)
+		assert.Equal(t, map[string]string{user.UserId: toInboxGroup.ChangeId}, page.Cursor)
+	})
+
+	t.Run("edited copy replaces the earlier copy", func(t *testing.T) {
+		edited := toInboxGroup
+		edited.Message = "edited"
+		edited.ChangeId = NewMessageId(time.Now())
+		assert.NoError(t, client.UpdateMessage(ctx, edited))
+		assert.NoError(t, client.StoreInboxMessages(ctx, edited, []string{user.UserId}))
+
+		page, err := client.GetMessages(ctx, user, MessagesQuery{Timestamp: hourAgo.Unix(), InboxGroups: query.InboxGroups})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{edited}, page.Messages)
+	})
+
+	t.Run("switched group is read after the switch", func(t *testing.T) {
+		inboxUntil := NewMessageId(time.Now())
+		later := newTestMessage(inboxGroup.GroupId, time.Now(), "later")
+		assert.NoError(t, client.StoreMessage(ctx, later))
+
+		page, err := client.GetMessages(ctx, user, MessagesQuery{Timestamp: hourAgo.Unix(), InboxGroups: map[string]string{inboxGroup.GroupId: inboxUntil}})
+		assert.NoError(t, err)
+		assert.Len(t, page.Messages, 2)
+		assert.Equal(t, later, page.Messages[1])
+	})
+
+	t.Run("group messages are not counted as private unread messages", func(t *testing.T) {
+		// moving the read marker counts the messages after it again
+		read := Conversation{UserId: user.UserId, ConversationId: toInboxGroup.SenderId, Type: ConversationPrivate, LastReadMessageId: MessageIdAfter(0)}
+		assert.NoError(t, client.SetReadMarker(ctx, read))
+		conversation, err := client.GetConversation(ctx, user.UserId, toInboxGroup.SenderId)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, conversation.UnreadCount)
+	})
+}
+
+// benchmarkGetMessages polls the messages of a user in the given number of groups, each with a few messages.
+// The user is polled with the groups fanned out on read, each group is queried, or on write, a single inbox query.
+func benchmarkGetMessages(b *testing.B, groups int, fanOutOnWrite bool) {
+	ctx := context.Background()
+	client, err := NewBoltDBClient(fmt.Sprintf("%s/bench.db", b.TempDir()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.(*boltDBClient).Close()
+
+	user := newTestUser()
+	query := MessagesQuery{Limit: 100, InboxGroups: map[string]string{}}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < groups; i++ {
+		group := newTestGroup()
+		user.Groups[group.GroupId] = true
+		if fanOutOnWrite {
+			query.InboxGroups[group.GroupId] = ""
+		}
+		for j := 0; j < 5; j++ {
+			msg := newTestMessage(group.GroupId, start, fmt.Sprintf("message %d", j))
+			client.StoreMessage(ctx, msg)
+			if fanOutOnWrite {
+				client.StoreInboxMessages(ctx, msg, []string{user.UserId})
+			}
+		}
+	}
+
+	queries := 1
+	if !fanOutOnWrite {
+		queries += groups
+	}
+	b.ReportMetric(float64(queries), "queries/op")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.GetMessages(ctx, user, query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Run with: go test ./db -run '^$' -bench GetMessages
+// The bolt queries are local, against DynamoDB every query is a round trip, so queries/op dominates the poll latency.
+func BenchmarkGetMessagesFanOutOnRead(b *testing.B) {
+	for _, groups := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("groups=%d", groups), func(b *testing.B) { benchmarkGetMessages(b, groups, false) })
+	}
+}
+
+func BenchmarkGetMessagesFanOutOnWrite(b *testing.B) {
+	for _, groups := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("groups=%d", groups), func(b *testing.B) { benchmarkGetMessages(b, groups, true) })
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "server/common"
+	"strconv"
+	"time"
+)
+
+// ErrInviteUnavailable is returned when joining with an invite that was revoked, expired or used up.
+var ErrInviteUnavailable = errors.New("invite is not available")
+
+// ErrUserBanned is returned when a user banned from the group joins with an invite, the use is not counted.
+var ErrUserBanned = errors.New("user is banned from the group")
+
+func (d *dynamoDBClient) StoreInvite(ctx context.Context, invite GroupInvite) error {
+	av, err := attributevalue.MarshalMap(invite)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(InvitesTableName),
+		Item:      av,
+	})
+	return err
+}
+
+func (d *dynamoDBClient) GetInvite(ctx context.Context, token string) (*GroupInvite, error) {
+	id, err := attributevalue.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(InvitesTableName),
+		Key:       map[string]types.AttributeValue{InvitePrimaryKey: id},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, no invite with the provided token exists
+	if result.Item == nil {
+		return nil, nil
+	}
+	var invite GroupInvite
+	err = attributevalue.UnmarshalMap(result.Item, &invite)
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (d *dynamoDBClient) GetGroupInvites(ctx context.Context, groupId string) ([]GroupInvite, error) {
+	id, err := attributevalue.Marshal(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	var invites []GroupInvite
+	var startKey map[string]types.AttributeValue
+	for {
+		results, err := d.client.Query(ctx, &dynamodb.QueryInput{
+			TableName: aws.String(InvitesTableName),
+			IndexName: aws.String(InviteGroupIndex),
+			KeyConditions: map[string]types.Condition{
+				GroupPrimaryKey: {
+					ComparisonOperator: types.ComparisonOperatorEq,
+					AttributeValueList: []types.AttributeValue{id},
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Items {
+			var invite GroupInvite
+			err = attributevalue.UnmarshalMap(item, &invite)
+			if err != nil {
+				return nil, err
+			}
+			invites = append(invites, invite)
+		}
+		startKey = results.LastEvaluatedKey
+		if len(startKey) == 0 {
+			return invites, nil
+		}
+	}
+}
+
+func (d *dynamoDBClient) DeleteInvite(ctx context.Context, token string) error {
+	id, err := attributevalue.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(InvitesTableName),
+		Key:       map[string]types.AttributeValue{InvitePrimaryKey: id},
+	})
+	return err
+}
+
+func (d *dynamoDBClient) JoinGroupWithInvite(ctx context.Context, invite GroupInvite, group Group, user User) error {
+	id, err := attributevalue.Marshal(invite.Token)
+	if err != nil {
+		return err
+	}
+	// count the use only if the invite still exists, is not expired and has uses left,
+	// so that concurrent joins can not use the invite more times than allowed
+	inviteUpdate := types.TransactWriteItem{
+		Update: &types.Update{
+			TableName:           aws.String(InvitesTableName),
+			Key:                 map[string]types.AttributeValue{InvitePrimaryKey: id},
+			UpdateExpression:    aws.String("SET #uses = #uses + :one"),
+			ConditionExpression: aws.String("attribute_exists(#token) AND (#maxUses = :zero OR #uses < #maxUses) AND (attribute_not_exists(#expiresAt) OR #expiresAt > :now)"),
+			ExpressionAttributeNames: map[string]string{
+				"#token":     InvitePrimaryKey,
+				"#uses":      "Uses",
+				"#maxUses":   "MaxUses",
+				"#expiresAt": "ExpiresAt",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":one":  &types.AttributeValueMemberN{Value: "1"},
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+				":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			},
+		},
+	}
+
+	// update in one transaction, after the user and the group
+	err = d.updateMembership(ctx, group, user, joinMember, inviteUpdate)
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		// the invite update is the last item of the transaction
+		reasons := canceled.CancellationReasons
+		if len(reasons) == 3 && aws.ToString(reasons[2].Code) == "ConditionalCheckFailed" {
+			return ErrInviteUnavailable
+		}
+	}
+	return err
+}
@@ -2,7 +2,10 @@ package db
 
 import (
 	"context"
+	"fmt"
 	. "server/common"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -10,7 +13,19 @@ type MockDBClient struct {
 	Users    map[string]User
 	Groups   map[string]Group
 	Messages map[string][]Message
-	Error    error
+	Invites  map[string]GroupInvite
+	// Conversations maps a user ID to the user conversations by conversation ID
+	Conversations map[string]map[string]Conversation
+	UserDeletions map[string]UserDeletion
+	Attachments   map[string]Attachment
+	// Reactions maps a message key to the added reactions by reaction key, see reactionKeys
+	Reactions map[string]map[string]bool
+	// Scheduled maps a sender ID to the scheduled messages of the sender by schedule ID
+	Scheduled map[string]map[string]ScheduledMessage
+	Error     error
+	// RecipientErrors fails the message queries of single recipients, for partial GetMessages results
+	RecipientErrors map[string]error
+	mu              sync.Mutex // allows handlers under test to use the mock concurrently
 }
 
 func NewMockDBClient() *MockDBClient {
@@ -18,10 +33,19 @@ func NewMockDBClient() *MockDBClient {
 		Users:    map[string]User{},
 		Groups:   map[string]Group{},
 		Messages: map[string][]Message{},
+		Invites:  map[string]GroupInvite{},
+
+		Conversations: map[string]map[string]Conversation{},
+		UserDeletions: map[string]UserDeletion{},
+		Attachments:   map[string]Attachment{},
+		Reactions:     map[string]map[string]bool{},
+		Scheduled:     map[string]map[string]ScheduledMessage{},
 	}
 }
 
 func (m *MockDBClient) StoreUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
@@ -32,6 +56,8 @@ func (m *MockDBClient) StoreUser(ctx context.Context, user User) error {
 }
 
 func (m *MockDBClient) BlockUser(ctx context.Context, user User, blockedUserId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
@@ -40,6 +66,8 @@ func (m *MockDBClient) BlockUser(ctx context.Context, user User, blockedUserId s
 }
 
 func (m *MockDBClient) UnBlockUser(ctx context.Context, user User, unBlockedUserId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
@@ -47,7 +75,46 @@ func (m *MockDBClient) UnBlockUser(ctx context.Context, user User, unBlockedUser
 	return nil
 }
 
+func (m *MockDBClient) MuteConversation(ctx context.Context, user User, conversationId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Users[user.UserId]
+	if stored.Muted == nil {
+		stored.Muted = map[string]bool{}
+	}
+	stored.Muted[conversationId] = true
+	m.Users[user.UserId] = stored
+	return nil
+}
+
+func (m *MockDBClient) UnmuteConversation(ctx context.Context, user User, conversationId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Users[user.UserId].Muted, conversationId)
+	return nil
+}
+
+func (m *MockDBClient) SetBlockedGroupMessages(ctx context.Context, user User, setting string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Users[user.UserId]
+	stored.BlockedGroupMessages = setting
+	m.Users[user.UserId] = stored
+	return nil
+}
+
 func (m *MockDBClient) GetUser(ctx context.Context, userId string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return nil, m.Error
 	}
@@ -56,15 +123,88 @@ func (m *MockDBClient) GetUser(ctx context.Context, userId string) (*User, error
 	}
 	return nil, nil
 }
+func (m *MockDBClient) DeleteUser(ctx context.Context, userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Users, userId)
+	return nil
+}
+func (m *MockDBClient) GetBlockingUsers(ctx context.Context, userId string, cursor string) ([]string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, "", m.Error
+	}
+	// a single page
+	var userIds []string
+	for _, user := range m.Users {
+		if user.BlockedUsers[userId] {
+			userIds = append(userIds, user.UserId)
+		}
+	}
+	sort.Strings(userIds)
+	return userIds, "", nil
+}
+func (m *MockDBClient) StoreUserDeletion(ctx context.Context, deletion UserDeletion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	m.UserDeletions[deletion.UserId] = deletion
+	return nil
+}
+func (m *MockDBClient) GetUserDeletion(ctx context.Context, userId string) (*UserDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	if deletion, ok := m.UserDeletions[userId]; ok {
+		return &deletion, nil
+	}
+	return nil, nil
+}
+func (m *MockDBClient) GetUserDeletions(ctx context.Context) ([]UserDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var deletions []UserDeletion
+	for _, deletion := range m.UserDeletions {
+		deletions = append(deletions, deletion)
+	}
+	return deletions, nil
+}
+func (m *MockDBClient) DeleteUserDeletion(ctx context.Context, userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.UserDeletions, userId)
+	return nil
+}
 func (m *MockDBClient) StoreGroup(ctx context.Context, group Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
 	group.Members = map[string]bool{}
+	if group.Admins == nil {
+		group.Admins = map[string]bool{}
+	}
 	m.Groups[group.GroupId] = group
 	return nil
 }
 func (m *MockDBClient) GetGroup(ctx context.Context, groupId string) (*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return nil, m.Error
 	}
@@ -74,6 +214,8 @@ func (m *MockDBClient) GetGroup(ctx context.Context, groupId string) (*Group, er
 	return nil, nil
 }
 func (m *MockDBClient) AddUserToGroup(ctx context.Context, group Group, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
@@ -82,43 +224,683 @@ func (m *MockDBClient) AddUserToGroup(ctx context.Context, group Group, user Use
 	return nil
 }
 func (m *MockDBClient) RemoveUserFromGroup(ctx context.Context, group Group, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
 	delete(m.Groups[group.GroupId].Members, user.UserId)
+	delete(m.Groups[group.GroupId].Admins, user.UserId)
+	delete(m.Users[user.UserId].Groups, group.GroupId)
+	return nil
+}
+func (m *MockDBClient) BanUserFromGroup(ctx context.Context, group Group, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Groups[group.GroupId]
+	delete(stored.Members, user.UserId)
+	delete(stored.Admins, user.UserId)
+	if stored.Banned == nil {
+		stored.Banned = map[string]bool{}
+	}
+	stored.Banned[user.UserId] = true
+	m.Groups[group.GroupId] = stored
 	delete(m.Users[user.UserId].Groups, group.GroupId)
 	return nil
 }
+func (m *MockDBClient) UnbanUserFromGroup(ctx context.Context, group Group, userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Groups[group.GroupId].Banned, userId)
+	return nil
+}
+func (m *MockDBClient) SetGroupAdmin(ctx context.Context, group Group, userId string, admin bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	if admin {
+		m.Groups[group.GroupId].Admins[userId] = true
+	} else {
+		delete(m.Groups[group.GroupId].Admins, userId)
+	}
+	return nil
+}
+func (m *MockDBClient) SetGroupOwner(ctx context.Context, group Group, ownerId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Groups[group.GroupId]
+	if stored.OwnerId == "" {
+		stored.OwnerId = ownerId
+		m.Groups[group.GroupId] = stored
+	}
+	return nil
+}
+func (m *MockDBClient) DeleteGroup(ctx context.Context, group Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	for userId := range m.Groups[group.GroupId].Members {
+		if user, ok := m.Users[userId]; ok {
+			delete(user.Groups, group.GroupId)
+		}
+	}
+	delete(m.Groups, group.GroupId)
+	return nil
+}
+func (m *MockDBClient) RemoveDeletedUserFromGroup(ctx context.Context, group Group, userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Groups[group.GroupId]
+	removeDeletedMember(&stored, userId)
+	m.Groups[group.GroupId] = stored
+	return nil
+}
+func (m *MockDBClient) StoreInvite(ctx context.Context, invite GroupInvite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	m.Invites[invite.Token] = invite
+	return nil
+}
+
+// GetSearchPostings indexes the stored messages on every query, the index is always up to date.
+func (m *MockDBClient) GetSearchPostings(ctx context.Context, query SearchQuery) ([]SearchPosting, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	keys := make(map[SearchKey]bool)
+	for _, key := range query.keys() {
+		keys[key] = true
+	}
+	byKey := make(map[SearchKey][]SearchPosting)
+	for _, messages := range m.Messages {
+		for _, msg := range messages {
+			if !query.includes(msg.MessageId) {
+				continue
+			}
+			for key, posting := range SearchPostings(msg) {
+				if keys[key] {
+					byKey[key] = append(byKey[key], posting)
+				}
+			}
+		}
+	}
+	var postings []SearchPosting
+	for _, keyPostings := range byKey {
+		sort.Slice(keyPostings, func(i, j int) bool {
+			return keyPostings[i].MessageId > keyPostings[j].MessageId
+		})
+		if query.Limit > 0 && len(keyPostings) > query.Limit {
+			keyPostings = keyPostings[:query.Limit]
+		}
+		postings = append(postings, keyPostings...)
+	}
+	return postings, nil
+}
+
+func (m *MockDBClient) StoreAttachment(ctx context.Context, attachment Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	m.Attachments[attachment.AttachmentId] = attachment
+	return nil
+}
+func (m *MockDBClient) GetAttachment(ctx context.Context, attachmentId string) (*Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	if attachment, ok := m.Attachments[attachmentId]; ok {
+		return &attachment, nil
+	}
+	return nil, nil
+}
+func (m *MockDBClient) SendAttachment(ctx context.Context, attachmentId string, recipientId string, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	attachment, ok := m.Attachments[attachmentId]
+	if !ok {
+		return fmt.Errorf("attachment %s not found", attachmentId)
+	}
+	if attachment.MessageId != "" {
+		return ErrAttachmentSent
+	}
+	attachment.RecipientId = recipientId
+	attachment.MessageId = messageId
+	m.Attachments[attachmentId] = attachment
+	return nil
+}
+
+func (m *MockDBClient) ReleaseAttachment(ctx context.Context, attachmentId string, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	attachment, ok := m.Attachments[attachmentId]
+	if !ok || attachment.MessageId != messageId {
+		return nil
+	}
+	attachment.RecipientId = ""
+	attachment.MessageId = ""
+	m.Attachments[attachmentId] = attachment
+	return nil
+}
+
+func (m *MockDBClient) StoreScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	if m.Scheduled[scheduled.SenderId] == nil {
+		m.Scheduled[scheduled.SenderId] = map[string]ScheduledMessage{}
+	}
+	m.Scheduled[scheduled.SenderId][scheduled.ScheduleId] = scheduled
+	return nil
+}
+func (m *MockDBClient) GetScheduledMessage(ctx context.Context, senderId string, scheduleId string) (*ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	if scheduled, ok := m.Scheduled[senderId][scheduleId]; ok {
+		return &scheduled, nil
+	}
+	return nil, nil
+}
+func (m *MockDBClient) GetScheduledMessages(ctx context.Context, senderId string) ([]ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var scheduled []ScheduledMessage
+	for _, s := range m.Scheduled[senderId] {
+		scheduled = append(scheduled, s)
+	}
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].ScheduleId < scheduled[j].ScheduleId })
+	return scheduled, nil
+}
+func (m *MockDBClient) GetDueScheduledMessages(ctx context.Context, now string, limit int) ([]ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var due []ScheduledMessage
+	for _, scheduled := range m.Scheduled {
+		for _, s := range scheduled {
+			if s.Status == ScheduledPending && s.SendAt <= now {
+				due = append(due, s)
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].SendAt < due[j].SendAt })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+func (m *MockDBClient) ClaimScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string, claimedUntil string, messageId string) (*ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	stored, ok := m.Scheduled[scheduled.SenderId][scheduled.ScheduleId]
+	if !ok || stored.Status != ScheduledPending || stored.Claimed(now) {
+		return nil, ErrScheduleUnavailable
+	}
+	stored.ClaimedUntil = claimedUntil
+	if stored.MessageId == "" {
+		stored.MessageId = messageId
+	}
+	m.Scheduled[scheduled.SenderId][scheduled.ScheduleId] = stored
+	return &stored, nil
+}
+func (m *MockDBClient) ReleaseScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	return m.endClaim(scheduled, func(stored *ScheduledMessage) {
+		stored.ClaimedUntil = ""
+	})
+}
+func (m *MockDBClient) FailScheduledMessage(ctx context.Context, scheduled ScheduledMessage, reason string) error {
+	return m.endClaim(scheduled, func(stored *ScheduledMessage) {
+		stored.ClaimedUntil = ""
+		stored.Status = ScheduledFailed
+		stored.Error = reason
+	})
+}
+func (m *MockDBClient) endClaim(scheduled ScheduledMessage, update func(stored *ScheduledMessage)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored, ok := m.Scheduled[scheduled.SenderId][scheduled.ScheduleId]
+	if ok && stored.ClaimedUntil == scheduled.ClaimedUntil {
+		update(&stored)
+		m.Scheduled[scheduled.SenderId][scheduled.ScheduleId] = stored
+	}
+	return nil
+}
+func (m *MockDBClient) CancelScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored, ok := m.Scheduled[scheduled.SenderId][scheduled.ScheduleId]
+	if !ok || stored.Claimed(now) {
+		return ErrScheduleUnavailable
+	}
+	delete(m.Scheduled[scheduled.SenderId], scheduled.ScheduleId)
+	return nil
+}
+func (m *MockDBClient) DeleteScheduledMessage(ctx context.Context, senderId string, scheduleId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Scheduled[senderId], scheduleId)
+	return nil
+}
+func (m *MockDBClient) GetInvite(ctx context.Context, token string) (*GroupInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	if invite, ok := m.Invites[token]; ok {
+		return &invite, nil
+	}
+	return nil, nil
+}
+func (m *MockDBClient) GetGroupInvites(ctx context.Context, groupId string) ([]GroupInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var invites []GroupInvite
+	for _, invite := range m.Invites {
+		if invite.GroupId == groupId {
+			invites = append(invites, invite)
+		}
+	}
+	return invites, nil
+}
+func (m *MockDBClient) DeleteInvite(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Invites, token)
+	return nil
+}
+func (m *MockDBClient) JoinGroupWithInvite(ctx context.Context, invite GroupInvite, group Group, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored, ok := m.Invites[invite.Token]
+	if !ok || stored.Expired(time.Now()) || stored.UsedUp() {
+		return ErrInviteUnavailable
+	}
+	if m.Groups[group.GroupId].Banned[user.UserId] {
+		return ErrUserBanned
+	}
+	stored.Uses++
+	m.Invites[invite.Token] = stored
+	m.Groups[group.GroupId].Members[user.UserId] = true
+	m.Users[user.UserId].Groups[group.GroupId] = true
+	return nil
+}
 func (m *MockDBClient) StoreMessage(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return m.Error
 	}
 	m.Messages[msg.RecipientId] = append(m.Messages[msg.RecipientId], msg)
+	m.updateUnreadCount(msg, unreadDelta(nil, msg))
 	return nil
 }
-func (m *MockDBClient) GetMessages(ctx context.Context, user User, timestamp int64) ([]Message, error) {
+func (m *MockDBClient) GetMessage(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	for _, msg := range m.Messages[recipientId] {
+		if msg.MessageId == messageId {
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+func (m *MockDBClient) GetMessageConsistent(ctx context.Context, recipientId string, messageId string) (*Message, error) {
+	return m.GetMessage(ctx, recipientId, messageId)
+}
+func (m *MockDBClient) UpdateMessage(ctx context.Context, message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	for i, msg := range m.Messages[message.RecipientId] {
+		if msg.MessageId == message.MessageId {
+			message.ReplyCount, message.Reactions = msg.ReplyCount, msg.Reactions
+			m.Messages[message.RecipientId][i] = message
+			m.updateUnreadCount(message, unreadDelta(&msg, message))
+			return nil
+		}
+	}
+	return fmt.Errorf("message %s not found", message.MessageId)
+}
+func (m *MockDBClient) UpdateReplyCount(ctx context.Context, recipientId string, messageId string, delta int, changeId string) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	for i, msg := range m.Messages[recipientId] {
+		if msg.MessageId == messageId {
+			msg.ReplyCount += delta
+			msg.ChangeId = changeId
+			m.Messages[recipientId][i] = msg
+			return &msg, nil
+		}
+	}
+	return nil, fmt.Errorf("message %s not found", messageId)
+}
+func (m *MockDBClient) AddReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	return m.updateReactions(reaction, 1, changeId)
+}
+func (m *MockDBClient) RemoveReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	return m.updateReactions(reaction, -1, changeId)
+}
+func (m *MockDBClient) updateReactions(reaction Reaction, delta int, changeId string) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	messageKey, reactionKey := reactionKeys(reaction)
+	exists := m.Reactions[messageKey][reactionKey]
+	if delta > 0 && exists {
+		return nil, ErrReactionExists
+	}
+	if delta < 0 && !exists {
+		return nil, ErrReactionNotFound
+	}
+	for i, msg := range m.Messages[reaction.RecipientId] {
+		if msg.MessageId == reaction.MessageId {
+			if m.Reactions[messageKey] == nil {
+				m.Reactions[messageKey] = map[string]bool{}
+			}
+			m.Reactions[messageKey][reactionKey] = delta > 0
+			msg.Reactions = countReaction(msg, reaction.Emoji, delta)
+			msg.ChangeId = changeId
+			m.Messages[reaction.RecipientId][i] = msg
+			return &msg, nil
+		}
+	}
+	return nil, fmt.Errorf("message %s not found", reaction.MessageId)
+}
+func (m *MockDBClient) GetThreadMessages(ctx context.Context, query ThreadQuery) (*HistoryPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var messages []Message
+	for _, recipientMessages := range m.Messages {
+		for _, msg := range recipientMessages {
+			if msg.ThreadKey == query.ThreadId && msg.ThreadKey != "" && msg.MessageId > query.After {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].MessageId < messages[j].MessageId
+	})
+	if len(messages) > query.Limit+1 {
+		messages = messages[:query.Limit+1]
+	}
+	return query.newPage(messages), nil
+}
+func (m *MockDBClient) GetMessages(ctx context.Context, user User, query MessagesQuery) (*MessagesPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.Error != nil {
 		return nil, m.Error
 	}
 
-	var msgs []Message
-	msgs = append(m.Messages[user.UserId], msgs...)
-	for groupId, _ := range user.Groups {
-		msgs = append(m.Messages[groupId], msgs...)
+	recipientIds := append(query.groupIds(user), user.UserId)
+	msgs, failed, err := queryRecipients(ctx, recipientIds, func(ctx context.Context, recipientId string) ([]Message, error) {
+		if err := m.RecipientErrors[recipientId]; err != nil {
+			return nil, err
+		}
+		recipientMsgs := append([]Message{}, m.Messages[recipientId]...)
+		sortMessages(recipientMsgs)
+		// return Messages changed after the timestamp and cursor position
+		return filterMessagesAfter(recipientMsgs, query.after(recipientId), query.fetchLimit()), nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// if timestamp is provided, return Messages after the timestamp
-	if timestamp > 0 {
-		var newMsgs []Message
-		for _, msg := range msgs {
-			// timestamp to RFC3339
-			fromTimestamp := time.Unix(timestamp, 0).Format(time.RFC3339)
-			if msg.Timestamp > fromTimestamp {
-				newMsgs = append(newMsgs, msg)
+	page := newMessagesPage(query, msgs)
+	page.Failed = failed
+	return fromInbox(user, page), nil
+}
+
+func (m *MockDBClient) updateConversation(userId string, conversationId string, update func(conversation *Conversation)) {
+	if m.Conversations[userId] == nil {
+		m.Conversations[userId] = map[string]Conversation{}
+	}
+	conversation, ok := m.Conversations[userId][conversationId]
+	if !ok {
+		conversation = Conversation{UserId: userId, ConversationId: conversationId}
+	}
+	update(&conversation)
+	m.Conversations[userId][conversationId] = conversation
+}
+func (m *MockDBClient) UpdateConversations(ctx context.Context, message Message, conversationType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	for userId, conversationId := range conversationUserIds(message, conversationType) {
+		m.updateConversation(userId, conversationId, func(conversation *Conversation) {
+			setLastMessage(conversation, message, conversationType)
+		})
+	}
+	return nil
+}
+func (m *MockDBClient) GetConversation(ctx context.Context, userId string, conversationId string) (*Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	if conversation, ok := m.Conversations[userId][conversationId]; ok {
+		return &conversation, nil
+	}
+	return nil, nil
+}
+func (m *MockDBClient) GetConversations(ctx context.Context, userId string) ([]Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var conversations []Conversation
+	for _, conversation := range m.Conversations[userId] {
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+func (m *MockDBClient) DeleteConversation(ctx context.Context, userId string, conversationId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	delete(m.Conversations[userId], conversationId)
+	return nil
+}
+func (m *MockDBClient) SetReadMarker(ctx context.Context, conversation Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	m.updateConversation(conversation.UserId, conversation.ConversationId, func(stored *Conversation) {
+		stored.Type = conversation.Type
+		if conversation.LastReadMessageId > stored.LastReadMessageId {
+			stored.LastReadMessageId = conversation.LastReadMessageId
+			stored.ReadAt = conversation.ReadAt
+			if stored.Type != ConversationGroup {
+				stored.UnreadCount = m.countUnread(*stored, 0)
 			}
 		}
-		msgs = newMsgs
+	})
+	return nil
+}
+func (m *MockDBClient) CountUnreadMessages(ctx context.Context, conversation Conversation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return 0, m.Error
 	}
-
-	return msgs, nil
+	if conversation.Type != ConversationGroup {
+		return conversation.UnreadCount, nil
+	}
+	return m.countUnread(conversation, MaxUnreadCount), nil
+}
+func (m *MockDBClient) countUnread(conversation Conversation, limit int) int {
+	count := 0
+	for _, msg := range m.Messages[unreadRecipientId(conversation)] {
+		if isUnread(conversation, msg) && (limit == 0 || count < limit) {
+			count++
+		}
+	}
+	return count
+}
+func (m *MockDBClient) updateUnreadCount(message Message, delta int) {
+	if _, ok := m.Conversations[message.RecipientId][message.SenderId]; delta == 0 || (delta < 0 && !ok) {
+		return
+	}
+	m.updateConversation(message.RecipientId, message.SenderId, func(conversation *Conversation) {
+		addUnread(conversation, message.MessageId, delta)
+	})
+}
+func (m *MockDBClient) GetConversationMessages(ctx context.Context, query HistoryQuery) (*HistoryPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	var messages []Message
+	for _, recipientMessages := range m.Messages {
+		for _, msg := range recipientMessages {
+			inConversation := msg.ConversationKey == query.ConversationId
+			if query.Type == ConversationGroup {
+				inConversation = msg.RecipientId == query.ConversationId
+			}
+			if inConversation && query.includes(msg.MessageId) {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	// order the messages in the query direction
+	sort.Slice(messages, func(i, j int) bool {
+		return (messages[i].MessageId < messages[j].MessageId) == query.forward()
+	})
+	if len(messages) > query.Limit+1 {
+		messages = messages[:query.Limit+1]
+	}
+	return newHistoryPage(query, messages), nil
+}
+func (m *MockDBClient) SetGroupFanOutOnRead(ctx context.Context, group Group, inboxUntil string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	stored := m.Groups[group.GroupId]
+	stored.FanOutOnWrite = false
+	stored.InboxUntil = inboxUntil
+	m.Groups[group.GroupId] = stored
+	return nil
+}
+func (m *MockDBClient) StoreInboxMessages(ctx context.Context, message Message, userIds []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	for _, userId := range userIds {
+		inboxMessage := toInbox(message, userId)
+		replaced := false
+		for i, msg := range m.Messages[userId] {
+			if msg.MessageId == message.MessageId {
+				m.Messages[userId][i] = inboxMessage
+				replaced = true
+			}
+		}
+		if !replaced {
+			m.Messages[userId] = append(m.Messages[userId], inboxMessage)
+		}
+	}
+	return nil
+}
+func (m *MockDBClient) StoreSenderInboxMessage(ctx context.Context, message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	copied := toSenderInbox(message)
+	for i, msg := range m.Messages[copied.RecipientId] {
+		if msg.MessageId == message.MessageId {
+			m.Messages[copied.RecipientId][i] = copied
+			return nil
+		}
+	}
+	m.Messages[copied.RecipientId] = append(m.Messages[copied.RecipientId], copied)
+	return nil
 }
@@ -0,0 +1,108 @@
+package db
+
+import (
+	. "server/common"
+	"sort"
+)
+
+// MessagesQuery selects the messages returned by GetMessages.
+type MessagesQuery struct {
+	// Timestamp is a unix timestamp (seconds), only messages created, edited or deleted after it are returned. 0 returns all messages.
+	Timestamp int64
+	// Limit is the maximal number of messages to return. 0 returns all messages.
+	Limit int
+	// Cursor maps a recipient ID (the user or one of their groups) to the last change ID already returned for it.
+	Cursor map[string]string
+	// InboxGroups maps the groups that copy their messages to the member inboxes to their InboxUntil change ID.
+	// Their messages are read from the user inbox, up to InboxUntil for groups that switched to fan-out-on-read,
+	// an empty InboxUntil means that the group is not queried at all.
+	InboxGroups map[string]string
+}
+
+// MessagesPage is a single page of messages ordered by change ID, so that edits and deletions are returned as new changes.
+type MessagesPage struct {
+	Messages []Message
+	// Cursor is the position to continue from, nil if there are no more messages.
+	Cursor map[string]string
+	// Failed lists the recipients whose messages could not be fetched and are missing from the page.
+	// Their cursor position does not move, so the next page or a retry of the same query fetches them again.
+	Failed []string
+}
+
+// after returns the exclusive lower bound of the change IDs to fetch for the recipient,
+// the later of the query timestamp and the recipient position in the cursor.
+func (q MessagesQuery) after(recipientId string) string {
+	after := ""
+	if q.Timestamp > 0 {
+		after = MessageIdAfter(q.Timestamp)
+	}
+	if position := q.Cursor[recipientId]; position > after {
+		after = position
+	}
+	if inboxUntil := q.InboxGroups[recipientId]; inboxUntil > after {
+		after = inboxUntil
+	}
+	return after
+}
+
+// groupIds returns the groups of the user to query, groups that copy all of their messages to the inbox are skipped.
+func (q MessagesQuery) groupIds(user User) []string {
+	groupIds := make([]string, 0, len(user.Groups))
+	for groupId := range user.Groups {
+		if inboxUntil, ok := q.InboxGroups[groupId]; ok && inboxUntil == "" {
+			continue
+		}
+		groupIds = append(groupIds, groupId)
+	}
+	return groupIds
+}
+
+// fetchLimit returns how many messages to fetch per recipient, one more than the page size so that
+// we know if there is another page. 0 means no limit.
+func (q MessagesQuery) fetchLimit() int {
+	if q.Limit <= 0 {
+		return 0
+	}
+	return q.Limit + 1
+}
+
+// newMessagesPage merges the messages fetched for all recipients into a page.
+// Each recipient contributes a prefix of its own messages, so the next cursor position of a recipient
+// is the last of its messages in the page.
+func newMessagesPage(query MessagesQuery, messages []Message) *MessagesPage {
+	sortMessages(messages)
+	if query.Limit <= 0 || len(messages) <= query.Limit {
+		return &MessagesPage{Messages: messages}
+	}
+
+	messages = messages[:query.Limit]
+	cursor := make(map[string]string, len(query.Cursor))
+	for recipientId, position := range query.Cursor {
+		cursor[recipientId] = position
+	}
+	for _, msg := range messages {
+		cursor[msg.RecipientId] = msg.ChangeId
+	}
+	return &MessagesPage{Messages: messages, Cursor: cursor}
+}
+
+// filterMessagesAfter returns up to limit messages with a change ID greater than after, limit 0 means no limit.
+// The messages are expected to be ordered by change ID.
+func filterMessagesAfter(messages []Message, after string, limit int) []Message {
+	var filtered []Message
+	for _, msg := range messages {
+		if limit > 0 && len(filtered) == limit {
+			break
+		}
+		if msg.ChangeId > after {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+func sortMessages(messages []Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ChangeId < messages[j].ChangeId
+	})
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	bolt "go.etcd.io/bbolt"
+	. "server/common"
+)
+
+// ErrReactionExists is returned when a user adds a reaction they already added to the message.
+var ErrReactionExists = errors.New("reaction already exists")
+
+// ErrReactionNotFound is returned when a user removes a reaction they did not add to the message.
+var ErrReactionNotFound = errors.New("reaction not found")
+
+// reactionItem is the record of a reaction in the reactions table, the reactions of a message are stored under its key.
+type reactionItem struct {
+	MessageKey  string
+	ReactionKey string
+	Reaction
+}
+
+// reactionKeys returns the message key and the reaction key of the reaction, a user reacts once with each emoji.
+func reactionKeys(reaction Reaction) (string, string) {
+	return reaction.RecipientId + "#" + reaction.MessageId, reaction.UserId + "#" + reaction.Emoji
+}
+
+// countReaction returns the reaction counts of the message with delta added to the count of the emoji,
+// the counts are copied, as the message may be shared.
+func countReaction(message Message, emoji string, delta int) map[string]int {
+	counts := make(map[string]int, len(message.Reactions)+1)
+	for e, count := range message.Reactions {
+		counts[e] = count
+	}
+	counts[emoji] += delta
+	if counts[emoji] <= 0 {
+		delete(counts, emoji)
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	return counts
+}
+
+func (d *dynamoDBClient) AddReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	messageKey, reactionKey := reactionKeys(reaction)
+	item, err := attributevalue.MarshalMap(reactionItem{MessageKey: messageKey, ReactionKey: reactionKey, Reaction: reaction})
+	if err != nil {
+		return nil, err
+	}
+	return d.updateReactions(ctx, reaction, 1, changeId, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(ReactionsTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + MessageKey + ")"),
+	}}, ErrReactionExists)
+}
+
+func (d *dynamoDBClient) RemoveReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	messageKey, reactionKey := reactionKeys(reaction)
+	return d.updateReactions(ctx, reaction, -1, changeId, types.TransactWriteItem{Delete: &types.Delete{
+		TableName: aws.String(ReactionsTableName),
+		Key: map[string]types.AttributeValue{
+			MessageKey:  &types.AttributeValueMemberS{Value: messageKey},
+			ReactionKey: &types.AttributeValueMemberS{Value: reactionKey},
+		},
+		ConditionExpression: aws.String("attribute_exists(" + MessageKey + ")"),
+	}}, ErrReactionNotFound)
+}
+
+// updateReactions writes the reaction record and the reaction counts of its message in one transaction. The counts are
+// written conditional on the message change ID, if the message changed since it was read, the counts are computed again
+// from the stored message. The record condition failing means the reaction was already added or removed, conditionErr.
+func (d *dynamoDBClient) updateReactions(ctx context.Context, reaction Reaction, delta int, changeId string, record types.TransactWriteItem, conditionErr error) (*Message, error) {
+	for attempt := 0; ; attempt++ {
+		message, err := d.getMessageItem(ctx, reaction.RecipientId, reaction.MessageId, true)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil {
+			return nil, fmt.Errorf("message %s of recipient %s not found", reaction.MessageId, reaction.RecipientId)
+		}
+		readChangeId := message.ChangeId
+		message.Reactions = countReaction(*message, reaction.Emoji, delta)
+		message.ChangeId = changeId
+
+		names := map[string]string{"#changeId": ChangeIdSortKey, "#reactions": ReactionsAttribute}
+		values := map[string]types.AttributeValue{
+			":changeId":     &types.AttributeValueMemberS{Value: changeId},
+			":readChangeId": &types.AttributeValueMemberS{Value: readChangeId},
+		}
+		update := "SET #changeId = :changeId REMOVE #reactions"
+		if message.Reactions != nil {
+			if values[":reactions"], err = attributevalue.Marshal(message.Reactions); err != nil {
+				return nil, err
+			}
+			update = "SET #changeId = :changeId, #reactions = :reactions"
+		}
+		_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{{Update: &types.Update{
+				TableName: aws.String(MessagesTableName),
+				Key: map[string]types.AttributeValue{
+					RecipientIdKey:   &types.AttributeValueMemberS{Value: reaction.RecipientId},
+					MessageIdSortKey: &types.AttributeValueMemberS{Value: reaction.MessageId},
+				},
+				UpdateExpression:          aws.String(update),
+				ConditionExpression:       aws.String("#changeId = :readChangeId"),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			}}, record},
+		})
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 1 &&
+			aws.ToString(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			return nil, conditionErr
+		}
+		if err == nil {
+			d.cache.StoreMessage(ctx, *message)
+			return message, nil
+		}
+		if !isTransactionConflict(err, 2) {
+			return nil, err
+		}
+		if attempt == maxVersionConflictRetries {
+			return nil, ErrVersionConflict
+		}
+		if err = waitBeforeRetry(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b *boltDBClient) AddReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	return b.updateReactions(reaction, 1, changeId)
+}
+
+func (b *boltDBClient) RemoveReaction(ctx context.Context, reaction Reaction, changeId string) (*Message, error) {
+	return b.updateReactions(reaction, -1, changeId)
+}
+
+// updateReactions adds or deletes the reaction record, by the sign of delta, and counts it on its message.
+func (b *boltDBClient) updateReactions(reaction Reaction, delta int, changeId string) (*Message, error) {
+	var message Message
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		messageKey, reactionKey := reactionKeys(reaction)
+		reactions, err := tx.Bucket(reactionsBucket).CreateBucketIfNotExists([]byte(messageKey))
+		if err != nil {
+			return err
+		}
+		exists := reactions.Get([]byte(reactionKey)) != nil
+		switch {
+		case delta > 0 && exists:
+			return ErrReactionExists
+		case delta < 0 && !exists:
+			return ErrReactionNotFound
+		case delta > 0:
+			err = putItem(reactions, reactionKey, reaction)
+		default:
+			err = reactions.Delete([]byte(reactionKey))
+		}
+		if err != nil {
+			return err
+		}
+
+		found := false
+		if bucket := tx.Bucket(messagesBucket).Bucket([]byte(reaction.RecipientId)); bucket != nil {
+			if found, err = getItem(bucket, reaction.MessageId, &message); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("message %s of recipient %s not found", reaction.MessageId, reaction.RecipientId)
+		}
+		message.Reactions = countReaction(message, reaction.Emoji, delta)
+		message.ChangeId = changeId
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"sync"
+)
+
+// maxConcurrentRecipientQueries bounds the recipient queries of a single poll that run at the same time,
+// so that a user in many groups does not exhaust the DynamoDB connections or the read capacity at once.
+const maxConcurrentRecipientQueries = 8
+
+// recipientQuery fetches the messages of a single recipient, the user or one of their groups.
+type recipientQuery func(ctx context.Context, recipientId string) ([]Message, error)
+
+// queryRecipients runs the query for every recipient with up to maxConcurrentRecipientQueries workers
+// and returns the messages of all recipients in change ID order, which is the creation time of the changes.
+// A failing recipient does not fail the others, it is returned in failed and its messages are missing.
+// An error is returned only if the context is canceled or every recipient failed.
+func queryRecipients(ctx context.Context, recipientIds []string, query recipientQuery) ([]Message, []string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]Message, len(recipientIds))
+	errs := make([]error, len(recipientIds))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxConcurrentRecipientQueries && w < len(recipientIds); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i], errs[i] = query(ctx, recipientIds[i])
+			}
+		}()
+	}
+
+feed:
+	for i := range recipientIds {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var messages []Message
+	var failed []string
+	var lastErr error
+	for i, recipientId := range recipientIds {
+		if errs[i] != nil {
+			slog.Error(fmt.Sprintf("Error getting messages of recipient %s: %v", recipientId, errs[i]))
+			failed = append(failed, recipientId)
+			lastErr = errs[i]
+			continue
+		}
+		messages = append(messages, results[i]...)
+	}
+	if len(recipientIds) > 0 && len(failed) == len(recipientIds) {
+		return nil, nil, lastErr
+	}
+	sortMessages(messages)
+	return messages, failed, nil
+}
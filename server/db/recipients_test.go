@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryRecipients(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour)
+
+	var recipientIds []string
+	stored := map[string][]Message{}
+	for i := 0; i < 3*maxConcurrentRecipientQueries; i++ {
+		recipientId := fmt.Sprintf("test-group-%d", i)
+		recipientIds = append(recipientIds, recipientId)
+		// interleave the messages of the recipients
+		stored[recipientId] = []Message{
+			newTestMessage(recipientId, start.Add(time.Duration(i)*time.Second), "first"),
+			newTestMessage(recipientId, start.Add(time.Duration(i)*time.Second+time.Minute), "second"),
+		}
+	}
+	fetch := func(ctx context.Context, recipientId string) ([]Message, error) {
+		return stored[recipientId], nil
+	}
+
+	t.Run("messages of all recipients are merged in change ID order", func(t *testing.T) {
+		messages, failed, err := queryRecipients(ctx, recipientIds, fetch)
+		assert.NoError(t, err)
+		assert.Empty(t, failed)
+		assert.Len(t, messages, 2*len(recipientIds))
+		for i := 1; i < len(messages); i++ {
+			assert.Less(t, messages[i-1].ChangeId, messages[i].ChangeId)
+		}
+	})
+
+	t.Run("queries run concurrently up to the limit", func(t *testing.T) {
+		var running, maxRunning int32
+		_, _, err := queryRecipients(ctx, recipientIds, func(ctx context.Context, recipientId string) ([]Message, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return fetch(ctx, recipientId)
+		})
+		assert.NoError(t, err)
+		assert.Greater(t, maxRunning, int32(1))
+		assert.LessOrEqual(t, maxRunning, int32(maxConcurrentRecipientQueries))
+	})
+
+	t.Run("failed recipients are reported with the messages of the others", func(t *testing.T) {
+		messages, failed, err := queryRecipients(ctx, recipientIds, func(ctx context.Context, recipientId string) ([]Message, error) {
+			if recipientId == recipientIds[1] {
+				return nil, fmt.Errorf("some error")
+			}
+			return fetch(ctx, recipientId)
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{recipientIds[1]}, failed)
+		assert.Len(t, messages, 2*(len(recipientIds)-1))
+		assert.NotContains(t, messages, stored[recipientIds[1]][0])
+	})
+
+	t.Run("every recipient failed", func(t *testing.T) {
+		_, _, err := queryRecipients(ctx, recipientIds, func(ctx context.Context, recipientId string) ([]Message, error) {
+			return nil, fmt.Errorf("some error")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("canceled context stops the queries", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		var queried int32
+		_, _, err := queryRecipients(ctx, recipientIds, func(ctx context.Context, recipientId string) ([]Message, error) {
+			atomic.AddInt32(&queried, 1)
+			cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, int(queried), len(recipientIds))
+	})
+
+	t.Run("no recipients", func(t *testing.T) {
+		messages, failed, err := queryRecipients(ctx, nil, fetch)
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+		assert.Empty(t, failed)
+	})
+}
@@ -0,0 +1,388 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	bolt "go.etcd.io/bbolt"
+	. "server/common"
+	"sort"
+)
+
+// ErrScheduleUnavailable is returned when claiming or canceling a scheduled message that is being sent by a scheduler
+// instance, or that was already sent, canceled or failed.
+var ErrScheduleUnavailable = errors.New("scheduled message is not available")
+
+// scheduledItem is the record of a scheduled message, DueKey puts pending messages in DueIndex. It is removed from
+// failed messages, so that the index only holds the messages still to be sent.
+type scheduledItem struct {
+	ScheduledMessage
+	DueKey string `dynamodbav:",omitempty"`
+}
+
+func scheduledKey(senderId string, scheduleId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		SenderIdKey:       &types.AttributeValueMemberS{Value: senderId},
+		ScheduleIdSortKey: &types.AttributeValueMemberS{Value: scheduleId},
+	}
+}
+
+func (d *dynamoDBClient) StoreScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	record := scheduledItem{ScheduledMessage: scheduled}
+	if scheduled.Status == ScheduledPending {
+		record.DueKey = ScheduledPending
+	}
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ScheduledTableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoDBClient) GetScheduledMessage(ctx context.Context, senderId string, scheduleId string) (*ScheduledMessage, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(ScheduledTableName),
+		Key:            scheduledKey(senderId, scheduleId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If result.Item is empty, the message was sent, canceled or never scheduled
+	if result.Item == nil {
+		return nil, nil
+	}
+	var scheduled ScheduledMessage
+	if err = attributevalue.UnmarshalMap(result.Item, &scheduled); err != nil {
+		return nil, err
+	}
+	return &scheduled, nil
+}
+
+func (d *dynamoDBClient) GetScheduledMessages(ctx context.Context, senderId string) ([]ScheduledMessage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(ScheduledTableName),
+		KeyConditionExpression:    aws.String("#senderId = :senderId"),
+		ExpressionAttributeNames:  map[string]string{"#senderId": SenderIdKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":senderId": &types.AttributeValueMemberS{Value: senderId}},
+		ConsistentRead:            aws.Bool(true),
+	}
+	var scheduled []ScheduledMessage
+	for {
+		results, err := d.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var page []ScheduledMessage
+		if err = attributevalue.UnmarshalListOfMaps(results.Items, &page); err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, page...)
+		input.ExclusiveStartKey = results.LastEvaluatedKey
+		if len(input.ExclusiveStartKey) == 0 {
+			return scheduled, nil
+		}
+	}
+}
+
+// GetDueScheduledMessages queries DueIndex, which is eventually consistent, a message sent by another instance may
+// still be returned, its claim fails then.
+func (d *dynamoDBClient) GetDueScheduledMessages(ctx context.Context, now string, limit int) ([]ScheduledMessage, error) {
+	results, err := d.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(ScheduledTableName),
+		IndexName:              aws.String(DueIndex),
+		KeyConditionExpression: aws.String("#dueKey = :pending AND #sendAt <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#dueKey": DueKey,
+			"#sendAt": "SendAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: ScheduledPending},
+			":now":     &types.AttributeValueMemberS{Value: now},
+		},
+		Limit: aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var scheduled []ScheduledMessage
+	if err = attributevalue.UnmarshalListOfMaps(results.Items, &scheduled); err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+func (d *dynamoDBClient) ClaimScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string, claimedUntil string, messageId string) (*ScheduledMessage, error) {
+	result, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ScheduledTableName),
+		Key:              scheduledKey(scheduled.SenderId, scheduled.ScheduleId),
+		UpdateExpression: aws.String("SET #claimedUntil = :claimedUntil, #messageId = if_not_exists(#messageId, :messageId)"),
+		// only one instance holds an unexpired claim, and never recreate a message that was sent or canceled
+		ConditionExpression: aws.String("#status = :pending AND (attribute_not_exists(#claimedUntil) OR #claimedUntil <= :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#claimedUntil": "ClaimedUntil",
+			"#messageId":    "MessageId",
+			"#status":       "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":claimedUntil": &types.AttributeValueMemberS{Value: claimedUntil},
+			":messageId":    &types.AttributeValueMemberS{Value: messageId},
+			":pending":      &types.AttributeValueMemberS{Value: ScheduledPending},
+			":now":          &types.AttributeValueMemberS{Value: now},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil, ErrScheduleUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+	var claimed ScheduledMessage
+	if err = attributevalue.UnmarshalMap(result.Attributes, &claimed); err != nil {
+		return nil, err
+	}
+	return &claimed, nil
+}
+
+func (d *dynamoDBClient) ReleaseScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	return d.endClaim(ctx, scheduled, "REMOVE #claimedUntil", nil, nil)
+}
+
+func (d *dynamoDBClient) FailScheduledMessage(ctx context.Context, scheduled ScheduledMessage, reason string) error {
+	return d.endClaim(ctx, scheduled, "SET #status = :failed, #error = :error REMOVE #claimedUntil, #dueKey",
+		map[string]string{"#status": "Status", "#error": "Error", "#dueKey": DueKey},
+		map[string]types.AttributeValue{
+			":failed": &types.AttributeValueMemberS{Value: ScheduledFailed},
+			":error":  &types.AttributeValueMemberS{Value: reason},
+		})
+}
+
+// endClaim updates a claimed message if the claim is still the one of the scheduled message.
+func (d *dynamoDBClient) endClaim(ctx context.Context, scheduled ScheduledMessage, update string, names map[string]string, values map[string]types.AttributeValue) error {
+	if names == nil {
+		names, values = map[string]string{}, map[string]types.AttributeValue{}
+	}
+	names["#claimedUntil"] = "ClaimedUntil"
+	values[":claimedUntil"] = &types.AttributeValueMemberS{Value: scheduled.ClaimedUntil}
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ScheduledTableName),
+		Key:                       scheduledKey(scheduled.SenderId, scheduled.ScheduleId),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("#claimedUntil = :claimedUntil"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// claimed again after the claim expired, the new claim decides
+		return nil
+	}
+	return err
+}
+
+func (d *dynamoDBClient) CancelScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(ScheduledTableName),
+		Key:                 scheduledKey(scheduled.SenderId, scheduled.ScheduleId),
+		ConditionExpression: aws.String("attribute_exists(#scheduleId) AND (attribute_not_exists(#claimedUntil) OR #claimedUntil <= :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#scheduleId":   ScheduleIdSortKey,
+			"#claimedUntil": "ClaimedUntil",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: now},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrScheduleUnavailable
+	}
+	return err
+}
+
+func (d *dynamoDBClient) DeleteScheduledMessage(ctx context.Context, senderId string, scheduleId string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ScheduledTableName),
+		Key:       scheduledKey(senderId, scheduleId),
+	})
+	return err
+}
+
+func (b *boltDBClient) StoreScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(scheduledBucket).CreateBucketIfNotExists([]byte(scheduled.SenderId))
+		if err != nil {
+			return err
+		}
+		return putItem(bucket, scheduled.ScheduleId, scheduled)
+	})
+}
+
+func (b *boltDBClient) GetScheduledMessage(ctx context.Context, senderId string, scheduleId string) (*ScheduledMessage, error) {
+	var scheduled *ScheduledMessage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		scheduled, err = getScheduled(tx, senderId, scheduleId)
+		return err
+	})
+	return scheduled, err
+}
+
+func (b *boltDBClient) GetScheduledMessages(ctx context.Context, senderId string) ([]ScheduledMessage, error) {
+	var scheduled []ScheduledMessage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket).Bucket([]byte(senderId))
+		if bucket == nil {
+			return nil
+		}
+		// keyed by schedule ID, so in order
+		return bucket.ForEach(func(k, v []byte) error {
+			var s ScheduledMessage
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			scheduled = append(scheduled, s)
+			return nil
+		})
+	})
+	return scheduled, err
+}
+
+// GetDueScheduledMessages scans the scheduled messages of all senders, there is a single instance using a bolt database.
+func (b *boltDBClient) GetDueScheduledMessages(ctx context.Context, now string, limit int) ([]ScheduledMessage, error) {
+	var due []ScheduledMessage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).ForEach(func(senderId, _ []byte) error {
+			return tx.Bucket(scheduledBucket).Bucket(senderId).ForEach(func(k, v []byte) error {
+				var s ScheduledMessage
+				if err := json.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				if s.Status == ScheduledPending && s.SendAt <= now {
+					due = append(due, s)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].SendAt < due[j].SendAt })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (b *boltDBClient) ClaimScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string, claimedUntil string, messageId string) (*ScheduledMessage, error) {
+	var claimed *ScheduledMessage
+	err := b.updateScheduled(scheduled, func(stored *ScheduledMessage) error {
+		if stored.Status != ScheduledPending || stored.Claimed(now) {
+			return ErrScheduleUnavailable
+		}
+		stored.ClaimedUntil = claimedUntil
+		if stored.MessageId == "" {
+			stored.MessageId = messageId
+		}
+		claimed = stored
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (b *boltDBClient) ReleaseScheduledMessage(ctx context.Context, scheduled ScheduledMessage) error {
+	return b.endClaim(scheduled, func(stored *ScheduledMessage) {
+		stored.ClaimedUntil = ""
+	})
+}
+
+func (b *boltDBClient) FailScheduledMessage(ctx context.Context, scheduled ScheduledMessage, reason string) error {
+	return b.endClaim(scheduled, func(stored *ScheduledMessage) {
+		stored.ClaimedUntil = ""
+		stored.Status = ScheduledFailed
+		stored.Error = reason
+	})
+}
+
+// endClaim updates a claimed message if the claim is still the one of the scheduled message.
+func (b *boltDBClient) endClaim(scheduled ScheduledMessage, update func(stored *ScheduledMessage)) error {
+	err := b.updateScheduled(scheduled, func(stored *ScheduledMessage) error {
+		if stored.ClaimedUntil != scheduled.ClaimedUntil {
+			return ErrScheduleUnavailable
+		}
+		update(stored)
+		return nil
+	})
+	if errors.Is(err, ErrScheduleUnavailable) {
+		return nil
+	}
+	return err
+}
+
+func (b *boltDBClient) CancelScheduledMessage(ctx context.Context, scheduled ScheduledMessage, now string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getScheduled(tx, scheduled.SenderId, scheduled.ScheduleId)
+		if err != nil {
+			return err
+		}
+		if stored == nil || stored.Claimed(now) {
+			return ErrScheduleUnavailable
+		}
+		return tx.Bucket(scheduledBucket).Bucket([]byte(scheduled.SenderId)).Delete([]byte(scheduled.ScheduleId))
+	})
+}
+
+func (b *boltDBClient) DeleteScheduledMessage(ctx context.Context, senderId string, scheduleId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket).Bucket([]byte(senderId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(scheduleId))
+	})
+}
+
+// updateScheduled updates the stored scheduled message in one transaction, it returns ErrScheduleUnavailable if the
+// message was deleted.
+func (b *boltDBClient) updateScheduled(scheduled ScheduledMessage, update func(stored *ScheduledMessage) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getScheduled(tx, scheduled.SenderId, scheduled.ScheduleId)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return ErrScheduleUnavailable
+		}
+		if err = update(stored); err != nil {
+			return err
+		}
+		return putItem(tx.Bucket(scheduledBucket).Bucket([]byte(scheduled.SenderId)), scheduled.ScheduleId, stored)
+	})
+}
+
+func getScheduled(tx *bolt.Tx, senderId string, scheduleId string) (*ScheduledMessage, error) {
+	bucket := tx.Bucket(scheduledBucket).Bucket([]byte(senderId))
+	if bucket == nil {
+		return nil, nil
+	}
+	var scheduled ScheduledMessage
+	found, err := getItem(bucket, scheduleId, &scheduled)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &scheduled, nil
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"sync"
+)
+
+// SearchQuery selects the postings returned by GetSearchPostings.
+type SearchQuery struct {
+	// Scopes are the users and groups whose messages are searched, see SearchScopes.
+	Scopes []string
+	Terms  []string
+	// After and Before are exclusive message ID bounds, either can be empty.
+	After  string
+	Before string
+	// Limit is the number of postings read per term and scope, the newest ones, so that a common term in a large
+	// scope does not read all of its messages. No limit if zero.
+	Limit int
+}
+
+// includes returns true if the message ID is within the query bounds.
+func (q SearchQuery) includes(messageId string) bool {
+	return messageId > q.After && (q.Before == "" || messageId < q.Before)
+}
+
+// keys returns every term of every scope of the query.
+func (q SearchQuery) keys() []SearchKey {
+	keys := make([]SearchKey, 0, len(q.Scopes)*len(q.Terms))
+	for _, scope := range q.Scopes {
+		for _, term := range q.Terms {
+			keys = append(keys, SearchKey{Scope: scope, Term: term})
+		}
+	}
+	return keys
+}
+
+// searchIndexItem is a posting as stored in the search index table, keyed by its scope and term and by the message ID.
+type searchIndexItem struct {
+	ScopeTerm string
+	SearchPosting
+}
+
+// changedSearchKeys returns the index entries of the previous version of the message that the new version does not have.
+func changedSearchKeys(previous *Message, postings map[SearchKey]SearchPosting) []SearchKey {
+	if previous == nil {
+		return nil
+	}
+	var removed []SearchKey
+	for key := range SearchPostings(*previous) {
+		if _, ok := postings[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// updateSearchIndex replaces the index entries of the previous version of the message, nil for a new message.
+// The message is already stored, so a failed update is logged and leaves the message out of some search results.
+func (d *dynamoDBClient) updateSearchIndex(ctx context.Context, previous *Message, message Message) {
+	postings := SearchPostings(message)
+	var requests []types.WriteRequest
+	for _, key := range changedSearchKeys(previous, postings) {
+		requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{
+			SearchKeyAttribute: &types.AttributeValueMemberS{Value: key.String()},
+			MessageIdSortKey:   &types.AttributeValueMemberS{Value: message.MessageId},
+		}}})
+	}
+	for key, posting := range postings {
+		av, err := attributevalue.MarshalMap(searchIndexItem{ScopeTerm: key.String(), SearchPosting: posting})
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error indexing message %s: %v", message.MessageId, err))
+			return
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: av}})
+	}
+	if err := d.batchWrite(ctx, SearchIndexTableName, requests); err != nil {
+		slog.Error(fmt.Sprintf("Error indexing message %s: %v", message.MessageId, err))
+	}
+}
+
+func (d *dynamoDBClient) GetSearchPostings(ctx context.Context, query SearchQuery) ([]SearchPosting, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys := query.keys()
+	results := make([][]SearchPosting, len(keys))
+	errs := make([]error, len(keys))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxConcurrentRecipientQueries && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i], errs[i] = d.querySearchIndex(ctx, keys[i], query)
+			}
+		}()
+	}
+feed:
+	for i := range keys {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var postings []SearchPosting
+	for i, err := range errs {
+		if err != nil {
+			// a missing term would drop the messages matching it from the results, so the search fails as a whole
+			return nil, err
+		}
+		postings = append(postings, results[i]...)
+	}
+	return postings, nil
+}
+
+// querySearchIndex returns the postings of a term of a scope within the message ID bounds of the query.
+func (d *dynamoDBClient) querySearchIndex(ctx context.Context, key SearchKey, query SearchQuery) ([]SearchPosting, error) {
+	names := map[string]string{"#scopeTerm": SearchKeyAttribute}
+	values := map[string]types.AttributeValue{
+		":scopeTerm": &types.AttributeValueMemberS{Value: key.String()},
+	}
+	keyCondition := "#scopeTerm = :scopeTerm"
+	if query.After != "" {
+		values[":after"] = &types.AttributeValueMemberS{Value: query.After}
+	}
+	if query.Before != "" {
+		values[":before"] = &types.AttributeValueMemberS{Value: query.Before}
+	}
+	switch {
+	case query.After != "" && query.Before != "":
+		// BETWEEN includes the bounds, they are filtered out below
+		keyCondition += " AND #messageId BETWEEN :after AND :before"
+	case query.After != "":
+		keyCondition += " AND #messageId > :after"
+	case query.Before != "":
+		keyCondition += " AND #messageId < :before"
+	}
+	if query.After != "" || query.Before != "" {
+		names["#messageId"] = MessageIdSortKey
+	}
+
+	var postings []SearchPosting
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(SearchIndexTableName),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		// newest first, up to the limit
+		ScanIndexForward: aws.Bool(false),
+	}
+	for {
+		if query.Limit > 0 {
+			// the bounds of BETWEEN are read too, so there may be one more page
+			input.Limit = aws.Int32(int32(query.Limit - len(postings)))
+		}
+		page, err := d.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var items []searchIndexItem
+		if err = attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if !query.includes(item.MessageId) {
+				continue
+			}
+			item.Scope, item.Term = key.Scope, key.Term
+			postings = append(postings, item.SearchPosting)
+		}
+		input.ExclusiveStartKey = page.LastEvaluatedKey
+		if len(input.ExclusiveStartKey) == 0 || (query.Limit > 0 && len(postings) >= query.Limit) {
+			return postings, nil
+		}
+	}
+}
+
+// searchIndexKey is the key of a posting in the search index bucket, the postings of a term of a scope are
+// adjacent and ordered by message ID.
+func searchIndexKey(key SearchKey, messageId string) []byte {
+	return []byte(key.Scope + "\x00" + key.Term + "\x00" + messageId)
+}
+
+// updateSearchIndex replaces the index entries of the previous version of the message, nil for a new message,
+// in the transaction that stores the message.
+func updateSearchIndex(tx *bolt.Tx, previous *Message, message Message) error {
+	index := tx.Bucket(searchIndexBucket)
+	postings := SearchPostings(message)
+	for _, key := range changedSearchKeys(previous, postings) {
+		if err := index.Delete(searchIndexKey(key, message.MessageId)); err != nil {
+			return err
+		}
+	}
+	for key, posting := range postings {
+		data, err := json.Marshal(posting)
+		if err != nil {
+			return err
+		}
+		if err = index.Put(searchIndexKey(key, message.MessageId), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltDBClient) GetSearchPostings(ctx context.Context, query SearchQuery) ([]SearchPosting, error) {
+	var postings []SearchPosting
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(searchIndexBucket).Cursor()
+		for _, key := range query.keys() {
+			prefix := searchIndexKey(key, "")
+			// newest first, from the last posting before the upper bound, message IDs sort below 0xff
+			before := query.Before
+			if before == "" {
+				before = "\xff"
+			}
+			k, v := c.Seek(searchIndexKey(key, before))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			for read := 0; k != nil && bytes.HasPrefix(k, prefix) && (query.Limit == 0 || read < query.Limit); k, v = c.Prev() {
+				messageId := string(k[len(prefix):])
+				if !query.includes(messageId) {
+					break
+				}
+				var posting SearchPosting
+				if err := json.Unmarshal(v, &posting); err != nil {
+					return err
+				}
+				posting.Scope, posting.Term = key.Scope, key.Term
+				postings = append(postings, posting)
+				read++
+			}
+		}
+		return nil
+	})
+	return postings, err
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	bolt "go.etcd.io/bbolt"
+	. "server/common"
+	"strconv"
+)
+
+// ThreadQuery selects the replies of a thread returned by GetThreadMessages.
+type ThreadQuery struct {
+	// ThreadId is the message ID of the first message of the thread, see Message.ThreadId.
+	ThreadId string
+	// After is an exclusive message ID bound, empty for the first replies.
+	After string
+	// Limit is the maximal number of replies to return, it must be positive.
+	Limit int
+}
+
+// newPage creates a page from up to Limit+1 replies ordered by message ID.
+func (q ThreadQuery) newPage(messages []Message) *HistoryPage {
+	page := &HistoryPage{Messages: messages}
+	if len(messages) > q.Limit {
+		page.Messages = messages[:q.Limit]
+		page.HasMore = true
+	}
+	return page
+}
+
+func (d *dynamoDBClient) UpdateReplyCount(ctx context.Context, recipientId string, messageId string, delta int, changeId string) (*Message, error) {
+	result, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(MessagesTableName),
+		Key: map[string]types.AttributeValue{
+			RecipientIdKey:   &types.AttributeValueMemberS{Value: recipientId},
+			MessageIdSortKey: &types.AttributeValueMemberS{Value: messageId},
+		},
+		UpdateExpression:         aws.String("ADD #replyCount :delta SET #changeId = :changeId"),
+		ExpressionAttributeNames: map[string]string{"#replyCount": ReplyCountAttribute, "#changeId": ChangeIdSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta":    &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+			":changeId": &types.AttributeValueMemberS{Value: changeId},
+		},
+		// never create a message that does not exist
+		ConditionExpression: aws.String("attribute_exists(" + MessageIdSortKey + ")"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var message Message
+	if err = attributevalue.UnmarshalMap(result.Attributes, &message); err != nil {
+		return nil, err
+	}
+	d.cache.StoreMessage(ctx, message)
+	return &message, nil
+}
+
+func (d *dynamoDBClient) GetThreadMessages(ctx context.Context, query ThreadQuery) (*HistoryPage, error) {
+	names := map[string]string{"#threadKey": ThreadKey}
+	values := map[string]types.AttributeValue{
+		":threadKey": &types.AttributeValueMemberS{Value: query.ThreadId},
+	}
+	keyCondition := "#threadKey = :threadKey"
+	if query.After != "" {
+		names["#messageId"] = MessageIdSortKey
+		values[":after"] = &types.AttributeValueMemberS{Value: query.After}
+		keyCondition += " AND #messageId > :after"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(MessagesTableName),
+		IndexName:                 aws.String(ThreadIndex),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	var messages []Message
+	for len(messages) <= query.Limit {
+		// fetch one more than the page size, so that we know if there are more replies
+		input.Limit = aws.Int32(int32(query.Limit + 1 - len(messages)))
+		results, err := d.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Items {
+			var message Message
+			if err = attributevalue.UnmarshalMap(item, &message); err != nil {
+				return nil, err
+			}
+			messages = append(messages, message)
+		}
+		if len(results.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = results.LastEvaluatedKey
+	}
+	return query.newPage(messages), nil
+}
+
+func (b *boltDBClient) UpdateReplyCount(ctx context.Context, recipientId string, messageId string, delta int, changeId string) (*Message, error) {
+	var message Message
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(recipientId))
+		if bucket == nil {
+			return fmt.Errorf("message %s of recipient %s not found", messageId, recipientId)
+		}
+		found, err := getItem(bucket, messageId, &message)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("message %s of recipient %s not found", messageId, recipientId)
+		}
+		message.ReplyCount += delta
+		message.ChangeId = changeId
+		return putMessage(tx, message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (b *boltDBClient) GetThreadMessages(ctx context.Context, query ThreadQuery) (*HistoryPage, error) {
+	var messages []Message
+	err := b.db.View(func(tx *bolt.Tx) error {
+		thread := tx.Bucket(threadIndexBucket).Bucket([]byte(query.ThreadId))
+		if thread == nil {
+			return nil
+		}
+		c := thread.Cursor()
+		// fetch one more than the page size, so that we know if there are more replies
+		for k, v := c.Seek([]byte(query.After)); k != nil && len(messages) <= query.Limit; k, v = c.Next() {
+			if string(k) <= query.After {
+				continue
+			}
+			// the index points to the recipient the reply is stored under
+			var message Message
+			found, err := getItem(tx.Bucket(messagesBucket).Bucket(v), string(k), &message)
+			if err != nil {
+				return err
+			}
+			if found {
+				messages = append(messages, message)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return query.newPage(messages), nil
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"math/rand"
+	. "server/common"
+	"strconv"
+	"time"
+)
+
+// ErrVersionConflict is returned when a user or group record changed since it was read.
+// Updates of single fields, like a membership or a blocked user, are applied again to the stored record instead,
+// it is returned for them only if they kept conflicting for maxVersionConflictRetries attempts.
+var ErrVersionConflict = errors.New("record was changed concurrently")
+
+// maxVersionConflictRetries is how often an update is applied again to the stored record after a conflicting write.
+const maxVersionConflictRetries = 10
+
+// versionConflictBackoff is the longest wait before the first retry, it doubles with every retry.
+const versionConflictBackoff = 10 * time.Millisecond
+
+// waitBeforeRetry waits a random time before the retry of a conflicting write, so that concurrent writers of the
+// same record, like members joining a group at once, do not keep conflicting with each other.
+func waitBeforeRetry(ctx context.Context, attempt int) error {
+	backoff := versionConflictBackoff << attempt
+	if backoff > time.Second {
+		backoff = time.Second
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int63n(int64(backoff)))):
+		return nil
+	}
+}
+
+// versionedPut returns the put of a record read with readVersion and written with the next version,
+// conditional on nobody else having written it in between. Records written before versions were added have no version,
+// they are read as version 0.
+func versionedPut(tableName string, record interface{}, readVersion int64) (*types.Put, error) {
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Put{
+		TableName:                aws.String(tableName),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#version) OR #version = :version"),
+		ExpressionAttributeNames: map[string]string{"#version": VersionAttribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(readVersion, 10)},
+		},
+	}, nil
+}
+
+// putVersioned writes the versioned put and returns ErrVersionConflict if the record changed since it was read.
+func (d *dynamoDBClient) putVersioned(ctx context.Context, put *types.Put) error {
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 put.TableName,
+		Item:                      put.Item,
+		ConditionExpression:       put.ConditionExpression,
+		ExpressionAttributeNames:  put.ExpressionAttributeNames,
+		ExpressionAttributeValues: put.ExpressionAttributeValues,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// isTransactionConflict returns true if the transaction was canceled because one of the first n items,
+// the versioned records, changed since they were read or were written by a concurrent transaction.
+func isTransactionConflict(err error, n int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for i, reason := range canceled.CancellationReasons {
+		code := aws.ToString(reason.Code)
+		if i < n && (code == "ConditionalCheckFailed" || code == "TransactionConflict") {
+			return true
+		}
+	}
+	return false
+}
+
+// updateUser applies the update to the user and writes it. If the user changed since it was read,
+// the update is applied again to the stored user, so that concurrent updates of different fields are not lost.
+func (d *dynamoDBClient) updateUser(ctx context.Context, user User, update func(user *User)) error {
+	for attempt := 0; ; attempt++ {
+		update(&user)
+		err := d.StoreUser(ctx, user)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxVersionConflictRetries {
+			return err
+		}
+		if err = waitBeforeRetry(ctx, attempt); err != nil {
+			return err
+		}
+		stored, err := d.getUserItem(ctx, user.UserId, true)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return fmt.Errorf("user %s not found", user.UserId)
+		}
+		user = *stored
+	}
+}
+
+// updateGroup applies the update to the group and writes it, see updateUser.
+func (d *dynamoDBClient) updateGroup(ctx context.Context, group Group, update func(group *Group)) error {
+	for attempt := 0; ; attempt++ {
+		update(&group)
+		err := d.StoreGroup(ctx, group)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxVersionConflictRetries {
+			return err
+		}
+		if err = waitBeforeRetry(ctx, attempt); err != nil {
+			return err
+		}
+		stored, err := d.getGroupItem(ctx, group.GroupId, true)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return fmt.Errorf("group %s not found", group.GroupId)
+		}
+		group = *stored
+	}
+}
+
+// updateMembership applies the update to the group and user and writes both, with the other items, in one transaction.
+// If the group or the user changed since they were read, the update is applied again to the stored records.
+func (d *dynamoDBClient) updateMembership(ctx context.Context, group Group, user User, update func(group *Group, user *User) error, items ...types.TransactWriteItem) error {
+	// both records are written in one transaction, so the cache must not keep either of them,
+	// also if the transaction failed, as it may have been applied nonetheless
+	defer d.cache.RemoveUser(ctx, user.UserId)
+	defer d.cache.RemoveGroup(ctx, group.GroupId)
+
+	for attempt := 0; ; attempt++ {
+		if err := update(&group, &user); err != nil {
+			return err
+		}
+		userPut, err := versionedPut(UsersTableName, nextUserVersion(user), user.Version)
+		if err != nil {
+			return err
+		}
+		groupPut, err := versionedPut(GroupsTableName, nextGroupVersion(group), group.Version)
+		if err != nil {
+			return err
+		}
+		_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: append([]types.TransactWriteItem{{Put: userPut}, {Put: groupPut}}, items...),
+		})
+		if !isTransactionConflict(err, 2) {
+			return err
+		}
+		if attempt == maxVersionConflictRetries {
+			return ErrVersionConflict
+		}
+		if err = waitBeforeRetry(ctx, attempt); err != nil {
+			return err
+		}
+
+		stored, err := d.getUserItem(ctx, user.UserId, true)
+		if err != nil {
+			return err
+		}
+		storedGroup, err := d.getGroupItem(ctx, group.GroupId, true)
+		if err != nil {
+			return err
+		}
+		if stored == nil || storedGroup == nil {
+			return fmt.Errorf("user %s or group %s not found", user.UserId, group.GroupId)
+		}
+		user, group = *stored, *storedGroup
+	}
+}
+
+func nextUserVersion(user User) User {
+	user.Version++
+	return user
+}
+
+func nextGroupVersion(group Group) Group {
+	group.Version++
+	return group
+}
@@ -8,16 +8,28 @@ import (
 	"server/common"
 	. "server/common"
 	"server/db"
+	"time"
 )
 
 type GroupHandlerInterface interface {
-	CreateGroup(ctx context.Context, req *CreateGroupRequest) (*CreateGroupResponse, error)
-	AddUserToGroup(ctx context.Context, groupId string, req *UserToGroupRequest) error
-	RemoveUserFromGroup(ctx context.Context, groupId string, req *UserToGroupRequest) error
+	CreateGroup(ctx context.Context, ownerId string, req *CreateGroupRequest) (*CreateGroupResponse, error)
+	AddUserToGroup(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	RemoveUserFromGroup(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	PromoteUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	DemoteUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	BanUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	UnbanUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error
+	DeleteGroup(ctx context.Context, actorId string, groupId string) error
+
+	CreateInvite(ctx context.Context, actorId string, groupId string, req *CreateInviteRequest) (*GroupInvite, error)
+	GetInvites(ctx context.Context, actorId string, groupId string) (*GetInvitesResponse, error)
+	RevokeInvite(ctx context.Context, actorId string, groupId string, token string) error
+	JoinGroup(ctx context.Context, userId string, token string) (*JoinGroupResponse, error)
 }
 
 type GroupHandler struct {
 	DBClient db.DynamoDBClientInterface
+	Delivery DeliveryPolicy // decides if new groups copy their messages to the member inboxes
 }
 
 type UserToGroupRequest struct {
@@ -31,54 +43,87 @@ type CreateGroupRequest struct {
 type CreateGroupResponse struct {
 	GroupId   string `json:"groupId"`
 	GroupName string `json:"groupName"`
+	OwnerId   string `json:"ownerId"`
 }
 
-func (handler *GroupHandler) CreateGroup(ctx context.Context, req *CreateGroupRequest) (*CreateGroupResponse, error) {
+// isAdmin returns true if the user can manage the group members, the owner is always an admin.
+func isAdmin(group *Group, userId string) bool {
+	return group.OwnerId == userId || group.Admins[userId]
+}
+
+// markJoined sets the read marker of the new member in the group conversation, so that the messages sent before the
+// user joined are not counted as unread. The member can still read them, a failure only changes the unread count.
+func (handler *GroupHandler) markJoined(ctx context.Context, groupId string, userId string) {
+	now := time.Now()
+	err := handler.DBClient.SetReadMarker(ctx, Conversation{
+		UserId:            userId,
+		ConversationId:    groupId,
+		Type:              ConversationGroup,
+		LastReadMessageId: MessageIdAfter(now.Unix()),
+		ReadAt:            now.Format(time.RFC3339),
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error setting read marker of user %s in group %s : %v", userId, groupId, err))
+	}
+}
+
+// CreateGroup creates a group owned by the creating user, who is also its first member.
+func (handler *GroupHandler) CreateGroup(ctx context.Context, ownerId string, req *CreateGroupRequest) (*CreateGroupResponse, error) {
+	owner, err := handler.getUser(ctx, ownerId)
+	if err != nil {
+		return nil, err
+	}
 
 	groupId := fmt.Sprintf("group-%s", uuid.New().String())
 
 	dbGroup := Group{
 		GroupId:   groupId,
 		GroupName: req.GroupName,
+		OwnerId:   ownerId,
+		Admins:    map[string]bool{},
 		Members:   map[string]bool{},
+		// the owner is the only member
+		FanOutOnWrite: handler.Delivery.FanOutOnWrite(1),
 	}
 
-	err := handler.DBClient.StoreGroup(ctx, dbGroup)
+	err = handler.DBClient.StoreGroup(ctx, dbGroup)
 	if err != nil {
 		// log error
 		slog.Error(fmt.Sprintf("Error storing group: %v", err))
 		return nil, &common.InternalServerError{Message: "Error storing group"}
 	}
-	slog.Info(fmt.Sprintf("Group created: %v", groupId))
+	err = handler.DBClient.AddUserToGroup(ctx, dbGroup, *owner)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error adding owner %s to group %s : %v", ownerId, groupId, err))
+		return nil, &common.InternalServerError{Message: "Error adding owner to group"}
+	}
+	handler.markJoined(ctx, groupId, ownerId)
+	slog.Info(fmt.Sprintf("Group created: %v, owner: %s", groupId, ownerId))
 
 	// return the group ID and name in the response
 	resp := CreateGroupResponse{
 		GroupId:   groupId,
 		GroupName: req.GroupName,
+		OwnerId:   ownerId,
 	}
 	return &resp, nil
 }
 
-func (handler *GroupHandler) AddUserToGroup(ctx context.Context, groupId string, req *UserToGroupRequest) error {
-
-	group, err := handler.DBClient.GetGroup(ctx, groupId)
+// AddUserToGroup adds a user to the group, only the owner and admins can add members.
+func (handler *GroupHandler) AddUserToGroup(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	group, err := handler.getGroup(ctx, groupId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error getting group %s : %v", groupId, err))
-		return &common.InternalServerError{Message: "Error getting group"}
+		return err
 	}
-	if group == nil {
-		slog.Error(fmt.Sprintf("Group %s not found", groupId))
-		return &common.NotFoundError{Message: "Group not found"}
+
+	if !isAdmin(group, actorId) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to add members to group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner and admins can add members"}
 	}
 
-	user, err := handler.DBClient.GetUser(ctx, req.UserId)
+	user, err := handler.getUser(ctx, req.UserId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error getting user %s: %v", req.UserId, err))
-		return &common.InternalServerError{Message: "Error getting user"}
-	}
-	if user == nil {
-		slog.Error(fmt.Sprintf("User %s not found", req.UserId))
-		return &common.NotFoundError{Message: "User not found"}
+		return err
 	}
 
 	// check if user is already a member
@@ -86,6 +131,10 @@ func (handler *GroupHandler) AddUserToGroup(ctx context.Context, groupId string,
 		slog.Error(fmt.Sprintf("User %s is already a member of the group %s", req.UserId, groupId))
 		return &common.BadRequestError{Message: "User is already a member of the group"}
 	}
+	if group.Banned[req.UserId] {
+		slog.Error(fmt.Sprintf("User %s is banned from the group %s", req.UserId, groupId))
+		return &common.ForbiddenError{Message: "User is banned from the group"}
+	}
 
 	// add user to group
 	err = handler.DBClient.AddUserToGroup(ctx, *group, *user)
@@ -93,31 +142,38 @@ func (handler *GroupHandler) AddUserToGroup(ctx context.Context, groupId string,
 		slog.Error(fmt.Sprintf("Error adding %s user to group %s : %v", req.UserId, groupId, err))
 		return &common.InternalServerError{Message: "Error adding user to group"}
 	}
+	handler.markJoined(ctx, groupId, req.UserId)
 	slog.Info(fmt.Sprintf("User %s added to group: %s", req.UserId, groupId))
 
 	return nil
 }
 
-func (handler *GroupHandler) RemoveUserFromGroup(ctx context.Context, groupId string, req *UserToGroupRequest) error {
-	group, err := handler.DBClient.GetGroup(ctx, groupId)
+// RemoveUserFromGroup removes a user from the group.
+// Members can leave the group, the owner and admins can remove members, and only the owner can remove admins.
+// The owner can not leave the group, the group should be deleted instead.
+func (handler *GroupHandler) RemoveUserFromGroup(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	group, err := handler.getGroup(ctx, groupId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error getting group %s : %v", groupId, err))
-		return &common.InternalServerError{Message: "Error getting group"}
-
+		return err
 	}
-	if group == nil {
-		slog.Error(fmt.Sprintf("Group %s not found", groupId))
-		return &common.NotFoundError{Message: "Group not found"}
+
+	switch {
+	case req.UserId == group.OwnerId:
+		slog.Error(fmt.Sprintf("User %s can not remove the owner of group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "The group owner can not be removed"}
+	case req.UserId == actorId:
+		// members can always leave
+	case group.Admins[req.UserId] && actorId != group.OwnerId:
+		slog.Error(fmt.Sprintf("User %s is not allowed to remove admin %s from group %s", actorId, req.UserId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner can remove admins"}
+	case !isAdmin(group, actorId):
+		slog.Error(fmt.Sprintf("User %s is not allowed to remove members from group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner and admins can remove members"}
 	}
 
-	user, err := handler.DBClient.GetUser(ctx, req.UserId)
+	user, err := handler.getUser(ctx, req.UserId)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error getting user %s: %v", req.UserId, err))
-		return &common.InternalServerError{Message: "Error getting user"}
-	}
-	if user == nil {
-		slog.Error(fmt.Sprintf("User %s not found", req.UserId))
-		return &common.NotFoundError{Message: "User not found"}
+		return err
 	}
 
 	// check if user is not a member
@@ -136,3 +192,172 @@ func (handler *GroupHandler) RemoveUserFromGroup(ctx context.Context, groupId st
 
 	return nil
 }
+
+// PromoteUser makes a member an admin of the group, only the owner can promote members.
+func (handler *GroupHandler) PromoteUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	return handler.setAdmin(ctx, actorId, groupId, req.UserId, true)
+}
+
+// DemoteUser makes an admin a regular member of the group, only the owner can demote admins.
+func (handler *GroupHandler) DemoteUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	return handler.setAdmin(ctx, actorId, groupId, req.UserId, false)
+}
+
+func (handler *GroupHandler) setAdmin(ctx context.Context, actorId string, groupId string, userId string, admin bool) error {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+
+	if actorId != group.OwnerId {
+		slog.Error(fmt.Sprintf("User %s is not allowed to change the admins of group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner can change admins"}
+	}
+	if userId == group.OwnerId {
+		slog.Error(fmt.Sprintf("User %s is the owner of group %s", userId, groupId))
+		return &common.BadRequestError{Message: "User is the group owner"}
+	}
+	if !group.Members[userId] {
+		slog.Error(fmt.Sprintf("User %s is not a member of the group %s", userId, groupId))
+		return &common.BadRequestError{Message: "User is not a member of the group"}
+	}
+	if group.Admins[userId] == admin {
+		slog.Error(fmt.Sprintf("User %s admin of group %s is already %v", userId, groupId, admin))
+		if admin {
+			return &common.BadRequestError{Message: "User is already an admin of the group"}
+		}
+		return &common.BadRequestError{Message: "User is not an admin of the group"}
+	}
+
+	err = handler.DBClient.SetGroupAdmin(ctx, *group, userId, admin)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error setting %s admin of group %s to %v : %v", userId, groupId, admin, err))
+		return &common.InternalServerError{Message: "Error updating group admins"}
+	}
+	slog.Info(fmt.Sprintf("User %s admin of group %s set to %v", userId, groupId, admin))
+
+	return nil
+}
+
+// BanUser removes a user from the group and keeps them from being added again or joining with an invite.
+// The owner and admins can ban members and users that are not members, only the owner can ban admins.
+func (handler *GroupHandler) BanUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !isAdmin(group, actorId):
+		slog.Error(fmt.Sprintf("User %s is not allowed to ban users from group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner and admins can ban users"}
+	case req.UserId == group.OwnerId:
+		slog.Error(fmt.Sprintf("User %s can not ban the owner of group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "The group owner can not be banned"}
+	case group.Admins[req.UserId] && actorId != group.OwnerId:
+		slog.Error(fmt.Sprintf("User %s is not allowed to ban admin %s from group %s", actorId, req.UserId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner can ban admins"}
+	case group.Banned[req.UserId]:
+		slog.Error(fmt.Sprintf("User %s is already banned from the group %s", req.UserId, groupId))
+		return &common.BadRequestError{Message: "User is already banned from the group"}
+	}
+
+	user, err := handler.getUser(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+
+	err = handler.DBClient.BanUserFromGroup(ctx, *group, *user)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error banning %s user from group %s : %v", req.UserId, groupId, err))
+		return &common.InternalServerError{Message: "Error banning user from group"}
+	}
+	slog.Info(fmt.Sprintf("User %s banned from group %s by %s", req.UserId, groupId, actorId))
+
+	return nil
+}
+
+// UnbanUser lifts the ban of a user, who can then be added again, only the owner and admins can unban.
+func (handler *GroupHandler) UnbanUser(ctx context.Context, actorId string, groupId string, req *UserToGroupRequest) error {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+
+	if !isAdmin(group, actorId) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to unban users from group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner and admins can unban users"}
+	}
+	if !group.Banned[req.UserId] {
+		slog.Error(fmt.Sprintf("User %s is not banned from the group %s", req.UserId, groupId))
+		return &common.BadRequestError{Message: "User is not banned from the group"}
+	}
+
+	err = handler.DBClient.UnbanUserFromGroup(ctx, *group, req.UserId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error unbanning %s user from group %s : %v", req.UserId, groupId, err))
+		return &common.InternalServerError{Message: "Error unbanning user from group"}
+	}
+	slog.Info(fmt.Sprintf("User %s unbanned from group %s by %s", req.UserId, groupId, actorId))
+
+	return nil
+}
+
+// DeleteGroup deletes the group and removes it from all members, only the owner can delete the group.
+func (handler *GroupHandler) DeleteGroup(ctx context.Context, actorId string, groupId string) error {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+
+	if actorId != group.OwnerId {
+		slog.Error(fmt.Sprintf("User %s is not allowed to delete group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner can delete the group"}
+	}
+
+	err = handler.DBClient.DeleteGroup(ctx, *group)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error deleting group %s : %v", groupId, err))
+		return &common.InternalServerError{Message: "Error deleting group"}
+	}
+	slog.Info(fmt.Sprintf("Group deleted: %s", groupId))
+
+	return nil
+}
+
+func (handler *GroupHandler) getGroup(ctx context.Context, groupId string) (*Group, error) {
+	group, err := handler.DBClient.GetGroup(ctx, groupId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group %s : %v", groupId, err))
+		return nil, &common.InternalServerError{Message: "Error getting group"}
+	}
+	if group == nil {
+		slog.Error(fmt.Sprintf("Group %s not found", groupId))
+		return nil, &common.NotFoundError{Message: "Group not found"}
+	}
+	if group.OwnerId == "" && len(group.Members) > 0 {
+		// groups created before owners were recorded have no owner, and the join order of their members is not known,
+		// so they pass to their first member by user ID like the group of a deleted owner, see db.NextOwnerId
+		ownerId := db.NextOwnerId(*group)
+		if err = handler.DBClient.SetGroupOwner(ctx, *group, ownerId); err != nil {
+			slog.Error(fmt.Sprintf("Error setting owner %s of group %s : %v", ownerId, groupId, err))
+			return nil, &common.InternalServerError{Message: "Error getting group"}
+		}
+		slog.Info(fmt.Sprintf("User %s is the owner of legacy group %s", ownerId, groupId))
+		group.OwnerId = ownerId
+	}
+	return group, nil
+}
+
+func (handler *GroupHandler) getUser(ctx context.Context, userId string) (*User, error) {
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user %s: %v", userId, err))
+		return nil, &common.InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User %s not found", userId))
+		return nil, &common.NotFoundError{Message: "User not found"}
+	}
+	return user, nil
+}
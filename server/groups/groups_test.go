@@ -8,6 +8,7 @@ import (
 	. "server/common"
 	"server/db"
 	"testing"
+	"time"
 )
 
 func TestCreateGroup(t *testing.T) {
@@ -15,6 +16,8 @@ func TestCreateGroup(t *testing.T) {
 	handler := GroupHandler{
 		DBClient: db.NewMockDBClient(),
 	}
+	handler.DBClient.StoreUser(ctx, User{UserId: "test-owner"})
+
 	t.Run("Create group successfully", func(t *testing.T) {
 		// create a new request
 		req := CreateGroupRequest{
@@ -22,11 +25,38 @@ func TestCreateGroup(t *testing.T) {
 		}
 
 		// seed the request to the handler
-		resp, err := handler.CreateGroup(ctx, &req)
+		resp, err := handler.CreateGroup(ctx, "test-owner", &req)
 		assert.NoError(t, err)
 		assert.NotEmpty(t, resp.GroupId)
 		assert.Equal(t, req.GroupName, resp.GroupName)
+		assert.Equal(t, "test-owner", resp.OwnerId)
+
+		// the owner is the first member
+		group, _ := handler.DBClient.GetGroup(ctx, resp.GroupId)
+		assert.Equal(t, "test-owner", group.OwnerId)
+		assert.Equal(t, map[string]bool{"test-owner": true}, group.Members)
+		owner, _ := handler.DBClient.GetUser(ctx, "test-owner")
+		assert.Contains(t, owner.Groups, resp.GroupId)
+		assert.False(t, group.FanOutOnWrite)
+	})
 
+	t.Run("Create group with fan-out-on-write delivery", func(t *testing.T) {
+		handler := GroupHandler{DBClient: handler.DBClient, Delivery: DeliveryPolicy{Mode: DeliveryBySize, MaxInboxGroupSize: 10}}
+		resp, err := handler.CreateGroup(ctx, "test-owner", &CreateGroupRequest{GroupName: "test-group"})
+		assert.NoError(t, err)
+
+		group, _ := handler.DBClient.GetGroup(ctx, resp.GroupId)
+		assert.True(t, group.FanOutOnWrite)
+	})
+
+	t.Run("owner not found", func(t *testing.T) {
+		req := CreateGroupRequest{
+			GroupName: "test-group",
+		}
+		resp, err := handler.CreateGroup(ctx, "test-missing", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.NotFoundError{}, err)
+		assert.Nil(t, resp)
 	})
 
 	t.Run("db error", func(t *testing.T) {
@@ -39,7 +69,7 @@ func TestCreateGroup(t *testing.T) {
 		req := CreateGroupRequest{
 			GroupName: "test-group",
 		}
-		resp, err := handler.CreateGroup(ctx, &req)
+		resp, err := handler.CreateGroup(ctx, "test-owner", &req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.InternalServerError{}, err)
 		assert.Nil(t, resp)
@@ -48,20 +78,34 @@ func TestCreateGroup(t *testing.T) {
 
 }
 
+// storeTestGroup stores a group owned by test-owner with the given admins and members, all stored as users.
+func storeTestGroup(handler GroupHandler, groupId string, admins []string, members []string) {
+	ctx := context.Background()
+	group := Group{GroupId: groupId, OwnerId: "test-owner", Admins: map[string]bool{}}
+	for _, admin := range admins {
+		group.Admins[admin] = true
+	}
+	handler.DBClient.StoreGroup(ctx, group)
+	for _, userId := range append(append([]string{"test-owner"}, admins...), members...) {
+		handler.DBClient.StoreUser(ctx, User{UserId: userId})
+		handler.DBClient.AddUserToGroup(ctx, group, User{UserId: userId})
+	}
+}
+
 func TestAddUserToGroup(t *testing.T) {
 	ctx := context.Background()
 	handler := GroupHandler{
 		DBClient: db.NewMockDBClient(),
 	}
 	t.Run("Add user to group successfully", func(t *testing.T) {
+		storeTestGroup(handler, "test-group-1", nil, nil)
 		handler.DBClient.StoreUser(context.Background(), User{UserId: "test-user-1"})
-		handler.DBClient.StoreGroup(context.Background(), Group{GroupId: "test-group-1"})
 		// create a new request
 		req := UserToGroupRequest{
 			UserId: "test-user-1",
 		}
 
-		err := handler.AddUserToGroup(ctx, "test-group-1", &req)
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group-1", &req)
 		assert.NoError(t, err)
 
 		user, _ := handler.DBClient.GetUser(ctx, "test-user-1")
@@ -77,35 +121,75 @@ func TestAddUserToGroup(t *testing.T) {
 		req := UserToGroupRequest{
 			UserId: "test-user-2",
 		}
-		err := handler.AddUserToGroup(ctx, "test-group-2", &req)
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group-2", &req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.NotFoundError{}, err)
 	})
 
 	t.Run("invalid user", func(t *testing.T) {
-		handler.DBClient.StoreGroup(ctx, Group{GroupId: "test-group-3"})
+		storeTestGroup(handler, "test-group-3", nil, nil)
 		// create a new request
 		req := UserToGroupRequest{
 			UserId: "test-user-3",
 		}
-		err := handler.AddUserToGroup(ctx, "test-group-3", &req)
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group-3", &req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.NotFoundError{}, err)
 	})
 
 	t.Run("user already in group", func(t *testing.T) {
+		storeTestGroup(handler, "test-group-4", nil, nil)
 		handler.DBClient.StoreUser(ctx, User{UserId: "test-user-4"})
-		handler.DBClient.StoreGroup(ctx, Group{GroupId: "test-group-4"})
 		req := UserToGroupRequest{
 			UserId: "test-user-4",
 		}
-		handler.AddUserToGroup(ctx, "test-group-4", &req)
+		handler.AddUserToGroup(ctx, "test-owner", "test-group-4", &req)
 
 		// add the user again
-		err := handler.AddUserToGroup(ctx, "test-group-4", &req)
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group-4", &req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.BadRequestError{}, err)
 	})
+
+	t.Run("admin adds user", func(t *testing.T) {
+		storeTestGroup(handler, "test-group-5", []string{"test-admin"}, nil)
+		handler.DBClient.StoreUser(ctx, User{UserId: "test-user-5"})
+		req := UserToGroupRequest{
+			UserId: "test-user-5",
+		}
+		err := handler.AddUserToGroup(ctx, "test-admin", "test-group-5", &req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("member can not add users", func(t *testing.T) {
+		storeTestGroup(handler, "test-group-6", nil, []string{"test-member"})
+		handler.DBClient.StoreUser(ctx, User{UserId: "test-user-6"})
+		req := UserToGroupRequest{
+			UserId: "test-user-6",
+		}
+		err := handler.AddUserToGroup(ctx, "test-member", "test-group-6", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group-6")
+		assert.NotContains(t, group.Members, "test-user-6")
+	})
+
+	t.Run("earlier messages are not unread for the new member", func(t *testing.T) {
+		storeTestGroup(handler, "test-group-7", nil, nil)
+		handler.DBClient.StoreUser(ctx, User{UserId: "test-user-7"})
+		messageId := NewMessageId(time.Now().Add(-time.Minute))
+		handler.DBClient.StoreMessage(ctx, Message{RecipientId: "test-group-7", MessageId: messageId, ChangeId: messageId, SenderId: "test-owner"})
+
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group-7", &UserToGroupRequest{UserId: "test-user-7"})
+		assert.NoError(t, err)
+
+		conversation, _ := handler.DBClient.GetConversation(ctx, "test-user-7", "test-group-7")
+		assert.NotNil(t, conversation)
+		count, err := handler.DBClient.CountUnreadMessages(ctx, *conversation)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
 }
 
 func TestRemoveUserFromGroup(t *testing.T) {
@@ -113,17 +197,260 @@ func TestRemoveUserFromGroup(t *testing.T) {
 	handler := GroupHandler{
 		DBClient: db.NewMockDBClient(),
 	}
-	t.Run("Remove user from group successfully", func(t *testing.T) {
-		handler.DBClient.StoreUser(ctx, User{UserId: "test-user-1"})
-		handler.DBClient.StoreGroup(ctx, Group{GroupId: "test-group-1"})
-		handler.DBClient.AddUserToGroup(ctx, Group{GroupId: "test-group-1"}, User{UserId: "test-user-1"})
+	storeTestGroup(handler, "test-group", []string{"test-admin-1", "test-admin-2"}, []string{"test-user-1", "test-user-2", "test-user-3"})
 
+	t.Run("Remove user from group successfully", func(t *testing.T) {
 		// create a new request
 		req := UserToGroupRequest{
 			UserId: "test-user-1",
 		}
-		err := handler.RemoveUserFromGroup(ctx, "test-group-1", &req)
+		err := handler.RemoveUserFromGroup(ctx, "test-admin-1", "test-group", &req)
+		assert.NoError(t, err)
+
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.NotContains(t, group.Members, "test-user-1")
+	})
+
+	t.Run("member leaves the group", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-user-2",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-user-2", "test-group", &req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("member can not remove other members", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-admin-2",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-user-3", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("admin can not remove admins", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-admin-2",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-admin-1", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("owner removes admin", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-admin-2",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-owner", "test-group", &req)
+		assert.NoError(t, err)
+
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.NotContains(t, group.Members, "test-admin-2")
+		assert.NotContains(t, group.Admins, "test-admin-2")
+	})
+
+	t.Run("owner can not be removed", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-owner",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-owner", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("user not in group", func(t *testing.T) {
+		req := UserToGroupRequest{
+			UserId: "test-user-1",
+		}
+		err := handler.RemoveUserFromGroup(ctx, "test-owner", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+}
+
+func TestPromoteAndDemoteUser(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", []string{"test-admin"}, []string{"test-user"})
+	req := UserToGroupRequest{
+		UserId: "test-user",
+	}
+
+	t.Run("owner promotes and demotes member", func(t *testing.T) {
+		err := handler.PromoteUser(ctx, "test-owner", "test-group", &req)
+		assert.NoError(t, err)
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.True(t, group.Admins["test-user"])
+
+		err = handler.DemoteUser(ctx, "test-owner", "test-group", &req)
+		assert.NoError(t, err)
+		group, _ = handler.DBClient.GetGroup(ctx, "test-group")
+		assert.False(t, group.Admins["test-user"])
+	})
+
+	t.Run("admin can not promote", func(t *testing.T) {
+		err := handler.PromoteUser(ctx, "test-admin", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("demote a member", func(t *testing.T) {
+		err := handler.DemoteUser(ctx, "test-owner", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("promote a non member", func(t *testing.T) {
+		err := handler.PromoteUser(ctx, "test-owner", "test-group", &UserToGroupRequest{UserId: "test-other"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+}
+
+func TestBanUser(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", []string{"test-admin", "test-admin-2"}, []string{"test-user"})
+	req := UserToGroupRequest{
+		UserId: "test-user",
+	}
+
+	t.Run("admin bans member", func(t *testing.T) {
+		err := handler.BanUser(ctx, "test-admin", "test-group", &req)
 		assert.NoError(t, err)
 
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.NotContains(t, group.Members, "test-user")
+		assert.True(t, group.Banned["test-user"])
+		user, _ := handler.DBClient.GetUser(ctx, "test-user")
+		assert.NotContains(t, user.Groups, "test-group")
+	})
+
+	t.Run("banned user can not be added again", func(t *testing.T) {
+		err := handler.AddUserToGroup(ctx, "test-owner", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("banned user can not join with an invite", func(t *testing.T) {
+		invite, _ := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{})
+		_, err := handler.JoinGroup(ctx, "test-user", invite.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+
+		// the failed join does not count as a use
+		stored, _ := handler.DBClient.GetInvite(ctx, invite.Token)
+		assert.Zero(t, stored.Uses)
+	})
+
+	t.Run("already banned", func(t *testing.T) {
+		err := handler.BanUser(ctx, "test-admin", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("unbanned user can be added again", func(t *testing.T) {
+		err := handler.UnbanUser(ctx, "test-admin", "test-group", &req)
+		assert.NoError(t, err)
+		err = handler.AddUserToGroup(ctx, "test-owner", "test-group", &req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("not banned", func(t *testing.T) {
+		err := handler.UnbanUser(ctx, "test-admin", "test-group", &req)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("member can not ban", func(t *testing.T) {
+		err := handler.BanUser(ctx, "test-user", "test-group", &UserToGroupRequest{UserId: "test-admin"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("admin can not ban admins", func(t *testing.T) {
+		err := handler.BanUser(ctx, "test-admin", "test-group", &UserToGroupRequest{UserId: "test-admin-2"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("owner can not be banned", func(t *testing.T) {
+		err := handler.BanUser(ctx, "test-admin", "test-group", &UserToGroupRequest{UserId: "test-owner"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("ban a non member", func(t *testing.T) {
+		handler.DBClient.StoreUser(ctx, User{UserId: "test-other"})
+		err := handler.BanUser(ctx, "test-owner", "test-group", &UserToGroupRequest{UserId: "test-other"})
+		assert.NoError(t, err)
+		err = handler.AddUserToGroup(ctx, "test-owner", "test-group", &UserToGroupRequest{UserId: "test-other"})
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+}
+
+func TestLegacyGroup(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	// created before owners were recorded
+	group := Group{GroupId: "test-group", Admins: map[string]bool{}}
+	handler.DBClient.StoreGroup(ctx, group)
+	for _, userId := range []string{"test-user-b", "test-user-a", "test-user-c", "test-user-d"} {
+		handler.DBClient.StoreUser(ctx, User{UserId: userId})
+	}
+	for _, userId := range []string{"test-user-b", "test-user-a", "test-user-c"} {
+		handler.DBClient.AddUserToGroup(ctx, group, User{UserId: userId})
+	}
+
+	t.Run("other members can not manage the group", func(t *testing.T) {
+		err := handler.AddUserToGroup(ctx, "test-user-b", "test-group", &UserToGroupRequest{UserId: "test-user-d"})
+		assert.IsType(t, &common.ForbiddenError{}, err)
+		err = handler.DeleteGroup(ctx, "test-user-b", "test-group")
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("first member by user ID is the owner", func(t *testing.T) {
+		stored, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.Equal(t, "test-user-a", stored.OwnerId)
+
+		assert.NoError(t, handler.PromoteUser(ctx, "test-user-a", "test-group", &UserToGroupRequest{UserId: "test-user-b"}))
+		assert.NoError(t, handler.AddUserToGroup(ctx, "test-user-b", "test-group", &UserToGroupRequest{UserId: "test-user-d"}))
+		assert.NoError(t, handler.DeleteGroup(ctx, "test-user-a", "test-group"))
+	})
+}
+
+func TestDeleteGroup(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", []string{"test-admin"}, []string{"test-user"})
+
+	t.Run("admin can not delete the group", func(t *testing.T) {
+		err := handler.DeleteGroup(ctx, "test-admin", "test-group")
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("owner deletes the group", func(t *testing.T) {
+		err := handler.DeleteGroup(ctx, "test-owner", "test-group")
+		assert.NoError(t, err)
+
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.Nil(t, group)
+		user, _ := handler.DBClient.GetUser(ctx, "test-user")
+		assert.NotContains(t, user.Groups, "test-group")
+	})
+
+	t.Run("group not found", func(t *testing.T) {
+		err := handler.DeleteGroup(ctx, "test-owner", "test-group")
+		assert.Error(t, err)
+		assert.IsType(t, &common.NotFoundError{}, err)
 	})
 }
@@ -0,0 +1,179 @@
+package groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"server/common"
+	. "server/common"
+	"server/db"
+	"time"
+)
+
+type CreateInviteRequest struct {
+	ExpiresIn int64 `json:"expiresIn"` // seconds until the invite expires, 0 never expires
+	MaxUses   int   `json:"maxUses"`   // 0 is unlimited
+}
+
+type GetInvitesResponse struct {
+	Invites []GroupInvite `json:"invites"`
+}
+
+type JoinGroupResponse struct {
+	GroupId   string `json:"groupId"`
+	GroupName string `json:"groupName"`
+}
+
+// CreateInvite creates an invite token for the group, only the owner and admins can create invites.
+func (handler *GroupHandler) CreateInvite(ctx context.Context, actorId string, groupId string, req *CreateInviteRequest) (*GroupInvite, error) {
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		slog.Error(fmt.Sprintf("Invalid invite request: %v", req))
+		return nil, &common.BadRequestError{Message: "expiresIn and maxUses must not be negative"}
+	}
+
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(group, actorId) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to create invites for group %s", actorId, groupId))
+		return nil, &common.ForbiddenError{Message: "Only the group owner and admins can create invites"}
+	}
+
+	now := time.Now()
+	invite := GroupInvite{
+		Token:     uuid.New().String(),
+		GroupId:   groupId,
+		CreatedBy: actorId,
+		CreatedAt: now.Format(time.RFC3339),
+		MaxUses:   req.MaxUses,
+	}
+	if req.ExpiresIn > 0 {
+		invite.ExpiresAt = now.Unix() + req.ExpiresIn
+	}
+
+	err = handler.DBClient.StoreInvite(ctx, invite)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error storing invite for group %s : %v", groupId, err))
+		return nil, &common.InternalServerError{Message: "Error storing invite"}
+	}
+	slog.Info(fmt.Sprintf("Invite created for group %s by %s", groupId, actorId))
+
+	return &invite, nil
+}
+
+// GetInvites returns the invites of the group that can still be used, only the owner and admins can list invites.
+func (handler *GroupHandler) GetInvites(ctx context.Context, actorId string, groupId string) (*GetInvitesResponse, error) {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(group, actorId) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to list invites of group %s", actorId, groupId))
+		return nil, &common.ForbiddenError{Message: "Only the group owner and admins can list invites"}
+	}
+
+	invites, err := handler.DBClient.GetGroupInvites(ctx, groupId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting invites of group %s : %v", groupId, err))
+		return nil, &common.InternalServerError{Message: "Error getting invites"}
+	}
+
+	// expired invites may still be stored until they are cleaned up
+	now := time.Now()
+	valid := make([]GroupInvite, 0, len(invites))
+	for _, invite := range invites {
+		if !invite.Expired(now) && !invite.UsedUp() {
+			valid = append(valid, invite)
+		}
+	}
+	return &GetInvitesResponse{Invites: valid}, nil
+}
+
+// RevokeInvite deletes an invite of the group, only the owner and admins can revoke invites.
+func (handler *GroupHandler) RevokeInvite(ctx context.Context, actorId string, groupId string, token string) error {
+	group, err := handler.getGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+	if !isAdmin(group, actorId) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to revoke invites of group %s", actorId, groupId))
+		return &common.ForbiddenError{Message: "Only the group owner and admins can revoke invites"}
+	}
+
+	invite, err := handler.DBClient.GetInvite(ctx, token)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting invite %s : %v", token, err))
+		return &common.InternalServerError{Message: "Error getting invite"}
+	}
+	if invite == nil || invite.GroupId != groupId {
+		slog.Error(fmt.Sprintf("Invite %s of group %s not found", token, groupId))
+		return &common.NotFoundError{Message: "Invite not found"}
+	}
+
+	err = handler.DBClient.DeleteInvite(ctx, token)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error deleting invite %s : %v", token, err))
+		return &common.InternalServerError{Message: "Error deleting invite"}
+	}
+	slog.Info(fmt.Sprintf("Invite %s of group %s revoked by %s", token, groupId, actorId))
+
+	return nil
+}
+
+// JoinGroup adds the user to the group of the invite and counts the invite use.
+func (handler *GroupHandler) JoinGroup(ctx context.Context, userId string, token string) (*JoinGroupResponse, error) {
+	invite, err := handler.DBClient.GetInvite(ctx, token)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting invite %s : %v", token, err))
+		return nil, &common.InternalServerError{Message: "Error getting invite"}
+	}
+	if invite == nil {
+		slog.Error(fmt.Sprintf("Invite %s not found", token))
+		return nil, &common.NotFoundError{Message: "Invite not found"}
+	}
+	if invite.Expired(time.Now()) || invite.UsedUp() {
+		slog.Error(fmt.Sprintf("Invite %s is expired or used up", token))
+		return nil, &common.BadRequestError{Message: "Invite is expired or used up"}
+	}
+
+	group, err := handler.getGroup(ctx, invite.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// check if user is already a member, so that the invite use is not counted
+	if group.Members[userId] {
+		slog.Error(fmt.Sprintf("User %s is already a member of the group %s", userId, group.GroupId))
+		return nil, &common.BadRequestError{Message: "User is already a member of the group"}
+	}
+	if group.Banned[userId] {
+		slog.Error(fmt.Sprintf("User %s is banned from the group %s", userId, group.GroupId))
+		return nil, &common.ForbiddenError{Message: "User is banned from the group"}
+	}
+
+	err = handler.DBClient.JoinGroupWithInvite(ctx, *invite, *group, *user)
+	if errors.Is(err, db.ErrInviteUnavailable) {
+		slog.Error(fmt.Sprintf("Invite %s was revoked, expired or used up", token))
+		return nil, &common.BadRequestError{Message: "Invite is expired or used up"}
+	}
+	if errors.Is(err, db.ErrUserBanned) {
+		// banned after the group was read
+		slog.Error(fmt.Sprintf("User %s is banned from the group %s", userId, group.GroupId))
+		return nil, &common.ForbiddenError{Message: "User is banned from the group"}
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error adding %s user to group %s with invite %s : %v", userId, group.GroupId, token, err))
+		return nil, &common.InternalServerError{Message: "Error adding user to group"}
+	}
+	handler.markJoined(ctx, group.GroupId, userId)
+	slog.Info(fmt.Sprintf("User %s joined group %s with invite %s", userId, group.GroupId, token))
+
+	return &JoinGroupResponse{GroupId: group.GroupId, GroupName: group.GroupName}, nil
+}
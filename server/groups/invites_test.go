@@ -0,0 +1,184 @@
+package groups
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"server/common"
+	. "server/common"
+	"server/db"
+	"testing"
+	"time"
+)
+
+func TestCreateInvite(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", []string{"test-admin"}, []string{"test-member"})
+
+	t.Run("Create invite successfully", func(t *testing.T) {
+		invite, err := handler.CreateInvite(ctx, "test-admin", "test-group", &CreateInviteRequest{ExpiresIn: 60, MaxUses: 2})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, invite.Token)
+		assert.Equal(t, "test-group", invite.GroupId)
+		assert.Equal(t, "test-admin", invite.CreatedBy)
+		assert.Equal(t, 2, invite.MaxUses)
+		assert.InDelta(t, time.Now().Unix()+60, invite.ExpiresAt, 1)
+
+		stored, _ := handler.DBClient.GetInvite(ctx, invite.Token)
+		assert.Equal(t, invite, stored)
+	})
+
+	t.Run("invite without limits", func(t *testing.T) {
+		invite, err := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{})
+		assert.NoError(t, err)
+		assert.Zero(t, invite.ExpiresAt)
+		assert.Zero(t, invite.MaxUses)
+	})
+
+	t.Run("member can not create invites", func(t *testing.T) {
+		invite, err := handler.CreateInvite(ctx, "test-member", "test-group", &CreateInviteRequest{})
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+		assert.Nil(t, invite)
+	})
+
+	t.Run("negative limits", func(t *testing.T) {
+		_, err := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{MaxUses: -1})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+}
+
+func TestGetAndRevokeInvites(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", nil, []string{"test-member"})
+	storeTestGroup(handler, "test-other-group", nil, nil)
+	invite, _ := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{})
+	handler.CreateInvite(ctx, "test-owner", "test-other-group", &CreateInviteRequest{})
+	// an expired invite that was not cleaned up yet
+	handler.DBClient.StoreInvite(ctx, GroupInvite{Token: "test-expired", GroupId: "test-group", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	t.Run("list valid invites", func(t *testing.T) {
+		resp, err := handler.GetInvites(ctx, "test-owner", "test-group")
+		assert.NoError(t, err)
+		assert.Equal(t, []GroupInvite{*invite}, resp.Invites)
+	})
+
+	t.Run("member can not list invites", func(t *testing.T) {
+		_, err := handler.GetInvites(ctx, "test-member", "test-group")
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("invite of another group", func(t *testing.T) {
+		err := handler.RevokeInvite(ctx, "test-owner", "test-other-group", invite.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+
+	t.Run("revoke invite", func(t *testing.T) {
+		err := handler.RevokeInvite(ctx, "test-owner", "test-group", invite.Token)
+		assert.NoError(t, err)
+
+		stored, _ := handler.DBClient.GetInvite(ctx, invite.Token)
+		assert.Nil(t, stored)
+	})
+}
+
+// staleGroupStore returns the group as it was read before, like a cached group.
+type staleGroupStore struct {
+	*db.MockDBClient
+	group Group
+}
+
+func (s *staleGroupStore) GetGroup(ctx context.Context, groupId string) (*Group, error) {
+	group := s.group
+	return &group, nil
+}
+
+func TestJoinGroup(t *testing.T) {
+	ctx := context.Background()
+	handler := GroupHandler{
+		DBClient: db.NewMockDBClient(),
+	}
+	storeTestGroup(handler, "test-group", nil, nil)
+	for _, userId := range []string{"test-user-1", "test-user-2", "test-user-3"} {
+		handler.DBClient.StoreUser(ctx, User{UserId: userId})
+	}
+	invite, _ := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{MaxUses: 1})
+
+	t.Run("Join group successfully", func(t *testing.T) {
+		resp, err := handler.JoinGroup(ctx, "test-user-1", invite.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "test-group", resp.GroupId)
+
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		assert.Contains(t, group.Members, "test-user-1")
+		user, _ := handler.DBClient.GetUser(ctx, "test-user-1")
+		assert.Contains(t, user.Groups, "test-group")
+		stored, _ := handler.DBClient.GetInvite(ctx, invite.Token)
+		assert.Equal(t, 1, stored.Uses)
+		// the messages sent before joining are read
+		conversation, _ := handler.DBClient.GetConversation(ctx, "test-user-1", "test-group")
+		assert.NotNil(t, conversation)
+		assert.NotEmpty(t, conversation.LastReadMessageId)
+	})
+
+	t.Run("invite used up", func(t *testing.T) {
+		_, err := handler.JoinGroup(ctx, "test-user-2", invite.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("invite expired", func(t *testing.T) {
+		handler.DBClient.StoreInvite(ctx, GroupInvite{Token: "test-expired", GroupId: "test-group", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+		_, err := handler.JoinGroup(ctx, "test-user-2", "test-expired")
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("already a member", func(t *testing.T) {
+		unlimited, _ := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{})
+		_, err := handler.JoinGroup(ctx, "test-user-1", unlimited.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+
+		// the failed join does not count as a use
+		stored, _ := handler.DBClient.GetInvite(ctx, unlimited.Token)
+		assert.Zero(t, stored.Uses)
+	})
+
+	t.Run("banned user", func(t *testing.T) {
+		unlimited, _ := handler.CreateInvite(ctx, "test-owner", "test-group", &CreateInviteRequest{})
+		group, _ := handler.DBClient.GetGroup(ctx, "test-group")
+		user, _ := handler.DBClient.GetUser(ctx, "test-user-2")
+		handler.DBClient.BanUserFromGroup(ctx, *group, *user)
+
+		_, err := handler.JoinGroup(ctx, "test-user-2", unlimited.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+
+		// banned after the group was read
+		stale := GroupHandler{DBClient: &staleGroupStore{MockDBClient: handler.DBClient.(*db.MockDBClient), group: *group}}
+		_, err = stale.JoinGroup(ctx, "test-user-2", unlimited.Token)
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+
+		// the failed joins do not count as uses
+		stored, _ := handler.DBClient.GetInvite(ctx, unlimited.Token)
+		assert.Zero(t, stored.Uses)
+		group, _ = handler.DBClient.GetGroup(ctx, "test-group")
+		assert.NotContains(t, group.Members, "test-user-2")
+	})
+
+	t.Run("invite not found", func(t *testing.T) {
+		_, err := handler.JoinGroup(ctx, "test-user-3", "test-missing")
+		assert.Error(t, err)
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+}
@@ -1,37 +1,211 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"server/attachments"
+	"server/auth"
+	"server/common"
+	"server/conversations"
 	"server/db"
 	"server/groups"
 	"server/messages"
 	"server/routes"
+	"server/scheduler"
+	"server/search"
+	"server/stream"
 	"server/users"
+	"strconv"
+	"time"
 )
 
 var dbClient db.DynamoDBClientInterface
 
+// newDBClient creates the storage backend selected by the DB_BACKEND environment variable.
+// Supported backends are "dynamodb" (default), at DYNAMODB_ENDPOINT if set, and "bolt", an embedded database stored at BOLT_DB_PATH.
+func newDBClient() (db.DynamoDBClientInterface, error) {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "", "dynamodb":
+		cache, err := newCache()
+		if err != nil {
+			return nil, err
+		}
+		return db.NewDynamoDBClient(cache, os.Getenv("DYNAMODB_ENDPOINT"))
+	case "bolt":
+		path := os.Getenv("BOLT_DB_PATH")
+		if path == "" {
+			path = "messaging.db"
+		}
+		return db.NewBoltDBClient(path)
+	default:
+		return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+	}
+}
+
+// newCache creates the cache of the DynamoDB backend selected by the CACHE_BACKEND environment variable.
+// Supported caches are "lru" (default), kept by every instance, and "redis", shared by all instances through the
+// Redis server at REDIS_ADDR. Cached users and groups expire after CACHE_TTL (default 5m).
+func newCache() (common.Cache, error) {
+	ttl := common.DefaultCacheTTL
+	if value := os.Getenv("CACHE_TTL"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid CACHE_TTL %q", value)
+		}
+	}
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "lru":
+		return common.NewLRUCache(common.DefaultLRUCacheSize, ttl)
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		return common.NewRedisCache(context.Background(), addr, ttl)
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", backend)
+	}
+}
+
+// newBlobStore creates the store of the attachment contents selected by the BLOB_STORE environment variable.
+// Supported stores are "local" (default), files in ATTACHMENTS_DIR (default "blobs"), and "s3", the bucket
+// S3_BUCKET in AWS_REGION (default us-west-2), or of an S3 compatible store at S3_ENDPOINT.
+func newBlobStore() (common.BlobStore, error) {
+	switch backend := os.Getenv("BLOB_STORE"); backend {
+	case "", "local":
+		dir := os.Getenv("ATTACHMENTS_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		return common.NewLocalBlobStore(dir)
+	case "s3":
+		bucket := os.Getenv("S3_BUCKET")
+		if bucket == "" {
+			return nil, fmt.Errorf("S3_BUCKET is required")
+		}
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-west-2"
+		}
+		return common.NewS3BlobStore(context.Background(), os.Getenv("S3_ENDPOINT"), bucket, region)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", backend)
+	}
+}
+
+// newAuthenticator signs tokens with the AUTH_SECRET environment variable. It is required, as tokens signed with a
+// secret of a single instance would fail on the other instances and after a restart.
+func newAuthenticator() (*auth.Authenticator, error) {
+	secret := []byte(os.Getenv("AUTH_SECRET"))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("AUTH_SECRET is required")
+	}
+	return auth.NewAuthenticator(secret, auth.DefaultTokenTTL), nil
+}
+
+// newDeliveryPolicy selects how group messages are delivered with the DELIVERY_MODE environment variable:
+// "read" (default) stores a group message once, "write" also copies it to the member inboxes so that a poll is a
+// single query, and "size" copies the messages of groups with up to INBOX_MAX_GROUP_SIZE (default 100) members.
+func newDeliveryPolicy() (common.DeliveryPolicy, error) {
+	policy := common.DeliveryPolicy{Mode: os.Getenv("DELIVERY_MODE"), MaxInboxGroupSize: 100}
+	switch policy.Mode {
+	case "":
+		policy.Mode = common.DeliveryFanOutOnRead
+	case common.DeliveryFanOutOnRead, common.DeliveryFanOutOnWrite, common.DeliveryBySize:
+	default:
+		return policy, fmt.Errorf("unknown DELIVERY_MODE %q", policy.Mode)
+	}
+	if size := os.Getenv("INBOX_MAX_GROUP_SIZE"); size != "" {
+		var err error
+		if policy.MaxInboxGroupSize, err = strconv.Atoi(size); err != nil {
+			return policy, fmt.Errorf("invalid INBOX_MAX_GROUP_SIZE %q", size)
+		}
+	}
+	return policy, nil
+}
+
+// newDeletedMessagesPolicy selects what happens to the messages of deleted users with the DELETED_USER_MESSAGES
+// environment variable: "delete" (default) deletes their conversations and group messages, "anonymize" keeps them
+// and replaces the user as sender.
+func newDeletedMessagesPolicy() (string, error) {
+	switch policy := os.Getenv("DELETED_USER_MESSAGES"); policy {
+	case "":
+		return common.DeletedMessagesDelete, nil
+	case common.DeletedMessagesDelete, common.DeletedMessagesAnonymize:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown DELETED_USER_MESSAGES %q", policy)
+	}
+}
+
 func main() {
 	var err error
-	dbClient, err = db.NewDynamoDBClient()
+	dbClient, err = newDBClient()
+	if err != nil {
+		log.Fatalf("Error creating DB client, %v", err)
+	}
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		log.Fatalf("Error creating authenticator, %v", err)
+	}
+
+	delivery, err := newDeliveryPolicy()
 	if err != nil {
-		log.Fatalf("Error creating DynamoDB client, %v", err)
+		log.Fatalf("Error creating delivery policy, %v", err)
+	}
+	deletedMessages, err := newDeletedMessagesPolicy()
+	if err != nil {
+		log.Fatalf("Error creating deleted messages policy, %v", err)
+	}
+	blobStore, err := newBlobStore()
+	if err != nil {
+		log.Fatalf("Error creating blob store, %v", err)
 	}
 
 	groupRoute := routes.GroupRoutes{
-		Handler: &groups.GroupHandler{DBClient: dbClient},
+		Handler: &groups.GroupHandler{DBClient: dbClient, Delivery: delivery},
 	}
+	hub := stream.NewLocalHub()
+	messageHandler := &messages.Handler{DBClient: dbClient, Hub: hub, Delivery: delivery}
+	// cleans up after deleted users, also resuming the deletions interrupted by a restart
+	deleter := users.NewDeleter(dbClient, messageHandler)
+	go deleter.Run(context.Background())
 	userRoute := routes.UsersRoutes{
-		Handler: &users.UsersHandler{DBClient: dbClient},
+		Handler: &users.UsersHandler{DBClient: dbClient, Auth: authenticator, Deletions: deleter, DeletedMessages: deletedMessages},
 	}
+	// sends the scheduled messages when they are due, on every instance
+	messageScheduler := &scheduler.Scheduler{DBClient: dbClient, Messages: messageHandler}
+	go messageScheduler.Run(context.Background())
 	messageRoute := routes.MessagesRoutes{
-		Handler: &messages.Handler{DBClient: dbClient},
+		Handler:   messageHandler,
+		Scheduler: messageScheduler,
+	}
+	conversationRoute := routes.ConversationsRoutes{
+		Handler: &conversations.Handler{DBClient: dbClient},
+	}
+	streamRoute := routes.StreamRoutes{
+		Handler: messageHandler,
+		Hub:     hub,
+		Users:   userRoute.Handler,
+	}
+	attachmentRoute := routes.AttachmentsRoutes{
+		Handler: &attachments.Handler{DBClient: dbClient, Store: blobStore},
+	}
+	searchRoute := routes.SearchRoutes{
+		Handler: &search.Handler{DBClient: dbClient},
 	}
 
 	r := routes.Router{
-		Users:    userRoute,
-		Groups:   groupRoute,
-		Messages: messageRoute,
+		Auth:          authenticator,
+		Users:         userRoute,
+		Groups:        groupRoute,
+		Messages:      messageRoute,
+		Conversations: conversationRoute,
+		Stream:        streamRoute,
+		Attachments:   attachmentRoute,
+		Search:        searchRoute,
 	}
 	router, err := r.NewRouter()
 	if err != nil {
@@ -2,133 +2,505 @@ package messages
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/exp/slog"
 	. "server/common"
 	"server/db"
+	"server/stream"
 	"time"
 )
 
+// MaxAttachments is the largest number of attachments sent with a message
+const MaxAttachments = 10
+
 type SendMessageRequest struct {
 	SenderId    string `json:"senderId"`
 	RecipientId string `json:"recipientId"`
 	Message     string `json:"message"`
+	// AttachmentIds are uploaded attachments of the sender, each attachment can be sent with a single message
+	AttachmentIds []string `json:"attachmentIds,omitempty"`
+	// ReplyTo is the ID of a message of the same conversation, the reply is sent with a quote of it
+	ReplyTo string `json:"replyTo,omitempty"`
+	// SendAt schedules the message to be sent later, RFC3339, see scheduler.Scheduler
+	SendAt string `json:"sendAt,omitempty"`
+	// MessageId is the ID of a scheduled message, chosen by the scheduler when it claims the message, so that a
+	// repeated delivery stores the same message, see ScheduledMessage.MessageId
+	MessageId string `json:"-"`
+}
+
+type SendMessageResponse struct {
+	MessageId string `json:"messageId"`
+	Timestamp string `json:"timestamp"`
+}
+
+type EditMessageRequest struct {
+	Message string `json:"message"`
 }
 
 type HandlerInterface interface {
-	SendPrivateMessage(ctx context.Context, req SendMessageRequest) error
-	SendGroupMessage(ctx context.Context, req SendMessageRequest) error
-	GetMessages(ctx context.Context, recipientId string, timestamp int64) (*UserMessagesResp, error)
+	SendPrivateMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error)
+	SendGroupMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error)
+	EditMessage(ctx context.Context, senderId string, recipientId string, messageId string, req EditMessageRequest) (*Message, error)
+	DeleteMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error)
+	GetMessages(ctx context.Context, recipientId string, req GetMessagesRequest) (*UserMessagesResp, error)
+	GetThread(ctx context.Context, userId string, recipientId string, messageId string, req GetThreadRequest) (*ThreadResponse, error)
+	AddReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error)
+	RemoveReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error)
 }
 
 type Handler struct {
 	DBClient db.DynamoDBClientInterface
+	Hub      stream.Hub     // optional, delivers stored messages to connected recipients
+	Delivery DeliveryPolicy // switches groups that outgrow fan-out-on-write to fan-out-on-read
+}
+
+// publish delivers a stored message to the recipients connected to the hub.
+func (handler *Handler) publish(recipientIds []string, msg Message) {
+	if handler.Hub == nil {
+		return
+	}
+	handler.Hub.Publish(recipientIds, msg)
 }
 
 /*
 Send a private message to a user
 If the recipient has blocked the sender, return 403 Forbidden
 */
-func (handler *Handler) SendPrivateMessage(ctx context.Context, req SendMessageRequest) error {
+func (handler *Handler) SendPrivateMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error) {
 
 	recipient, err := handler.DBClient.GetUser(ctx, req.RecipientId)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error getting recipient user: %v", err))
-		return &InternalServerError{Message: "Error getting recipient user"}
+		return nil, &InternalServerError{Message: "Error getting recipient user"}
 	}
 	if recipient == nil {
 		slog.Error(fmt.Sprintf("Recipient user not found: %v", req.RecipientId))
-		return &NotFoundError{Message: "Recipient not found"}
+		return nil, &NotFoundError{Message: "Recipient not found"}
 	}
 	// check if the recipient has blocked the sender
 	if recipient.BlockedUsers[req.SenderId] {
 		slog.Error(fmt.Sprintf("Recipient %s has blocked sender %s", req.RecipientId, req.SenderId))
-		return &ForbiddenError{Message: "Recipient has blocked the sender"}
+		return nil, &ForbiddenError{Message: "Recipient has blocked the sender"}
 	}
 
 	// validate sender and recipient exists
 	sender, err := handler.DBClient.GetUser(ctx, req.SenderId)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error getting sender: %v", err))
-		return &InternalServerError{Message: "Error getting sender"}
+		return nil, &InternalServerError{Message: "Error getting sender"}
 	}
 	if sender == nil {
 		slog.Error(fmt.Sprintf("Sender not found: %v", req.SenderId))
-		return &NotFoundError{Message: "Sender not found"}
+		return nil, &NotFoundError{Message: "Sender not found"}
+	}
+	attachments, err := handler.getAttachments(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
+	now := time.Now()
+	messageId, changeId := newMessageIds(req, now)
 	msg := Message{
 		RecipientId: req.RecipientId,
-		Timestamp:   time.Now().Format(time.RFC3339), // store the dates in RFC339 string format so that they can be both human-readable and easy to query.
+		MessageId:   messageId,
+		ChangeId:    changeId,                 // the creation is the first change of the message
+		Timestamp:   now.Format(time.RFC3339), // store the dates in RFC339 string format so that they can be both human-readable and easy to query.
 		SenderId:    req.SenderId,
 		Message:     req.Message,
+		// index the message in the conversation of both users, so that the history has both directions
+		ConversationKey: PrivateConversationKey(req.SenderId, req.RecipientId),
+	}
+	thread, err := handler.replyTo(ctx, &msg, req.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Attachments, err = handler.sendAttachments(ctx, msg, attachments); err != nil {
+		return nil, err
 	}
 
 	err = handler.DBClient.StoreMessage(ctx, msg)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error storing message: %v", err))
-		return &InternalServerError{Message: "Error storing message"}
+		handler.releaseAttachments(ctx, msg.MessageId, msg.Attachments)
+		return nil, &InternalServerError{Message: "Error storing message"}
 	}
 
-	slog.Info(fmt.Sprintf("Message sent from %s to user %s", req.SenderId, req.RecipientId))
+	handler.updateConversations(ctx, msg, ConversationPrivate)
+	handler.publish([]string{req.RecipientId}, msg)
+	handler.countReply(ctx, thread, 1)
 
-	return nil
+	slog.Info(fmt.Sprintf("Message %s sent from %s to user %s", msg.MessageId, req.SenderId, req.RecipientId))
+
+	return &SendMessageResponse{MessageId: msg.MessageId, Timestamp: msg.Timestamp}, nil
 }
 
 /*
 Send a group message
 If the sender is not a member of the group, return 403 Forbidden
 */
-func (handler *Handler) SendGroupMessage(ctx context.Context, req SendMessageRequest) error {
+func (handler *Handler) SendGroupMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error) {
 	// validate sender and recipient exists
 	sender, err := handler.DBClient.GetUser(ctx, req.SenderId)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error getting sender: %v", err))
-		return &InternalServerError{Message: "Error getting sender"}
+		return nil, &InternalServerError{Message: "Error getting sender"}
 	}
 	if sender == nil {
 		slog.Error(fmt.Sprintf("Sender not found: %v", req.SenderId))
-		return &NotFoundError{Message: "Sender not found"}
+		return nil, &NotFoundError{Message: "Sender not found"}
 	}
 
 	recipient, err := handler.DBClient.GetGroup(ctx, req.RecipientId)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error getting recipient group: %v", err))
-		return &InternalServerError{Message: "Error getting recipient group"}
+		return nil, &InternalServerError{Message: "Error getting recipient group"}
 	}
 	if recipient == nil {
 		slog.Error(fmt.Sprintf("Recipient group not found: %v", req.RecipientId))
-		return &NotFoundError{Message: "Recipient not found"}
+		return nil, &NotFoundError{Message: "Recipient not found"}
 	}
 
 	// check if the sender is a member of the group
 	if !sender.Groups[req.RecipientId] {
 		slog.Error(fmt.Sprintf("Sender %s is not a member of group %s", req.SenderId, req.RecipientId))
-		return &ForbiddenError{Message: "Sender is not a member of the group"}
+		return nil, &ForbiddenError{Message: "Sender is not a member of the group"}
+	}
+	attachments, err := handler.getAttachments(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	fanOutOnWrite, err := handler.fanOutOnWrite(ctx, recipient)
+	if err != nil {
+		return nil, err
 	}
 
+	now := time.Now()
+	messageId, changeId := newMessageIds(req, now)
 	msg := Message{
 		RecipientId: req.RecipientId,
-		Timestamp:   time.Now().Format(time.RFC3339),
+		MessageId:   messageId,
+		ChangeId:    changeId, // the creation is the first change of the message
+		Timestamp:   now.Format(time.RFC3339),
 		SenderId:    req.SenderId,
 		Message:     req.Message,
 	}
+	thread, err := handler.replyTo(ctx, &msg, req.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Attachments, err = handler.sendAttachments(ctx, msg, attachments); err != nil {
+		return nil, err
+	}
 
 	err = handler.DBClient.StoreMessage(ctx, msg)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error storing message: %v", err))
-		return &InternalServerError{Message: "Error storing message"}
+		handler.releaseAttachments(ctx, msg.MessageId, msg.Attachments)
+		return nil, &InternalServerError{Message: "Error storing message"}
+	}
+
+	members := groupMembers(recipient)
+	if fanOutOnWrite {
+		err = handler.DBClient.StoreInboxMessages(ctx, msg, members)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error copying message %s to the inboxes of group %s: %v", msg.MessageId, req.RecipientId, err))
+			return nil, &InternalServerError{Message: "Error delivering message"}
+		}
+	}
+
+	handler.updateConversations(ctx, msg, ConversationGroup)
+	handler.publish(members, msg)
+	handler.countReply(ctx, thread, 1)
+
+	slog.Info(fmt.Sprintf("Message %s sent from %s to group %s", msg.MessageId, req.SenderId, req.RecipientId))
+	return &SendMessageResponse{MessageId: msg.MessageId, Timestamp: msg.Timestamp}, nil
+}
+
+// newMessageIds returns the message ID and the change ID of a new message. The change ID is always new, so that clients
+// polling for changes get a scheduled message whose ID was chosen before.
+func newMessageIds(req SendMessageRequest, now time.Time) (string, string) {
+	changeId := NewMessageId(now)
+	if req.MessageId != "" {
+		return req.MessageId, changeId
+	}
+	return changeId, changeId
+}
+
+// getAttachments returns the attachments of the request, they must be uploaded by the sender and not sent yet.
+// An attachment already sent with the message ID of the request was sent by an interrupted delivery of the same message.
+func (handler *Handler) getAttachments(ctx context.Context, req SendMessageRequest) ([]Attachment, error) {
+	if len(req.AttachmentIds) > MaxAttachments {
+		slog.Error(fmt.Sprintf("Message of %s has %d attachments", req.SenderId, len(req.AttachmentIds)))
+		return nil, &BadRequestError{Message: fmt.Sprintf("A message can have at most %d attachments", MaxAttachments)}
+	}
+	attachments := make([]Attachment, 0, len(req.AttachmentIds))
+	seen := make(map[string]bool, len(req.AttachmentIds))
+	for _, attachmentId := range req.AttachmentIds {
+		if seen[attachmentId] {
+			slog.Error(fmt.Sprintf("Attachment %s is sent twice", attachmentId))
+			return nil, &BadRequestError{Message: "Attachment is sent twice"}
+		}
+		seen[attachmentId] = true
+		attachment, err := handler.DBClient.GetAttachment(ctx, attachmentId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting attachment %s: %v", attachmentId, err))
+			return nil, &InternalServerError{Message: "Error getting attachment"}
+		}
+		if attachment == nil || attachment.UploaderId != req.SenderId {
+			slog.Error(fmt.Sprintf("Attachment %s of sender %s not found", attachmentId, req.SenderId))
+			return nil, &NotFoundError{Message: "Attachment not found"}
+		}
+		if attachment.MessageId != "" && attachment.MessageId != req.MessageId {
+			slog.Error(fmt.Sprintf("Attachment %s was already sent with message %s", attachmentId, attachment.MessageId))
+			return nil, &BadRequestError{Message: "Attachment was already sent"}
+		}
+		attachments = append(attachments, *attachment)
+	}
+	return attachments, nil
+}
+
+// sendAttachments records the message the attachments are sent with, so that its recipients can download them, and
+// returns the references of the message. The attachments are released if the message is not stored, see releaseAttachments.
+func (handler *Handler) sendAttachments(ctx context.Context, msg Message, attachments []Attachment) ([]AttachmentRef, error) {
+	var refs []AttachmentRef
+	for _, attachment := range attachments {
+		if attachment.MessageId == msg.MessageId {
+			refs = append(refs, attachment.Ref())
+			continue
+		}
+		err := handler.DBClient.SendAttachment(ctx, attachment.AttachmentId, msg.RecipientId, msg.MessageId)
+		if errors.Is(err, db.ErrAttachmentSent) {
+			// sent by a concurrent request
+			slog.Error(fmt.Sprintf("Attachment %s was already sent", attachment.AttachmentId))
+			handler.releaseAttachments(ctx, msg.MessageId, refs)
+			return nil, &BadRequestError{Message: "Attachment was already sent"}
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error sending attachment %s with message %s: %v", attachment.AttachmentId, msg.MessageId, err))
+			handler.releaseAttachments(ctx, msg.MessageId, refs)
+			return nil, &InternalServerError{Message: "Error sending attachment"}
+		}
+		refs = append(refs, attachment.Ref())
+	}
+	return refs, nil
+}
+
+// releaseAttachments makes the attachments of a message that was not stored available to be sent again, and no longer
+// downloadable by its recipients. An attachment that can not be released stays bound to the message ID, so it is still
+// accepted by a retry of a scheduled message, which sends the same message ID.
+func (handler *Handler) releaseAttachments(ctx context.Context, messageId string, refs []AttachmentRef) {
+	for _, ref := range refs {
+		if err := handler.DBClient.ReleaseAttachment(ctx, ref.AttachmentId, messageId); err != nil {
+			slog.Error(fmt.Sprintf("Error releasing attachment %s of message %s: %v", ref.AttachmentId, messageId, err))
+		}
+	}
+}
+
+// fanOutOnWrite returns true if the group messages are copied to the member inboxes.
+// A group that grew past the delivery policy switches to fan-out-on-read, the messages copied so far stay in the inboxes,
+// and the messages from now on are read from the group. The switch is one way, so that every message is read from one place.
+func (handler *Handler) fanOutOnWrite(ctx context.Context, group *Group) (bool, error) {
+	if !group.FanOutOnWrite || handler.Delivery.FanOutOnWrite(len(group.Members)) {
+		return group.FanOutOnWrite, nil
 	}
+	// messages created or changed from now on have greater change IDs
+	inboxUntil := NewMessageId(time.Now())
+	err := handler.DBClient.SetGroupFanOutOnRead(ctx, *group, inboxUntil)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error switching group %s to fan-out-on-read: %v", group.GroupId, err))
+		return false, &InternalServerError{Message: "Error updating group"}
+	}
+	slog.Info(fmt.Sprintf("Group %s with %d members switched to fan-out-on-read", group.GroupId, len(group.Members)))
+	return false, nil
+}
 
-	slog.Info(fmt.Sprintf("Message sent from %s to group %s", req.SenderId, req.RecipientId))
+// updateConversations records the message as the latest message of its conversation.
+// The message is already stored, so a failure to update the conversation does not fail the request.
+func (handler *Handler) updateConversations(ctx context.Context, msg Message, conversationType string) {
+	err := handler.DBClient.UpdateConversations(ctx, msg, conversationType)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error updating conversations of message %s: %v", msg.MessageId, err))
+	}
+}
+
+func groupMembers(group *Group) []string {
+	members := make([]string, 0, len(group.Members))
+	for member := range group.Members {
+		members = append(members, member)
+	}
+	return members
+}
+
+/*
+Edit the text of a message, only the sender can edit their messages
+The message gets a new change ID, so that polling clients get it again as a change
+*/
+func (handler *Handler) EditMessage(ctx context.Context, senderId string, recipientId string, messageId string, req EditMessageRequest) (*Message, error) {
+	return handler.changeMessage(ctx, senderId, recipientId, messageId, func(msg *Message) {
+		msg.Message = req.Message
+	})
+}
+
+/*
+Delete a message, only the sender can delete their messages
+The message is kept as a tombstone without its text, so that polling clients get the deletion as a change
+A deleted reply is no longer counted in its thread
+*/
+func (handler *Handler) DeleteMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error) {
+	msg, err := handler.changeMessage(ctx, senderId, recipientId, messageId, func(msg *Message) {
+		msg.Message = ""
+		msg.Attachments = nil
+		msg.Quote = nil
+		msg.Deleted = true
+	})
+	if err != nil || msg.ThreadId == "" {
+		return msg, err
+	}
+	if thread, err := handler.getThread(ctx, *msg); err == nil {
+		handler.countReply(ctx, thread, -1)
+	}
+	return msg, nil
+}
+
+/*
+Anonymize a message of a deleted user, the text is kept and the sender is replaced by DeletedUserId
+The message gets a new change ID, so that polling clients get the new sender as a change
+*/
+func (handler *Handler) AnonymizeMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error) {
+	return handler.changeMessage(ctx, senderId, recipientId, messageId, func(msg *Message) {
+		msg.SenderId = DeletedUserId
+	})
+}
+
+func (handler *Handler) changeMessage(ctx context.Context, senderId string, recipientId string, messageId string, change func(msg *Message)) (*Message, error) {
+	msg, err := handler.DBClient.GetMessage(ctx, recipientId, messageId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting message %s: %v", messageId, err))
+		return nil, &InternalServerError{Message: "Error getting message"}
+	}
+	if msg == nil {
+		slog.Error(fmt.Sprintf("Message %s of recipient %s not found", messageId, recipientId))
+		return nil, &NotFoundError{Message: "Message not found"}
+	}
+	if msg.SenderId != senderId {
+		slog.Error(fmt.Sprintf("User %s is not the sender of message %s", senderId, messageId))
+		return nil, &ForbiddenError{Message: "Only the sender can change the message"}
+	}
+	if msg.IsInboxCopy() {
+		// the copy of a message in an inbox is changed with its message
+		slog.Error(fmt.Sprintf("Message %s of recipient %s is an inbox copy", messageId, recipientId))
+		return nil, &NotFoundError{Message: "Message not found"}
+	}
+	if msg.Deleted {
+		slog.Error(fmt.Sprintf("Message %s is deleted", messageId))
+		return nil, &BadRequestError{Message: "Message is deleted"}
+	}
+
+	now := time.Now()
+	change(msg)
+	msg.ChangeId = NewMessageId(now)
+	msg.EditedAt = now.Format(time.RFC3339)
+
+	err = handler.DBClient.UpdateMessage(ctx, *msg)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error updating message %s: %v", messageId, err))
+		return nil, &InternalServerError{Message: "Error updating message"}
+	}
+	if err = handler.deliverChange(ctx, *msg); err != nil {
+		return nil, err
+	}
+	handler.updateQuotes(ctx, *msg)
+
+	slog.Info(fmt.Sprintf("Message %s of recipient %s changed by %s, deleted: %v", messageId, recipientId, senderId, msg.Deleted))
+	return msg, nil
+}
+
+// deliverChange delivers a changed message to the inboxes, conversations and connected recipients,
+// group members are looked up again as they may have changed.
+// A changed private message is copied to the inbox of its sender, as the sender polls changes like reactions to it.
+func (handler *Handler) deliverChange(ctx context.Context, msg Message) error {
+	recipients := []string{msg.RecipientId}
+	conversationType := ConversationPrivate
+	group, err := handler.DBClient.GetGroup(ctx, msg.RecipientId)
+	if err == nil && group != nil {
+		recipients = groupMembers(group)
+		conversationType = ConversationGroup
+		if group.FanOutOnWrite {
+			// replace the inbox copies, so that members polling their inbox get the change
+			err = handler.DBClient.StoreInboxMessages(ctx, msg, recipients)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error copying message %s to the inboxes of group %s: %v", msg.MessageId, msg.RecipientId, err))
+				return &InternalServerError{Message: "Error delivering message"}
+			}
+		}
+	} else if err == nil && msg.SenderId != msg.RecipientId && msg.SenderId != DeletedUserId {
+		if err = handler.DBClient.StoreSenderInboxMessage(ctx, msg); err != nil {
+			slog.Error(fmt.Sprintf("Error copying message %s to the inbox of sender %s: %v", msg.MessageId, msg.SenderId, err))
+			return &InternalServerError{Message: "Error delivering message"}
+		}
+		recipients = append(recipients, msg.SenderId)
+	}
+	// replaces the conversation preview if this is the latest message
+	handler.updateConversations(ctx, msg, conversationType)
+	handler.publish(recipients, msg)
 	return nil
 }
 
+const (
+	DefaultMessagesLimit = 100
+	MaxMessagesLimit     = 1000
+	MaxMessagesWait      = 30 * time.Second
+	// WaitPollInterval is how often the messages are queried again while waiting. The hub only wakes the requests of
+	// the instance a message was sent through, so a message sent through another instance is returned up to this late.
+	WaitPollInterval = 5 * time.Second
+)
+
+type GetMessagesRequest struct {
+	Timestamp int64         // unix timestamp, only messages after it are returned
+	Limit     int           // page size, DefaultMessagesLimit if not provided
+	Cursor    string        // nextCursor of the previous page
+	Wait      time.Duration // if there are no messages, wait up to this long for a new one
+}
+
 type UserMessagesResp struct {
-	Messages []Message `json:"messages"`
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+	// Partial is true if the messages of some recipients could not be fetched, the same request can be retried for them
+	Partial          bool     `json:"partial,omitempty"`
+	FailedRecipients []string `json:"failedRecipients,omitempty"`
 }
 
-func (handler *Handler) GetMessages(ctx context.Context, recipientId string, timestamp int64) (*UserMessagesResp, error) {
+/*
+Get a page of messages for a user, including private messages and group messages, ordered by change ID
+Edited and deleted messages are returned again after the change, with the new text or as a tombstone
+Messages of conversations muted by the user are marked as muted
+Group messages of users blocked by the user are shown, hidden or collapsed by the setting of the user
+If there are more messages, the response contains a cursor to get the next page
+If the messages of the user or some of their groups could not be fetched, the others are returned and the response is marked as partial
+If there are no messages and a wait is requested, block until a message for the user or one of their groups is sent or the wait expires,
+a message sent through another instance of the service is found by querying again every WaitPollInterval
+*/
+func (handler *Handler) GetMessages(ctx context.Context, recipientId string, req GetMessagesRequest) (*UserMessagesResp, error) {
+	if req.Limit <= 0 {
+		req.Limit = DefaultMessagesLimit
+	}
+	if req.Limit > MaxMessagesLimit {
+		slog.Error(fmt.Sprintf("Invalid limit: %d", req.Limit))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Limit must not exceed %d", MaxMessagesLimit)}
+	}
+	if req.Wait > MaxMessagesWait {
+		slog.Error(fmt.Sprintf("Invalid wait: %v", req.Wait))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Wait must not exceed %v", MaxMessagesWait)}
+	}
+	cursor, err := decodeCursor(req.Cursor)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid cursor %s: %v", req.Cursor, err))
+		return nil, &BadRequestError{Message: "Invalid cursor"}
+	}
 
 	user, err := handler.DBClient.GetUser(ctx, recipientId)
 	if err != nil {
@@ -141,17 +513,135 @@ func (handler *Handler) GetMessages(ctx context.Context, recipientId string, tim
 		return nil, &NotFoundError{Message: "User not found"}
 	}
 
-	messages, err := handler.DBClient.GetMessages(ctx, *user, timestamp)
+	inboxGroups, err := handler.inboxGroups(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	query := db.MessagesQuery{
+		Timestamp:   req.Timestamp,
+		Limit:       req.Limit,
+		Cursor:      cursor,
+		InboxGroups: inboxGroups,
+	}
+
+	var live <-chan Message
+	if req.Wait > 0 && handler.Hub != nil {
+		// subscribe before querying, so that a message sent in between is not missed
+		var unsubscribe func()
+		live, unsubscribe = handler.Hub.Subscribe(recipientId)
+		defer unsubscribe()
+	}
+
+	page, err := handler.DBClient.GetMessages(ctx, *user, query)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error getting messages: %v", err))
 		return nil, &InternalServerError{Message: "Error getting messages"}
 	}
 
+	// a partial page is returned right away, so that the client retries the failed recipients
+	deadline := time.Now().Add(req.Wait)
+	for len(page.Messages) == 0 && len(page.Failed) == 0 && waitForMessage(ctx, &live, deadline) {
+		page, err = handler.DBClient.GetMessages(ctx, *user, query)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting messages: %v", err))
+			return nil, &InternalServerError{Message: "Error getting messages"}
+		}
+	}
+
+	// the cursor is past the hidden messages, so a page may be shorter than the limit
+	messages := page.Messages
+	if messages != nil {
+		messages = NewMessageView(*user).ApplyAll(messages)
+	}
+
 	resp := UserMessagesResp{
-		Messages: messages,
+		Messages:         messages,
+		Partial:          len(page.Failed) > 0,
+		FailedRecipients: page.Failed,
+	}
+	if page.Cursor != nil {
+		resp.NextCursor, err = encodeCursor(page.Cursor)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error encoding cursor: %v", err))
+			return nil, &InternalServerError{Message: "Error getting messages"}
+		}
 	}
 
+	if resp.Partial {
+		slog.Warn(fmt.Sprintf("Messages of recipients %v not retrieved for user %s", page.Failed, recipientId))
+	}
 	slog.Info(fmt.Sprintf("Total of %d messages retrieved for user %s", len(messages), recipientId))
 
 	return &resp, nil
 }
+
+// inboxGroups returns the groups of the user that copied their messages to the member inboxes, see MessagesQuery.
+// With fan-out-on-read deployments all groups are queried, the groups are not looked up.
+func (handler *Handler) inboxGroups(ctx context.Context, user *User) (map[string]string, error) {
+	if handler.Delivery.Mode == "" || handler.Delivery.Mode == DeliveryFanOutOnRead {
+		return nil, nil
+	}
+	inboxGroups := map[string]string{}
+	for groupId := range user.Groups {
+		group, err := handler.DBClient.GetGroup(ctx, groupId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting group %s: %v", groupId, err))
+			return nil, &InternalServerError{Message: "Error getting group"}
+		}
+		if group != nil && (group.FanOutOnWrite || group.InboxUntil != "") {
+			inboxGroups[groupId] = group.InboxUntil
+		}
+	}
+	return inboxGroups, nil
+}
+
+// waitForMessage blocks until a message is delivered through the hub, the poll interval passed or the request is
+// canceled, live is nil without a hub. Once the hub drops the subscription of a slow subscriber, live is set to nil,
+// so that the messages are polled from then on. It returns true if the messages should be queried again, false once the
+// deadline passed.
+func waitForMessage(ctx context.Context, live *<-chan Message, deadline time.Time) bool {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	if wait > WaitPollInterval {
+		wait = WaitPollInterval
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case _, ok := <-*live:
+		if !ok {
+			// the subscription was dropped, a message may have been missed
+			*live = nil
+		}
+		return true
+	case <-timer.C:
+		// a message may have been sent through another instance
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// encodeCursor encodes the per recipient positions into an opaque, URL safe cursor.
+func encodeCursor(positions map[string]string) (string, error) {
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (map[string]string, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var positions map[string]string
+	err = json.Unmarshal(data, &positions)
+	return positions, err
+}
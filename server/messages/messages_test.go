@@ -8,10 +8,55 @@ import (
 	"server/common"
 	. "server/common"
 	"server/db"
+	"server/stream"
 	"testing"
 	"time"
 )
 
+// failingMessageStore fails to store messages, the other writes succeed.
+type failingMessageStore struct {
+	*db.MockDBClient
+}
+
+func (f failingMessageStore) StoreMessage(ctx context.Context, message Message) error {
+	return fmt.Errorf("message %s not stored", message.MessageId)
+}
+
+// sendingAttachmentStore fails to send the attachment, like when it was sent by a concurrent request.
+type sendingAttachmentStore struct {
+	*db.MockDBClient
+	attachmentId string
+}
+
+func (s sendingAttachmentStore) SendAttachment(ctx context.Context, attachmentId string, recipientId string, messageId string) error {
+	if attachmentId == s.attachmentId {
+		return db.ErrAttachmentSent
+	}
+	return s.MockDBClient.SendAttachment(ctx, attachmentId, recipientId, messageId)
+}
+
+// countingMessageStore counts the message queries.
+type countingMessageStore struct {
+	*db.MockDBClient
+	queries *int
+}
+
+func (c countingMessageStore) GetMessages(ctx context.Context, user User, query db.MessagesQuery) (*db.MessagesPage, error) {
+	*c.queries++
+	return c.MockDBClient.GetMessages(ctx, user, query)
+}
+
+// droppingHub drops every subscription right away, like the hub does for a subscriber that fell behind.
+type droppingHub struct{}
+
+func (droppingHub) Subscribe(userId string) (<-chan Message, func()) {
+	messages := make(chan Message)
+	close(messages)
+	return messages, func() {}
+}
+
+func (droppingHub) Publish(userIds []string, message Message) {}
+
 func TestSendPrivateMessage(t *testing.T) {
 	ctx := context.Background()
 
@@ -31,7 +76,7 @@ func TestSendPrivateMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendPrivateMessage(ctx, req)
+		resp, err := handler.SendPrivateMessage(ctx, req)
 		assert.NoError(t, err)
 
 		assert.NotEmpty(t, handler.DBClient.(*db.MockDBClient).Messages[req.RecipientId])
@@ -39,7 +84,32 @@ func TestSendPrivateMessage(t *testing.T) {
 		msg := handler.DBClient.(*db.MockDBClient).Messages[req.RecipientId][0]
 		assert.Equal(t, req.SenderId, msg.SenderId)
 		assert.Equal(t, req.Message, msg.Message)
+		assert.NotEmpty(t, msg.MessageId)
+		assert.Equal(t, msg.MessageId, resp.MessageId)
+		assert.Equal(t, msg.Timestamp, resp.Timestamp)
+
+		// both users have the conversation
+		conversations := handler.DBClient.(*db.MockDBClient).Conversations
+		assert.Equal(t, ConversationPrivate, conversations[user1.UserId][user2.UserId].Type)
+		assert.Equal(t, ConversationPrivate, conversations[user2.UserId][user1.UserId].Type)
+	})
+
+	t.Run("Message is delivered to the connected recipient", func(t *testing.T) {
+		hub := stream.NewLocalHub()
+		handler := Handler{DBClient: handler.DBClient, Hub: hub}
+		user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user1)
+		handler.DBClient.StoreUser(ctx, user2)
 
+		live, unsubscribe := hub.Subscribe(user2.UserId)
+		defer unsubscribe()
+
+		resp, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Hello"})
+		assert.NoError(t, err)
+		msg := <-live
+		assert.Equal(t, resp.MessageId, msg.MessageId)
+		assert.Equal(t, "Hello", msg.Message)
 	})
 
 	t.Run("User not found", func(t *testing.T) {
@@ -55,7 +125,7 @@ func TestSendPrivateMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendPrivateMessage(ctx, req)
+		_, err := handler.SendPrivateMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.NotFoundError{}, err)
 	})
@@ -69,7 +139,7 @@ func TestSendPrivateMessage(t *testing.T) {
 			RecipientId: "test-user-2",
 			Message:     "Hello",
 		}
-		err := handler.SendPrivateMessage(ctx, req)
+		_, err := handler.SendPrivateMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.InternalServerError{}, err)
 	})
@@ -95,7 +165,7 @@ func TestSendGroupMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendGroupMessage(ctx, req)
+		resp, err := handler.SendGroupMessage(ctx, req)
 		assert.NoError(t, err)
 
 		assert.NotEmpty(t, handler.DBClient.(*db.MockDBClient).Messages[req.RecipientId])
@@ -103,6 +173,8 @@ func TestSendGroupMessage(t *testing.T) {
 		msg := handler.DBClient.(*db.MockDBClient).Messages[req.RecipientId][0]
 		assert.Equal(t, req.SenderId, msg.SenderId)
 		assert.Equal(t, req.Message, msg.Message)
+		assert.NotEmpty(t, msg.MessageId)
+		assert.Equal(t, msg.MessageId, resp.MessageId)
 
 	})
 
@@ -120,7 +192,7 @@ func TestSendGroupMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendGroupMessage(ctx, req)
+		_, err := handler.SendGroupMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.ForbiddenError{}, err)
 	})
@@ -138,7 +210,7 @@ func TestSendGroupMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendGroupMessage(ctx, req)
+		_, err := handler.SendGroupMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.NotFoundError{}, err)
 	})
@@ -156,11 +228,34 @@ func TestSendGroupMessage(t *testing.T) {
 			Message:     "Hello",
 		}
 
-		err := handler.SendGroupMessage(ctx, req)
+		_, err := handler.SendGroupMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.NotFoundError{}, err)
 	})
 
+	t.Run("Message is delivered to connected group members", func(t *testing.T) {
+		hub := stream.NewLocalHub()
+		handler := Handler{DBClient: handler.DBClient, Hub: hub}
+		user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user1)
+		handler.DBClient.StoreUser(ctx, user2)
+		handler.DBClient.StoreGroup(ctx, group)
+		handler.DBClient.AddUserToGroup(ctx, group, user1)
+		handler.DBClient.AddUserToGroup(ctx, group, user2)
+
+		live1, unsubscribe1 := hub.Subscribe(user1.UserId)
+		defer unsubscribe1()
+		live2, unsubscribe2 := hub.Subscribe(user2.UserId)
+		defer unsubscribe2()
+
+		resp, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "Hello"})
+		assert.NoError(t, err)
+		assert.Equal(t, resp.MessageId, (<-live1).MessageId)
+		assert.Equal(t, resp.MessageId, (<-live2).MessageId)
+	})
+
 	t.Run("db error", func(t *testing.T) {
 		handler := Handler{DBClient: db.NewMockDBClient()}
 
@@ -170,13 +265,236 @@ func TestSendGroupMessage(t *testing.T) {
 			RecipientId: "test-group-1",
 			Message:     "Hello",
 		}
-		err := handler.SendGroupMessage(ctx, req)
+		_, err := handler.SendGroupMessage(ctx, req)
 		assert.Error(t, err)
 		assert.IsType(t, &common.InternalServerError{}, err)
 	})
 
 }
 
+func TestSendMessageWithAttachments(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	handler.DBClient.StoreUser(ctx, sender)
+	handler.DBClient.StoreUser(ctx, recipient)
+	handler.DBClient.StoreGroup(ctx, group)
+	handler.DBClient.AddUserToGroup(ctx, group, sender)
+
+	newAttachment := func(uploaderId string) Attachment {
+		attachment := Attachment{
+			AttachmentId: fmt.Sprintf("attachment-%s", uuid.New().String()),
+			UploaderId:   uploaderId,
+			FileName:     "photo.png",
+			ContentType:  "image/png",
+			Size:         5,
+			Checksum:     "checksum",
+		}
+		handler.DBClient.StoreAttachment(ctx, attachment)
+		return attachment
+	}
+
+	t.Run("Send private message with attachments", func(t *testing.T) {
+		first, second := newAttachment(sender.UserId), newAttachment(sender.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{first.AttachmentId, second.AttachmentId}}
+		resp, err := handler.SendPrivateMessage(ctx, req)
+		assert.NoError(t, err)
+
+		msg, _ := handler.DBClient.GetMessage(ctx, recipient.UserId, resp.MessageId)
+		assert.Equal(t, []AttachmentRef{first.Ref(), second.Ref()}, msg.Attachments)
+		assert.Empty(t, msg.Message)
+		// the recipient can download the attachments
+		assert.Equal(t, recipient.UserId, dbClient.Attachments[first.AttachmentId].RecipientId)
+		assert.Equal(t, resp.MessageId, dbClient.Attachments[first.AttachmentId].MessageId)
+
+		// an attachment is sent with a single message
+		_, err = handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{first.AttachmentId}})
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("Send group message with attachment", func(t *testing.T) {
+		attachment := newAttachment(sender.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: group.GroupId, Message: "Hello", AttachmentIds: []string{attachment.AttachmentId}}
+		resp, err := handler.SendGroupMessage(ctx, req)
+		assert.NoError(t, err)
+
+		msg, _ := handler.DBClient.GetMessage(ctx, group.GroupId, resp.MessageId)
+		assert.Equal(t, []AttachmentRef{attachment.Ref()}, msg.Attachments)
+		assert.Equal(t, group.GroupId, dbClient.Attachments[attachment.AttachmentId].RecipientId)
+	})
+
+	t.Run("Attachment of another user", func(t *testing.T) {
+		attachment := newAttachment(recipient.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{attachment.AttachmentId}}
+		_, err := handler.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.NotFoundError{}, err)
+		assert.Empty(t, dbClient.Attachments[attachment.AttachmentId].MessageId)
+
+		req.AttachmentIds = []string{"attachment-missing"}
+		_, err = handler.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+
+	t.Run("Invalid attachments", func(t *testing.T) {
+		attachment := newAttachment(sender.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{attachment.AttachmentId, attachment.AttachmentId}}
+		_, err := handler.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.BadRequestError{}, err)
+
+		req.AttachmentIds = nil
+		for i := 0; i <= MaxAttachments; i++ {
+			req.AttachmentIds = append(req.AttachmentIds, newAttachment(sender.UserId).AttachmentId)
+		}
+		_, err = handler.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.BadRequestError{}, err)
+		assert.Empty(t, dbClient.Attachments[req.AttachmentIds[0]].MessageId)
+	})
+
+	t.Run("Repeated delivery of a scheduled message", func(t *testing.T) {
+		attachment := newAttachment(sender.UserId)
+		messageId := common.NewMessageId(time.Now())
+		// the attachment was sent by a delivery interrupted before the message was stored
+		dbClient.SendAttachment(ctx, attachment.AttachmentId, recipient.UserId, messageId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{attachment.AttachmentId}, MessageId: messageId}
+		resp, err := handler.SendPrivateMessage(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, messageId, resp.MessageId)
+
+		msg, _ := handler.DBClient.GetMessage(ctx, recipient.UserId, messageId)
+		assert.Equal(t, []AttachmentRef{attachment.Ref()}, msg.Attachments)
+		assert.Greater(t, msg.ChangeId, messageId)
+	})
+
+	t.Run("Attachments of a message that was not stored can be sent again", func(t *testing.T) {
+		failing := Handler{DBClient: failingMessageStore{dbClient}}
+		attachment := newAttachment(sender.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{attachment.AttachmentId}}
+		_, err := failing.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.InternalServerError{}, err)
+		assert.Equal(t, attachment, dbClient.Attachments[attachment.AttachmentId])
+
+		req.RecipientId = group.GroupId
+		_, err = failing.SendGroupMessage(ctx, req)
+		assert.IsType(t, &common.InternalServerError{}, err)
+		assert.Equal(t, attachment, dbClient.Attachments[attachment.AttachmentId])
+
+		resp, err := handler.SendGroupMessage(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, resp.MessageId, dbClient.Attachments[attachment.AttachmentId].MessageId)
+	})
+
+	t.Run("Attachments sent before a failing one are released", func(t *testing.T) {
+		first, sent := newAttachment(sender.UserId), newAttachment(sender.UserId)
+		// sent by a concurrent request after it was checked
+		failing := Handler{DBClient: sendingAttachmentStore{dbClient, sent.AttachmentId}}
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{first.AttachmentId, sent.AttachmentId}}
+		_, err := failing.SendPrivateMessage(ctx, req)
+		assert.IsType(t, &common.BadRequestError{}, err)
+		assert.Equal(t, first, dbClient.Attachments[first.AttachmentId])
+	})
+
+	t.Run("Deleted message has no attachments", func(t *testing.T) {
+		attachment := newAttachment(sender.UserId)
+		req := SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, AttachmentIds: []string{attachment.AttachmentId}}
+		resp, _ := handler.SendPrivateMessage(ctx, req)
+		msg, err := handler.DeleteMessage(ctx, sender.UserId, recipient.UserId, resp.MessageId)
+		assert.NoError(t, err)
+		assert.Empty(t, msg.Attachments)
+	})
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	ctx := context.Background()
+	hub := stream.NewLocalHub()
+	handler := Handler{DBClient: db.NewMockDBClient(), Hub: hub}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	handler.DBClient.StoreUser(ctx, sender)
+	handler.DBClient.StoreUser(ctx, recipient)
+	sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, Message: "hello"})
+	sentAt := time.Now().Unix()
+
+	t.Run("Edit message successfully", func(t *testing.T) {
+		live, unsubscribe := hub.Subscribe(recipient.UserId)
+		defer unsubscribe()
+
+		msg, err := handler.EditMessage(ctx, sender.UserId, recipient.UserId, sent.MessageId, EditMessageRequest{Message: "edited"})
+		assert.NoError(t, err)
+		assert.Equal(t, "edited", msg.Message)
+		assert.NotEmpty(t, msg.EditedAt)
+		assert.Greater(t, msg.ChangeId, sent.MessageId)
+		assert.Equal(t, *msg, <-live)
+
+		// polling clients get the edit as a change after the message was sent
+		msgs, err := handler.GetMessages(ctx, recipient.UserId, GetMessagesRequest{Timestamp: sentAt - 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{*msg}, msgs.Messages)
+
+		// the edited message is the latest message of the conversation
+		conversation, _ := handler.DBClient.GetConversation(ctx, recipient.UserId, sender.UserId)
+		assert.Equal(t, msg, conversation.LastMessage)
+	})
+
+	t.Run("only the sender can edit", func(t *testing.T) {
+		_, err := handler.EditMessage(ctx, recipient.UserId, recipient.UserId, sent.MessageId, EditMessageRequest{Message: "edited"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.ForbiddenError{}, err)
+	})
+
+	t.Run("message not found", func(t *testing.T) {
+		_, err := handler.DeleteMessage(ctx, sender.UserId, recipient.UserId, "missing")
+		assert.Error(t, err)
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+
+	t.Run("Delete message successfully", func(t *testing.T) {
+		msg, err := handler.DeleteMessage(ctx, sender.UserId, recipient.UserId, sent.MessageId)
+		assert.NoError(t, err)
+		assert.True(t, msg.Deleted)
+		assert.Empty(t, msg.Message)
+
+		stored, _ := handler.DBClient.GetMessage(ctx, recipient.UserId, sent.MessageId)
+		assert.Equal(t, msg, stored)
+	})
+
+	t.Run("deleted message can not be edited", func(t *testing.T) {
+		_, err := handler.EditMessage(ctx, sender.UserId, recipient.UserId, sent.MessageId, EditMessageRequest{Message: "edited"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("group members get the change", func(t *testing.T) {
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		handler.DBClient.StoreGroup(ctx, group)
+		handler.DBClient.AddUserToGroup(ctx, group, sender)
+		handler.DBClient.AddUserToGroup(ctx, group, recipient)
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: group.GroupId, Message: "hello"})
+
+		live, unsubscribe := hub.Subscribe(recipient.UserId)
+		defer unsubscribe()
+		msg, err := handler.DeleteMessage(ctx, sender.UserId, group.GroupId, sent.MessageId)
+		assert.NoError(t, err)
+		assert.Equal(t, *msg, <-live)
+	})
+
+	t.Run("Anonymize message successfully", func(t *testing.T) {
+		sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, Message: "hello"})
+		msg, err := handler.AnonymizeMessage(ctx, sender.UserId, recipient.UserId, sent.MessageId)
+		assert.NoError(t, err)
+		assert.Equal(t, DeletedUserId, msg.SenderId)
+		assert.Equal(t, "hello", msg.Message)
+		assert.NotEqual(t, sent.MessageId, msg.ChangeId)
+
+		stored, _ := handler.DBClient.GetMessage(ctx, recipient.UserId, sent.MessageId)
+		assert.Equal(t, msg, stored)
+	})
+}
+
 func TestGetMessages(t *testing.T) {
 	ctx := context.Background()
 	handler := Handler{DBClient: db.NewMockDBClient()}
@@ -189,7 +507,7 @@ func TestGetMessages(t *testing.T) {
 		handler.DBClient.StoreGroup(ctx, group)
 		handler.DBClient.AddUserToGroup(ctx, group, user)
 
-		msgs, err := handler.GetMessages(ctx, user.UserId, 0)
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
 		assert.NoError(t, err)
 		assert.Empty(t, msgs.Messages)
 
@@ -199,8 +517,11 @@ func TestGetMessages(t *testing.T) {
 		user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
 		user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
 
+		messageId := NewMessageId(time.Now().Add(-time.Hour))
 		msg := Message{
 			RecipientId: user1.UserId,
+			MessageId:   messageId,
+			ChangeId:    messageId,
 			Timestamp:   time.Now().Add(-time.Hour).Format(time.RFC3339),
 			SenderId:    user2.UserId,
 			Message:     "hello",
@@ -210,21 +531,21 @@ func TestGetMessages(t *testing.T) {
 		handler.DBClient.StoreMessage(ctx, msg)
 
 		t.Run("no timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user1.UserId, 0)
+			msgs, err := handler.GetMessages(ctx, user1.UserId, GetMessagesRequest{})
 			assert.NoError(t, err)
 			assert.Equal(t, 1, len(msgs.Messages))
 			assert.Contains(t, msgs.Messages, msg)
 		})
 
 		t.Run("with timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user1.UserId, time.Now().Add(-2*time.Hour).Unix())
+			msgs, err := handler.GetMessages(ctx, user1.UserId, GetMessagesRequest{Timestamp: time.Now().Add(-2 * time.Hour).Unix()})
 			assert.NoError(t, err)
 			assert.Equal(t, 1, len(msgs.Messages))
 			assert.Contains(t, msgs.Messages, msg)
 		})
 
 		t.Run("with greater timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user1.UserId, time.Now().Unix())
+			msgs, err := handler.GetMessages(ctx, user1.UserId, GetMessagesRequest{Timestamp: time.Now().Unix()})
 			assert.NoError(t, err)
 			assert.Equal(t, 0, len(msgs.Messages))
 		})
@@ -235,8 +556,11 @@ func TestGetMessages(t *testing.T) {
 		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
 		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
 
+		messageId := NewMessageId(time.Now().Add(-time.Hour))
 		msg := Message{
 			RecipientId: group.GroupId,
+			MessageId:   messageId,
+			ChangeId:    messageId,
 			Timestamp:   time.Now().Add(-time.Hour).Format(time.RFC3339),
 			SenderId:    user.UserId,
 			Message:     "hello",
@@ -247,33 +571,397 @@ func TestGetMessages(t *testing.T) {
 		handler.DBClient.StoreMessage(ctx, msg)
 
 		t.Run("no timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user.UserId, 0)
+			msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
 			assert.NoError(t, err)
 			assert.Equal(t, 1, len(msgs.Messages))
 			assert.Contains(t, msgs.Messages, msg)
 		})
 
 		t.Run("with timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user.UserId, time.Now().Add(-2*time.Hour).Unix())
+			msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Timestamp: time.Now().Add(-2 * time.Hour).Unix()})
 			assert.NoError(t, err)
 			assert.Equal(t, 1, len(msgs.Messages))
 			assert.Contains(t, msgs.Messages, msg)
 		})
 
 		t.Run("with greater timestamp", func(t *testing.T) {
-			msgs, err := handler.GetMessages(ctx, user.UserId, time.Now().Unix())
+			msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Timestamp: time.Now().Unix()})
 			assert.NoError(t, err)
 			assert.Equal(t, 0, len(msgs.Messages))
 		})
 	})
 
+	t.Run("Messages of muted conversations are marked", func(t *testing.T) {
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		muted := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		for _, u := range []User{user, muted, other} {
+			handler.DBClient.StoreUser(ctx, u)
+		}
+		assert.NoError(t, handler.DBClient.MuteConversation(ctx, user, muted.UserId))
+
+		for _, senderId := range []string{muted.UserId, other.UserId} {
+			_, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: senderId, RecipientId: user.UserId, Message: "hello"})
+			assert.NoError(t, err)
+		}
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Len(t, msgs.Messages, 2)
+		for _, msg := range msgs.Messages {
+			assert.Equal(t, msg.SenderId == muted.UserId, msg.Muted)
+		}
+	})
+
+	t.Run("Group messages of blocked users", func(t *testing.T) {
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		blocked := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+		handler.DBClient.StoreGroup(ctx, group)
+		for _, u := range []User{user, blocked, other} {
+			handler.DBClient.StoreUser(ctx, u)
+			handler.DBClient.AddUserToGroup(ctx, group, u)
+		}
+		stored, _ := handler.DBClient.GetUser(ctx, user.UserId)
+		assert.NoError(t, handler.DBClient.BlockUser(ctx, *stored, blocked.UserId))
+		for _, senderId := range []string{blocked.UserId, other.UserId} {
+			_, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: senderId, RecipientId: group.GroupId, Message: "hello"})
+			assert.NoError(t, err)
+		}
+
+		get := func(setting string) []Message {
+			stored, _ := handler.DBClient.GetUser(ctx, user.UserId)
+			assert.NoError(t, handler.DBClient.SetBlockedGroupMessages(ctx, *stored, setting))
+			msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
+			assert.NoError(t, err)
+			return msgs.Messages
+		}
+
+		t.Run("shown by default", func(t *testing.T) {
+			msgs := get("")
+			assert.Len(t, msgs, 2)
+			assert.Equal(t, "hello", msgs[0].Message)
+			assert.False(t, msgs[0].Collapsed)
+		})
+
+		t.Run("hidden", func(t *testing.T) {
+			msgs := get(BlockedMessagesHide)
+			assert.Len(t, msgs, 1)
+			assert.Equal(t, other.UserId, msgs[0].SenderId)
+		})
+
+		t.Run("collapsed", func(t *testing.T) {
+			msgs := get(BlockedMessagesCollapse)
+			assert.Len(t, msgs, 2)
+			assert.Equal(t, blocked.UserId, msgs[0].SenderId)
+			assert.True(t, msgs[0].Collapsed)
+			assert.Empty(t, msgs[0].Message)
+			assert.False(t, msgs[1].Collapsed)
+		})
+
+		t.Run("other members are not affected", func(t *testing.T) {
+			msgs, err := handler.GetMessages(ctx, other.UserId, GetMessagesRequest{})
+			assert.NoError(t, err)
+			assert.Len(t, msgs.Messages, 2)
+			assert.Equal(t, "hello", msgs.Messages[0].Message)
+		})
+	})
+
+	t.Run("Messages sent in the same second are ordered by message id", func(t *testing.T) {
+		user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user1)
+		handler.DBClient.StoreUser(ctx, user2)
+
+		var sent []string
+		for _, text := range []string{"first", "second", "third"} {
+			resp, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: text})
+			assert.NoError(t, err)
+			sent = append(sent, resp.MessageId)
+		}
+
+		msgs, err := handler.GetMessages(ctx, user1.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(msgs.Messages))
+		for i, msg := range msgs.Messages {
+			assert.Equal(t, sent[i], msg.MessageId)
+		}
+		assert.Equal(t, "first", msgs.Messages[0].Message)
+		assert.Equal(t, "third", msgs.Messages[2].Message)
+	})
+
+	t.Run("Get messages in pages", func(t *testing.T) {
+		user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user1)
+		handler.DBClient.StoreUser(ctx, user2)
+		handler.DBClient.StoreGroup(ctx, group)
+		handler.DBClient.AddUserToGroup(ctx, group, user1)
+
+		var sent []string
+		for i := 0; i < 5; i++ {
+			resp, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "private"})
+			assert.NoError(t, err)
+			sent = append(sent, resp.MessageId)
+			resp, err = handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "group"})
+			assert.NoError(t, err)
+			sent = append(sent, resp.MessageId)
+		}
+
+		var received []string
+		req := GetMessagesRequest{Limit: 3}
+		for pages := 1; ; pages++ {
+			msgs, err := handler.GetMessages(ctx, user1.UserId, req)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, len(msgs.Messages), 3)
+			for _, msg := range msgs.Messages {
+				received = append(received, msg.MessageId)
+			}
+			if msgs.NextCursor == "" {
+				assert.Equal(t, 4, pages)
+				break
+			}
+			req.Cursor = msgs.NextCursor
+		}
+		assert.Equal(t, sent, received)
+	})
+
+	t.Run("Wait for a new message", func(t *testing.T) {
+		hub := stream.NewLocalHub()
+		handler := Handler{DBClient: handler.DBClient, Hub: hub}
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+		handler.DBClient.StoreGroup(ctx, group)
+		handler.DBClient.AddUserToGroup(ctx, group, user)
+
+		sent := make(chan string)
+		go func() {
+			// send once the poll is waiting
+			for hub.SubscriberCount(user.UserId) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			resp, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user.UserId, RecipientId: group.GroupId, Message: "Hello"})
+			sent <- resp.MessageId
+		}()
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Timestamp: time.Now().Unix() - 1, Wait: 5 * time.Second})
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Equal(t, 1, len(msgs.Messages))
+		assert.Equal(t, <-sent, msgs.Messages[0].MessageId)
+	})
+
+	t.Run("Wait for a message sent through another instance", func(t *testing.T) {
+		// the hub of this instance is never told about the message
+		handler := Handler{DBClient: handler.DBClient, Hub: stream.NewLocalHub()}
+		other := Handler{DBClient: handler.DBClient}
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+		handler.DBClient.StoreUser(ctx, sender)
+
+		sent := make(chan string)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			resp, _ := other.SendPrivateMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: user.UserId, Message: "Hello"})
+			sent <- resp.MessageId
+		}()
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Timestamp: time.Now().Unix() - 1, Wait: MaxMessagesWait})
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), WaitPollInterval+time.Second)
+		assert.Equal(t, 1, len(msgs.Messages))
+		assert.Equal(t, <-sent, msgs.Messages[0].MessageId)
+	})
+
+	t.Run("Wait without a hub", func(t *testing.T) {
+		handler := Handler{DBClient: handler.DBClient}
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Wait: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Empty(t, msgs.Messages)
+	})
+
+	t.Run("Wait after the subscription was dropped", func(t *testing.T) {
+		queries := 0
+		handler := Handler{DBClient: countingMessageStore{MockDBClient: db.NewMockDBClient(), queries: &queries}, Hub: droppingHub{}}
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Wait: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Empty(t, msgs.Messages)
+		// queried again once for the dropped subscription and once at the deadline, not in a loop
+		assert.Equal(t, 3, queries)
+	})
+
+	t.Run("Wait expires without messages", func(t *testing.T) {
+		handler := Handler{DBClient: handler.DBClient, Hub: stream.NewLocalHub()}
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Wait: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Empty(t, msgs.Messages)
+	})
+
+	t.Run("Partial messages when a group query fails", func(t *testing.T) {
+		handler := Handler{DBClient: db.NewMockDBClient(), Hub: stream.NewLocalHub()}
+		user := User{UserId: "test-user"}
+		failing := Group{GroupId: "test-group-failing"}
+		working := Group{GroupId: "test-group-working"}
+		handler.DBClient.StoreUser(ctx, user)
+		for _, group := range []Group{failing, working} {
+			handler.DBClient.StoreGroup(ctx, group)
+			handler.DBClient.AddUserToGroup(ctx, group, user)
+			_, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user.UserId, RecipientId: group.GroupId, Message: "hello"})
+			assert.NoError(t, err)
+		}
+		handler.DBClient.(*db.MockDBClient).RecipientErrors = map[string]error{failing.GroupId: fmt.Errorf("some error")}
+
+		start := time.Now()
+		msgs, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{Wait: time.Second})
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+		assert.True(t, msgs.Partial)
+		assert.Equal(t, []string{failing.GroupId}, msgs.FailedRecipients)
+		assert.Equal(t, 1, len(msgs.Messages))
+		assert.Equal(t, working.GroupId, msgs.Messages[0].RecipientId)
+
+		// once the group recovers, the same request returns all messages
+		handler.DBClient.(*db.MockDBClient).RecipientErrors = nil
+		msgs, err = handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.False(t, msgs.Partial)
+		assert.Equal(t, 2, len(msgs.Messages))
+	})
+
+	t.Run("Every recipient query fails", func(t *testing.T) {
+		handler := Handler{DBClient: db.NewMockDBClient()}
+		user := User{UserId: "test-user"}
+		handler.DBClient.StoreUser(ctx, user)
+		handler.DBClient.(*db.MockDBClient).RecipientErrors = map[string]error{user.UserId: fmt.Errorf("some error")}
+
+		_, err := handler.GetMessages(ctx, user.UserId, GetMessagesRequest{})
+		assert.Error(t, err)
+		assert.IsType(t, &common.InternalServerError{}, err)
+	})
+
+	t.Run("Wait too long", func(t *testing.T) {
+		_, err := handler.GetMessages(ctx, "user-1", GetMessagesRequest{Wait: MaxMessagesWait + time.Second})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		_, err := handler.GetMessages(ctx, "user-1", GetMessagesRequest{Cursor: "not a cursor"})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
+	t.Run("Limit too large", func(t *testing.T) {
+		_, err := handler.GetMessages(ctx, "user-1", GetMessagesRequest{Limit: MaxMessagesLimit + 1})
+		assert.Error(t, err)
+		assert.IsType(t, &common.BadRequestError{}, err)
+	})
+
 	t.Run("db error", func(t *testing.T) {
 		handler := Handler{DBClient: db.NewMockDBClient()}
 
 		handler.DBClient.(*db.MockDBClient).Error = fmt.Errorf("some error")
-		_, err := handler.GetMessages(ctx, "user-1", 0)
+		_, err := handler.GetMessages(ctx, "user-1", GetMessagesRequest{})
 		assert.Error(t, err)
 		assert.IsType(t, &common.InternalServerError{}, err)
 	})
 
 }
+
+func TestFanOutOnWrite(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient, Delivery: DeliveryPolicy{Mode: DeliveryBySize, MaxInboxGroupSize: 2}}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	member := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), FanOutOnWrite: true}
+	dbClient.StoreUser(ctx, sender)
+	dbClient.StoreUser(ctx, member)
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, sender)
+	dbClient.AddUserToGroup(ctx, group, member)
+
+	var sent []string
+	t.Run("group message is copied to the member inboxes", func(t *testing.T) {
+		resp, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: group.GroupId, Message: "hello"})
+		assert.NoError(t, err)
+		sent = append(sent, resp.MessageId)
+
+		inbox := dbClient.Messages[member.UserId]
+		assert.Len(t, inbox, 1)
+		assert.Equal(t, group.GroupId, inbox[0].InboxGroupId)
+
+		// the poll reads the group message from the inbox
+		msgs, err := handler.GetMessages(ctx, member.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Len(t, msgs.Messages, 1)
+		assert.Equal(t, group.GroupId, msgs.Messages[0].RecipientId)
+		assert.Empty(t, msgs.Messages[0].InboxGroupId)
+		assert.Equal(t, resp.MessageId, msgs.Messages[0].MessageId)
+	})
+
+	t.Run("edit replaces the inbox copies", func(t *testing.T) {
+		edited, err := handler.EditMessage(ctx, sender.UserId, group.GroupId, sent[0], EditMessageRequest{Message: "edited"})
+		assert.NoError(t, err)
+
+		msgs, err := handler.GetMessages(ctx, member.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{*edited}, msgs.Messages)
+
+		// the copy can not be changed on its own
+		_, err = handler.DeleteMessage(ctx, sender.UserId, member.UserId, sent[0])
+		assert.IsType(t, &common.NotFoundError{}, err)
+	})
+
+	t.Run("group that outgrows the policy switches to fan-out-on-read", func(t *testing.T) {
+		third := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, third)
+		stored, _ := dbClient.GetGroup(ctx, group.GroupId)
+		dbClient.AddUserToGroup(ctx, *stored, third)
+
+		resp, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: sender.UserId, RecipientId: group.GroupId, Message: "after"})
+		assert.NoError(t, err)
+		sent = append(sent, resp.MessageId)
+
+		stored, _ = dbClient.GetGroup(ctx, group.GroupId)
+		assert.False(t, stored.FanOutOnWrite)
+		assert.Less(t, stored.InboxUntil, resp.MessageId)
+		assert.Len(t, dbClient.Messages[member.UserId], 1)
+
+		// earlier messages from the inbox and later ones from the group, each once
+		msgs, err := handler.GetMessages(ctx, member.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Len(t, msgs.Messages, 2)
+		assert.Equal(t, sent, []string{msgs.Messages[0].MessageId, msgs.Messages[1].MessageId})
+	})
+
+	t.Run("inbox copies of left groups are not returned", func(t *testing.T) {
+		stored, _ := dbClient.GetGroup(ctx, group.GroupId)
+		dbClient.RemoveUserFromGroup(ctx, *stored, member)
+
+		msgs, err := handler.GetMessages(ctx, member.UserId, GetMessagesRequest{})
+		assert.NoError(t, err)
+		assert.Empty(t, msgs.Messages)
+	})
+}
@@ -0,0 +1,132 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+	"time"
+)
+
+/*
+Add a reaction with an emoji to a message, the user must be able to send a message to its conversation
+The message gets a new change ID, so that polling clients get its reaction counts as a change
+Adding a reaction again returns the message unchanged
+*/
+func (handler *Handler) AddReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error) {
+	return handler.react(ctx, userId, recipientId, messageId, emoji, true)
+}
+
+/*
+Remove a reaction of the user from a message, see AddReaction
+Removing a reaction the user did not add returns the message unchanged
+*/
+func (handler *Handler) RemoveReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error) {
+	return handler.react(ctx, userId, recipientId, messageId, emoji, false)
+}
+
+func (handler *Handler) react(ctx context.Context, userId string, recipientId string, messageId string, emoji string, add bool) (*Message, error) {
+	if !ValidReaction(emoji) {
+		slog.Error(fmt.Sprintf("Invalid reaction %q of user %s", emoji, userId))
+		return nil, &BadRequestError{Message: "Reaction must be an emoji"}
+	}
+	user, msg, err := handler.reactable(ctx, userId, recipientId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	view := NewMessageView(*user)
+	// checked on the message as read, so concurrent reactions can exceed the limit by a few emojis
+	if add && msg.Reactions[emoji] == 0 && len(msg.Reactions) >= MaxReactionEmojis {
+		slog.Error(fmt.Sprintf("Message %s has too many reactions", messageId))
+		return nil, &BadRequestError{Message: fmt.Sprintf("A message can have at most %d different reactions", MaxReactionEmojis)}
+	}
+
+	now := time.Now()
+	reaction := Reaction{RecipientId: recipientId, MessageId: messageId, UserId: userId, Emoji: emoji, CreatedAt: now.Format(time.RFC3339)}
+	var updated *Message
+	if add {
+		updated, err = handler.DBClient.AddReaction(ctx, reaction, NewMessageId(now))
+	} else {
+		updated, err = handler.DBClient.RemoveReaction(ctx, reaction, NewMessageId(now))
+	}
+	if errors.Is(err, db.ErrReactionExists) || errors.Is(err, db.ErrReactionNotFound) {
+		slog.Info(fmt.Sprintf("Reaction %s of user %s to message %s is unchanged", emoji, userId, messageId))
+		viewed, _ := view.Apply(*msg)
+		return &viewed, nil
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error updating reactions of message %s: %v", messageId, err))
+		return nil, &InternalServerError{Message: "Error updating reactions"}
+	}
+	if err = handler.deliverChange(ctx, *updated); err != nil {
+		return nil, err
+	}
+
+	slog.Info(fmt.Sprintf("Reaction %s of user %s to message %s of recipient %s, added: %v", emoji, userId, messageId, recipientId, add))
+	viewed, _ := view.Apply(*updated)
+	return &viewed, nil
+}
+
+// reactable returns the user and the message they react to, if the user can send a message to its conversation:
+// group members to the group messages, users to the private messages they sent or received, unless the peer blocked them.
+// Deleted messages and messages hidden from the user can not be reacted to.
+func (handler *Handler) reactable(ctx context.Context, userId string, recipientId string, messageId string) (*User, *Message, error) {
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return nil, nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User not found: %v", userId))
+		return nil, nil, &NotFoundError{Message: "User not found"}
+	}
+	msg, err := handler.DBClient.GetMessage(ctx, recipientId, messageId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting message %s: %v", messageId, err))
+		return nil, nil, &InternalServerError{Message: "Error getting message"}
+	}
+	if msg == nil || msg.IsInboxCopy() {
+		slog.Error(fmt.Sprintf("Message %s of recipient %s not found", messageId, recipientId))
+		return nil, nil, &NotFoundError{Message: "Message not found"}
+	}
+
+	group, err := handler.DBClient.GetGroup(ctx, recipientId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group %s: %v", recipientId, err))
+		return nil, nil, &InternalServerError{Message: "Error getting group"}
+	}
+	if group != nil {
+		if !user.Groups[recipientId] {
+			slog.Error(fmt.Sprintf("User %s is not a member of group %s", userId, recipientId))
+			return nil, nil, &ForbiddenError{Message: "User is not a member of the group"}
+		}
+	} else {
+		if msg.SenderId != userId && msg.RecipientId != userId {
+			slog.Error(fmt.Sprintf("User %s is not in the conversation of message %s", userId, messageId))
+			return nil, nil, &ForbiddenError{Message: "User is not in the conversation of the message"}
+		}
+		peerId := msg.ConversationId(userId)
+		peer, err := handler.DBClient.GetUser(ctx, peerId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting peer user: %v", err))
+			return nil, nil, &InternalServerError{Message: "Error getting peer user"}
+		}
+		// the peer of anonymized messages is deleted
+		if peer != nil && peer.BlockedUsers[userId] {
+			slog.Error(fmt.Sprintf("Peer %s has blocked user %s", peerId, userId))
+			return nil, nil, &ForbiddenError{Message: "Peer has blocked the user"}
+		}
+	}
+
+	if msg.Deleted {
+		slog.Error(fmt.Sprintf("Message %s is deleted", messageId))
+		return nil, nil, &BadRequestError{Message: "Message is deleted"}
+	}
+	if _, visible := NewMessageView(*user).Apply(*msg); !visible {
+		slog.Error(fmt.Sprintf("Message %s is hidden from user %s", messageId, userId))
+		return nil, nil, &NotFoundError{Message: "Message not found"}
+	}
+	return user, msg, nil
+}
@@ -0,0 +1,138 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"server/db"
+	"server/stream"
+	"testing"
+	"time"
+)
+
+func TestReactions(t *testing.T) {
+	ctx := context.Background()
+	hub := stream.NewLocalHub()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient, Hub: hub}
+
+	user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	user3 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user1)
+	dbClient.StoreUser(ctx, user2)
+	dbClient.StoreUser(ctx, user3)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	for _, user := range []User{user1, user2} {
+		dbClient.AddUserToGroup(ctx, group, user)
+	}
+	polledAt := time.Now().Unix() - 1
+
+	t.Run("React to a group message", func(t *testing.T) {
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "Lunch?"})
+
+		live, unsubscribe := hub.Subscribe(user1.UserId)
+		defer unsubscribe()
+		msg, err := handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "👍")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 1}, msg.Reactions)
+		assert.Greater(t, msg.ChangeId, sent.MessageId)
+		assert.Equal(t, *msg, <-live)
+
+		msg, err = handler.AddReaction(ctx, user1.UserId, group.GroupId, sent.MessageId, "👍")
+		assert.NoError(t, err)
+		msg, err = handler.AddReaction(ctx, user1.UserId, group.GroupId, sent.MessageId, "🎉")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 2, "🎉": 1}, msg.Reactions)
+
+		// the reactions are polled as a change of the message
+		msgs, err := handler.GetMessages(ctx, user2.UserId, GetMessagesRequest{Timestamp: polledAt})
+		assert.NoError(t, err)
+		assert.Contains(t, msgs.Messages, *msg)
+	})
+
+	t.Run("Adding and removing reactions again leaves the message unchanged", func(t *testing.T) {
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "Movie?"})
+		added, err := handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "❤️")
+		assert.NoError(t, err)
+
+		again, err := handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "❤️")
+		assert.NoError(t, err)
+		assert.Equal(t, added, again)
+
+		removed, err := handler.RemoveReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "❤️")
+		assert.NoError(t, err)
+		assert.Empty(t, removed.Reactions)
+		assert.Greater(t, removed.ChangeId, added.ChangeId)
+
+		again, err = handler.RemoveReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "❤️")
+		assert.NoError(t, err)
+		assert.Equal(t, removed, again)
+	})
+
+	t.Run("React to a private message", func(t *testing.T) {
+		sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Dinner?"})
+		msg, err := handler.AddReaction(ctx, user2.UserId, user2.UserId, sent.MessageId, "👍")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"👍": 1}, msg.Reactions)
+
+		// the sender polls the reaction from the copy of the message in their inbox, which is not indexed by conversation
+		msgs, err := handler.GetMessages(ctx, user1.UserId, GetMessagesRequest{Timestamp: polledAt})
+		assert.NoError(t, err)
+		polled := *msg
+		polled.ConversationKey = ""
+		assert.Contains(t, msgs.Messages, polled)
+		msgs, err = handler.GetMessages(ctx, user2.UserId, GetMessagesRequest{Timestamp: polledAt})
+		assert.NoError(t, err)
+		assert.Contains(t, msgs.Messages, *msg)
+		copied, _ := dbClient.GetMessage(ctx, user1.UserId, sent.MessageId)
+		assert.Equal(t, user2.UserId, copied.InboxPeerId)
+
+		// the copy is not a message of its own
+		_, err = handler.AddReaction(ctx, user1.UserId, user1.UserId, sent.MessageId, "👍")
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Only users of the conversation can react", func(t *testing.T) {
+		private, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "hi"})
+		_, err := handler.AddReaction(ctx, user3.UserId, user2.UserId, private.MessageId, "👍")
+		assert.IsType(t, &ForbiddenError{}, err)
+
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "hi"})
+		_, err = handler.AddReaction(ctx, user3.UserId, group.GroupId, sent.MessageId, "👍")
+		assert.IsType(t, &ForbiddenError{}, err)
+
+		_, err = handler.AddReaction(ctx, user1.UserId, group.GroupId, "missing", "👍")
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Blocked users can not react to private messages", func(t *testing.T) {
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocking)
+		sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: blocking.UserId, RecipientId: user3.UserId, Message: "hi"})
+		dbClient.BlockUser(ctx, blocking, user3.UserId)
+		_, err := handler.AddReaction(ctx, user3.UserId, user3.UserId, sent.MessageId, "👍")
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Invalid reactions", func(t *testing.T) {
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "hi"})
+		_, err := handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "nice")
+		assert.IsType(t, &BadRequestError{}, err)
+
+		for i := 0; i < MaxReactionEmojis; i++ {
+			_, err = handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, string(rune(0x1F600+i)))
+			assert.NoError(t, err)
+		}
+		_, err = handler.AddReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, "👍")
+		assert.IsType(t, &BadRequestError{}, err)
+
+		_, err = handler.DeleteMessage(ctx, user1.UserId, group.GroupId, sent.MessageId)
+		assert.NoError(t, err)
+		_, err = handler.RemoveReaction(ctx, user2.UserId, group.GroupId, sent.MessageId, string(rune(0x1F600)))
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+}
@@ -0,0 +1,229 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+	"time"
+)
+
+const (
+	DefaultThreadLimit = 50
+	MaxThreadLimit     = 1000
+)
+
+type GetThreadRequest struct {
+	After string // message ID, only later replies are returned
+	Limit int    // page size, DefaultThreadLimit if not provided
+}
+
+type ThreadResponse struct {
+	Message Message   `json:"message"` // the first message of the thread, with its reply count
+	Replies []Message `json:"replies"` // ordered by message ID, oldest first
+	HasMore bool      `json:"hasMore"` // there are more replies after the last one
+}
+
+// replyTo makes the message a reply to the message of its conversation with the given ID, if any, and returns the first
+// message of the thread the reply is counted on. The replies to a reply are in the thread of the message replied to.
+func (handler *Handler) replyTo(ctx context.Context, msg *Message, parentId string) (*Message, error) {
+	if parentId == "" {
+		return nil, nil
+	}
+	parent, err := handler.findMessage(ctx, conversationRecipients(*msg), parentId)
+	if err != nil {
+		return nil, err
+	}
+	// the partition of a user also has the private messages of their other conversations, the new message has
+	// a conversation key if it is private
+	if parent != nil && msg.ConversationKey == "" && parent.RecipientId != msg.RecipientId {
+		parent = nil
+	}
+	if parent != nil && msg.ConversationKey != "" && PrivateConversationKey(parent.SenderId, parent.RecipientId) != msg.ConversationKey {
+		parent = nil
+	}
+	if parent == nil {
+		slog.Error(fmt.Sprintf("Message %s replied to by %s not found in the conversation", parentId, msg.SenderId))
+		return nil, &NotFoundError{Message: "Message replied to not found"}
+	}
+	if parent.Deleted {
+		slog.Error(fmt.Sprintf("Message %s replied to by %s is deleted", parentId, msg.SenderId))
+		return nil, &BadRequestError{Message: "Message replied to is deleted"}
+	}
+	thread := parent
+	if parent.ThreadId != "" {
+		if thread, err = handler.getThread(ctx, *parent); err != nil {
+			return nil, err
+		}
+	}
+	msg.ReplyTo = parent.MessageId
+	msg.ThreadId = thread.MessageId
+	msg.ThreadKey = thread.MessageId
+	msg.Quote = NewQuote(*parent)
+	return thread, nil
+}
+
+// conversationRecipients returns the IDs the messages of the conversation of msg may be stored under, the group for
+// group messages and both users for private messages.
+func conversationRecipients(msg Message) []string {
+	if msg.SenderId == msg.RecipientId {
+		return []string{msg.RecipientId}
+	}
+	return []string{msg.RecipientId, msg.SenderId}
+}
+
+// findMessage returns the message stored under one of the recipients, nil if not found. Inbox copies are not returned.
+func (handler *Handler) findMessage(ctx context.Context, recipientIds []string, messageId string) (*Message, error) {
+	for _, recipientId := range recipientIds {
+		found, err := handler.DBClient.GetMessage(ctx, recipientId, messageId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting message %s: %v", messageId, err))
+			return nil, &InternalServerError{Message: "Error getting message"}
+		}
+		if found != nil && !found.IsInboxCopy() {
+			return found, nil
+		}
+	}
+	return nil, nil
+}
+
+// getThread returns the first message of the thread of a reply, it is in the conversation of the reply.
+func (handler *Handler) getThread(ctx context.Context, reply Message) (*Message, error) {
+	thread, err := handler.findMessage(ctx, conversationRecipients(reply), reply.ThreadId)
+	if err != nil {
+		return nil, err
+	}
+	if thread == nil {
+		slog.Error(fmt.Sprintf("Thread %s of message %s not found", reply.ThreadId, reply.MessageId))
+		return nil, &NotFoundError{Message: "Thread not found"}
+	}
+	return thread, nil
+}
+
+// countReply adds delta to the reply count of the first message of a thread and delivers the count as a change.
+// The reply is already stored or deleted, so a failure to count it does not fail the request.
+func (handler *Handler) countReply(ctx context.Context, thread *Message, delta int) {
+	if thread == nil {
+		return
+	}
+	updated, err := handler.DBClient.UpdateReplyCount(ctx, thread.RecipientId, thread.MessageId, delta, NewMessageId(time.Now()))
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error counting reply of thread %s: %v", thread.MessageId, err))
+		return
+	}
+	if err = handler.deliverChange(ctx, *updated); err != nil {
+		slog.Error(fmt.Sprintf("Error delivering reply count of thread %s: %v", thread.MessageId, err))
+	}
+}
+
+// updateQuotes refreshes the quote of a changed message in its replies, so that they show its edited text, or no text
+// once deleted. The message is already changed, so a failure to update a reply does not fail the request.
+func (handler *Handler) updateQuotes(ctx context.Context, msg Message) {
+	threadId := msg.ThreadId
+	if threadId == "" {
+		if msg.ReplyCount == 0 {
+			return
+		}
+		threadId = msg.MessageId
+	}
+	query := db.ThreadQuery{ThreadId: threadId, Limit: MaxThreadLimit}
+	for {
+		page, err := handler.DBClient.GetThreadMessages(ctx, query)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting replies of thread %s: %v", threadId, err))
+			return
+		}
+		for _, reply := range page.Messages {
+			if reply.ReplyTo != msg.MessageId || reply.Deleted {
+				continue
+			}
+			reply.Quote = NewQuote(msg)
+			reply.ChangeId = NewMessageId(time.Now())
+			if err = handler.DBClient.UpdateMessage(ctx, reply); err != nil {
+				slog.Error(fmt.Sprintf("Error updating quote of reply %s: %v", reply.MessageId, err))
+				continue
+			}
+			if err = handler.deliverChange(ctx, reply); err != nil {
+				slog.Error(fmt.Sprintf("Error delivering quote of reply %s: %v", reply.MessageId, err))
+			}
+		}
+		if !page.HasMore {
+			return
+		}
+		query.After = page.Messages[len(page.Messages)-1].MessageId
+	}
+}
+
+/*
+Get the thread of a message, the first message of the thread and a page of its replies, oldest first
+The message can be any message of the thread, only the users of its conversation can read it
+Group messages of users blocked by the user are shown, hidden or collapsed by the setting of the user
+*/
+func (handler *Handler) GetThread(ctx context.Context, userId string, recipientId string, messageId string, req GetThreadRequest) (*ThreadResponse, error) {
+	if req.Limit <= 0 {
+		req.Limit = DefaultThreadLimit
+	}
+	if req.Limit > MaxThreadLimit {
+		slog.Error(fmt.Sprintf("Invalid limit: %d", req.Limit))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Limit must not exceed %d", MaxThreadLimit)}
+	}
+
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User not found: %v", userId))
+		return nil, &NotFoundError{Message: "User not found"}
+	}
+	msg, err := handler.DBClient.GetMessage(ctx, recipientId, messageId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting message %s: %v", messageId, err))
+		return nil, &InternalServerError{Message: "Error getting message"}
+	}
+	if msg == nil || msg.IsInboxCopy() {
+		slog.Error(fmt.Sprintf("Message %s of recipient %s not found", messageId, recipientId))
+		return nil, &NotFoundError{Message: "Message not found"}
+	}
+	// group messages are stored under the group, private messages under one of their users
+	inConversation := msg.SenderId == userId || msg.RecipientId == userId
+	group, err := handler.DBClient.GetGroup(ctx, recipientId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group %s: %v", recipientId, err))
+		return nil, &InternalServerError{Message: "Error getting group"}
+	}
+	if group != nil {
+		inConversation = group.Members[userId]
+	}
+	if !inConversation {
+		slog.Error(fmt.Sprintf("User %s is not in the conversation of message %s", userId, messageId))
+		return nil, &ForbiddenError{Message: "User is not in the conversation of the message"}
+	}
+
+	thread := msg
+	if msg.ThreadId != "" {
+		if thread, err = handler.getThread(ctx, *msg); err != nil {
+			return nil, err
+		}
+	}
+	view := NewMessageView(*user)
+	viewed, visible := view.Apply(*thread)
+	if !visible {
+		slog.Error(fmt.Sprintf("Thread %s is hidden from user %s", thread.MessageId, userId))
+		return nil, &NotFoundError{Message: "Thread not found"}
+	}
+
+	page, err := handler.DBClient.GetThreadMessages(ctx, db.ThreadQuery{ThreadId: thread.MessageId, After: req.After, Limit: req.Limit})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting replies of thread %s: %v", thread.MessageId, err))
+		return nil, &InternalServerError{Message: "Error getting messages"}
+	}
+	// the page is past the hidden replies, so it may be shorter than the limit
+	replies := view.ApplyAll(page.Messages)
+	if replies == nil {
+		replies = []Message{}
+	}
+	return &ThreadResponse{Message: viewed, Replies: replies, HasMore: page.HasMore}, nil
+}
@@ -0,0 +1,218 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"server/db"
+	"server/stream"
+	"testing"
+)
+
+func TestReplies(t *testing.T) {
+	ctx := context.Background()
+	hub := stream.NewLocalHub()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient, Hub: hub}
+
+	user1 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	user2 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	user3 := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user1)
+	dbClient.StoreUser(ctx, user2)
+	dbClient.StoreUser(ctx, user3)
+	first, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Lunch?"})
+
+	t.Run("Reply to a private message", func(t *testing.T) {
+		resp, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "Sure", ReplyTo: first.MessageId})
+		assert.NoError(t, err)
+
+		reply, _ := dbClient.GetMessage(ctx, user1.UserId, resp.MessageId)
+		assert.Equal(t, first.MessageId, reply.ReplyTo)
+		assert.Equal(t, first.MessageId, reply.ThreadId)
+		assert.Equal(t, &Quote{SenderId: user1.UserId, Message: "Lunch?"}, reply.Quote)
+
+		// the reply is counted on the message replied to, as a change
+		thread, _ := dbClient.GetMessage(ctx, user2.UserId, first.MessageId)
+		assert.Equal(t, 1, thread.ReplyCount)
+		assert.Greater(t, thread.ChangeId, resp.MessageId)
+	})
+
+	t.Run("Replies to a reply are in the same thread", func(t *testing.T) {
+		page, _ := dbClient.GetThreadMessages(ctx, db.ThreadQuery{ThreadId: first.MessageId, Limit: 10})
+		resp, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Noon then", ReplyTo: page.Messages[0].MessageId})
+		assert.NoError(t, err)
+
+		reply, _ := dbClient.GetMessage(ctx, user2.UserId, resp.MessageId)
+		assert.Equal(t, page.Messages[0].MessageId, reply.ReplyTo)
+		assert.Equal(t, first.MessageId, reply.ThreadId)
+		assert.Equal(t, "Sure", reply.Quote.Message)
+		thread, _ := dbClient.GetMessage(ctx, user2.UserId, first.MessageId)
+		assert.Equal(t, 2, thread.ReplyCount)
+	})
+
+	t.Run("Message replied to must be in the conversation", func(t *testing.T) {
+		other, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user3.UserId, RecipientId: user1.UserId, Message: "hi"})
+		_, err := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "hi", ReplyTo: other.MessageId})
+		assert.IsType(t, &NotFoundError{}, err)
+
+		_, err = handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "hi", ReplyTo: "missing"})
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Edited and deleted messages update their quotes", func(t *testing.T) {
+		sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Dinner?"})
+		resp, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "Yes", ReplyTo: sent.MessageId})
+
+		live, unsubscribe := hub.Subscribe(user1.UserId)
+		defer unsubscribe()
+		_, err := handler.EditMessage(ctx, user1.UserId, user2.UserId, sent.MessageId, EditMessageRequest{Message: "Dinner at 8?"})
+		assert.NoError(t, err)
+		reply, _ := dbClient.GetMessage(ctx, user1.UserId, resp.MessageId)
+		assert.Equal(t, "Dinner at 8?", reply.Quote.Message)
+		assert.Greater(t, reply.ChangeId, resp.MessageId)
+		assert.Empty(t, reply.EditedAt)
+		// the sender gets the edit, then the reply is delivered again with the new quote
+		assert.Equal(t, sent.MessageId, (<-live).MessageId)
+		assert.Equal(t, *reply, <-live)
+
+		_, err = handler.DeleteMessage(ctx, user1.UserId, user2.UserId, sent.MessageId)
+		assert.NoError(t, err)
+		reply, _ = dbClient.GetMessage(ctx, user1.UserId, resp.MessageId)
+		assert.Equal(t, &Quote{SenderId: user1.UserId, Deleted: true}, reply.Quote)
+
+		_, err = handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "hi", ReplyTo: sent.MessageId})
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+
+	t.Run("Deleted replies are not counted", func(t *testing.T) {
+		sent, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: user2.UserId, Message: "Movie?"})
+		resp, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: user1.UserId, Message: "Which one?", ReplyTo: sent.MessageId})
+
+		reply, err := handler.DeleteMessage(ctx, user2.UserId, user1.UserId, resp.MessageId)
+		assert.NoError(t, err)
+		assert.Nil(t, reply.Quote)
+		thread, _ := dbClient.GetMessage(ctx, user2.UserId, sent.MessageId)
+		assert.Equal(t, 0, thread.ReplyCount)
+	})
+
+	t.Run("Reply to a group message", func(t *testing.T) {
+		group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		other := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		dbClient.StoreGroup(ctx, group)
+		dbClient.StoreGroup(ctx, other)
+		for _, user := range []User{user1, user2} {
+			dbClient.AddUserToGroup(ctx, group, user)
+			dbClient.AddUserToGroup(ctx, other, user)
+		}
+		sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user1.UserId, RecipientId: group.GroupId, Message: "Standup?"})
+
+		live, unsubscribe := hub.Subscribe(user1.UserId)
+		defer unsubscribe()
+		resp, err := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: group.GroupId, Message: "Now", ReplyTo: sent.MessageId})
+		assert.NoError(t, err)
+		assert.Equal(t, resp.MessageId, (<-live).MessageId)
+		// the members get the reply count of the thread
+		thread := <-live
+		assert.Equal(t, sent.MessageId, thread.MessageId)
+		assert.Equal(t, 1, thread.ReplyCount)
+
+		// the message replied to is in another group
+		_, err = handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: user2.UserId, RecipientId: other.GroupId, Message: "Now", ReplyTo: sent.MessageId})
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+}
+
+func TestGetThread(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	member := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	outsider := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, member)
+	dbClient.StoreUser(ctx, peer)
+	dbClient.StoreUser(ctx, outsider)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, member)
+	dbClient.AddUserToGroup(ctx, group, peer)
+
+	sent, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: member.UserId, RecipientId: group.GroupId, Message: "Standup?"})
+	var replies []string
+	for _, text := range []string{"Now", "In 5", "Skip"} {
+		resp, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: peer.UserId, RecipientId: group.GroupId, Message: text, ReplyTo: sent.MessageId})
+		replies = append(replies, resp.MessageId)
+	}
+
+	t.Run("Get the thread and page through the replies", func(t *testing.T) {
+		resp, err := handler.GetThread(ctx, member.UserId, group.GroupId, sent.MessageId, GetThreadRequest{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, "Standup?", resp.Message.Message)
+		assert.Equal(t, 3, resp.Message.ReplyCount)
+		assert.Equal(t, []string{"Now", "In 5"}, []string{resp.Replies[0].Message, resp.Replies[1].Message})
+		assert.True(t, resp.HasMore)
+
+		resp, err = handler.GetThread(ctx, member.UserId, group.GroupId, sent.MessageId, GetThreadRequest{After: resp.Replies[1].MessageId, Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, resp.Replies, 1)
+		assert.Equal(t, "Skip", resp.Replies[0].Message)
+		assert.False(t, resp.HasMore)
+	})
+
+	t.Run("Get the thread of a reply", func(t *testing.T) {
+		resp, err := handler.GetThread(ctx, member.UserId, group.GroupId, replies[1], GetThreadRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, sent.MessageId, resp.Message.MessageId)
+		assert.Len(t, resp.Replies, 3)
+	})
+
+	t.Run("Message without replies", func(t *testing.T) {
+		other, _ := handler.SendGroupMessage(ctx, SendMessageRequest{SenderId: member.UserId, RecipientId: group.GroupId, Message: "hello"})
+		resp, err := handler.GetThread(ctx, member.UserId, group.GroupId, other.MessageId, GetThreadRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{}, resp.Replies)
+	})
+
+	t.Run("Private thread", func(t *testing.T) {
+		private, _ := handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: member.UserId, RecipientId: peer.UserId, Message: "hi"})
+		handler.SendPrivateMessage(ctx, SendMessageRequest{SenderId: peer.UserId, RecipientId: member.UserId, Message: "hey", ReplyTo: private.MessageId})
+
+		for _, user := range []User{member, peer} {
+			resp, err := handler.GetThread(ctx, user.UserId, peer.UserId, private.MessageId, GetThreadRequest{})
+			assert.NoError(t, err)
+			assert.Equal(t, "hey", resp.Replies[0].Message)
+		}
+		_, err := handler.GetThread(ctx, outsider.UserId, peer.UserId, private.MessageId, GetThreadRequest{})
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Replies of blocked users", func(t *testing.T) {
+		dbClient.BlockUser(ctx, member, peer.UserId)
+		stored, _ := dbClient.GetUser(ctx, member.UserId)
+		dbClient.SetBlockedGroupMessages(ctx, *stored, BlockedMessagesHide)
+
+		resp, err := handler.GetThread(ctx, member.UserId, group.GroupId, sent.MessageId, GetThreadRequest{})
+		assert.NoError(t, err)
+		assert.Empty(t, resp.Replies)
+		assert.Equal(t, 3, resp.Message.ReplyCount)
+	})
+
+	t.Run("Not a member of the group", func(t *testing.T) {
+		_, err := handler.GetThread(ctx, outsider.UserId, group.GroupId, sent.MessageId, GetThreadRequest{})
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Message not found", func(t *testing.T) {
+		_, err := handler.GetThread(ctx, member.UserId, group.GroupId, "missing", GetThreadRequest{})
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		_, err := handler.GetThread(ctx, member.UserId, group.GroupId, sent.MessageId, GetThreadRequest{Limit: MaxThreadLimit + 1})
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+}
@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+	"mime"
+	"net/http"
+	"server/attachments"
+	"server/common"
+)
+
+// multipartOverhead is the room left for the boundaries and headers of the multipart upload
+const multipartOverhead = 1 << 20
+
+type AttachmentsRoutes struct {
+	Handler attachments.HandlerInterface
+}
+
+/*
+Upload a file as multipart form data, in the field file, the uploader is the authenticated user
+Returns the attachment, its attachmentId is then sent with a message in attachmentIds
+API: POST /v1/attachments
+*/
+func (ar *AttachmentsRoutes) UploadHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, attachments.MaxAttachmentSize+multipartOverhead)
+	header, err := c.FormFile("file")
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid upload: %v", err))
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error opening upload %s: %v", header.Filename, err))
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	defer file.Close()
+
+	attachment, err := ar.Handler.Upload(c, authUserId(c), attachments.UploadRequest{
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		Content:     file,
+	})
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, attachment)
+}
+
+/*
+Download an attachment, by the uploader or by the recipients of the message it was sent with
+The ETag is the SHA-256 checksum of the content
+API: GET /v1/attachments/:attachmentId
+*/
+func (ar *AttachmentsRoutes) DownloadHandler(c *gin.Context) {
+	attachmentId := c.Param("attachmentId")
+	attachment, content, err := ar.Handler.Download(c, authUserId(c), attachmentId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, content, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}),
+		"ETag":                   fmt.Sprintf("%q", attachment.Checksum),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
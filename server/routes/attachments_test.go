@@ -0,0 +1,150 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"server/attachments"
+	"server/common"
+	"strings"
+	"testing"
+)
+
+type attachmentHandlerMock struct {
+	error   error
+	userId  string
+	content string
+	req     attachments.UploadRequest
+}
+
+func (ah *attachmentHandlerMock) Upload(ctx context.Context, userId string, req attachments.UploadRequest) (*common.Attachment, error) {
+	ah.userId = userId
+	ah.req = req
+	if ah.error != nil {
+		return nil, ah.error
+	}
+	content, _ := io.ReadAll(req.Content)
+	ah.content = string(content)
+	return &common.Attachment{AttachmentId: "attachment-id", UploaderId: userId, FileName: req.FileName, ContentType: req.ContentType, Size: req.Size}, nil
+}
+
+func (ah *attachmentHandlerMock) Download(ctx context.Context, userId string, attachmentId string) (*common.Attachment, io.ReadCloser, error) {
+	ah.userId = userId
+	if ah.error != nil {
+		return nil, nil, ah.error
+	}
+	attachment := &common.Attachment{AttachmentId: attachmentId, FileName: "hello world.txt", ContentType: "text/plain", Size: 5, Checksum: "checksum"}
+	return attachment, io.NopCloser(strings.NewReader("hello")), nil
+}
+
+func newUploadRequest(t *testing.T, field string, content string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="`+field+`"; filename="hello.txt"`)
+	header.Set("Content-Type", "text/plain")
+	part, err := writer.CreatePart(header)
+	assert.Nil(t, err)
+	part.Write([]byte(content))
+	writer.Close()
+	req, err := http.NewRequest(http.MethodPost, "/v1/attachments", &body)
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestUploadHandler(t *testing.T) {
+	mock := &attachmentHandlerMock{}
+	r := Router{Auth: testAuth, Attachments: AttachmentsRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := newUploadRequest(t, "file", "hello")
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "user", mock.userId)
+		assert.Equal(t, attachments.UploadRequest{FileName: "hello.txt", ContentType: "text/plain", Size: 5, Content: mock.req.Content}, mock.req)
+		assert.Equal(t, "hello", mock.content)
+		var resp common.Attachment
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "attachment-id", resp.AttachmentId)
+	})
+
+	t.Run("Without file", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := newUploadRequest(t, "other", "hello")
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Invalid upload", func(t *testing.T) {
+		mock.error = &common.BadRequestError{Message: "Attachment too large"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req := newUploadRequest(t, "file", "hello")
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, "file", "hello"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestDownloadHandler(t *testing.T) {
+	mock := &attachmentHandlerMock{}
+	r := Router{Auth: testAuth, Attachments: AttachmentsRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/attachments/attachment-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "user", mock.userId)
+		assert.Equal(t, "hello", w.Body.String())
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="hello world.txt"`, w.Header().Get("Content-Disposition"))
+		assert.Equal(t, `"checksum"`, w.Header().Get("ETag"))
+	})
+
+	t.Run("Not a recipient", func(t *testing.T) {
+		mock.error = &common.ForbiddenError{Message: "Only the recipients of the message can download the attachment"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/attachments/attachment-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		mock.error = &common.NotFoundError{Message: "Attachment not found"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/attachments/attachment-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
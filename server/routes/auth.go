@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strings"
+)
+
+// authUserIdKey is the gin context key of the user ID authenticated by the request token.
+const authUserIdKey = "authUserId"
+
+/*
+Authenticate the request with the bearer token in the Authorization header
+The authenticated user ID is available to the route handlers with authUserId
+*/
+func (router *Router) authenticate(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || token == "" {
+		slog.Error("Missing bearer token")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	userId, err := router.Auth.ParseToken(token)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid token: %v", err))
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(authUserIdKey, userId)
+	c.Next()
+}
+
+// authUserId returns the user ID authenticated by the request token.
+func authUserId(c *gin.Context) string {
+	return c.GetString(authUserIdKey)
+}
+
+// requireAuthUser checks that the user in the request path is the authenticated user,
+// users can only act on their own behalf.
+func requireAuthUser(c *gin.Context, userId string) bool {
+	if userId != authUserId(c) {
+		slog.Error(fmt.Sprintf("User %s is not allowed to act as %s", authUserId(c), userId))
+		c.String(http.StatusForbidden, "Not allowed to act on behalf of another user")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"server/auth"
+	"testing"
+	"time"
+)
+
+var testAuth = auth.NewAuthenticator([]byte("test-secret"), time.Hour)
+
+// authHeader returns the Authorization header of a request authenticated as the user.
+func authHeader(userId string) http.Header {
+	token, _, _ := testAuth.IssueToken(userId)
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+func authorize(req *http.Request, userId string) {
+	req.Header.Set("Authorization", authHeader(userId).Get("Authorization"))
+}
+
+func TestAuthenticate(t *testing.T) {
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Authenticated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
+		assert.Nil(t, err)
+		authorize(req, "recipient")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Missing token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer invalid")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Token of another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
+		assert.Nil(t, err)
+		authorize(req, "other-user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
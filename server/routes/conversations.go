@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"server/common"
+	"server/conversations"
+	"strconv"
+)
+
+type ConversationsRoutes struct {
+	Handler conversations.HandlerInterface
+}
+
+/*
+Mark the messages of a conversation of the authenticated user as read, the ID is the peer user ID or the group ID
+Optional body with the last read message ID, without it every message up to now is read
+API: POST /v1/conversations/:id/read
+*/
+func (cr *ConversationsRoutes) MarkReadHandler(c *gin.Context) {
+	conversationId := c.Param("id")
+	if conversationId == "" {
+		slog.Error("Conversation ID is required")
+		c.String(http.StatusBadRequest, "Conversation ID is required")
+		return
+	}
+	var req conversations.MarkReadRequest
+	if c.Request.ContentLength != 0 {
+		decoder := json.NewDecoder(c.Request.Body)
+		err := decoder.Decode(&req)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Invalid input: %v", err))
+			c.String(http.StatusBadRequest, "Invalid input")
+			return
+		}
+	}
+	conversation, err := cr.Handler.MarkRead(c, authUserId(c), conversationId, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, conversation)
+}
+
+/*
+Get the read marker of a peer in the private conversation with the authenticated user (read receipts)
+Messages sent to the peer up to lastReadMessageId were read
+API: GET /v1/conversations/:id/read
+*/
+func (cr *ConversationsRoutes) GetReadMarkerHandler(c *gin.Context) {
+	peerId := c.Param("id")
+	if peerId == "" {
+		slog.Error("Conversation ID is required")
+		c.String(http.StatusBadRequest, "Conversation ID is required")
+		return
+	}
+	conversation, err := cr.Handler.GetReadMarker(c, authUserId(c), peerId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, conversation)
+}
+
+/*
+Get the unread message counts of every private conversation and group of the user
+The user ID must be the authenticated user
+API: GET /v1/users/:userId/unread
+*/
+func (cr *ConversationsRoutes) GetUnreadCountsHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := cr.Handler.GetUnreadCounts(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Get the conversations of the user, every private peer and group with the latest message, last activity time and
+unread count, sorted by recency
+The user ID must be the authenticated user
+API: GET /v1/users/:userId/conversations
+*/
+func (cr *ConversationsRoutes) GetConversationsHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := cr.Handler.GetConversations(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Get the messages of the private conversation between the authenticated user and the peer, oldest first
+Optional query parameters before and after, message IDs to page back to older or forward to newer messages, and limit
+API: GET /v1/conversations/private/:peerId?before=abc&after=abc&limit=50
+*/
+func (cr *ConversationsRoutes) GetPrivateHistoryHandler(c *gin.Context) {
+	req, ok := historyRequest(c)
+	if !ok {
+		return
+	}
+	resp, err := cr.Handler.GetPrivateHistory(c, authUserId(c), c.Param("peerId"), req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Get the messages of a group the authenticated user is a member of, oldest first
+Optional query parameters before and after, message IDs to page back to older or forward to newer messages, and limit
+API: GET /v1/conversations/group/:groupId?before=abc&after=abc&limit=50
+*/
+func (cr *ConversationsRoutes) GetGroupHistoryHandler(c *gin.Context) {
+	req, ok := historyRequest(c)
+	if !ok {
+		return
+	}
+	resp, err := cr.Handler.GetGroupHistory(c, authUserId(c), c.Param("groupId"), req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func historyRequest(c *gin.Context) (conversations.HistoryRequest, bool) {
+	req := conversations.HistoryRequest{Before: c.Query("before"), After: c.Query("after")}
+	if limit := c.Query("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			slog.Error(fmt.Sprintf("Invalid limit: %v", limit))
+			c.String(http.StatusBadRequest, "Invalid limit")
+			return req, false
+		}
+		req.Limit = i
+	}
+	return req, true
+}
@@ -0,0 +1,276 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"server/common"
+	"server/conversations"
+	"testing"
+)
+
+type conversationHandlerMock struct {
+	error      error
+	req        conversations.MarkReadRequest
+	historyReq conversations.HistoryRequest
+}
+
+func (ch *conversationHandlerMock) MarkRead(ctx context.Context, userId string, conversationId string, req conversations.MarkReadRequest) (*common.Conversation, error) {
+	ch.req = req
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &common.Conversation{UserId: userId, ConversationId: conversationId, LastReadMessageId: req.MessageId}, nil
+}
+func (ch *conversationHandlerMock) GetReadMarker(ctx context.Context, userId string, peerId string) (*common.Conversation, error) {
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &common.Conversation{UserId: peerId, ConversationId: userId, LastReadMessageId: "message-id"}, nil
+}
+func (ch *conversationHandlerMock) GetUnreadCounts(ctx context.Context, userId string) (*conversations.UnreadCountsResponse, error) {
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &conversations.UnreadCountsResponse{
+		Conversations: []conversations.UnreadCount{{ConversationId: "peer", Type: common.ConversationPrivate, UnreadCount: 2}},
+		Total:         2,
+	}, nil
+}
+
+func (ch *conversationHandlerMock) GetConversations(ctx context.Context, userId string) (*conversations.ConversationsResponse, error) {
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &conversations.ConversationsResponse{Conversations: []conversations.ConversationSummary{{
+		ConversationId: "peer",
+		Type:           common.ConversationPrivate,
+		LastMessage:    &common.Message{MessageId: "message-id", SenderId: "peer", RecipientId: userId, Message: "hello"},
+		UnreadCount:    1,
+	}}}, nil
+}
+
+func (ch *conversationHandlerMock) GetPrivateHistory(ctx context.Context, userId string, peerId string, req conversations.HistoryRequest) (*conversations.HistoryResponse, error) {
+	ch.historyReq = req
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &conversations.HistoryResponse{Messages: []common.Message{{MessageId: "message-id", SenderId: peerId, RecipientId: userId}}, HasMore: true}, nil
+}
+func (ch *conversationHandlerMock) GetGroupHistory(ctx context.Context, userId string, groupId string, req conversations.HistoryRequest) (*conversations.HistoryResponse, error) {
+	ch.historyReq = req
+	if ch.error != nil {
+		return nil, ch.error
+	}
+	return &conversations.HistoryResponse{Messages: []common.Message{{MessageId: "message-id", SenderId: userId, RecipientId: groupId}}}, nil
+}
+
+func TestMarkReadHandler(t *testing.T) {
+	mock := &conversationHandlerMock{}
+	r := Router{Auth: testAuth, Conversations: ConversationsRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/conversations/peer/read", bytes.NewReader([]byte(`{"messageId": "message-id"}`)))
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp common.Conversation
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, common.Conversation{UserId: "user", ConversationId: "peer", LastReadMessageId: "message-id"}, resp)
+	})
+
+	t.Run("Without body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/conversations/peer/read", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, mock.req.MessageId)
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/conversations/peer/read", bytes.NewReader([]byte(`{invalid`)))
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Not a member of the group", func(t *testing.T) {
+		mock.error = &common.ForbiddenError{Message: "User is not a member of the group"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/conversations/group/read", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/conversations/peer/read", nil)
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestGetReadMarkerHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Conversations: ConversationsRoutes{Handler: &conversationHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/v1/conversations/peer/read", nil)
+	assert.Nil(t, err)
+	authorize(req, "user")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp common.Conversation
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, "peer", resp.UserId)
+	assert.Equal(t, "message-id", resp.LastReadMessageId)
+}
+
+func TestGetUnreadCountsHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Conversations: ConversationsRoutes{Handler: &conversationHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/user/unread", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp conversations.UnreadCountsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, 2, resp.Total)
+		assert.Len(t, resp.Conversations, 1)
+	})
+
+	t.Run("Another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/other/unread", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestGetConversationsHandler(t *testing.T) {
+	mock := &conversationHandlerMock{}
+	r := Router{Auth: testAuth, Conversations: ConversationsRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/user/conversations", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp conversations.ConversationsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Len(t, resp.Conversations, 1)
+		assert.Equal(t, "hello", resp.Conversations[0].LastMessage.Message)
+	})
+
+	t.Run("Another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/other/conversations", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("User not found", func(t *testing.T) {
+		mock.error = &common.NotFoundError{Message: "User not found"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/user/conversations", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestHistoryHandlers(t *testing.T) {
+	mock := &conversationHandlerMock{}
+	r := Router{Auth: testAuth, Conversations: ConversationsRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Private history with cursors", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/conversations/private/peer?before=b&after=a&limit=10", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, conversations.HistoryRequest{Before: "b", After: "a", Limit: 10}, mock.historyReq)
+
+		var resp conversations.HistoryResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.True(t, resp.HasMore)
+		assert.Equal(t, "peer", resp.Messages[0].SenderId)
+	})
+
+	t.Run("Group history", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/conversations/group/group-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, conversations.HistoryRequest{}, mock.historyReq)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/conversations/group/group-id?limit=abc", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Not a member of the group", func(t *testing.T) {
+		mock.error = &common.ForbiddenError{Message: "User is not a member of the group"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/conversations/group/group-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Read markers are still routed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/conversations/peer/read", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -15,7 +15,7 @@ type GroupRoutes struct {
 }
 
 /*
-Create a new group
+Create a new group, the authenticated user is the group owner and its first member
 API: POST /v1/groups/create
 */
 func (gr GroupRoutes) CreateGroupHandler(c *gin.Context) {
@@ -27,7 +27,7 @@ func (gr GroupRoutes) CreateGroupHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Invalid input")
 		return
 	}
-	resp, err := gr.Handler.CreateGroup(c, &req)
+	resp, err := gr.Handler.CreateGroup(c, authUserId(c), &req)
 	if err != nil {
 		common.HandleError(err, c)
 		return
@@ -36,8 +36,12 @@ func (gr GroupRoutes) CreateGroupHandler(c *gin.Context) {
 }
 
 /*
-Add a user to a group or remove a user from a group
-API: POST /v1/groups/:groupId?op=[add/remove]
+Add a user to a group or remove a user from a group, promote a member to admin or demote an admin to member
+Owner and admins can add and remove members, members can remove themselves, only the owner can remove admins
+Only the owner can promote and demote
+Owner and admins can ban a user, which removes them and keeps them from being added again or joining with an invite until unbanned,
+only the owner can ban admins
+API: POST /v1/groups/:groupId?op=[add/remove/promote/demote/ban/unban]
 */
 func (gr GroupRoutes) UserToGroupHandler(c *gin.Context) {
 	// get the group ID from the URL path
@@ -63,9 +67,17 @@ func (gr GroupRoutes) UserToGroupHandler(c *gin.Context) {
 	op := c.Query("op")
 	switch op {
 	case "add":
-		err = gr.Handler.AddUserToGroup(c, groupId, &req)
+		err = gr.Handler.AddUserToGroup(c, authUserId(c), groupId, &req)
 	case "remove":
-		err = gr.Handler.RemoveUserFromGroup(c, groupId, &req)
+		err = gr.Handler.RemoveUserFromGroup(c, authUserId(c), groupId, &req)
+	case "promote":
+		err = gr.Handler.PromoteUser(c, authUserId(c), groupId, &req)
+	case "demote":
+		err = gr.Handler.DemoteUser(c, authUserId(c), groupId, &req)
+	case "ban":
+		err = gr.Handler.BanUser(c, authUserId(c), groupId, &req)
+	case "unban":
+		err = gr.Handler.UnbanUser(c, authUserId(c), groupId, &req)
 	default:
 		slog.Error(fmt.Sprintf("Invalid operation %s", op))
 		c.String(http.StatusBadRequest, "Invalid operation")
@@ -77,3 +89,111 @@ func (gr GroupRoutes) UserToGroupHandler(c *gin.Context) {
 	}
 	c.Writer.WriteHeader(http.StatusOK)
 }
+
+/*
+Delete a group, only the group owner can delete it
+API: DELETE /v1/groups/:groupId
+*/
+func (gr GroupRoutes) DeleteGroupHandler(c *gin.Context) {
+	groupId := c.Param("groupId")
+	if groupId == "" {
+		slog.Error("Group ID is required")
+		c.String(http.StatusBadRequest, "Group ID is required")
+		return
+	}
+	err := gr.Handler.DeleteGroup(c, authUserId(c), groupId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Create an invite to the group, only the group owner and admins can create invites
+Optional expiresIn (seconds) and maxUses, 0 or missing never expires / allows unlimited uses
+API: POST /v1/groups/:groupId/invites
+*/
+func (gr GroupRoutes) CreateInviteHandler(c *gin.Context) {
+	groupId := c.Param("groupId")
+	if groupId == "" {
+		slog.Error("Group ID is required")
+		c.String(http.StatusBadRequest, "Group ID is required")
+		return
+	}
+	var req groups.CreateInviteRequest
+	// the body is optional, an empty body creates an invite without limits
+	if c.Request.ContentLength != 0 {
+		decoder := json.NewDecoder(c.Request.Body)
+		err := decoder.Decode(&req)
+		if err != nil || req.ExpiresIn < 0 || req.MaxUses < 0 {
+			slog.Error(fmt.Sprintf("Invalid input: %v, err: %v", req, err))
+			c.String(http.StatusBadRequest, "Invalid input")
+			return
+		}
+	}
+	invite, err := gr.Handler.CreateInvite(c, authUserId(c), groupId, &req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, invite)
+}
+
+/*
+List the invites of the group that can still be used, only the group owner and admins can list invites
+API: GET /v1/groups/:groupId/invites
+*/
+func (gr GroupRoutes) GetInvitesHandler(c *gin.Context) {
+	groupId := c.Param("groupId")
+	if groupId == "" {
+		slog.Error("Group ID is required")
+		c.String(http.StatusBadRequest, "Group ID is required")
+		return
+	}
+	resp, err := gr.Handler.GetInvites(c, authUserId(c), groupId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Revoke an invite of the group, only the group owner and admins can revoke invites
+API: DELETE /v1/groups/:groupId/invites/:token
+*/
+func (gr GroupRoutes) RevokeInviteHandler(c *gin.Context) {
+	groupId := c.Param("groupId")
+	token := c.Param("token")
+	if groupId == "" || token == "" {
+		slog.Error("Group ID and token are required")
+		c.String(http.StatusBadRequest, "Group ID and token are required")
+		return
+	}
+	err := gr.Handler.RevokeInvite(c, authUserId(c), groupId, token)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Join a group with an invite token, the authenticated user is added to the group
+API: POST /v1/groups/join/:token
+*/
+func (gr GroupRoutes) JoinGroupHandler(c *gin.Context) {
+	token := c.Param("token")
+	if token == "" {
+		slog.Error("Token is required")
+		c.String(http.StatusBadRequest, "Token is required")
+		return
+	}
+	resp, err := gr.Handler.JoinGroup(c, authUserId(c), token)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -16,27 +16,75 @@ type groupHandlerMock struct {
 	error error
 }
 
-func (gh *groupHandlerMock) CreateGroup(ctx context.Context, req *groups.CreateGroupRequest) (*groups.CreateGroupResponse, error) {
+func (gh *groupHandlerMock) CreateGroup(ctx context.Context, ownerId string, req *groups.CreateGroupRequest) (*groups.CreateGroupResponse, error) {
 	if gh.error != nil {
 		return nil, gh.error
 	}
-	return &groups.CreateGroupResponse{GroupId: req.GroupName, GroupName: req.GroupName}, nil
+	return &groups.CreateGroupResponse{GroupId: req.GroupName, GroupName: req.GroupName, OwnerId: ownerId}, nil
 }
-func (gh *groupHandlerMock) AddUserToGroup(ctx context.Context, groupId string, req *groups.UserToGroupRequest) error {
+func (gh *groupHandlerMock) AddUserToGroup(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
 	if gh.error != nil {
 		return gh.error
 	}
 	return nil
 }
-func (gh *groupHandlerMock) RemoveUserFromGroup(ctx context.Context, groupId string, req *groups.UserToGroupRequest) error {
+func (gh *groupHandlerMock) RemoveUserFromGroup(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
 	if gh.error != nil {
 		return gh.error
 	}
 	return nil
 }
+func (gh *groupHandlerMock) PromoteUser(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
+	if gh.error != nil {
+		return gh.error
+	}
+	return nil
+}
+func (gh *groupHandlerMock) DemoteUser(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
+	if gh.error != nil {
+		return gh.error
+	}
+	return nil
+}
+func (gh *groupHandlerMock) BanUser(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
+	return gh.error
+}
+func (gh *groupHandlerMock) UnbanUser(ctx context.Context, actorId string, groupId string, req *groups.UserToGroupRequest) error {
+	return gh.error
+}
+func (gh *groupHandlerMock) DeleteGroup(ctx context.Context, actorId string, groupId string) error {
+	if gh.error != nil {
+		return gh.error
+	}
+	return nil
+}
+func (gh *groupHandlerMock) CreateInvite(ctx context.Context, actorId string, groupId string, req *groups.CreateInviteRequest) (*common.GroupInvite, error) {
+	if gh.error != nil {
+		return nil, gh.error
+	}
+	return &common.GroupInvite{Token: "test-token", GroupId: groupId, CreatedBy: actorId, MaxUses: req.MaxUses}, nil
+}
+func (gh *groupHandlerMock) GetInvites(ctx context.Context, actorId string, groupId string) (*groups.GetInvitesResponse, error) {
+	if gh.error != nil {
+		return nil, gh.error
+	}
+	return &groups.GetInvitesResponse{Invites: []common.GroupInvite{{Token: "test-token", GroupId: groupId}}}, nil
+}
+func (gh *groupHandlerMock) RevokeInvite(ctx context.Context, actorId string, groupId string, token string) error {
+	if gh.error != nil {
+		return gh.error
+	}
+	return nil
+}
+func (gh *groupHandlerMock) JoinGroup(ctx context.Context, userId string, token string) (*groups.JoinGroupResponse, error) {
+	if gh.error != nil {
+		return nil, gh.error
+	}
+	return &groups.JoinGroupResponse{GroupId: "test-group"}, nil
+}
 
 func TestCreateGroupHandler(t *testing.T) {
-	r := Router{Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
+	r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
@@ -50,6 +98,7 @@ func TestCreateGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/create", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -58,6 +107,7 @@ func TestCreateGroupHandler(t *testing.T) {
 		_ = decoder.Decode(&groupRes)
 
 		assert.Equal(t, reqBody.GroupName, groupRes.GroupName)
+		assert.Equal(t, "test-user", groupRes.OwnerId)
 
 	})
 
@@ -70,13 +120,14 @@ func TestCreateGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/create", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
 	t.Run("Error", func(t *testing.T) {
-		r := Router{Groups: GroupRoutes{Handler: &groupHandlerMock{error: assert.AnError}}}
+		r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{error: assert.AnError}}}
 		router, err := r.NewRouter()
 		assert.Nil(t, err)
 
@@ -88,6 +139,7 @@ func TestCreateGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/create", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusInternalServerError, w.Code)
@@ -96,7 +148,7 @@ func TestCreateGroupHandler(t *testing.T) {
 }
 
 func TestUserToGroupHandler(t *testing.T) {
-	r := Router{Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
+	r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
@@ -109,6 +161,7 @@ func TestUserToGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=add", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -123,6 +176,7 @@ func TestUserToGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=remove", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -137,13 +191,14 @@ func TestUserToGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=add", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
 	t.Run("Not found error", func(t *testing.T) {
-		r := Router{Groups: GroupRoutes{Handler: &groupHandlerMock{error: &common.NotFoundError{Message: "some error"}}}}
+		r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{error: &common.NotFoundError{Message: "some error"}}}}
 		router, err := r.NewRouter()
 		assert.Nil(t, err)
 
@@ -155,11 +210,60 @@ func TestUserToGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/?op=add", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
+	t.Run("Promote user successfully", func(t *testing.T) {
+		reqBody := groups.UserToGroupRequest{
+			UserId: "test-user-2",
+		}
+		body, _ := json.Marshal(reqBody)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=promote", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Ban and unban user successfully", func(t *testing.T) {
+		for _, op := range []string{"ban", "unban"} {
+			body, _ := json.Marshal(groups.UserToGroupRequest{UserId: "test-user-2"})
+			w := httptest.NewRecorder()
+
+			req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op="+op, bytes.NewReader(body))
+			assert.Nil(t, err)
+			authorize(req, "test-user")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("Forbidden error", func(t *testing.T) {
+		r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{error: &common.ForbiddenError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		reqBody := groups.UserToGroupRequest{
+			UserId: "test-user-2",
+		}
+		body, _ := json.Marshal(reqBody)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=demote", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
 	t.Run("Invalid op", func(t *testing.T) {
 		reqBody := groups.UserToGroupRequest{
 			UserId: "test-user",
@@ -169,6 +273,138 @@ func TestUserToGroupHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group?op=invalid", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestDeleteGroupHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Delete successfully", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/groups/test-group", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Not the owner", func(t *testing.T) {
+		r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{error: &common.ForbiddenError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/groups/test-group", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/groups/test-group", nil)
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestInviteHandlers(t *testing.T) {
+	r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Create invite successfully", func(t *testing.T) {
+		body, _ := json.Marshal(groups.CreateInviteRequest{MaxUses: 5})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group/invites", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var invite common.GroupInvite
+		_ = json.NewDecoder(w.Body).Decode(&invite)
+		assert.Equal(t, "test-group", invite.GroupId)
+		assert.Equal(t, "test-user", invite.CreatedBy)
+		assert.Equal(t, 5, invite.MaxUses)
+	})
+
+	t.Run("Create invite without body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group/invites", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Create invite invalid input", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/test-group/invites", bytes.NewReader([]byte(`{"maxUses": -1}`)))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("List invites", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/groups/test-group/invites", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp groups.GetInvitesResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		assert.Len(t, resp.Invites, 1)
+	})
+
+	t.Run("Revoke invite", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/groups/test-group/invites/test-token", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Join group", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/join/test-token", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp groups.JoinGroupResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "test-group", resp.GroupId)
+	})
+
+	t.Run("Join group error", func(t *testing.T) {
+		r := Router{Auth: testAuth, Groups: GroupRoutes{Handler: &groupHandlerMock{error: &common.BadRequestError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/groups/join/test-token", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -8,32 +9,55 @@ import (
 	"net/http"
 	"server/common"
 	"server/messages"
+	"server/scheduler"
 	"strconv"
+	"time"
 )
 
 type MessagesRoutes struct {
-	Handler messages.HandlerInterface
+	Handler   messages.HandlerInterface
+	Scheduler scheduler.HandlerInterface
 }
 
 /*
 Send a private or group message, type can be [group/private]
+The sender is the authenticated user
+Optional attachmentIds, of attachments uploaded with POST /v1/attachments, the text can then be empty
+Optional replyTo, the ID of a message of the same conversation, the reply is stored with a quote of it
+Optional sendAt, an RFC3339 time, schedules the message to be sent then, returns 202 Accepted with the scheduled message
 API: POST /v1/messages/send?type=[private/group]
 */
 func (mr *MessagesRoutes) SendMessageHandler(c *gin.Context) {
 	decoder := json.NewDecoder(c.Request.Body)
 	var req messages.SendMessageRequest
 	err := decoder.Decode(&req)
-	if err != nil || req.SenderId == "" || req.RecipientId == "" || req.Message == "" {
+	// a message has a text, attachments or both
+	if err != nil || req.RecipientId == "" || (req.Message == "" && len(req.AttachmentIds) == 0) {
 		slog.Error(fmt.Sprintf("Invalid input: %v", c.Request.Body))
 		c.String(http.StatusBadRequest, "Invalid input")
 		return
 	}
+	// senderId is optional, if provided it must be the authenticated user
+	if req.SenderId != "" && !requireAuthUser(c, req.SenderId) {
+		return
+	}
+	req.SenderId = authUserId(c)
 	msgType := c.Query("type")
+	if req.SendAt != "" {
+		scheduled, err := mr.Scheduler.Schedule(c, msgType, req)
+		if err != nil {
+			common.HandleError(err, c)
+			return
+		}
+		c.JSON(http.StatusAccepted, scheduled)
+		return
+	}
+	var resp *messages.SendMessageResponse
 	switch msgType {
 	case "private":
-		err = mr.Handler.SendPrivateMessage(c, req)
+		resp, err = mr.Handler.SendPrivateMessage(c, req)
 	case "group":
-		err = mr.Handler.SendGroupMessage(c, req)
+		resp, err = mr.Handler.SendGroupMessage(c, req)
 	default:
 		slog.Error(fmt.Sprintf("Invalid type %s", msgType))
 		c.String(http.StatusBadRequest, "Invalid operation")
@@ -43,13 +67,17 @@ func (mr *MessagesRoutes) SendMessageHandler(c *gin.Context) {
 		common.HandleError(err, c)
 		return
 	}
-	c.Writer.WriteHeader(http.StatusOK)
+	c.JSON(http.StatusOK, resp)
 }
 
 /*
 Get all messages for a user by userId, including private messages and group messages
+The user ID must be the authenticated user
 Optional query parameter timestamp, to get messages after a certain timestamp
-API: GET /v1/messages/:userId?timestamp=123456
+Optional query parameters limit and cursor, to page through the messages. The response contains nextCursor if there are more messages
+Optional query parameter wait, in seconds, to block until a new message arrives if there are no messages (long polling),
+messages sent through another instance of the service are found within messages.WaitPollInterval
+API: GET /v1/messages/:userId?timestamp=123456&limit=100&cursor=abc&wait=20
 */
 func (mr *MessagesRoutes) GetMessagesHandler(c *gin.Context) {
 	recipientId := c.Param("userId")
@@ -59,7 +87,10 @@ func (mr *MessagesRoutes) GetMessagesHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "userId is required")
 		return
 	}
-	var unixTimeStemp int64
+	if !requireAuthUser(c, recipientId) {
+		return
+	}
+	req := messages.GetMessagesRequest{Cursor: c.Query("cursor")}
 	if timestamp != "" {
 		// parse timestamp to int64 and validate
 		i, err := strconv.ParseInt(timestamp, 10, 64)
@@ -68,10 +99,175 @@ func (mr *MessagesRoutes) GetMessagesHandler(c *gin.Context) {
 			c.String(http.StatusBadRequest, "Invalid timestamp")
 			return
 		}
-		unixTimeStemp = i
+		req.Timestamp = i
+	}
+	if limit := c.Query("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			slog.Error(fmt.Sprintf("Invalid limit: %v", limit))
+			c.String(http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		req.Limit = i
+	}
+	if wait := c.Query("wait"); wait != "" {
+		i, err := strconv.Atoi(wait)
+		if err != nil || i < 0 {
+			slog.Error(fmt.Sprintf("Invalid wait: %v", wait))
+			c.String(http.StatusBadRequest, "Invalid wait")
+			return
+		}
+		req.Wait = time.Duration(i) * time.Second
+	}
+
+	resp, err := mr.Handler.GetMessages(c, recipientId, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Edit a message, only the sender can edit their messages
+The recipient ID is the user or group the message was sent to
+API: PUT /v1/messages/:recipientId/:messageId
+*/
+func (mr *MessagesRoutes) EditMessageHandler(c *gin.Context) {
+	recipientId := c.Param("recipientId")
+	messageId := c.Param("messageId")
+	decoder := json.NewDecoder(c.Request.Body)
+	var req messages.EditMessageRequest
+	err := decoder.Decode(&req)
+	if err != nil || recipientId == "" || messageId == "" || req.Message == "" {
+		slog.Error(fmt.Sprintf("Invalid input: %v, err: %v", req, err))
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	resp, err := mr.Handler.EditMessage(c, authUserId(c), recipientId, messageId, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Delete a message, only the sender can delete their messages
+The message is kept as a tombstone, with deleted set and without its text
+API: DELETE /v1/messages/:recipientId/:messageId
+*/
+func (mr *MessagesRoutes) DeleteMessageHandler(c *gin.Context) {
+	recipientId := c.Param("recipientId")
+	messageId := c.Param("messageId")
+	if recipientId == "" || messageId == "" {
+		slog.Error("recipientId and messageId are required")
+		c.String(http.StatusBadRequest, "recipientId and messageId are required")
+		return
+	}
+	resp, err := mr.Handler.DeleteMessage(c, authUserId(c), recipientId, messageId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
 	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+React to a message with an emoji, the authenticated user must be able to send a message to its conversation
+The recipient ID is the user or group the message was sent to, the emoji is URL encoded
+The response is the message with its reaction counts by emoji, polling clients get it as a change
+API: POST /v1/messages/:recipientId/:messageId/reactions/:emoji
+*/
+func (mr *MessagesRoutes) AddReactionHandler(c *gin.Context) {
+	mr.reactionHandler(c, mr.Handler.AddReaction)
+}
+
+/*
+Remove a reaction of the authenticated user from a message
+API: DELETE /v1/messages/:recipientId/:messageId/reactions/:emoji
+*/
+func (mr *MessagesRoutes) RemoveReactionHandler(c *gin.Context) {
+	mr.reactionHandler(c, mr.Handler.RemoveReaction)
+}
+
+func (mr *MessagesRoutes) reactionHandler(c *gin.Context, react func(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*common.Message, error)) {
+	recipientId := c.Param("recipientId")
+	messageId := c.Param("messageId")
+	emoji := c.Param("emoji")
+	if recipientId == "" || messageId == "" || emoji == "" {
+		slog.Error("recipientId, messageId and emoji are required")
+		c.String(http.StatusBadRequest, "recipientId, messageId and emoji are required")
+		return
+	}
+	resp, err := react(c, authUserId(c), recipientId, messageId, emoji)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Get the scheduled messages of the user, the pending ones and the ones that failed to be sent, with the reason
+The user ID must be the authenticated user
+API: GET /v1/users/:userId/scheduled
+*/
+func (mr *MessagesRoutes) GetScheduledMessagesHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := mr.Scheduler.GetScheduledMessages(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	resp, err := mr.Handler.GetMessages(c, recipientId, unixTimeStemp)
+/*
+Cancel a scheduled message of the user, the user ID must be the authenticated user
+A message that is being sent can no longer be canceled
+API: DELETE /v1/users/:userId/scheduled/:scheduleId
+*/
+func (mr *MessagesRoutes) CancelScheduledMessageHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	if err := mr.Scheduler.CancelScheduledMessage(c, userId, c.Param("scheduleId")); err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+/*
+Get the thread of a message, the first message of the thread with its reply count and a page of replies, oldest first
+The recipient ID is the user or group the message was sent to, the authenticated user must be in its conversation
+Optional query parameters after, the message ID of the last reply of the previous page, and limit
+API: GET /v1/threads/:recipientId/:messageId?after=abc&limit=50
+*/
+func (mr *MessagesRoutes) GetThreadHandler(c *gin.Context) {
+	recipientId := c.Param("recipientId")
+	messageId := c.Param("messageId")
+	if recipientId == "" || messageId == "" {
+		slog.Error("recipientId and messageId are required")
+		c.String(http.StatusBadRequest, "recipientId and messageId are required")
+		return
+	}
+	req := messages.GetThreadRequest{After: c.Query("after")}
+	if limit := c.Query("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			slog.Error(fmt.Sprintf("Invalid limit: %v", limit))
+			c.String(http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		req.Limit = i
+	}
+	resp, err := mr.Handler.GetThread(c, authUserId(c), recipientId, messageId, req)
 	if err != nil {
 		common.HandleError(err, c)
 		return
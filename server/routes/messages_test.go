@@ -9,35 +9,78 @@ import (
 	"net/http/httptest"
 	. "server/common"
 	"server/messages"
+	"server/scheduler"
 	"testing"
 )
 
 type messageHandlerMock struct {
 	error error
+	req   messages.SendMessageRequest
 }
 
-func (mh *messageHandlerMock) SendPrivateMessage(ctx context.Context, req messages.SendMessageRequest) error {
+func (mh *messageHandlerMock) SendPrivateMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error) {
+	mh.req = req
 	if mh.error != nil {
-		return mh.error
+		return nil, mh.error
+	}
+	return &messages.SendMessageResponse{MessageId: "message-id"}, nil
+}
+func (mh *messageHandlerMock) SendGroupMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error) {
+	if mh.error != nil {
+		return nil, mh.error
+	}
+	return &messages.SendMessageResponse{MessageId: "message-id"}, nil
+}
+
+func (mh *messageHandlerMock) GetMessages(ctx context.Context, recipientId string, req messages.GetMessagesRequest) (*messages.UserMessagesResp, error) {
+	if mh.error != nil {
+		return nil, mh.error
+	}
+	return &messages.UserMessagesResp{Messages: []Message{Message{MessageId: "message-id", ChangeId: "message-id", Message: "hello"}}, NextCursor: req.Cursor}, nil
+}
+
+func (mh *messageHandlerMock) EditMessage(ctx context.Context, senderId string, recipientId string, messageId string, req messages.EditMessageRequest) (*Message, error) {
+	if mh.error != nil {
+		return nil, mh.error
+	}
+	return &Message{RecipientId: recipientId, MessageId: messageId, SenderId: senderId, Message: req.Message}, nil
+}
+
+func (mh *messageHandlerMock) DeleteMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error) {
+	if mh.error != nil {
+		return nil, mh.error
+	}
+	return &Message{RecipientId: recipientId, MessageId: messageId, SenderId: senderId, Deleted: true}, nil
+}
+
+func (mh *messageHandlerMock) GetThread(ctx context.Context, userId string, recipientId string, messageId string, req messages.GetThreadRequest) (*messages.ThreadResponse, error) {
+	if mh.error != nil {
+		return nil, mh.error
 	}
-	return nil
+	reply := Message{RecipientId: recipientId, MessageId: "reply-id", SenderId: userId, Message: "me too", ReplyTo: messageId, ThreadId: messageId}
+	return &messages.ThreadResponse{
+		Message: Message{RecipientId: recipientId, MessageId: messageId, Message: "hello", ReplyCount: 1},
+		Replies: []Message{reply},
+		HasMore: req.Limit == 1,
+	}, nil
 }
-func (mh *messageHandlerMock) SendGroupMessage(ctx context.Context, req messages.SendMessageRequest) error {
+
+func (mh *messageHandlerMock) AddReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error) {
 	if mh.error != nil {
-		return mh.error
+		return nil, mh.error
 	}
-	return nil
+	return &Message{RecipientId: recipientId, MessageId: messageId, Reactions: map[string]int{emoji: 1}}, nil
 }
 
-func (mh *messageHandlerMock) GetMessages(ctx context.Context, recipientId string, timestamp int64) (*messages.UserMessagesResp, error) {
+func (mh *messageHandlerMock) RemoveReaction(ctx context.Context, userId string, recipientId string, messageId string, emoji string) (*Message, error) {
 	if mh.error != nil {
 		return nil, mh.error
 	}
-	return &messages.UserMessagesResp{Messages: []Message{Message{Message: "hello"}}}, nil
+	return &Message{RecipientId: recipientId, MessageId: messageId}, nil
 }
 
 func TestSendMessageHandler(t *testing.T) {
-	r := Router{Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
@@ -45,6 +88,20 @@ func TestSendMessageHandler(t *testing.T) {
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"SenderId": "sender", "RecipientId": "recipient", "Message": "hello"}`)))
 		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp messages.SendMessageResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "message-id", resp.MessageId)
+	})
+
+	t.Run("Message with attachments only", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"recipientId": "recipient", "attachmentIds": ["attachment-id"]}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusOK, w.Code)
 	})
@@ -53,14 +110,40 @@ func TestSendMessageHandler(t *testing.T) {
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=group", bytes.NewReader([]byte(`{"SenderId": "sender", "RecipientId": "recipient", "Message": "hello"}`)))
 		assert.Nil(t, err)
+		authorize(req, "sender")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusOK, w.Code)
 	})
 
+	t.Run("Sender is the authenticated user", func(t *testing.T) {
+		handler := &messageHandlerMock{}
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: handler}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"RecipientId": "recipient", "Message": "hello"}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "sender", handler.req.SenderId)
+	})
+
+	t.Run("Sender is another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"SenderId": "other-user", "RecipientId": "recipient", "Message": "hello"}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
 	t.Run("Invalid input", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{}`)))
 		assert.Nil(t, err)
+		authorize(req, "sender")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
@@ -69,18 +152,20 @@ func TestSendMessageHandler(t *testing.T) {
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=invalid", bytes.NewReader([]byte(`{"SenderId": "sender", "RecipientId": "recipient", "Message": "hello"}`)))
 		assert.Nil(t, err)
+		authorize(req, "sender")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
 	t.Run("Error", func(t *testing.T) {
-		r := Router{Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &ForbiddenError{Message: "error"}}}}
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &ForbiddenError{Message: "error"}}}}
 		router, err := r.NewRouter()
 		assert.Nil(t, err)
 
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"SenderId": "sender", "RecipientId": "recipient", "Message": "hello"}`)))
 		assert.Nil(t, err)
+		authorize(req, "sender")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusForbidden, w.Code)
 	})
@@ -88,7 +173,7 @@ func TestSendMessageHandler(t *testing.T) {
 }
 
 func TestGetMessagesHandler(t *testing.T) {
-	r := Router{Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
@@ -96,6 +181,7 @@ func TestGetMessagesHandler(t *testing.T) {
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
 		assert.Nil(t, err)
+		authorize(req, "recipient")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusOK, w.Code)
 
@@ -105,15 +191,285 @@ func TestGetMessagesHandler(t *testing.T) {
 		assert.Equal(t, "hello", resp.Messages[0].Message)
 	})
 
+	t.Run("With limit and cursor", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient?limit=10&cursor=abc", nil)
+		assert.Nil(t, err)
+		authorize(req, "recipient")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp messages.UserMessagesResp
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "abc", resp.NextCursor)
+	})
+
+	t.Run("Invalid wait", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient?wait=abc", nil)
+		assert.Nil(t, err)
+		authorize(req, "recipient")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient?limit=-1", nil)
+		assert.Nil(t, err)
+		authorize(req, "recipient")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("Error", func(t *testing.T) {
-		r := Router{Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &NotFoundError{Message: "error"}}}}
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &NotFoundError{Message: "error"}}}}
 		router, err := r.NewRouter()
 		assert.Nil(t, err)
 
 		w := httptest.NewRecorder()
 		req, err := http.NewRequest(http.MethodGet, "/v1/messages/recipient", nil)
 		assert.Nil(t, err)
+		authorize(req, "recipient")
 		router.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 }
+
+func TestEditAndDeleteMessageHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Edit message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPut, "/v1/messages/recipient/message-id", bytes.NewReader([]byte(`{"message": "edited"}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var msg Message
+		json.NewDecoder(w.Body).Decode(&msg)
+		assert.Equal(t, Message{RecipientId: "recipient", MessageId: "message-id", SenderId: "sender", Message: "edited"}, msg)
+	})
+
+	t.Run("Edit with empty message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPut, "/v1/messages/recipient/message-id", bytes.NewReader([]byte(`{"message": ""}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Delete message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/messages/recipient/message-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var msg Message
+		json.NewDecoder(w.Body).Decode(&msg)
+		assert.True(t, msg.Deleted)
+	})
+
+	t.Run("Not the sender", func(t *testing.T) {
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &ForbiddenError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/messages/recipient/message-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "other")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestGetThreadHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/threads/group/message-id?limit=1", nil)
+		assert.Nil(t, err)
+		authorize(req, "member")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp messages.ThreadResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, 1, resp.Message.ReplyCount)
+		assert.Equal(t, "message-id", resp.Replies[0].ReplyTo)
+		assert.Equal(t, "member", resp.Replies[0].SenderId)
+		assert.True(t, resp.HasMore)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/threads/group/message-id?limit=abc", nil)
+		assert.Nil(t, err)
+		authorize(req, "member")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Not in the conversation", func(t *testing.T) {
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &ForbiddenError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/threads/group/message-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "other")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestReactionHandlers(t *testing.T) {
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Add reaction", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/group/message-id/reactions/%F0%9F%91%8D", nil)
+		assert.Nil(t, err)
+		authorize(req, "member")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var msg Message
+		json.NewDecoder(w.Body).Decode(&msg)
+		assert.Equal(t, map[string]int{"👍": 1}, msg.Reactions)
+	})
+
+	t.Run("Remove reaction", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/messages/group/message-id/reactions/%F0%9F%91%8D", nil)
+		assert.Nil(t, err)
+		authorize(req, "member")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var msg Message
+		json.NewDecoder(w.Body).Decode(&msg)
+		assert.Empty(t, msg.Reactions)
+	})
+
+	t.Run("Not in the conversation", func(t *testing.T) {
+		r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{error: &ForbiddenError{Message: "some error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/group/message-id/reactions/%F0%9F%91%8D", nil)
+		assert.Nil(t, err)
+		authorize(req, "other")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+type schedulerMock struct {
+	error      error
+	msgType    string
+	req        messages.SendMessageRequest
+	canceledId string
+}
+
+func (sm *schedulerMock) Schedule(ctx context.Context, msgType string, req messages.SendMessageRequest) (*ScheduledMessage, error) {
+	sm.msgType, sm.req = msgType, req
+	if sm.error != nil {
+		return nil, sm.error
+	}
+	return &ScheduledMessage{SenderId: req.SenderId, ScheduleId: "schedule-id", Type: msgType, RecipientId: req.RecipientId, Message: req.Message, SendAt: req.SendAt, Status: ScheduledPending}, nil
+}
+
+func (sm *schedulerMock) GetScheduledMessages(ctx context.Context, userId string) (*scheduler.ScheduledMessagesResponse, error) {
+	if sm.error != nil {
+		return nil, sm.error
+	}
+	return &scheduler.ScheduledMessagesResponse{Scheduled: []ScheduledMessage{{SenderId: userId, ScheduleId: "schedule-id", Status: ScheduledPending}}}, nil
+}
+
+func (sm *schedulerMock) CancelScheduledMessage(ctx context.Context, userId string, scheduleId string) error {
+	sm.canceledId = scheduleId
+	return sm.error
+}
+
+func TestScheduledMessageHandlers(t *testing.T) {
+	mock := &schedulerMock{}
+	r := Router{Auth: testAuth, Messages: MessagesRoutes{Handler: &messageHandlerMock{}, Scheduler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Schedule a message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=group", bytes.NewReader([]byte(`{"recipientId": "group", "message": "later", "sendAt": "2030-01-02T15:04:05Z"}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		assert.Equal(t, "group", mock.msgType)
+		assert.Equal(t, "sender", mock.req.SenderId)
+		var scheduled ScheduledMessage
+		json.NewDecoder(w.Body).Decode(&scheduled)
+		assert.Equal(t, "schedule-id", scheduled.ScheduleId)
+		assert.Equal(t, "2030-01-02T15:04:05Z", scheduled.SendAt)
+	})
+
+	t.Run("List scheduled messages", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/sender/scheduled", nil)
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp scheduler.ScheduledMessagesResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Len(t, resp.Scheduled, 1)
+	})
+
+	t.Run("Cancel a scheduled message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/users/sender/scheduled/schedule-id", nil)
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "schedule-id", mock.canceledId)
+	})
+
+	t.Run("Other user", func(t *testing.T) {
+		for method, path := range map[string]string{http.MethodGet: "/v1/users/sender/scheduled", http.MethodDelete: "/v1/users/sender/scheduled/schedule-id"} {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(method, path, nil)
+			assert.Nil(t, err)
+			authorize(req, "other")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusForbidden, w.Code, method)
+		}
+	})
+
+	t.Run("Invalid schedule", func(t *testing.T) {
+		mock.error = &BadRequestError{Message: "sendAt must be in the future"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/messages/send?type=private", bytes.NewReader([]byte(`{"recipientId": "recipient", "message": "later", "sendAt": "2000-01-01T00:00:00Z"}`)))
+		assert.Nil(t, err)
+		authorize(req, "sender")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -1,15 +1,25 @@
 package routes
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gin-gonic/gin"
+	"server/auth"
+)
 
 type Router struct {
-	Users    UsersRoutes
-	Groups   GroupRoutes
-	Messages MessagesRoutes
+	Auth          *auth.Authenticator
+	Users         UsersRoutes
+	Groups        GroupRoutes
+	Messages      MessagesRoutes
+	Conversations ConversationsRoutes
+	Stream        StreamRoutes
+	Attachments   AttachmentsRoutes
+	Search        SearchRoutes
 }
 
 func (router *Router) NewRouter() (engine *gin.Engine, err error) {
 	engine = gin.Default()
+	// use the request context for cancellation, so that long running requests stop when the client goes away
+	engine.ContextWithFallback = true
 	router.Route(engine)
 
 	engine.NoRoute(func(c *gin.Context) {
@@ -32,13 +42,51 @@ func (router *Router) Route(r *gin.Engine) {
 
 func (router *Router) v1Routes(group *gin.RouterGroup) {
 
+	// public routes
 	group.POST("/users/create", router.Users.CreateUserHandler)
+	group.POST("/users/login", router.Users.LoginHandler)
+
+	// all other routes act on behalf of the user authenticated by the request token
+	group = group.Group("", router.authenticate)
+
 	group.POST("/users/:userId", router.Users.BlockUserHandler)
+	group.DELETE("/users/:userId", router.Users.DeleteUserHandler)
+	group.GET("/users/:userId/blocked", router.Users.GetBlockedUsersHandler)
+	group.GET("/users/:userId/muted", router.Users.GetMutedConversationsHandler)
+	group.POST("/users/:userId/muted", router.Users.MuteConversationHandler)
+	group.DELETE("/users/:userId/muted/:conversationId", router.Users.UnmuteConversationHandler)
+	group.GET("/users/:userId/settings", router.Users.GetSettingsHandler)
+	group.PUT("/users/:userId/settings", router.Users.UpdateSettingsHandler)
+	group.GET("/users/:userId/unread", router.Conversations.GetUnreadCountsHandler)
+	group.GET("/users/:userId/conversations", router.Conversations.GetConversationsHandler)
+	group.GET("/users/:userId/search", router.Search.SearchHandler)
+	group.GET("/users/:userId/scheduled", router.Messages.GetScheduledMessagesHandler)
+	group.DELETE("/users/:userId/scheduled/:scheduleId", router.Messages.CancelScheduledMessageHandler)
 
 	group.POST("/groups/create", router.Groups.CreateGroupHandler)
 	group.POST("/groups/:groupId", router.Groups.UserToGroupHandler)
+	group.DELETE("/groups/:groupId", router.Groups.DeleteGroupHandler)
+	group.POST("/groups/:groupId/invites", router.Groups.CreateInviteHandler)
+	group.GET("/groups/:groupId/invites", router.Groups.GetInvitesHandler)
+	group.DELETE("/groups/:groupId/invites/:token", router.Groups.RevokeInviteHandler)
+	group.POST("/groups/join/:token", router.Groups.JoinGroupHandler)
 
 	group.POST("/messages/send", router.Messages.SendMessageHandler)
 	group.GET("/messages/:userId", router.Messages.GetMessagesHandler)
+	group.PUT("/messages/:recipientId/:messageId", router.Messages.EditMessageHandler)
+	group.DELETE("/messages/:recipientId/:messageId", router.Messages.DeleteMessageHandler)
+	group.POST("/messages/:recipientId/:messageId/reactions/:emoji", router.Messages.AddReactionHandler)
+	group.DELETE("/messages/:recipientId/:messageId/reactions/:emoji", router.Messages.RemoveReactionHandler)
+	group.GET("/threads/:recipientId/:messageId", router.Messages.GetThreadHandler)
+
+	group.POST("/conversations/:id/read", router.Conversations.MarkReadHandler)
+	group.GET("/conversations/:id/read", router.Conversations.GetReadMarkerHandler)
+	group.GET("/conversations/private/:peerId", router.Conversations.GetPrivateHistoryHandler)
+	group.GET("/conversations/group/:groupId", router.Conversations.GetGroupHistoryHandler)
+
+	group.POST("/attachments", router.Attachments.UploadHandler)
+	group.GET("/attachments/:attachmentId", router.Attachments.DownloadHandler)
+
+	group.GET("/stream/:userId", router.Stream.StreamHandler)
 
 }
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"server/common"
+	"server/search"
+	"strconv"
+)
+
+type SearchRoutes struct {
+	Handler search.HandlerInterface
+}
+
+/*
+Search the messages the user may see, ranked by relevance: their private messages, the messages they sent and the messages of their groups
+The user ID must be the authenticated user
+Query parameter q, words and quoted phrases that must all match
+Optional query parameters from, a sender ID, group, a group of the user, after and before, unix timestamps, and limit and cursor to page through the results
+API: GET /v1/users/:userId/search?q=lunch%20%22at%20noon%22&from=abc&group=abc&after=123456&before=123456&limit=20&cursor=abc
+*/
+func (sr *SearchRoutes) SearchHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	req := search.SearchRequest{
+		Query:    c.Query("q"),
+		SenderId: c.Query("from"),
+		GroupId:  c.Query("group"),
+		Cursor:   c.Query("cursor"),
+	}
+	if req.Query == "" {
+		slog.Error("q is required")
+		c.String(http.StatusBadRequest, "q is required")
+		return
+	}
+	for name, value := range map[string]*int64{"after": &req.After, "before": &req.Before} {
+		if param := c.Query(name); param != "" {
+			i, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Invalid %s: %v", name, param))
+				c.String(http.StatusBadRequest, fmt.Sprintf("Invalid %s", name))
+				return
+			}
+			*value = i
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			slog.Error(fmt.Sprintf("Invalid limit: %v", limit))
+			c.String(http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		req.Limit = i
+	}
+
+	resp, err := sr.Handler.Search(c, userId, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
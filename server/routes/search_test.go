@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"server/common"
+	"server/search"
+	"testing"
+)
+
+type searchHandlerMock struct {
+	error error
+	req   search.SearchRequest
+}
+
+func (sh *searchHandlerMock) Search(ctx context.Context, userId string, req search.SearchRequest) (*search.SearchResponse, error) {
+	sh.req = req
+	if sh.error != nil {
+		return nil, sh.error
+	}
+	return &search.SearchResponse{Results: []search.SearchResult{{Message: common.Message{MessageId: "message-id", Message: "lunch"}, Score: 1}}}, nil
+}
+
+func TestSearchHandler(t *testing.T) {
+	mock := &searchHandlerMock{}
+	r := Router{Auth: testAuth, Search: SearchRoutes{Handler: mock}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, `/v1/users/user/search?q=lunch+%22at+noon%22&from=peer&group=group&after=100&before=200&limit=10&cursor=abc`, nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, search.SearchRequest{Query: `lunch "at noon"`, SenderId: "peer", GroupId: "group", After: 100, Before: 200, Limit: 10, Cursor: "abc"}, mock.req)
+		var resp search.SearchResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "message-id", resp.Results[0].Message.MessageId)
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		for _, query := range []string{"", "?q=lunch&after=abc", "?q=lunch&before=abc", "?q=lunch&limit=0"} {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/v1/users/user/search"+query, nil)
+			assert.Nil(t, err)
+			authorize(req, "user")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+
+	t.Run("Not a member of the group", func(t *testing.T) {
+		mock.error = &common.ForbiddenError{Message: "User is not a member of the group"}
+		defer func() { mock.error = nil }()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/user/search?q=lunch&group=other", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Other user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/other/search?q=lunch", nil)
+		assert.Nil(t, err)
+		authorize(req, "user")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
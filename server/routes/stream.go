@@ -0,0 +1,186 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"server/common"
+	"server/messages"
+	"server/stream"
+	"server/users"
+	"strconv"
+	"time"
+)
+
+const (
+	streamWriteTimeout = 10 * time.Second
+	streamPongTimeout  = 60 * time.Second
+	streamPingInterval = streamPongTimeout * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the API is not used from browsers and has no cookies based sessions, so any origin is accepted
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type StreamRoutes struct {
+	Handler messages.HandlerInterface
+	Hub     stream.Hub
+	// Users applies the settings of the user to the live messages, see MessageView, optional
+	Users users.UsersHandlerInterface
+}
+
+/*
+Stream messages for a user over a WebSocket, each message is sent as a JSON text frame
+Edited and deleted messages are sent again with the same message ID, the client should replace the previous version
+Messages of muted conversations are marked as muted, and group messages of blocked users are shown, hidden or collapsed
+by the setting of the user. Changes of the mutes, blocks and settings while connected apply after reconnecting
+The user ID must be the authenticated user
+Optional query parameter timestamp, to first receive the messages stored after it (the same messages GET /v1/messages/:userId returns)
+The backlog is a single page of messages.MaxMessagesLimit messages, if there are more the connection is refused with 400,
+the client gets them with GET /v1/messages/:userId first and connects with the timestamp of the last one
+API: GET /v1/stream/:userId?timestamp=123456
+*/
+func (sr *StreamRoutes) StreamHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if userId == "" {
+		slog.Error("userId is required")
+		c.String(http.StatusBadRequest, "userId is required")
+		return
+	}
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	var unixTimeStamp int64
+	if timestamp := c.Query("timestamp"); timestamp != "" {
+		i, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Invalid timestamp: %v", timestamp))
+			c.String(http.StatusBadRequest, "Invalid timestamp")
+			return
+		}
+		unixTimeStamp = i
+	}
+
+	// subscribe before reading the backlog, so that no message stored in between is missed
+	live, unsubscribe := sr.Hub.Subscribe(userId)
+	defer unsubscribe()
+
+	backlog, err := sr.getBacklog(c, userId, unixTimeStamp)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	view, err := sr.getView(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		slog.Error(fmt.Sprintf("Error upgrading connection for user %s: %v", userId, err))
+		return
+	}
+	defer conn.Close()
+	slog.Info(fmt.Sprintf("User %s connected to stream, sending %d backlog messages", userId, len(backlog)))
+
+	sent := make(map[string]bool, len(backlog))
+	for _, msg := range backlog {
+		if err = writeStreamMessage(conn, msg); err != nil {
+			slog.Error(fmt.Sprintf("Error sending message to user %s: %v", userId, err))
+			return
+		}
+		sent[msg.ChangeId] = true
+	}
+
+	closed := readUntilClosed(conn)
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-live:
+			if !ok {
+				// the hub dropped the subscription, the client should reconnect and resume from its last message
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resubscribe"), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if sent[msg.ChangeId] {
+				// already sent as part of the backlog, edits and deletions have a new change ID and are sent again
+				continue
+			}
+			// the hub delivers the same message to every recipient
+			viewed, visible := view.Apply(msg)
+			if !visible {
+				continue
+			}
+			if err = writeStreamMessage(conn, viewed); err != nil {
+				slog.Error(fmt.Sprintf("Error sending message to user %s: %v", userId, err))
+				return
+			}
+		case <-ping.C:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			slog.Info(fmt.Sprintf("User %s disconnected from stream", userId))
+			return
+		}
+	}
+}
+
+// getView returns the settings applied to the live messages, none without Users.
+func (sr *StreamRoutes) getView(c *gin.Context, userId string) (*common.MessageView, error) {
+	if sr.Users == nil {
+		return &common.MessageView{UserId: userId}, nil
+	}
+	return sr.Users.GetMessageView(c, userId)
+}
+
+// getBacklog returns the messages stored after the timestamp, at most one page.
+// A longer backlog is refused rather than held in memory while the live messages queue up in the subscription.
+func (sr *StreamRoutes) getBacklog(c *gin.Context, userId string, timestamp int64) ([]common.Message, error) {
+	req := messages.GetMessagesRequest{Timestamp: timestamp, Limit: messages.MaxMessagesLimit}
+	resp, err := sr.Handler.GetMessages(c, userId, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Partial {
+		// the stream can not report missing messages, the client reconnects from the same timestamp instead
+		return nil, &common.InternalServerError{Message: "Error getting messages"}
+	}
+	if resp.NextCursor != "" {
+		slog.Error(fmt.Sprintf("Backlog of user %s after %d is longer than %d messages", userId, timestamp, messages.MaxMessagesLimit))
+		return nil, &common.BadRequestError{Message: fmt.Sprintf("More than %d messages after the timestamp, get them with GET /v1/messages first", messages.MaxMessagesLimit)}
+	}
+	return resp.Messages, nil
+}
+
+func writeStreamMessage(conn *websocket.Conn, msg common.Message) error {
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return conn.WriteJSON(msg)
+}
+
+// readUntilClosed reads from the connection to handle pongs and close frames, the returned channel is closed
+// once the client disconnects or stops answering pings.
+func readUntilClosed(conn *websocket.Conn) <-chan struct{} {
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
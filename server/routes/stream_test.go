@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	. "server/common"
+	"server/messages"
+	"server/stream"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pagedMessageHandlerMock always has another page of messages.
+type pagedMessageHandlerMock struct {
+	messageHandlerMock
+}
+
+func (mh *pagedMessageHandlerMock) GetMessages(ctx context.Context, recipientId string, req messages.GetMessagesRequest) (*messages.UserMessagesResp, error) {
+	resp, err := mh.messageHandlerMock.GetMessages(ctx, recipientId, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.NextCursor = "next"
+	return resp, nil
+}
+
+func TestStreamHandler(t *testing.T) {
+	hub := stream.NewLocalHub()
+	r := Router{Auth: testAuth, Stream: StreamRoutes{Handler: &messageHandlerMock{}, Hub: hub}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("Happy path", func(t *testing.T) {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+"/v1/stream/recipient?timestamp=123", authHeader("recipient"))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		// backlog
+		var msg Message
+		assert.Nil(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "hello", msg.Message)
+
+		// live message
+		hub.Publish([]string{"recipient"}, Message{MessageId: "live-message", ChangeId: "live-message", Message: "live"})
+		assert.Nil(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "live-message", msg.MessageId)
+		assert.Equal(t, "live", msg.Message)
+
+		// the backlog message is not sent again, but its edit is
+		hub.Publish([]string{"recipient"}, Message{MessageId: "message-id", ChangeId: "message-id", Message: "hello"})
+		hub.Publish([]string{"recipient"}, Message{MessageId: "message-id", ChangeId: "edit-id", Message: "edited"})
+		assert.Nil(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "message-id", msg.MessageId)
+		assert.Equal(t, "edited", msg.Message)
+	})
+
+	t.Run("Muted conversation and blocked sender", func(t *testing.T) {
+		r := Router{Auth: testAuth, Stream: StreamRoutes{Handler: &messageHandlerMock{}, Hub: hub, Users: &userHandlerMock{}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/stream/recipient?timestamp=123", authHeader("recipient"))
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var msg Message
+		assert.Nil(t, conn.ReadJSON(&msg))
+
+		// the mock mutes the conversation with muted-user
+		hub.Publish([]string{"recipient"}, Message{MessageId: "muted-message", ChangeId: "muted-message", SenderId: "muted-user", RecipientId: "recipient"})
+		assert.Nil(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "muted-message", msg.MessageId)
+		assert.True(t, msg.Muted)
+		// the mock hides the group messages of blocked-user
+		hub.Publish([]string{"recipient"}, Message{MessageId: "blocked-message", ChangeId: "blocked-message", SenderId: "blocked-user", RecipientId: "test-group"})
+		hub.Publish([]string{"recipient"}, Message{MessageId: "other-message", ChangeId: "other-message", SenderId: "other-user", RecipientId: "recipient"})
+		var other Message
+		assert.Nil(t, conn.ReadJSON(&other))
+		assert.Equal(t, "other-message", other.MessageId)
+		assert.False(t, other.Muted)
+	})
+
+	t.Run("Invalid timestamp", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"/v1/stream/recipient?timestamp=abc", authHeader("recipient"))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Backlog longer than a page", func(t *testing.T) {
+		r := Router{Auth: testAuth, Stream: StreamRoutes{Handler: &pagedMessageHandlerMock{}, Hub: hub}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/stream/recipient", authHeader("recipient"))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"/v1/stream/recipient", nil)
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		r := Router{Auth: testAuth, Stream: StreamRoutes{Handler: &messageHandlerMock{error: &NotFoundError{Message: "error"}}, Hub: hub}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/stream/recipient", authHeader("recipient"))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
@@ -23,8 +23,8 @@ func (ur *UsersRoutes) CreateUserHandler(c *gin.Context) {
 	decoder := json.NewDecoder(c.Request.Body)
 	var req users.RegisterUserRequest
 	err := decoder.Decode(&req)
-	if err != nil || req.UserName == "" {
-		slog.Error(fmt.Sprintf("Invalid input %v", req))
+	if err != nil || req.UserName == "" || req.Password == "" {
+		slog.Error(fmt.Sprintf("Invalid input for user %s", req.UserName))
 		c.String(http.StatusBadRequest, "Invalid input")
 		return
 	}
@@ -37,8 +37,30 @@ func (ur *UsersRoutes) CreateUserHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+/*
+Login and get a bearer token for the other APIs
+API: POST /v1/users/login
+*/
+func (ur *UsersRoutes) LoginHandler(c *gin.Context) {
+	decoder := json.NewDecoder(c.Request.Body)
+	var req users.LoginRequest
+	err := decoder.Decode(&req)
+	if err != nil || req.UserId == "" || req.Password == "" {
+		slog.Error(fmt.Sprintf("Invalid login input for user %s", req.UserId))
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	resp, err := ur.Handler.Login(c, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 /*
 Block a user for the given user ID, op can be block or unblock
+The user ID must be the authenticated user
 API: POST /v1/users/:userId?op=[block/unblock]
 */
 func (ur *UsersRoutes) BlockUserHandler(c *gin.Context) {
@@ -48,6 +70,9 @@ func (ur *UsersRoutes) BlockUserHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "userId is required")
 		return
 	}
+	if !requireAuthUser(c, userId) {
+		return
+	}
 
 	// read the request body
 	decoder := json.NewDecoder(c.Request.Body)
@@ -76,3 +101,137 @@ func (ur *UsersRoutes) BlockUserHandler(c *gin.Context) {
 	}
 	c.Writer.WriteHeader(http.StatusOK)
 }
+
+/*
+Delete the user account, the user ID must be the authenticated user
+The user can no longer log in once the request returns, the groups, blocks and messages of the user are cleaned up in the background
+API: DELETE /v1/users/:userId
+*/
+func (ur *UsersRoutes) DeleteUserHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := ur.Handler.DeleteUser(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusAccepted, resp)
+}
+
+/*
+Get the users blocked by the user, the user ID must be the authenticated user
+API: GET /v1/users/:userId/blocked
+*/
+func (ur *UsersRoutes) GetBlockedUsersHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := ur.Handler.GetBlockedUsers(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Get the conversations muted by the user, the user ID must be the authenticated user
+API: GET /v1/users/:userId/muted
+*/
+func (ur *UsersRoutes) GetMutedConversationsHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := ur.Handler.GetMutedConversations(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Mute a private conversation or a group, its messages are delivered marked as muted and are not counted as unread
+The user ID must be the authenticated user
+API: POST /v1/users/:userId/muted
+*/
+func (ur *UsersRoutes) MuteConversationHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	decoder := json.NewDecoder(c.Request.Body)
+	var req users.MuteRequest
+	err := decoder.Decode(&req)
+	if err != nil || req.ConversationId == "" {
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	if err = ur.Handler.MuteConversation(c, userId, req); err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Unmute a conversation, the user ID must be the authenticated user
+API: DELETE /v1/users/:userId/muted/:conversationId
+*/
+func (ur *UsersRoutes) UnmuteConversationHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	if err := ur.Handler.UnmuteConversation(c, userId, c.Param("conversationId")); err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Get the settings of the user, the user ID must be the authenticated user
+API: GET /v1/users/:userId/settings
+*/
+func (ur *UsersRoutes) GetSettingsHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	resp, err := ur.Handler.GetSettings(c, userId)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/*
+Update the settings of the user, settings missing in the request are not changed
+blockedGroupMessages is show, hide or collapse, for the group messages of blocked users
+The user ID must be the authenticated user
+API: PUT /v1/users/:userId/settings
+*/
+func (ur *UsersRoutes) UpdateSettingsHandler(c *gin.Context) {
+	userId := c.Param("userId")
+	if !requireAuthUser(c, userId) {
+		return
+	}
+	decoder := json.NewDecoder(c.Request.Body)
+	var req users.Settings
+	if err := decoder.Decode(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid input")
+		return
+	}
+	resp, err := ur.Handler.UpdateSettings(c, userId, req)
+	if err != nil {
+		common.HandleError(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"server/common"
 	"server/users"
 	"testing"
 )
@@ -22,6 +23,13 @@ func (uh *userHandlerMock) RegisterUser(ctx context.Context, req users.RegisterU
 	return &users.RegisterUserResponse{UserId: req.UserName, UserName: req.UserName}, nil
 }
 
+func (uh *userHandlerMock) Login(ctx context.Context, req users.LoginRequest) (*users.LoginResponse, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &users.LoginResponse{Token: "token"}, nil
+}
+
 func (uh *userHandlerMock) BlockUser(ctx context.Context, userId string, req users.BlockUserRequest) error {
 	if uh.error != nil {
 		return uh.error
@@ -36,15 +44,71 @@ func (uh *userHandlerMock) UnblockUser(ctx context.Context, userId string, req u
 	return nil
 }
 
+func (uh *userHandlerMock) GetBlockedUsers(ctx context.Context, userId string) (*users.BlockedUsersResponse, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &users.BlockedUsersResponse{BlockedUsers: []string{"blocked-user"}}, nil
+}
+
+func (uh *userHandlerMock) MuteConversation(ctx context.Context, userId string, req users.MuteRequest) error {
+	return uh.error
+}
+
+func (uh *userHandlerMock) UnmuteConversation(ctx context.Context, userId string, conversationId string) error {
+	return uh.error
+}
+
+func (uh *userHandlerMock) GetMutedConversations(ctx context.Context, userId string) (*users.MutedConversationsResponse, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &users.MutedConversationsResponse{Muted: []string{"muted-user"}}, nil
+}
+
+func (uh *userHandlerMock) GetSettings(ctx context.Context, userId string) (*users.Settings, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &users.Settings{BlockedGroupMessages: common.BlockedMessagesShow}, nil
+}
+
+func (uh *userHandlerMock) UpdateSettings(ctx context.Context, userId string, req users.Settings) (*users.Settings, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &req, nil
+}
+
+func (uh *userHandlerMock) GetMessageView(ctx context.Context, userId string) (*common.MessageView, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &common.MessageView{
+		UserId:               userId,
+		Muted:                map[string]bool{"muted-user": true},
+		BlockedUsers:         map[string]bool{"blocked-user": true},
+		BlockedGroupMessages: common.BlockedMessagesHide,
+	}, nil
+}
+
+func (uh *userHandlerMock) DeleteUser(ctx context.Context, userId string) (*users.DeleteUserResponse, error) {
+	if uh.error != nil {
+		return nil, uh.error
+	}
+	return &users.DeleteUserResponse{UserId: userId, MessagePolicy: common.DeletedMessagesDelete}, nil
+}
+
 func TestRegisterUserHandler(t *testing.T) {
 
-	r := Router{Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
 	t.Run("Happy path", func(t *testing.T) {
 		reqBody := users.RegisterUserRequest{
 			UserName: "test-user",
+			Password: "test-password",
 		}
 		body, _ := json.Marshal(reqBody)
 		w := httptest.NewRecorder()
@@ -71,12 +135,13 @@ func TestRegisterUserHandler(t *testing.T) {
 	})
 
 	t.Run("Error", func(t *testing.T) {
-		r := Router{Users: UsersRoutes{Handler: &userHandlerMock{error: assert.AnError}}}
+		r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{error: assert.AnError}}}
 		router, err := r.NewRouter()
 		assert.Nil(t, err)
 
 		reqBody := users.RegisterUserRequest{
 			UserName: "test-user",
+			Password: "test-password",
 		}
 		body, _ := json.Marshal(reqBody)
 		w := httptest.NewRecorder()
@@ -89,8 +154,54 @@ func TestRegisterUserHandler(t *testing.T) {
 	})
 }
 
+func TestLoginHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		body, _ := json.Marshal(users.LoginRequest{UserId: "test-user", Password: "test-password"})
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/login", bytes.NewReader(body))
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp users.LoginResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		assert.Equal(t, "token", resp.Token)
+	})
+
+	t.Run("Missing password", func(t *testing.T) {
+		body, _ := json.Marshal(users.LoginRequest{UserId: "test-user"})
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/login", bytes.NewReader(body))
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{error: &common.UnauthorizedError{Message: "error"}}}}
+		router, err := r.NewRouter()
+		assert.Nil(t, err)
+
+		body, _ := json.Marshal(users.LoginRequest{UserId: "test-user", Password: "wrong-password"})
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/login", bytes.NewReader(body))
+		assert.Nil(t, err)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
 func TestBlockUserHandler(t *testing.T) {
-	r := Router{Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
 	router, err := r.NewRouter()
 	assert.Nil(t, err)
 
@@ -103,6 +214,7 @@ func TestBlockUserHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user?op=block", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -117,6 +229,7 @@ func TestBlockUserHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user?op=unblock", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -131,12 +244,28 @@ func TestBlockUserHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user?op=invalid", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	})
 
+	t.Run("Block on behalf of another user", func(t *testing.T) {
+		reqBody := users.BlockUserRequest{
+			BlockedUserId: "test-user-2",
+		}
+		body, _ := json.Marshal(reqBody)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/other-user?op=block", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
 	t.Run("Invalid input", func(t *testing.T) {
 		reqBody := users.BlockUserRequest{
 			BlockedUserId: "",
@@ -146,9 +275,209 @@ func TestBlockUserHandler(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user?op=block", bytes.NewReader(body))
 		assert.Nil(t, err)
+		authorize(req, "test-user")
 		router.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
 }
+
+func TestDeleteUserHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Delete happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/users/test-user", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		var resp users.DeleteUserResponse
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "test-user", resp.UserId)
+	})
+
+	t.Run("Delete another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/users/other-user", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("User not found", func(t *testing.T) {
+		r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{error: &common.NotFoundError{Message: "error"}}}}
+		router, _ := r.NewRouter()
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/users/test-user", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestGetBlockedUsersHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/test-user/blocked", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp users.BlockedUsersResponse
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, []string{"blocked-user"}, resp.BlockedUsers)
+	})
+
+	t.Run("Another user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/other-user/blocked", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestMuteConversationHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Mute happy path", func(t *testing.T) {
+		body, _ := json.Marshal(users.MuteRequest{ConversationId: "test-user-2"})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user/muted", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("List muted conversations", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/test-user/muted", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp users.MutedConversationsResponse
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, []string{"muted-user"}, resp.Muted)
+	})
+
+	t.Run("Unmute happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/v1/users/test-user/muted/test-user-2", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		body, _ := json.Marshal(users.MuteRequest{ConversationId: ""})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user/muted", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Mute on behalf of another user", func(t *testing.T) {
+		body, _ := json.Marshal(users.MuteRequest{ConversationId: "test-user-2"})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/other-user/muted", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Conversation not found", func(t *testing.T) {
+		r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{error: &common.NotFoundError{Message: "error"}}}}
+		router, _ := r.NewRouter()
+		body, _ := json.Marshal(users.MuteRequest{ConversationId: "unknown"})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/v1/users/test-user/muted", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestSettingsHandler(t *testing.T) {
+	r := Router{Auth: testAuth, Users: UsersRoutes{Handler: &userHandlerMock{}}}
+	router, err := r.NewRouter()
+	assert.Nil(t, err)
+
+	t.Run("Get settings", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/test-user/settings", nil)
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp users.Settings
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, common.BlockedMessagesShow, resp.BlockedGroupMessages)
+	})
+
+	t.Run("Update settings", func(t *testing.T) {
+		body, _ := json.Marshal(users.Settings{BlockedGroupMessages: common.BlockedMessagesCollapse})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPut, "/v1/users/test-user/settings", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp users.Settings
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, common.BlockedMessagesCollapse, resp.BlockedGroupMessages)
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPut, "/v1/users/test-user/settings", bytes.NewReader([]byte("{")))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Update settings of another user", func(t *testing.T) {
+		body, _ := json.Marshal(users.Settings{BlockedGroupMessages: common.BlockedMessagesHide})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPut, "/v1/users/other-user/settings", bytes.NewReader(body))
+		assert.Nil(t, err)
+		authorize(req, "test-user")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
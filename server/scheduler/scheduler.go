@@ -0,0 +1,338 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+	"server/messages"
+	"time"
+)
+
+const (
+	// ScheduleInterval is how often the due messages are sent, a message is sent up to this late.
+	ScheduleInterval = 5 * time.Second
+	// ClaimDuration is how long a scheduler instance holds a due message while sending it. A delivery is given half
+	// of it, so that the claim does not expire during the delivery, and an instance stopped while sending the message
+	// leaves it to the other instances once the claim expired.
+	ClaimDuration = time.Minute
+	// MaxScheduleAhead is how far ahead a message can be scheduled.
+	MaxScheduleAhead = 365 * 24 * time.Hour
+	// MaxScheduledMessages is the largest number of pending scheduled messages of a user.
+	MaxScheduledMessages = 100
+	// dueBatchSize is the number of due messages sent per ScheduleInterval, the rest are sent with the next ones.
+	dueBatchSize = 100
+)
+
+// errSenderDeleted is returned when delivering a message of a deleted user, the message is deleted with its sender.
+var errSenderDeleted = errors.New("sender was deleted")
+
+// MessageSender sends the due messages, it is implemented by messages.Handler, so that a scheduled message is sent
+// like a message sent by its sender when it is due.
+type MessageSender interface {
+	SendPrivateMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error)
+	SendGroupMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error)
+}
+
+type ScheduledMessagesResponse struct {
+	Scheduled []ScheduledMessage `json:"scheduled"`
+}
+
+type HandlerInterface interface {
+	Schedule(ctx context.Context, msgType string, req messages.SendMessageRequest) (*ScheduledMessage, error)
+	GetScheduledMessages(ctx context.Context, userId string) (*ScheduledMessagesResponse, error)
+	CancelScheduledMessage(ctx context.Context, userId string, scheduleId string) error
+}
+
+// Scheduler stores the messages to be sent later and sends them when they are due. Every instance runs a scheduler,
+// a due message is claimed by one instance at a time, see ScheduledMessage.ClaimedUntil.
+type Scheduler struct {
+	DBClient db.DynamoDBClientInterface
+	Messages MessageSender
+}
+
+/*
+Schedule a private or group message to be sent at req.SendAt
+The sender must be able to send the message now, blocks and group membership are checked again when it is due
+*/
+func (s *Scheduler) Schedule(ctx context.Context, msgType string, req messages.SendMessageRequest) (*ScheduledMessage, error) {
+	now := time.Now()
+	sendAt, err := time.Parse(time.RFC3339, req.SendAt)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid sendAt %q: %v", req.SendAt, err))
+		return nil, &BadRequestError{Message: "sendAt must be an RFC3339 time"}
+	}
+	if !sendAt.After(now) || sendAt.After(now.Add(MaxScheduleAhead)) {
+		slog.Error(fmt.Sprintf("sendAt %s of sender %s is out of range", req.SendAt, req.SenderId))
+		return nil, &BadRequestError{Message: fmt.Sprintf("sendAt must be in the future, within %v", MaxScheduleAhead)}
+	}
+	if len(req.AttachmentIds) > messages.MaxAttachments {
+		slog.Error(fmt.Sprintf("Message of %s has %d attachments", req.SenderId, len(req.AttachmentIds)))
+		return nil, &BadRequestError{Message: fmt.Sprintf("A message can have at most %d attachments", messages.MaxAttachments)}
+	}
+	if err = s.checkRecipient(ctx, msgType, req); err != nil {
+		return nil, err
+	}
+
+	scheduled, err := s.DBClient.GetScheduledMessages(ctx, req.SenderId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting scheduled messages of %s: %v", req.SenderId, err))
+		return nil, &InternalServerError{Message: "Error getting scheduled messages"}
+	}
+	pending := 0
+	for _, message := range scheduled {
+		if message.Status == ScheduledPending {
+			pending++
+		}
+	}
+	// checked on the messages as read, so concurrent requests can exceed the limit by a few messages
+	if pending >= MaxScheduledMessages {
+		slog.Error(fmt.Sprintf("Sender %s has %d scheduled messages", req.SenderId, pending))
+		return nil, &BadRequestError{Message: fmt.Sprintf("A user can have at most %d scheduled messages", MaxScheduledMessages)}
+	}
+
+	message := ScheduledMessage{
+		SenderId:      req.SenderId,
+		ScheduleId:    NewMessageId(now),
+		Type:          msgType,
+		RecipientId:   req.RecipientId,
+		Message:       req.Message,
+		AttachmentIds: req.AttachmentIds,
+		ReplyTo:       req.ReplyTo,
+		SendAt:        sendAt.UTC().Format(time.RFC3339),
+		CreatedAt:     now.Format(time.RFC3339),
+		Status:        ScheduledPending,
+	}
+	if err = s.DBClient.StoreScheduledMessage(ctx, message); err != nil {
+		slog.Error(fmt.Sprintf("Error storing scheduled message: %v", err))
+		return nil, &InternalServerError{Message: "Error storing scheduled message"}
+	}
+	slog.Info(fmt.Sprintf("Message %s of %s to %s %s scheduled at %s", message.ScheduleId, req.SenderId, msgType, req.RecipientId, message.SendAt))
+	return &message, nil
+}
+
+// checkRecipient returns an error if the sender can not send a message to the recipient now,
+// so that a message that would fail when it is due is not scheduled.
+func (s *Scheduler) checkRecipient(ctx context.Context, msgType string, req messages.SendMessageRequest) error {
+	sender, err := s.DBClient.GetUser(ctx, req.SenderId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting sender: %v", err))
+		return &InternalServerError{Message: "Error getting sender"}
+	}
+	if sender == nil {
+		slog.Error(fmt.Sprintf("Sender not found: %v", req.SenderId))
+		return &NotFoundError{Message: "Sender not found"}
+	}
+	switch msgType {
+	case ConversationPrivate:
+		recipient, err := s.DBClient.GetUser(ctx, req.RecipientId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting recipient user: %v", err))
+			return &InternalServerError{Message: "Error getting recipient user"}
+		}
+		if recipient == nil {
+			slog.Error(fmt.Sprintf("Recipient user not found: %v", req.RecipientId))
+			return &NotFoundError{Message: "Recipient not found"}
+		}
+		if recipient.BlockedUsers[req.SenderId] {
+			slog.Error(fmt.Sprintf("Recipient %s has blocked sender %s", req.RecipientId, req.SenderId))
+			return &ForbiddenError{Message: "Recipient has blocked the sender"}
+		}
+	case ConversationGroup:
+		group, err := s.DBClient.GetGroup(ctx, req.RecipientId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting recipient group: %v", err))
+			return &InternalServerError{Message: "Error getting recipient group"}
+		}
+		if group == nil {
+			slog.Error(fmt.Sprintf("Recipient group not found: %v", req.RecipientId))
+			return &NotFoundError{Message: "Recipient not found"}
+		}
+		if !sender.Groups[req.RecipientId] {
+			slog.Error(fmt.Sprintf("Sender %s is not a member of group %s", req.SenderId, req.RecipientId))
+			return &ForbiddenError{Message: "Sender is not a member of the group"}
+		}
+	default:
+		slog.Error(fmt.Sprintf("Invalid type %s", msgType))
+		return &BadRequestError{Message: "Invalid type"}
+	}
+	return nil
+}
+
+/*
+Get the scheduled messages of the user, the pending ones and the ones that failed, by schedule ID
+*/
+func (s *Scheduler) GetScheduledMessages(ctx context.Context, userId string) (*ScheduledMessagesResponse, error) {
+	scheduled, err := s.DBClient.GetScheduledMessages(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting scheduled messages of %s: %v", userId, err))
+		return nil, &InternalServerError{Message: "Error getting scheduled messages"}
+	}
+	if scheduled == nil {
+		scheduled = []ScheduledMessage{}
+	}
+	return &ScheduledMessagesResponse{Scheduled: scheduled}, nil
+}
+
+/*
+Cancel a scheduled message of the user, a pending or failed one
+A message that is being sent can not be canceled, return 400 Bad Request
+*/
+func (s *Scheduler) CancelScheduledMessage(ctx context.Context, userId string, scheduleId string) error {
+	scheduled, err := s.DBClient.GetScheduledMessage(ctx, userId, scheduleId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting scheduled message %s: %v", scheduleId, err))
+		return &InternalServerError{Message: "Error getting scheduled message"}
+	}
+	if scheduled == nil {
+		slog.Error(fmt.Sprintf("Scheduled message %s of user %s not found", scheduleId, userId))
+		return &NotFoundError{Message: "Scheduled message not found"}
+	}
+	err = s.DBClient.CancelScheduledMessage(ctx, *scheduled, formatTime(time.Now()))
+	if errors.Is(err, db.ErrScheduleUnavailable) {
+		slog.Error(fmt.Sprintf("Scheduled message %s is being sent", scheduleId))
+		return &BadRequestError{Message: "Scheduled message is being sent"}
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error canceling scheduled message %s: %v", scheduleId, err))
+		return &InternalServerError{Message: "Error canceling scheduled message"}
+	}
+	slog.Info(fmt.Sprintf("Scheduled message %s of user %s canceled", scheduleId, userId))
+	return nil
+}
+
+// Run sends the due messages every ScheduleInterval until the context is done. The instances all run the scheduler,
+// each message is sent by the instance that claims it.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SendDue(ctx, time.Now()); err != nil {
+				slog.Error(fmt.Sprintf("Error sending scheduled messages, retrying later: %v", err))
+			}
+		}
+	}
+}
+
+// SendDue sends a batch of the messages due at now, earliest first. A message that can not be sent, as the recipient
+// blocked the sender or the sender left the group in the meantime, fails, other errors leave it to the next run.
+func (s *Scheduler) SendDue(ctx context.Context, now time.Time) error {
+	due, err := s.DBClient.GetDueScheduledMessages(ctx, formatTime(now), dueBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, scheduled := range due {
+		if err = s.send(ctx, scheduled, now); err != nil {
+			slog.Error(fmt.Sprintf("Error sending scheduled message %s, retrying later: %v", scheduled.ScheduleId, err))
+		}
+	}
+	return nil
+}
+
+// send claims the message and sends it, unless another instance claimed it.
+func (s *Scheduler) send(ctx context.Context, scheduled ScheduledMessage, now time.Time) error {
+	claimed, err := s.DBClient.ClaimScheduledMessage(ctx, scheduled, formatTime(now), formatTime(now.Add(ClaimDuration)), NewMessageId(now))
+	if errors.Is(err, db.ErrScheduleUnavailable) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, ClaimDuration/2)
+	defer cancel()
+	err = s.deliver(sendCtx, *claimed)
+	var internal *InternalServerError
+	switch {
+	case err == nil:
+		slog.Info(fmt.Sprintf("Scheduled message %s sent as message %s", claimed.ScheduleId, claimed.MessageId))
+		return s.DBClient.DeleteScheduledMessage(ctx, claimed.SenderId, claimed.ScheduleId)
+	case errors.Is(err, errSenderDeleted):
+		slog.Info(fmt.Sprintf("Scheduled message %s of deleted user %s is dropped", claimed.ScheduleId, claimed.SenderId))
+		return s.DBClient.DeleteScheduledMessage(ctx, claimed.SenderId, claimed.ScheduleId)
+	case errors.As(err, &internal) || sendCtx.Err() != nil:
+		if releaseErr := s.DBClient.ReleaseScheduledMessage(ctx, *claimed); releaseErr != nil {
+			slog.Error(fmt.Sprintf("Error releasing scheduled message %s: %v", claimed.ScheduleId, releaseErr))
+		}
+		return err
+	default:
+		slog.Warn(fmt.Sprintf("Scheduled message %s of %s can not be sent: %v", claimed.ScheduleId, claimed.SenderId, err))
+		return s.DBClient.FailScheduledMessage(ctx, *claimed, err.Error())
+	}
+}
+
+// deliver sends the claimed message through the messages handler with the message ID of the claim. A message already
+// stored with the ID was sent by a delivery that was interrupted before the scheduled message was deleted, possibly
+// before its copies to the inboxes of the group, which are stored again. The conversation lists and the connected
+// recipients are only updated by the interrupted delivery, see resumeDelivery.
+func (s *Scheduler) deliver(ctx context.Context, claimed ScheduledMessage) error {
+	// the message may have been stored by the previous claim just before, an eventually consistent read could miss it
+	sent, err := s.DBClient.GetMessageConsistent(ctx, claimed.RecipientId, claimed.MessageId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting message %s: %v", claimed.MessageId, err))
+		return &InternalServerError{Message: "Error getting message"}
+	}
+	if sent != nil {
+		slog.Info(fmt.Sprintf("Scheduled message %s was already sent", claimed.ScheduleId))
+		return s.resumeDelivery(ctx, claimed, *sent)
+	}
+	sender, err := s.DBClient.GetUser(ctx, claimed.SenderId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting sender: %v", err))
+		return &InternalServerError{Message: "Error getting sender"}
+	}
+	if sender == nil {
+		return errSenderDeleted
+	}
+	req := messages.SendMessageRequest{
+		SenderId:      claimed.SenderId,
+		RecipientId:   claimed.RecipientId,
+		Message:       claimed.Message,
+		AttachmentIds: claimed.AttachmentIds,
+		ReplyTo:       claimed.ReplyTo,
+		MessageId:     claimed.MessageId,
+	}
+	if claimed.Type == ConversationGroup {
+		_, err = s.Messages.SendGroupMessage(ctx, req)
+	} else {
+		_, err = s.Messages.SendPrivateMessage(ctx, req)
+	}
+	return err
+}
+
+// resumeDelivery copies a group message sent by an interrupted delivery to the inboxes of the group again, the copies
+// replace those already stored. The conversation lists are not updated again, they show the message once another
+// message is sent, and the connected recipients get it when they poll or reconnect.
+func (s *Scheduler) resumeDelivery(ctx context.Context, claimed ScheduledMessage, sent Message) error {
+	if claimed.Type != ConversationGroup {
+		return nil
+	}
+	group, err := s.DBClient.GetGroup(ctx, claimed.RecipientId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting group: %v", err))
+		return &InternalServerError{Message: "Error getting group"}
+	}
+	if group == nil || !group.FanOutOnWrite {
+		return nil
+	}
+	members := make([]string, 0, len(group.Members))
+	for member := range group.Members {
+		members = append(members, member)
+	}
+	if err = s.DBClient.StoreInboxMessages(ctx, sent, members); err != nil {
+		slog.Error(fmt.Sprintf("Error copying message %s to the inboxes of group %s: %v", sent.MessageId, group.GroupId, err))
+		return &InternalServerError{Message: "Error delivering message"}
+	}
+	return nil
+}
+
+// formatTime formats a time like ScheduledMessage.SendAt, so that the times compare as strings.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,321 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"server/db"
+	"server/messages"
+	"sync"
+	"testing"
+	"time"
+)
+
+// interruptedSender sends the messages and then fails like an instance stopped before it deleted the scheduled message.
+type interruptedSender struct {
+	MessageSender
+}
+
+func (i *interruptedSender) SendPrivateMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error) {
+	if _, err := i.MessageSender.SendPrivateMessage(ctx, req); err != nil {
+		return nil, err
+	}
+	return nil, &InternalServerError{Message: "Interrupted"}
+}
+
+// uncopiedSender stores the group messages and then fails like an instance stopped before it copied them to the inboxes.
+type uncopiedSender struct {
+	MessageSender
+	dbClient db.DynamoDBClientInterface
+}
+
+func (u *uncopiedSender) SendGroupMessage(ctx context.Context, req messages.SendMessageRequest) (*messages.SendMessageResponse, error) {
+	msg := Message{RecipientId: req.RecipientId, MessageId: req.MessageId, ChangeId: req.MessageId, SenderId: req.SenderId, Message: req.Message, Timestamp: time.Now().Format(time.RFC3339)}
+	if err := u.dbClient.StoreMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	return nil, &InternalServerError{Message: "Interrupted"}
+}
+
+// sentMessages returns the messages stored for the recipient, a user or a group.
+func sentMessages(ctx context.Context, dbClient *db.MockDBClient, recipientId string) []Message {
+	page, _ := dbClient.GetConversationMessages(ctx, db.HistoryQuery{Type: ConversationGroup, ConversationId: recipientId, Limit: 100})
+	return page.Messages
+}
+
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	scheduler := &Scheduler{DBClient: dbClient, Messages: &messages.Handler{DBClient: dbClient}}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, sender)
+	dbClient.StoreUser(ctx, recipient)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, sender)
+	sendAt := time.Now().Add(time.Hour)
+
+	t.Run("Schedule, list and cancel", func(t *testing.T) {
+		req := messages.SendMessageRequest{SenderId: sender.UserId, RecipientId: recipient.UserId, Message: "later", SendAt: sendAt.Format(time.RFC3339)}
+		scheduled, err := scheduler.Schedule(ctx, ConversationPrivate, req)
+		assert.NoError(t, err)
+		assert.Equal(t, ScheduledPending, scheduled.Status)
+		assert.Equal(t, sendAt.UTC().Format(time.RFC3339), scheduled.SendAt)
+
+		resp, err := scheduler.GetScheduledMessages(ctx, sender.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []ScheduledMessage{*scheduled}, resp.Scheduled)
+
+		assert.NoError(t, scheduler.CancelScheduledMessage(ctx, sender.UserId, scheduled.ScheduleId))
+		resp, err = scheduler.GetScheduledMessages(ctx, sender.UserId)
+		assert.NoError(t, err)
+		assert.Empty(t, resp.Scheduled)
+
+		err = scheduler.CancelScheduledMessage(ctx, sender.UserId, scheduled.ScheduleId)
+		assert.IsType(t, &NotFoundError{}, err)
+		err = scheduler.CancelScheduledMessage(ctx, recipient.UserId, scheduled.ScheduleId)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for name, test := range map[string]struct {
+			msgType string
+			req     messages.SendMessageRequest
+			err     error
+		}{
+			"invalid time": {ConversationPrivate, messages.SendMessageRequest{RecipientId: recipient.UserId, SendAt: "tomorrow"}, &BadRequestError{}},
+			"past":         {ConversationPrivate, messages.SendMessageRequest{RecipientId: recipient.UserId, SendAt: time.Now().Add(-time.Minute).Format(time.RFC3339)}, &BadRequestError{}},
+			"too far":      {ConversationPrivate, messages.SendMessageRequest{RecipientId: recipient.UserId, SendAt: time.Now().Add(2 * MaxScheduleAhead).Format(time.RFC3339)}, &BadRequestError{}},
+			"invalid type": {"other", messages.SendMessageRequest{RecipientId: recipient.UserId, SendAt: sendAt.Format(time.RFC3339)}, &BadRequestError{}},
+			"no recipient": {ConversationPrivate, messages.SendMessageRequest{RecipientId: "missing", SendAt: sendAt.Format(time.RFC3339)}, &NotFoundError{}},
+			"no group":     {ConversationGroup, messages.SendMessageRequest{RecipientId: "missing", SendAt: sendAt.Format(time.RFC3339)}, &NotFoundError{}},
+		} {
+			test.req.SenderId = sender.UserId
+			test.req.Message = "later"
+			_, err := scheduler.Schedule(ctx, test.msgType, test.req)
+			assert.IsType(t, test.err, err, name)
+		}
+	})
+
+	t.Run("The sender must be able to send the message now", func(t *testing.T) {
+		other := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, other)
+		_, err := scheduler.Schedule(ctx, ConversationGroup, messages.SendMessageRequest{SenderId: other.UserId, RecipientId: group.GroupId, Message: "later", SendAt: sendAt.Format(time.RFC3339)})
+		assert.IsType(t, &ForbiddenError{}, err)
+
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocking)
+		dbClient.BlockUser(ctx, blocking, other.UserId)
+		_, err = scheduler.Schedule(ctx, ConversationPrivate, messages.SendMessageRequest{SenderId: other.UserId, RecipientId: blocking.UserId, Message: "later", SendAt: sendAt.Format(time.RFC3339)})
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Too many scheduled messages", func(t *testing.T) {
+		busy := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, busy)
+		req := messages.SendMessageRequest{SenderId: busy.UserId, RecipientId: recipient.UserId, Message: "later", SendAt: sendAt.Format(time.RFC3339)}
+		for i := 0; i < MaxScheduledMessages; i++ {
+			_, err := scheduler.Schedule(ctx, ConversationPrivate, req)
+			assert.NoError(t, err)
+		}
+		_, err := scheduler.Schedule(ctx, ConversationPrivate, req)
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+}
+
+func TestSendDue(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := &messages.Handler{DBClient: dbClient}
+	scheduler := &Scheduler{DBClient: dbClient, Messages: handler}
+
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, sender)
+	dbClient.StoreUser(ctx, recipient)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	for _, user := range []User{sender, recipient} {
+		dbClient.AddUserToGroup(ctx, group, user)
+	}
+	sendAt := time.Now().Add(time.Hour)
+	schedule := func(msgType string, recipientId string) *ScheduledMessage {
+		scheduled, err := scheduler.Schedule(ctx, msgType, messages.SendMessageRequest{SenderId: sender.UserId, RecipientId: recipientId, Message: "later", SendAt: sendAt.Format(time.RFC3339)})
+		assert.NoError(t, err)
+		return scheduled
+	}
+	scheduledMessage := func(scheduleId string) *ScheduledMessage {
+		scheduled, _ := dbClient.GetScheduledMessage(ctx, sender.UserId, scheduleId)
+		return scheduled
+	}
+
+	t.Run("Send private and group messages when due", func(t *testing.T) {
+		private := schedule(ConversationPrivate, recipient.UserId)
+		groupMessage := schedule(ConversationGroup, group.GroupId)
+
+		assert.NoError(t, scheduler.SendDue(ctx, time.Now()))
+		assert.Empty(t, sentMessages(ctx, dbClient, recipient.UserId))
+
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		for _, scheduled := range []*ScheduledMessage{private, groupMessage} {
+			assert.Nil(t, scheduledMessage(scheduled.ScheduleId))
+			sent := sentMessages(ctx, dbClient, scheduled.RecipientId)
+			if assert.Len(t, sent, 1) {
+				assert.Equal(t, sender.UserId, sent[0].SenderId)
+				assert.Equal(t, "later", sent[0].Message)
+			}
+		}
+		// the recipient gets the message like any other
+		msgs, err := handler.GetMessages(ctx, recipient.UserId, messages.GetMessagesRequest{Timestamp: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		assert.Len(t, msgs.Messages, 2)
+	})
+
+	t.Run("Blocks and membership are checked when due", func(t *testing.T) {
+		blocking := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocking)
+		private := schedule(ConversationPrivate, blocking.UserId)
+		dbClient.BlockUser(ctx, blocking, sender.UserId)
+
+		left := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+		dbClient.StoreGroup(ctx, left)
+		dbClient.AddUserToGroup(ctx, left, sender)
+		groupMessage := schedule(ConversationGroup, left.GroupId)
+		stored, _ := dbClient.GetGroup(ctx, left.GroupId)
+		member, _ := dbClient.GetUser(ctx, sender.UserId)
+		dbClient.RemoveUserFromGroup(ctx, *stored, *member)
+
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		for _, scheduled := range []*ScheduledMessage{private, groupMessage} {
+			failed := scheduledMessage(scheduled.ScheduleId)
+			assert.Equal(t, ScheduledFailed, failed.Status)
+			assert.NotEmpty(t, failed.Error)
+			assert.Empty(t, sentMessages(ctx, dbClient, scheduled.RecipientId))
+		}
+		assert.Equal(t, "Recipient has blocked the sender", scheduledMessage(private.ScheduleId).Error)
+
+		// failed messages stay listed until canceled, and are not sent again
+		resp, _ := scheduler.GetScheduledMessages(ctx, sender.UserId)
+		assert.Len(t, resp.Scheduled, 2)
+		dbClient.UnBlockUser(ctx, blocking, sender.UserId)
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		assert.Empty(t, sentMessages(ctx, dbClient, blocking.UserId))
+		assert.NoError(t, scheduler.CancelScheduledMessage(ctx, sender.UserId, private.ScheduleId))
+		assert.NoError(t, scheduler.CancelScheduledMessage(ctx, sender.UserId, groupMessage.ScheduleId))
+	})
+
+	t.Run("Errors leave the message to the next run", func(t *testing.T) {
+		peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, peer)
+		scheduled := schedule(ConversationPrivate, peer.UserId)
+		failing := &Scheduler{DBClient: dbClient, Messages: &interruptedSender{MessageSender: handler}}
+
+		assert.NoError(t, failing.SendDue(ctx, sendAt))
+		pending := scheduledMessage(scheduled.ScheduleId)
+		assert.Equal(t, ScheduledPending, pending.Status)
+		assert.Empty(t, pending.ClaimedUntil)
+		assert.NotEmpty(t, pending.MessageId)
+
+		// the message was stored before the interruption, so it is not sent again
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		assert.Nil(t, scheduledMessage(scheduled.ScheduleId))
+		sent := sentMessages(ctx, dbClient, peer.UserId)
+		if assert.Len(t, sent, 1) {
+			assert.Equal(t, pending.MessageId, sent[0].MessageId)
+		}
+	})
+
+	t.Run("Inbox copies of an interrupted group message are stored again", func(t *testing.T) {
+		inboxGroup := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), FanOutOnWrite: true}
+		dbClient.StoreGroup(ctx, inboxGroup)
+		for _, user := range []User{sender, recipient} {
+			member, _ := dbClient.GetUser(ctx, user.UserId)
+			dbClient.AddUserToGroup(ctx, inboxGroup, *member)
+		}
+		scheduled := schedule(ConversationGroup, inboxGroup.GroupId)
+		failing := &Scheduler{DBClient: dbClient, Messages: &uncopiedSender{MessageSender: handler, dbClient: dbClient}}
+
+		assert.NoError(t, failing.SendDue(ctx, sendAt))
+		pending := scheduledMessage(scheduled.ScheduleId)
+		assert.Equal(t, ScheduledPending, pending.Status)
+		inbox, _ := dbClient.GetMessageConsistent(ctx, recipient.UserId, pending.MessageId)
+		assert.Nil(t, inbox)
+
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		assert.Nil(t, scheduledMessage(scheduled.ScheduleId))
+		assert.Len(t, sentMessages(ctx, dbClient, inboxGroup.GroupId), 1)
+		for _, user := range []User{sender, recipient} {
+			inbox, _ = dbClient.GetMessageConsistent(ctx, user.UserId, pending.MessageId)
+			if assert.NotNil(t, inbox) {
+				assert.Equal(t, "later", inbox.Message)
+			}
+		}
+	})
+
+	t.Run("Claimed messages can not be canceled", func(t *testing.T) {
+		scheduled := schedule(ConversationPrivate, recipient.UserId)
+		now := time.Now()
+		_, err := dbClient.ClaimScheduledMessage(ctx, *scheduled, now.UTC().Format(time.RFC3339), now.Add(ClaimDuration).UTC().Format(time.RFC3339), NewMessageId(now))
+		assert.NoError(t, err)
+		err = scheduler.CancelScheduledMessage(ctx, sender.UserId, scheduled.ScheduleId)
+		assert.IsType(t, &BadRequestError{}, err)
+		dbClient.DeleteScheduledMessage(ctx, sender.UserId, scheduled.ScheduleId)
+	})
+
+	t.Run("Messages of deleted users are dropped", func(t *testing.T) {
+		deleted := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, deleted)
+		scheduled, err := scheduler.Schedule(ctx, ConversationPrivate, messages.SendMessageRequest{SenderId: deleted.UserId, RecipientId: recipient.UserId, Message: "later", SendAt: sendAt.Format(time.RFC3339)})
+		assert.NoError(t, err)
+		dbClient.DeleteUser(ctx, deleted.UserId)
+
+		before := len(sentMessages(ctx, dbClient, recipient.UserId))
+		assert.NoError(t, scheduler.SendDue(ctx, sendAt))
+		stored, _ := dbClient.GetScheduledMessage(ctx, deleted.UserId, scheduled.ScheduleId)
+		assert.Nil(t, stored)
+		assert.Len(t, sentMessages(ctx, dbClient, recipient.UserId), before)
+	})
+}
+
+func TestSendDueOnSeveralInstances(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := &messages.Handler{DBClient: dbClient}
+	sender := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	recipient := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, sender)
+	dbClient.StoreUser(ctx, recipient)
+
+	sendAt := time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		_, err := (&Scheduler{DBClient: dbClient, Messages: handler}).Schedule(ctx, ConversationPrivate, messages.SendMessageRequest{
+			SenderId: sender.UserId, RecipientId: recipient.UserId, Message: fmt.Sprintf("later %d", i), SendAt: sendAt.Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance := &Scheduler{DBClient: dbClient, Messages: handler}
+			assert.NoError(t, instance.SendDue(ctx, sendAt))
+		}()
+	}
+	wg.Wait()
+
+	sent := sentMessages(ctx, dbClient, recipient.UserId)
+	assert.Len(t, sent, 10)
+	texts := map[string]bool{}
+	for _, msg := range sent {
+		texts[msg.Message] = true
+	}
+	assert.Len(t, texts, 10)
+	scheduled, _ := dbClient.GetScheduledMessages(ctx, sender.UserId)
+	assert.Empty(t, scheduled)
+}
@@ -0,0 +1,348 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"math"
+	. "server/common"
+	"server/db"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	// MaxSearchTerms bounds the index queries of a search, one per term and scope
+	MaxSearchTerms = 10
+	// MaxSearchPostings is the number of the newest messages read per term and scope, so that a common word in a
+	// large group does not read its whole history on every page. Older messages are found by searching before them.
+	MaxSearchPostings = 1000
+)
+
+// BM25 ranking parameters, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type SearchRequest struct {
+	Query    string // words and quoted phrases, all of them must match
+	SenderId string // only messages sent by this user, optional
+	GroupId  string // only messages of this group of the user, optional
+	After    int64  // unix timestamp, only messages sent after it, optional
+	Before   int64  // unix timestamp, only messages sent before it, optional
+	Limit    int    // page size, DefaultSearchLimit if not provided
+	Cursor   string // nextCursor of the previous page
+}
+
+type SearchResult struct {
+	Message Message `json:"message"`
+	Score   float64 `json:"score"`
+}
+
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+type HandlerInterface interface {
+	Search(ctx context.Context, userId string, req SearchRequest) (*SearchResponse, error)
+}
+
+type Handler struct {
+	DBClient db.DynamoDBClientInterface
+}
+
+// candidate is a message with postings of the query terms.
+type candidate struct {
+	recipientId string
+	messageId   string
+	senderId    string
+	length      int
+	positions   map[string][]int // by term
+	score       float64
+}
+
+/*
+Search the messages the user may see: the private messages they received, the messages they sent, and the messages of
+their groups. Results are ranked by relevance, the newer message first on equal relevance
+Group messages of users blocked by the user are left out if the user hides or collapses them
+The index is updated as messages are sent, edited and deleted, so a later page may repeat or skip results that moved
+Only the newest MaxSearchPostings messages of each term in each of the scopes are searched, see SearchRequest.Before
+*/
+func (handler *Handler) Search(ctx context.Context, userId string, req SearchRequest) (*SearchResponse, error) {
+	if req.Limit <= 0 {
+		req.Limit = DefaultSearchLimit
+	}
+	if req.Limit > MaxSearchLimit {
+		slog.Error(fmt.Sprintf("Invalid limit: %d", req.Limit))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Limit must not exceed %d", MaxSearchLimit)}
+	}
+	phrases := parseQuery(req.Query)
+	terms := queryTerms(phrases)
+	if len(terms) == 0 {
+		slog.Error(fmt.Sprintf("Invalid search query: %q", req.Query))
+		return nil, &BadRequestError{Message: "Query must have at least one word"}
+	}
+	if len(terms) > MaxSearchTerms {
+		slog.Error(fmt.Sprintf("Search query has %d terms", len(terms)))
+		return nil, &BadRequestError{Message: fmt.Sprintf("Query must not have more than %d words", MaxSearchTerms)}
+	}
+	offset, err := decodeCursor(req.Cursor)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid cursor %s: %v", req.Cursor, err))
+		return nil, &BadRequestError{Message: "Invalid cursor"}
+	}
+
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User not found: %v", userId))
+		return nil, &NotFoundError{Message: "User not found"}
+	}
+	query := db.SearchQuery{Terms: terms, Limit: MaxSearchPostings}
+	if req.GroupId != "" {
+		if !user.Groups[req.GroupId] {
+			slog.Error(fmt.Sprintf("User %s is not a member of group %s", userId, req.GroupId))
+			return nil, &ForbiddenError{Message: "User is not a member of the group"}
+		}
+		query.Scopes = []string{req.GroupId}
+	} else {
+		query.Scopes = append([]string{userId}, groupIds(user)...)
+	}
+	if req.After > 0 {
+		query.After = MessageIdAfter(req.After)
+	}
+	if req.Before > 0 {
+		query.Before = MessageIdAfter(req.Before - 1)
+	}
+
+	postings, err := handler.DBClient.GetSearchPostings(ctx, query)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error searching messages of user %s: %v", userId, err))
+		return nil, &InternalServerError{Message: "Error searching messages"}
+	}
+	view := NewMessageView(*user)
+	candidates := collect(postings)
+	ranked := rank(terms, candidates, filter(candidates, req, view, phrases))
+
+	resp := &SearchResponse{Results: []SearchResult{}}
+	if offset >= len(ranked) {
+		return resp, nil
+	}
+	page := ranked[offset:]
+	if len(page) > req.Limit {
+		page = page[:req.Limit]
+		resp.NextCursor = encodeCursor(offset + req.Limit)
+	}
+	for _, c := range page {
+		msg, err := handler.DBClient.GetMessage(ctx, c.recipientId, c.messageId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting message %s: %v", c.messageId, err))
+			return nil, &InternalServerError{Message: "Error getting message"}
+		}
+		// the index of a message that changed since may lag behind if its update failed
+		if msg == nil || !matchesText(phrases, msg.Message) {
+			continue
+		}
+		viewed, _ := view.Apply(*msg)
+		resp.Results = append(resp.Results, SearchResult{Message: viewed, Score: c.score})
+	}
+	return resp, nil
+}
+
+// parseQuery returns the phrases of the query, quoted phrases and single words, as terms that must appear in order.
+// A word that tokenizes into several terms, such as e-mail, is a phrase as well.
+func parseQuery(query string) [][]string {
+	var phrases [][]string
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			// quoted, an unterminated quote runs to the end of the query
+			if terms := Tokenize(part); len(terms) > 0 {
+				phrases = append(phrases, terms)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if terms := Tokenize(word); len(terms) > 0 {
+				phrases = append(phrases, terms)
+			}
+		}
+	}
+	return phrases
+}
+
+// queryTerms returns the distinct terms of the phrases.
+func queryTerms(phrases [][]string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, phrase := range phrases {
+		for _, term := range phrase {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+func groupIds(user *User) []string {
+	ids := make([]string, 0, len(user.Groups))
+	for groupId := range user.Groups {
+		ids = append(ids, groupId)
+	}
+	return ids
+}
+
+// collect groups the postings by message, a message found in both the recipient and the sender scope has the same
+// postings in both.
+func collect(postings []SearchPosting) []*candidate {
+	byMessage := map[string]*candidate{}
+	var candidates []*candidate
+	for _, posting := range postings {
+		key := posting.RecipientId + "/" + posting.MessageId
+		c, ok := byMessage[key]
+		if !ok {
+			c = &candidate{
+				recipientId: posting.RecipientId,
+				messageId:   posting.MessageId,
+				senderId:    posting.SenderId,
+				length:      posting.Length,
+				positions:   map[string][]int{},
+			}
+			byMessage[key] = c
+			candidates = append(candidates, c)
+		}
+		c.positions[posting.Term] = posting.Positions
+	}
+	return candidates
+}
+
+// filter returns the messages that match every phrase and the filters of the request.
+func filter(candidates []*candidate, req SearchRequest, view MessageView, phrases [][]string) []*candidate {
+	var matched []*candidate
+	for _, c := range candidates {
+		if req.SenderId != "" && c.senderId != req.SenderId {
+			continue
+		}
+		// the text of collapsed messages is not shown, so it is not searched either
+		msg, visible := view.Apply(Message{RecipientId: c.recipientId, SenderId: c.senderId, MessageId: c.messageId})
+		if !visible || msg.Collapsed {
+			continue
+		}
+		if matchesPhrases(phrases, c.positions) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// matchesPhrases returns true if every phrase appears, its terms at consecutive positions.
+func matchesPhrases(phrases [][]string, positions map[string][]int) bool {
+	for _, phrase := range phrases {
+		if !matchesPhrase(phrase, positions) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesPhrase(phrase []string, positions map[string][]int) bool {
+	for _, start := range positions[phrase[0]] {
+		found := true
+		for i, term := range phrase[1:] {
+			if !containsPosition(positions[term], start+i+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPosition returns true if the sorted positions contain the position.
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+// matchesText returns true if the text of a message still matches the phrases.
+func matchesText(phrases [][]string, text string) bool {
+	positions := map[string][]int{}
+	for i, term := range Tokenize(text) {
+		positions[term] = append(positions[term], i)
+	}
+	return matchesPhrases(phrases, positions)
+}
+
+// rank scores the matched messages with BM25 and orders them by score, the newer message first on equal scores.
+// The index keeps no message counts, so the document frequencies and lengths are taken from the candidates, the
+// messages the user may see with any of the terms, which ranks rare terms higher within the results.
+func rank(terms []string, candidates []*candidate, matched []*candidate) []*candidate {
+	if len(matched) == 0 {
+		return matched
+	}
+	total := 0
+	df := map[string]float64{}
+	for _, c := range candidates {
+		total += c.length
+		for term := range c.positions {
+			df[term]++
+		}
+	}
+	n := float64(len(candidates))
+	averageLength := math.Max(float64(total)/n, 1)
+	for _, c := range matched {
+		for _, term := range terms {
+			idf := math.Log(1 + (n-df[term]+0.5)/(df[term]+0.5))
+			tf := float64(len(c.positions[term]))
+			c.score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(c.length)/averageLength))
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].score != matched[j].score {
+			return matched[i].score > matched[j].score
+		}
+		return matched[i].messageId > matched[j].messageId
+	})
+	return matched
+}
+
+// searchCursor is the position of the next page in the ranked results.
+type searchCursor struct {
+	Offset int `json:"offset"`
+}
+
+func encodeCursor(offset int) string {
+	data, _ := json.Marshal(searchCursor{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	var position searchCursor
+	if err = json.Unmarshal(data, &position); err != nil {
+		return 0, err
+	}
+	if position.Offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", position.Offset)
+	}
+	return position.Offset, nil
+}
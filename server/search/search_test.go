@@ -0,0 +1,204 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"server/db"
+	"testing"
+	"time"
+)
+
+func storeMessage(ctx context.Context, dbClient db.DynamoDBClientInterface, senderId string, recipientId string, sentAt time.Time, text string) Message {
+	messageId := NewMessageId(sentAt)
+	msg := Message{RecipientId: recipientId, MessageId: messageId, ChangeId: messageId, SenderId: senderId, Message: text, Timestamp: sentAt.Format(time.RFC3339)}
+	dbClient.StoreMessage(ctx, msg)
+	return msg
+}
+
+func resultTexts(resp *SearchResponse) []string {
+	texts := []string{}
+	for _, result := range resp.Results {
+		texts = append(texts, result.Message.Message)
+	}
+	return texts
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	stranger := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	dbClient.StoreUser(ctx, peer)
+	dbClient.StoreUser(ctx, stranger)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	other := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.StoreGroup(ctx, other)
+	dbClient.AddUserToGroup(ctx, group, user)
+	dbClient.AddUserToGroup(ctx, group, peer)
+	dbClient.AddUserToGroup(ctx, other, peer)
+
+	now := time.Now()
+	storeMessage(ctx, dbClient, peer.UserId, user.UserId, now.Add(-3*time.Hour), "Lunch tomorrow at the usual place?")
+	storeMessage(ctx, dbClient, user.UserId, peer.UserId, now.Add(-2*time.Hour), "Sure, lunch at noon")
+	storeMessage(ctx, dbClient, peer.UserId, group.GroupId, now.Add(-time.Hour), "Team lunch lunch lunch")
+	// not visible to the user
+	storeMessage(ctx, dbClient, peer.UserId, other.GroupId, now, "Lunch without the user")
+	storeMessage(ctx, dbClient, peer.UserId, stranger.UserId, now, "Lunch with a stranger")
+
+	t.Run("Search the messages the user may see", func(t *testing.T) {
+		resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "LUNCH"})
+		assert.NoError(t, err)
+		// ranked by the term frequency, shorter messages first
+		assert.Equal(t, []string{"Team lunch lunch lunch", "Sure, lunch at noon", "Lunch tomorrow at the usual place?"}, resultTexts(resp))
+		assert.Greater(t, resp.Results[0].Score, resp.Results[1].Score)
+		assert.Empty(t, resp.NextCursor)
+	})
+
+	t.Run("All words must match", func(t *testing.T) {
+		resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch noon"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Sure, lunch at noon"}, resultTexts(resp))
+
+		resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch dinner"})
+		assert.NoError(t, err)
+		assert.Empty(t, resp.Results)
+	})
+
+	t.Run("Phrase query", func(t *testing.T) {
+		resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: `"lunch at"`})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Sure, lunch at noon"}, resultTexts(resp))
+
+		resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: `"at lunch"`})
+		assert.NoError(t, err)
+		assert.Empty(t, resp.Results)
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", SenderId: user.UserId})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Sure, lunch at noon"}, resultTexts(resp))
+
+		resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", GroupId: group.GroupId})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Team lunch lunch lunch"}, resultTexts(resp))
+
+		resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", After: now.Add(-150 * time.Minute).Unix(), Before: now.Add(-30 * time.Minute).Unix()})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"Team lunch lunch lunch", "Sure, lunch at noon"}, resultTexts(resp))
+	})
+
+	t.Run("Not a member of the group", func(t *testing.T) {
+		_, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", GroupId: other.GroupId})
+		assert.IsType(t, &ForbiddenError{}, err)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Team lunch lunch lunch", "Sure, lunch at noon"}, resultTexts(resp))
+		assert.NotEmpty(t, resp.NextCursor)
+
+		resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: "lunch", Limit: 2, Cursor: resp.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Lunch tomorrow at the usual place?"}, resultTexts(resp))
+		assert.Empty(t, resp.NextCursor)
+	})
+
+	t.Run("Edited and deleted messages", func(t *testing.T) {
+		msg := storeMessage(ctx, dbClient, peer.UserId, user.UserId, now, "pizza tonight")
+		resp, _ := handler.Search(ctx, user.UserId, SearchRequest{Query: "pizza"})
+		assert.Equal(t, []string{"pizza tonight"}, resultTexts(resp))
+
+		msg.Message = "sushi tonight"
+		dbClient.UpdateMessage(ctx, msg)
+		resp, _ = handler.Search(ctx, user.UserId, SearchRequest{Query: "pizza"})
+		assert.Empty(t, resp.Results)
+		resp, _ = handler.Search(ctx, user.UserId, SearchRequest{Query: "sushi"})
+		assert.Equal(t, []string{"sushi tonight"}, resultTexts(resp))
+
+		msg.Message = ""
+		msg.Deleted = true
+		dbClient.UpdateMessage(ctx, msg)
+		resp, _ = handler.Search(ctx, user.UserId, SearchRequest{Query: "sushi"})
+		assert.Empty(t, resp.Results)
+	})
+
+	t.Run("Group messages of blocked users", func(t *testing.T) {
+		blocker := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		dbClient.StoreUser(ctx, blocker)
+		dbClient.AddUserToGroup(ctx, group, blocker)
+		dbClient.BlockUser(ctx, blocker, peer.UserId)
+
+		resp, _ := handler.Search(ctx, blocker.UserId, SearchRequest{Query: "team"})
+		assert.Equal(t, []string{"Team lunch lunch lunch"}, resultTexts(resp))
+
+		for _, setting := range []string{BlockedMessagesHide, BlockedMessagesCollapse} {
+			stored, _ := dbClient.GetUser(ctx, blocker.UserId)
+			dbClient.SetBlockedGroupMessages(ctx, *stored, setting)
+			resp, _ = handler.Search(ctx, blocker.UserId, SearchRequest{Query: "team"})
+			assert.Empty(t, resp.Results)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for _, req := range []SearchRequest{
+			{Query: ""},
+			{Query: `" -- "`},
+			{Query: "a b c d e f g h i j k"},
+			{Query: "lunch", Limit: MaxSearchLimit + 1},
+			{Query: "lunch", Cursor: "invalid"},
+		} {
+			_, err := handler.Search(ctx, user.UserId, req)
+			assert.IsType(t, &BadRequestError{}, err, req)
+		}
+	})
+
+	t.Run("User not found", func(t *testing.T) {
+		_, err := handler.Search(ctx, "test-user-missing", SearchRequest{Query: "lunch"})
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+}
+
+func TestParseQuery(t *testing.T) {
+	assert.Equal(t, [][]string{{"lunch"}, {"at", "noon"}, {"e", "mail"}}, parseQuery(`Lunch "at NOON" e-mail`))
+	// an unterminated quote runs to the end
+	assert.Equal(t, [][]string{{"lunch"}, {"at", "noon"}}, parseQuery(`lunch "at noon`))
+	assert.Empty(t, parseQuery(` "" -- `))
+}
+
+func TestSearchNewestMessages(t *testing.T) {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	handler := Handler{DBClient: dbClient}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	dbClient.StoreUser(ctx, user)
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String())}
+	dbClient.StoreGroup(ctx, group)
+	dbClient.AddUserToGroup(ctx, group, user)
+
+	now := time.Now()
+	oldest := now.Add(-time.Duration(MaxSearchPostings+1) * time.Minute)
+	storeMessage(ctx, dbClient, user.UserId, group.GroupId, oldest, "daily standup notes")
+	for i := MaxSearchPostings; i > 0; i-- {
+		storeMessage(ctx, dbClient, user.UserId, group.GroupId, now.Add(-time.Duration(i)*time.Minute), "daily standup")
+	}
+
+	// the oldest message is past the newest postings of standup
+	resp, err := handler.Search(ctx, user.UserId, SearchRequest{Query: "standup notes"})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Results)
+
+	resp, err = handler.Search(ctx, user.UserId, SearchRequest{Query: "standup notes", Before: oldest.Add(time.Minute).Unix()})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"daily standup notes"}, resultTexts(resp))
+}
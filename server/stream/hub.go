@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"sync"
+)
+
+// subscriberBufferSize is the number of messages buffered per subscriber before it is considered too slow.
+const subscriberBufferSize = 64
+
+// Hub delivers stored messages to the users currently listening for them.
+// LocalHub only reaches listeners connected to this server instance, an implementation backed by a broker
+// (e.g. Redis pub/sub or SNS) can be plugged in for multi instance deployments.
+type Hub interface {
+	// Subscribe starts listening for messages delivered to the user.
+	// The channel is closed when unsubscribe is called or when the subscriber falls behind,
+	// in which case the listener should resume from the last message it received.
+	Subscribe(userId string) (messages <-chan Message, unsubscribe func())
+	// Publish delivers the message to all subscribers of the given users.
+	Publish(userIds []string, message Message)
+}
+
+type subscriber struct {
+	messages  chan Message
+	closeOnce sync.Once
+}
+
+func (s *subscriber) close() {
+	s.closeOnce.Do(func() { close(s.messages) })
+}
+
+// LocalHub is an in-process Hub.
+type LocalHub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*subscriber]struct{}
+}
+
+func NewLocalHub() *LocalHub {
+	return &LocalHub{subscribers: map[string]map[*subscriber]struct{}{}}
+}
+
+func (h *LocalHub) Subscribe(userId string) (<-chan Message, func()) {
+	sub := &subscriber{messages: make(chan Message, subscriberBufferSize)}
+
+	h.mu.Lock()
+	if h.subscribers[userId] == nil {
+		h.subscribers[userId] = map[*subscriber]struct{}{}
+	}
+	h.subscribers[userId][sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.messages, func() { h.unsubscribe(userId, sub) }
+}
+
+// SubscriberCount returns the number of active subscriptions of the user.
+func (h *LocalHub) SubscriberCount(userId string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers[userId])
+}
+
+func (h *LocalHub) unsubscribe(userId string, sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subscribers[userId], sub)
+	if len(h.subscribers[userId]) == 0 {
+		delete(h.subscribers, userId)
+	}
+	h.mu.Unlock()
+	sub.close()
+}
+
+func (h *LocalHub) Publish(userIds []string, message Message) {
+	var slow []*subscriber
+	var slowUsers []string
+
+	h.mu.RLock()
+	for _, userId := range userIds {
+		for sub := range h.subscribers[userId] {
+			select {
+			case sub.messages <- message:
+			default:
+				// never block the sender on a slow listener, drop the listener instead
+				slow = append(slow, sub)
+				slowUsers = append(slowUsers, userId)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for i, sub := range slow {
+		slog.Warn(fmt.Sprintf("Subscriber of user %s is too slow, closing subscription", slowUsers[i]))
+		h.unsubscribe(slowUsers[i], sub)
+	}
+}
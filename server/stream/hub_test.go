@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, messages <-chan Message) (Message, bool) {
+	select {
+	case msg, ok := <-messages:
+		return msg, ok
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+		return Message{}, false
+	}
+}
+
+func TestLocalHub(t *testing.T) {
+	t.Run("publish to subscribed users", func(t *testing.T) {
+		hub := NewLocalHub()
+		user1, unsubscribe1 := hub.Subscribe("test-user-1")
+		defer unsubscribe1()
+		user2, unsubscribe2 := hub.Subscribe("test-user-2")
+		defer unsubscribe2()
+		other, unsubscribe3 := hub.Subscribe("test-user-3")
+		defer unsubscribe3()
+
+		hub.Publish([]string{"test-user-1", "test-user-2"}, Message{MessageId: "1", Message: "hello"})
+
+		msg, ok := receive(t, user1)
+		assert.True(t, ok)
+		assert.Equal(t, "hello", msg.Message)
+		msg, ok = receive(t, user2)
+		assert.True(t, ok)
+		assert.Equal(t, "hello", msg.Message)
+		assert.Empty(t, other)
+	})
+
+	t.Run("multiple connections of the same user", func(t *testing.T) {
+		hub := NewLocalHub()
+		conn1, unsubscribe1 := hub.Subscribe("test-user-1")
+		defer unsubscribe1()
+		conn2, unsubscribe2 := hub.Subscribe("test-user-1")
+		defer unsubscribe2()
+
+		hub.Publish([]string{"test-user-1"}, Message{MessageId: "1"})
+
+		_, ok := receive(t, conn1)
+		assert.True(t, ok)
+		_, ok = receive(t, conn2)
+		assert.True(t, ok)
+	})
+
+	t.Run("unsubscribe closes the channel", func(t *testing.T) {
+		hub := NewLocalHub()
+		messages, unsubscribe := hub.Subscribe("test-user-1")
+		unsubscribe()
+		// unsubscribing twice is safe
+		unsubscribe()
+
+		hub.Publish([]string{"test-user-1"}, Message{MessageId: "1"})
+		_, ok := receive(t, messages)
+		assert.False(t, ok)
+		assert.Empty(t, hub.subscribers)
+	})
+
+	t.Run("slow subscriber is dropped", func(t *testing.T) {
+		hub := NewLocalHub()
+		messages, unsubscribe := hub.Subscribe("test-user-1")
+		defer unsubscribe()
+
+		for i := 0; i <= subscriberBufferSize; i++ {
+			hub.Publish([]string{"test-user-1"}, Message{MessageId: "1"})
+		}
+
+		received := 0
+		for range messages {
+			received++
+		}
+		assert.Equal(t, subscriberBufferSize, received)
+	})
+}
@@ -0,0 +1,251 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	. "server/common"
+	"server/db"
+	"time"
+)
+
+const (
+	// DeletionRetryInterval is how often the user deletions in progress are resumed, the ones interrupted by a restart
+	// or failed, also those started by other instances.
+	DeletionRetryInterval = time.Minute
+	// deletionQueueSize is the number of user deletions waiting to run, more are started with the next retry.
+	deletionQueueSize = 100
+	// deletionHistoryPageSize is the number of conversation messages changed per page.
+	deletionHistoryPageSize = 100
+)
+
+// MessageChanger changes the messages of deleted users, it is implemented by messages.Handler, so that the changes are
+// delivered to the inboxes, conversations and connected clients like the changes by the sender.
+type MessageChanger interface {
+	DeleteMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error)
+	AnonymizeMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error)
+}
+
+// Deleter cleans up after deleted users in the background, see UserDeletion. A user can be in more groups and
+// conversations than a DynamoDB transaction allows, so every group, conversation and blocking user is a step of its own.
+type Deleter struct {
+	DBClient db.DynamoDBClientInterface
+	Messages MessageChanger
+	queue    chan string
+}
+
+func NewDeleter(dbClient db.DynamoDBClientInterface, messages MessageChanger) *Deleter {
+	return &Deleter{DBClient: dbClient, Messages: messages, queue: make(chan string, deletionQueueSize)}
+}
+
+// Enqueue starts the deletion of the user in the background. The deletion is stored, so if the queue is full
+// it is started with the next retry.
+func (d *Deleter) Enqueue(userId string) {
+	select {
+	case d.queue <- userId:
+	default:
+		slog.Warn(fmt.Sprintf("Deletion queue is full, deletion of user %s starts with the next retry", userId))
+	}
+}
+
+// Run runs the queued user deletions one at a time until the context is done, and resumes the deletions in progress
+// on start and every DeletionRetryInterval. Instances may run the same deletion at once, as every step can be repeated.
+func (d *Deleter) Run(ctx context.Context) {
+	ticker := time.NewTicker(DeletionRetryInterval)
+	defer ticker.Stop()
+	d.resume(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case userId := <-d.queue:
+			if err := d.Delete(ctx, userId); err != nil {
+				slog.Error(fmt.Sprintf("Error deleting user %s, retrying later: %v", userId, err))
+			}
+		case <-ticker.C:
+			d.resume(ctx)
+		}
+	}
+}
+
+func (d *Deleter) resume(ctx context.Context) {
+	deletions, err := d.DBClient.GetUserDeletions(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user deletions: %v", err))
+		return
+	}
+	for _, deletion := range deletions {
+		if err = d.Delete(ctx, deletion.UserId); err != nil {
+			slog.Error(fmt.Sprintf("Error deleting user %s, retrying later: %v", deletion.UserId, err))
+		}
+	}
+}
+
+// Delete runs the deletion of the user from its stored progress to the end, and then removes the deletion.
+// It does nothing if the user is not being deleted.
+func (d *Deleter) Delete(ctx context.Context, userId string) error {
+	deletion, err := d.DBClient.GetUserDeletion(ctx, userId)
+	if err != nil || deletion == nil {
+		return err
+	}
+
+	if !deletion.ConversationsListed {
+		// the user record is deleted by the request, again here in case the request was interrupted,
+		// so that no new conversations or memberships start while they are listed
+		if err = d.DBClient.DeleteUser(ctx, userId); err != nil {
+			return err
+		}
+		conversations, err := d.DBClient.GetConversations(ctx, userId)
+		if err != nil {
+			return err
+		}
+		for _, conversation := range conversations {
+			// group conversations of the user hold read markers, also of groups the user left
+			if conversation.Type == ConversationGroup {
+				deletion.Groups = appendMissing(deletion.Groups, conversation.ConversationId)
+			} else {
+				deletion.Peers = appendMissing(deletion.Peers, conversation.ConversationId)
+			}
+		}
+		deletion.ConversationsListed = true
+		if err = d.DBClient.StoreUserDeletion(ctx, *deletion); err != nil {
+			return err
+		}
+	}
+
+	for len(deletion.Peers) > 0 {
+		if err = d.deletePrivateConversation(ctx, deletion, deletion.Peers[0]); err != nil {
+			return err
+		}
+		deletion.Peers = deletion.Peers[1:]
+		if err = d.DBClient.StoreUserDeletion(ctx, *deletion); err != nil {
+			return err
+		}
+	}
+
+	for len(deletion.Groups) > 0 {
+		if err = d.leaveGroup(ctx, deletion, deletion.Groups[0]); err != nil {
+			return err
+		}
+		deletion.Groups = deletion.Groups[1:]
+		if err = d.DBClient.StoreUserDeletion(ctx, *deletion); err != nil {
+			return err
+		}
+	}
+
+	for !deletion.BlocksRemoved {
+		userIds, next, err := d.DBClient.GetBlockingUsers(ctx, userId, deletion.BlockCursor)
+		if err != nil {
+			return err
+		}
+		for _, blockingUserId := range userIds {
+			user, err := d.DBClient.GetUser(ctx, blockingUserId)
+			if err != nil {
+				return err
+			}
+			if user == nil {
+				continue
+			}
+			if err = d.DBClient.UnBlockUser(ctx, *user, userId); err != nil {
+				return err
+			}
+		}
+		deletion.BlockCursor = next
+		deletion.BlocksRemoved = next == ""
+		if err = d.DBClient.StoreUserDeletion(ctx, *deletion); err != nil {
+			return err
+		}
+	}
+
+	if err = d.DBClient.DeleteUserDeletion(ctx, userId); err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("User %s deleted, messages: %s", userId, deletion.MessagePolicy))
+	return nil
+}
+
+// deletePrivateConversation changes the messages of the private conversation with the peer by the message policy,
+// and deletes the conversation of the user. The conversation of the peer is kept.
+func (d *Deleter) deletePrivateConversation(ctx context.Context, deletion *UserDeletion, peerId string) error {
+	query := db.HistoryQuery{Type: ConversationPrivate, ConversationId: PrivateConversationKey(deletion.UserId, peerId)}
+	if err := d.changeMessages(ctx, deletion, query, false); err != nil {
+		return err
+	}
+	return d.DBClient.DeleteConversation(ctx, deletion.UserId, peerId)
+}
+
+// leaveGroup changes the messages the user sent to the group by the message policy, removes the user from the group,
+// and deletes the conversation of the user. A group without other members is deleted.
+func (d *Deleter) leaveGroup(ctx context.Context, deletion *UserDeletion, groupId string) error {
+	query := db.HistoryQuery{Type: ConversationGroup, ConversationId: groupId}
+	if err := d.changeMessages(ctx, deletion, query, true); err != nil {
+		return err
+	}
+	group, err := d.DBClient.GetGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+	switch {
+	case group == nil || !group.Members[deletion.UserId]:
+		// deleted, or already left
+	case len(group.Members) == 1:
+		err = d.DBClient.DeleteGroup(ctx, *group)
+	default:
+		err = d.DBClient.RemoveDeletedUserFromGroup(ctx, *group, deletion.UserId)
+	}
+	if err != nil {
+		return err
+	}
+	return d.DBClient.DeleteConversation(ctx, deletion.UserId, groupId)
+}
+
+// changeMessages changes the messages of the conversation by the message policy, from the latest back to the first.
+// Messages that were already changed are skipped, so that a resumed deletion continues where it stopped.
+func (d *Deleter) changeMessages(ctx context.Context, deletion *UserDeletion, query db.HistoryQuery, sentOnly bool) error {
+	query.Limit = deletionHistoryPageSize
+	for {
+		page, err := d.DBClient.GetConversationMessages(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, msg := range page.Messages {
+			if err = d.changeMessage(ctx, deletion, msg, sentOnly); err != nil {
+				return err
+			}
+		}
+		if !page.HasMore || len(page.Messages) == 0 {
+			return nil
+		}
+		query.Before = page.Messages[0].MessageId
+	}
+}
+
+func (d *Deleter) changeMessage(ctx context.Context, deletion *UserDeletion, msg Message, sentOnly bool) error {
+	anonymize := deletion.MessagePolicy == DeletedMessagesAnonymize
+	// the messages received by the user are only deleted, anonymized messages are no longer sent by the user
+	if msg.Deleted || ((sentOnly || anonymize) && msg.SenderId != deletion.UserId) {
+		return nil
+	}
+	var err error
+	if anonymize {
+		_, err = d.Messages.AnonymizeMessage(ctx, msg.SenderId, msg.RecipientId, msg.MessageId)
+	} else {
+		_, err = d.Messages.DeleteMessage(ctx, msg.SenderId, msg.RecipientId, msg.MessageId)
+	}
+	var badRequest *BadRequestError
+	if errors.As(err, &badRequest) {
+		// deleted by its sender in the meantime
+		return nil
+	}
+	return err
+}
+
+func appendMissing(ids []string, id string) []string {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
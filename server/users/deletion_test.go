@@ -0,0 +1,277 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	. "server/common"
+	"server/db"
+	"server/messages"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deletionQueueMock records the enqueued deletions.
+type deletionQueueMock struct {
+	userIds []string
+}
+
+func (q *deletionQueueMock) Enqueue(userId string) {
+	q.userIds = append(q.userIds, userId)
+}
+
+// failingMessageChanger fails the first message changes, to interrupt a deletion.
+type failingMessageChanger struct {
+	MessageChanger
+	failures int
+	mu       sync.Mutex
+}
+
+func (f *failingMessageChanger) fail() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures == 0 {
+		return false
+	}
+	f.failures--
+	return true
+}
+
+func (f *failingMessageChanger) DeleteMessage(ctx context.Context, senderId string, recipientId string, messageId string) (*Message, error) {
+	if f.fail() {
+		return nil, &InternalServerError{Message: "Error updating message"}
+	}
+	return f.MessageChanger.DeleteMessage(ctx, senderId, recipientId, messageId)
+}
+
+// deletionTest is a user with a private conversation, a group they own with other members, a group of their own,
+// and a user that blocked them.
+type deletionTest struct {
+	dbClient   *db.MockDBClient
+	messages   *messages.Handler
+	user       User
+	peer       User
+	admin      User
+	group      Group
+	ownGroup   Group
+	sent       string // private message from the user to the peer
+	received   string // private message from the peer to the user
+	groupSent  string // group message of the user
+	groupOther string // group message of the peer
+}
+
+func newDeletionTest(t *testing.T) *deletionTest {
+	ctx := context.Background()
+	dbClient := db.NewMockDBClient()
+	test := &deletionTest{
+		dbClient: dbClient,
+		messages: &messages.Handler{DBClient: dbClient},
+		user:     User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())},
+		peer:     User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())},
+		admin:    User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())},
+	}
+	for _, user := range []User{test.user, test.peer, test.admin} {
+		assert.NoError(t, dbClient.StoreUser(ctx, user))
+	}
+	test.group = Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), OwnerId: test.user.UserId, Admins: map[string]bool{}, Members: map[string]bool{}}
+	test.ownGroup = Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), OwnerId: test.user.UserId, Admins: map[string]bool{}, Members: map[string]bool{}}
+	assert.NoError(t, dbClient.StoreGroup(ctx, test.group))
+	assert.NoError(t, dbClient.StoreGroup(ctx, test.ownGroup))
+	for _, user := range []User{test.user, test.peer, test.admin} {
+		assert.NoError(t, dbClient.AddUserToGroup(ctx, test.group, user))
+	}
+	assert.NoError(t, dbClient.AddUserToGroup(ctx, test.ownGroup, test.user))
+	assert.NoError(t, dbClient.SetGroupAdmin(ctx, test.group, test.admin.UserId, true))
+
+	send := func(senderId string, recipientId string, isGroup bool) string {
+		req := messages.SendMessageRequest{SenderId: senderId, RecipientId: recipientId, Message: "hello"}
+		send := test.messages.SendPrivateMessage
+		if isGroup {
+			send = test.messages.SendGroupMessage
+		}
+		resp, err := send(ctx, req)
+		assert.NoError(t, err)
+		return resp.MessageId
+	}
+	test.sent = send(test.user.UserId, test.peer.UserId, false)
+	test.received = send(test.peer.UserId, test.user.UserId, false)
+	test.groupSent = send(test.user.UserId, test.group.GroupId, true)
+	test.groupOther = send(test.peer.UserId, test.group.GroupId, true)
+	assert.NoError(t, dbClient.SetReadMarker(ctx, Conversation{UserId: test.user.UserId, ConversationId: test.group.GroupId, Type: ConversationGroup, LastReadMessageId: test.groupOther}))
+
+	peer, _ := dbClient.GetUser(ctx, test.peer.UserId)
+	assert.NoError(t, dbClient.BlockUser(ctx, *peer, test.user.UserId))
+	return test
+}
+
+func (test *deletionTest) message(t *testing.T, recipientId string, messageId string) *Message {
+	msg, err := test.dbClient.GetMessage(context.Background(), recipientId, messageId)
+	assert.NoError(t, err)
+	return msg
+}
+
+// assertCleanedUp checks everything but the messages.
+func (test *deletionTest) assertCleanedUp(t *testing.T) {
+	ctx := context.Background()
+	user, _ := test.dbClient.GetUser(ctx, test.user.UserId)
+	assert.Nil(t, user)
+	deletion, _ := test.dbClient.GetUserDeletion(ctx, test.user.UserId)
+	assert.Nil(t, deletion)
+
+	// the group passed to its admin
+	group, _ := test.dbClient.GetGroup(ctx, test.group.GroupId)
+	assert.Equal(t, test.admin.UserId, group.OwnerId)
+	assert.Empty(t, group.Admins)
+	assert.Equal(t, map[string]bool{test.peer.UserId: true, test.admin.UserId: true}, group.Members)
+	// the group without other members is deleted
+	ownGroup, _ := test.dbClient.GetGroup(ctx, test.ownGroup.GroupId)
+	assert.Nil(t, ownGroup)
+
+	peer, _ := test.dbClient.GetUser(ctx, test.peer.UserId)
+	assert.Empty(t, peer.BlockedUsers)
+	assert.True(t, peer.Groups[test.group.GroupId])
+	conversations, _ := test.dbClient.GetConversations(ctx, test.user.UserId)
+	assert.Empty(t, conversations)
+	// the conversation of the peer is kept
+	conversation, _ := test.dbClient.GetConversation(ctx, test.peer.UserId, test.user.UserId)
+	assert.NotNil(t, conversation)
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Delete user successfully", func(t *testing.T) {
+		test := newDeletionTest(t)
+		queue := &deletionQueueMock{}
+		handler := UsersHandler{DBClient: test.dbClient, Deletions: queue}
+
+		resp, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, test.user.UserId, resp.UserId)
+		assert.Equal(t, DeletedMessagesDelete, resp.MessagePolicy)
+		assert.Equal(t, []string{test.user.UserId}, queue.userIds)
+
+		// the user is gone right away, the rest is cleaned up by the deleter
+		user, _ := test.dbClient.GetUser(ctx, test.user.UserId)
+		assert.Nil(t, user)
+		deletion, _ := test.dbClient.GetUserDeletion(ctx, test.user.UserId)
+		assert.ElementsMatch(t, []string{test.group.GroupId, test.ownGroup.GroupId}, deletion.Groups)
+
+		// deleting again returns the deletion in progress
+		again, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, resp, again)
+	})
+
+	t.Run("non existing user", func(t *testing.T) {
+		handler := UsersHandler{DBClient: db.NewMockDBClient()}
+		_, err := handler.DeleteUser(ctx, "non-existing-user")
+		assert.Error(t, err)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("db error", func(t *testing.T) {
+		handler := UsersHandler{DBClient: db.NewMockDBClient()}
+		handler.DBClient.(*db.MockDBClient).Error = fmt.Errorf("some error")
+		_, err := handler.DeleteUser(ctx, "test-user")
+		assert.Error(t, err)
+		assert.IsType(t, &InternalServerError{}, err)
+	})
+}
+
+func TestDeleter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("delete messages", func(t *testing.T) {
+		test := newDeletionTest(t)
+		handler := UsersHandler{DBClient: test.dbClient, DeletedMessages: DeletedMessagesDelete}
+		_, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+
+		assert.NoError(t, NewDeleter(test.dbClient, test.messages).Delete(ctx, test.user.UserId))
+		test.assertCleanedUp(t)
+		// both directions of the private conversation and the group messages of the user
+		assert.True(t, test.message(t, test.peer.UserId, test.sent).Deleted)
+		assert.True(t, test.message(t, test.user.UserId, test.received).Deleted)
+		assert.True(t, test.message(t, test.group.GroupId, test.groupSent).Deleted)
+		assert.False(t, test.message(t, test.group.GroupId, test.groupOther).Deleted)
+	})
+
+	t.Run("anonymize messages", func(t *testing.T) {
+		test := newDeletionTest(t)
+		handler := UsersHandler{DBClient: test.dbClient, DeletedMessages: DeletedMessagesAnonymize}
+		_, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+
+		assert.NoError(t, NewDeleter(test.dbClient, test.messages).Delete(ctx, test.user.UserId))
+		test.assertCleanedUp(t)
+		for _, msg := range []*Message{test.message(t, test.peer.UserId, test.sent), test.message(t, test.group.GroupId, test.groupSent)} {
+			assert.Equal(t, DeletedUserId, msg.SenderId)
+			assert.Equal(t, "hello", msg.Message)
+		}
+		// the messages of the peer are kept as they are
+		for _, msg := range []*Message{test.message(t, test.user.UserId, test.received), test.message(t, test.group.GroupId, test.groupOther)} {
+			assert.Equal(t, test.peer.UserId, msg.SenderId)
+			assert.False(t, msg.Deleted)
+		}
+	})
+
+	t.Run("interrupted deletion resumes", func(t *testing.T) {
+		test := newDeletionTest(t)
+		handler := UsersHandler{DBClient: test.dbClient}
+		_, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+
+		// the first message change fails
+		deleter := NewDeleter(test.dbClient, &failingMessageChanger{MessageChanger: test.messages, failures: 1})
+		assert.Error(t, deleter.Delete(ctx, test.user.UserId))
+		deletion, _ := test.dbClient.GetUserDeletion(ctx, test.user.UserId)
+		assert.True(t, deletion.ConversationsListed)
+		assert.Equal(t, []string{test.peer.UserId}, deletion.Peers)
+
+		assert.NoError(t, deleter.Delete(ctx, test.user.UserId))
+		test.assertCleanedUp(t)
+		assert.True(t, test.message(t, test.peer.UserId, test.sent).Deleted)
+		assert.True(t, test.message(t, test.user.UserId, test.received).Deleted)
+	})
+
+	t.Run("run resumes the deletions in progress", func(t *testing.T) {
+		test := newDeletionTest(t)
+		handler := UsersHandler{DBClient: test.dbClient}
+		_, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		deleter := NewDeleter(test.dbClient, test.messages)
+		go deleter.Run(ctx)
+		assert.Eventually(t, func() bool {
+			deletion, _ := test.dbClient.GetUserDeletion(ctx, test.user.UserId)
+			return deletion == nil
+		}, time.Second, 10*time.Millisecond)
+		test.assertCleanedUp(t)
+	})
+
+	t.Run("run deletes the queued users", func(t *testing.T) {
+		test := newDeletionTest(t)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		deleter := NewDeleter(test.dbClient, test.messages)
+		go deleter.Run(ctx)
+
+		handler := UsersHandler{DBClient: test.dbClient, Deletions: deleter}
+		_, err := handler.DeleteUser(ctx, test.user.UserId)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			deletion, _ := test.dbClient.GetUserDeletion(ctx, test.user.UserId)
+			return deletion == nil
+		}, time.Second, 10*time.Millisecond)
+		test.assertCleanedUp(t)
+	})
+
+	t.Run("nothing to delete", func(t *testing.T) {
+		assert.NoError(t, NewDeleter(db.NewMockDBClient(), nil).Delete(ctx, "test-user"))
+	})
+}
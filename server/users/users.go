@@ -5,43 +5,111 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"golang.org/x/exp/slog"
+	"server/auth"
 	. "server/common"
 	"server/db"
+	"sort"
+	"time"
 )
 
+// dummyPasswordHash is checked instead of the password hash of a user that does not exist, so that the login takes as
+// long as for an existing user and its duration does not reveal whether the user exists. It has the default bcrypt cost.
+const dummyPasswordHash = "$2a$10$A0MjacBINsssbd./hxXvTuu0A5QDP.qhjJPm1..TW8FjpXFlg9KWu"
+
 type RegisterUserRequest struct {
 	UserName string `json:"userName"`
+	Password string `json:"password"`
 }
 type RegisterUserResponse struct {
 	UserId   string `json:"userId"`
 	UserName string `json:"userName"`
 }
 
+type LoginRequest struct {
+	UserId   string `json:"userId"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
 type BlockUserRequest struct {
 	BlockedUserId string `json:"blockedUserId"`
 }
 
+type BlockedUsersResponse struct {
+	BlockedUsers []string `json:"blockedUsers"`
+}
+
+type MuteRequest struct {
+	ConversationId string `json:"conversationId"` // peer user ID or group ID
+}
+
+type MutedConversationsResponse struct {
+	Muted []string `json:"muted"`
+}
+
+type Settings struct {
+	// BlockedGroupMessages is how the group messages of blocked users are delivered, show, hide or collapse
+	BlockedGroupMessages string `json:"blockedGroupMessages"`
+}
+
+type DeleteUserResponse struct {
+	UserId        string `json:"userId"`
+	MessagePolicy string `json:"messagePolicy"`
+	RequestedAt   string `json:"requestedAt"`
+}
+
+// DeletionQueue starts user deletions in the background, it is implemented by Deleter.
+type DeletionQueue interface {
+	Enqueue(userId string)
+}
+
 type UsersHandlerInterface interface {
 	RegisterUser(ctx context.Context, req RegisterUserRequest) (*RegisterUserResponse, error)
+	Login(ctx context.Context, req LoginRequest) (*LoginResponse, error)
 	BlockUser(ctx context.Context, userId string, req BlockUserRequest) error
 	UnblockUser(ctx context.Context, userId string, req BlockUserRequest) error
+	GetBlockedUsers(ctx context.Context, userId string) (*BlockedUsersResponse, error)
+	MuteConversation(ctx context.Context, userId string, req MuteRequest) error
+	UnmuteConversation(ctx context.Context, userId string, conversationId string) error
+	GetMutedConversations(ctx context.Context, userId string) (*MutedConversationsResponse, error)
+	GetSettings(ctx context.Context, userId string) (*Settings, error)
+	UpdateSettings(ctx context.Context, userId string, req Settings) (*Settings, error)
+	// GetMessageView returns the settings applied to the messages delivered to the user, see MessageView
+	GetMessageView(ctx context.Context, userId string) (*MessageView, error)
+	DeleteUser(ctx context.Context, userId string) (*DeleteUserResponse, error)
 }
 
 type UsersHandler struct {
 	DBClient db.DynamoDBClientInterface
+	Auth     *auth.Authenticator
+	// Deletions cleans up after deleted users, without it the deletions wait for the next resume of a Deleter
+	Deletions DeletionQueue
+	// DeletedMessages is the policy for the messages of deleted users, DeletedMessagesDelete if empty
+	DeletedMessages string
 }
 
 func (handler *UsersHandler) RegisterUser(ctx context.Context, req RegisterUserRequest) (*RegisterUserResponse, error) {
 	// generate a new user ID with UUID
 	userId := fmt.Sprintf("user-%s", uuid.New().String())
 
+	passwordHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error hashing password: %v", err))
+		return nil, &InternalServerError{Message: "Error storing user"}
+	}
+
 	// store the user in the database
 	user := User{
 		UserId:       userId,
 		UserName:     req.UserName,
+		PasswordHash: passwordHash,
 		BlockedUsers: make(map[string]bool),
 	}
-	err := handler.DBClient.StoreUser(ctx, user)
+	err = handler.DBClient.StoreUser(ctx, user)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error storing user: %v", err))
 		return nil, &InternalServerError{Message: "Error storing user"}
@@ -54,6 +122,35 @@ func (handler *UsersHandler) RegisterUser(ctx context.Context, req RegisterUserR
 	return &resp, nil
 }
 
+/*
+Login with the user ID and password set when the user was created
+Returns a bearer token that authenticates the user for the other APIs
+*/
+func (handler *UsersHandler) Login(ctx context.Context, req LoginRequest) (*LoginResponse, error) {
+	user, err := handler.DBClient.GetUser(ctx, req.UserId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	// do not reveal if the user exists, by the response or by the time it takes
+	passwordHash := dummyPasswordHash
+	if user != nil {
+		passwordHash = user.PasswordHash
+	}
+	if !auth.CheckPassword(passwordHash, req.Password) || user == nil {
+		slog.Error(fmt.Sprintf("Invalid credentials for user %s", req.UserId))
+		return nil, &UnauthorizedError{Message: "Invalid user ID or password"}
+	}
+
+	token, expiresAt, err := handler.Auth.IssueToken(user.UserId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error issuing token: %v", err))
+		return nil, &InternalServerError{Message: "Error issuing token"}
+	}
+	slog.Info(fmt.Sprintf("User %s logged in", user.UserId))
+	return &LoginResponse{Token: token, ExpiresAt: expiresAt}, nil
+}
+
 func (handler *UsersHandler) UnblockUser(ctx context.Context, userId string, req BlockUserRequest) error {
 
 	user, err := handler.DBClient.GetUser(ctx, userId)
@@ -135,3 +232,221 @@ func (handler *UsersHandler) BlockUser(ctx context.Context, userId string, req B
 
 	return nil
 }
+
+// getUser returns the user, or a NotFoundError if it does not exist.
+func (handler *UsersHandler) getUser(ctx context.Context, userId string) (*User, error) {
+	user, err := handler.DBClient.GetUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting user: %v", err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if user == nil {
+		slog.Error(fmt.Sprintf("User %s not found", userId))
+		return nil, &NotFoundError{Message: "User not found"}
+	}
+	return user, nil
+}
+
+// sortedIds returns the IDs of the set in order, an empty set is an empty list.
+func sortedIds(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id, ok := range set {
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/*
+Get the users blocked by the user, ordered by user ID
+*/
+func (handler *UsersHandler) GetBlockedUsers(ctx context.Context, userId string) (*BlockedUsersResponse, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockedUsersResponse{BlockedUsers: sortedIds(user.BlockedUsers)}, nil
+}
+
+/*
+Mute a private conversation with a peer or a group of the user
+Messages of muted conversations are still delivered, marked as muted, and are not counted as unread
+*/
+func (handler *UsersHandler) MuteConversation(ctx context.Context, userId string, req MuteRequest) error {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if user.Muted[req.ConversationId] {
+		slog.Error(fmt.Sprintf("Conversation %s is already muted by %s", req.ConversationId, userId))
+		return &BadRequestError{Message: "Conversation is already muted"}
+	}
+
+	// the conversation is a group of the user or a peer
+	if !user.Groups[req.ConversationId] {
+		peer, err := handler.DBClient.GetUser(ctx, req.ConversationId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting user: %v", err))
+			return &InternalServerError{Message: "Error getting user"}
+		}
+		if peer == nil {
+			slog.Error(fmt.Sprintf("Conversation %s of user %s not found", req.ConversationId, userId))
+			return &NotFoundError{Message: "Conversation not found"}
+		}
+	}
+
+	err = handler.DBClient.MuteConversation(ctx, *user, req.ConversationId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error muting conversation: %v", err))
+		return &InternalServerError{Message: "Error muting conversation"}
+	}
+	slog.Info(fmt.Sprintf("Conversation %s muted by %s", req.ConversationId, userId))
+	return nil
+}
+
+/*
+Unmute a conversation muted by the user
+*/
+func (handler *UsersHandler) UnmuteConversation(ctx context.Context, userId string, conversationId string) error {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if !user.Muted[conversationId] {
+		slog.Error(fmt.Sprintf("Conversation %s is not muted by %s", conversationId, userId))
+		return &BadRequestError{Message: "Conversation is not muted"}
+	}
+
+	err = handler.DBClient.UnmuteConversation(ctx, *user, conversationId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error unmuting conversation: %v", err))
+		return &InternalServerError{Message: "Error unmuting conversation"}
+	}
+	slog.Info(fmt.Sprintf("Conversation %s unmuted by %s", conversationId, userId))
+	return nil
+}
+
+/*
+Get the conversations muted by the user, peer user IDs and group IDs ordered by ID
+*/
+func (handler *UsersHandler) GetMutedConversations(ctx context.Context, userId string) (*MutedConversationsResponse, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &MutedConversationsResponse{Muted: sortedIds(user.Muted)}, nil
+}
+
+/*
+Get the settings of the user, the defaults for settings that were never changed
+*/
+func (handler *UsersHandler) GetSettings(ctx context.Context, userId string) (*Settings, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return userSettings(user), nil
+}
+
+func userSettings(user *User) *Settings {
+	settings := &Settings{BlockedGroupMessages: user.BlockedGroupMessages}
+	if settings.BlockedGroupMessages == "" {
+		settings.BlockedGroupMessages = BlockedMessagesShow
+	}
+	return settings
+}
+
+/*
+Update the settings of the user, settings missing in the request are not changed
+The group messages of blocked users are shown, hidden or collapsed, without their text, when the user gets their messages
+*/
+func (handler *UsersHandler) UpdateSettings(ctx context.Context, userId string, req Settings) (*Settings, error) {
+	if req.BlockedGroupMessages != "" && !ValidBlockedMessages(req.BlockedGroupMessages) {
+		slog.Error(fmt.Sprintf("Invalid blocked group messages setting: %s", req.BlockedGroupMessages))
+		return nil, &BadRequestError{Message: "blockedGroupMessages must be show, hide or collapse"}
+	}
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if req.BlockedGroupMessages == "" || req.BlockedGroupMessages == user.BlockedGroupMessages {
+		return userSettings(user), nil
+	}
+
+	err = handler.DBClient.SetBlockedGroupMessages(ctx, *user, req.BlockedGroupMessages)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error updating settings: %v", err))
+		return nil, &InternalServerError{Message: "Error updating settings"}
+	}
+	slog.Info(fmt.Sprintf("Blocked group messages of %s set to %s", userId, req.BlockedGroupMessages))
+	user.BlockedGroupMessages = req.BlockedGroupMessages
+	return userSettings(user), nil
+}
+
+func (handler *UsersHandler) GetMessageView(ctx context.Context, userId string) (*MessageView, error) {
+	user, err := handler.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	view := NewMessageView(*user)
+	return &view, nil
+}
+
+/*
+Delete the user account
+The user record is deleted right away, so that the user can no longer log in or be found by other users.
+The memberships, blocks, conversations and messages of the user are cleaned up in the background, see UserDeletion.
+Deleting a user whose deletion is in progress returns the pending deletion again.
+*/
+func (handler *UsersHandler) DeleteUser(ctx context.Context, userId string) (*DeleteUserResponse, error) {
+	deletion, err := handler.DBClient.GetUserDeletion(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error getting deletion of user %s: %v", userId, err))
+		return nil, &InternalServerError{Message: "Error getting user"}
+	}
+	if deletion == nil {
+		user, err := handler.DBClient.GetUser(ctx, userId)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error getting user: %v", err))
+			return nil, &InternalServerError{Message: "Error getting user"}
+		}
+		if user == nil {
+			slog.Error(fmt.Sprintf("User %s not found", userId))
+			return nil, &NotFoundError{Message: "User not found"}
+		}
+
+		deletion = &UserDeletion{
+			UserId:        userId,
+			MessagePolicy: handler.DeletedMessages,
+			RequestedAt:   time.Now().Format(time.RFC3339),
+		}
+		if deletion.MessagePolicy == "" {
+			deletion.MessagePolicy = DeletedMessagesDelete
+		}
+		// the groups are only listed in the user record
+		for groupId := range user.Groups {
+			deletion.Groups = append(deletion.Groups, groupId)
+		}
+		sort.Strings(deletion.Groups)
+		err = handler.DBClient.StoreUserDeletion(ctx, *deletion)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error storing deletion of user %s: %v", userId, err))
+			return nil, &InternalServerError{Message: "Error deleting user"}
+		}
+	}
+
+	// the deletion is stored first, so that it completes in the background even if this request is interrupted
+	err = handler.DBClient.DeleteUser(ctx, userId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error deleting user %s: %v", userId, err))
+		return nil, &InternalServerError{Message: "Error deleting user"}
+	}
+	if handler.Deletions != nil {
+		handler.Deletions.Enqueue(userId)
+	}
+
+	slog.Info(fmt.Sprintf("User %s deleted, cleaning up in the background", userId))
+	return &DeleteUserResponse{UserId: userId, MessagePolicy: deletion.MessagePolicy, RequestedAt: deletion.RequestedAt}, nil
+}
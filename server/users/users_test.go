@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"server/auth"
 	. "server/common"
 	"server/db"
 	"testing"
+	"time"
 )
 
 func TestRegisterUser(t *testing.T) {
@@ -18,12 +21,18 @@ func TestRegisterUser(t *testing.T) {
 		// create a new request
 		req := RegisterUserRequest{
 			UserName: "test-user",
+			Password: "test-password",
 		}
 		resp, err := handler.RegisterUser(ctx, req)
 		assert.NoError(t, err)
 		assert.NotEmpty(t, resp.UserId)
 		assert.Equal(t, req.UserName, resp.UserName)
 
+		// only the password hash is stored
+		user, _ := handler.DBClient.GetUser(ctx, resp.UserId)
+		assert.NotEmpty(t, user.PasswordHash)
+		assert.NotEqual(t, req.Password, user.PasswordHash)
+
 	})
 
 	t.Run("db error", func(t *testing.T) {
@@ -42,6 +51,60 @@ func TestRegisterUser(t *testing.T) {
 
 }
 
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	authenticator := auth.NewAuthenticator([]byte("test-secret"), time.Hour)
+	handler := UsersHandler{DBClient: db.NewMockDBClient(), Auth: authenticator}
+
+	user, err := handler.RegisterUser(ctx, RegisterUserRequest{UserName: "test-user", Password: "test-password"})
+	assert.NoError(t, err)
+
+	t.Run("Login successfully", func(t *testing.T) {
+		resp, err := handler.Login(ctx, LoginRequest{UserId: user.UserId, Password: "test-password"})
+		assert.NoError(t, err)
+		assert.True(t, resp.ExpiresAt.After(time.Now()))
+
+		userId, err := authenticator.ParseToken(resp.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, user.UserId, userId)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		resp, err := handler.Login(ctx, LoginRequest{UserId: user.UserId, Password: "wrong-password"})
+		assert.Error(t, err)
+		assert.IsType(t, &UnauthorizedError{}, err)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("non existing user", func(t *testing.T) {
+		resp, err := handler.Login(ctx, LoginRequest{UserId: "test-user-1", Password: "test-password"})
+		assert.Error(t, err)
+		assert.IsType(t, &UnauthorizedError{}, err)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("non existing user is checked against a hash of the default cost", func(t *testing.T) {
+		cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+		assert.NoError(t, err)
+		assert.Equal(t, bcrypt.DefaultCost, cost)
+
+		// the password of the dummy hash does not log in either
+		resp, err := handler.Login(ctx, LoginRequest{UserId: "test-user-1", Password: "not a password of any user"})
+		assert.Error(t, err)
+		assert.IsType(t, &UnauthorizedError{}, err)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("db error", func(t *testing.T) {
+		handler := UsersHandler{DBClient: db.NewMockDBClient(), Auth: authenticator}
+		handler.DBClient.(*db.MockDBClient).Error = fmt.Errorf("some error")
+
+		_, err := handler.Login(ctx, LoginRequest{UserId: user.UserId, Password: "test-password"})
+		assert.Error(t, err)
+		assert.IsType(t, &InternalServerError{}, err)
+	})
+}
+
 func TestBlockUser(t *testing.T) {
 	ctx := context.Background()
 	handler := UsersHandler{DBClient: db.NewMockDBClient()}
@@ -176,3 +239,138 @@ func TestUnblockUser(t *testing.T) {
 
 	})
 }
+
+func TestGetBlockedUsers(t *testing.T) {
+	ctx := context.Background()
+	handler := UsersHandler{DBClient: db.NewMockDBClient()}
+
+	t.Run("Get blocked users successfully", func(t *testing.T) {
+		user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+		handler.DBClient.StoreUser(ctx, user)
+
+		resp, err := handler.GetBlockedUsers(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{}, resp.BlockedUsers)
+
+		for _, blockedUserId := range []string{"test-user-b", "test-user-a"} {
+			handler.DBClient.StoreUser(ctx, User{UserId: blockedUserId})
+			assert.NoError(t, handler.BlockUser(ctx, user.UserId, BlockUserRequest{BlockedUserId: blockedUserId}))
+		}
+		resp, err = handler.GetBlockedUsers(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"test-user-a", "test-user-b"}, resp.BlockedUsers)
+	})
+
+	t.Run("non existing user", func(t *testing.T) {
+		_, err := handler.GetBlockedUsers(ctx, "non-existing-user")
+		assert.Error(t, err)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+}
+
+func TestMuteConversation(t *testing.T) {
+	ctx := context.Background()
+	handler := UsersHandler{DBClient: db.NewMockDBClient()}
+
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	peer := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	group := Group{GroupId: fmt.Sprintf("test-group-%s", uuid.New().String()), Members: map[string]bool{}}
+	handler.DBClient.StoreUser(ctx, user)
+	handler.DBClient.StoreUser(ctx, peer)
+	handler.DBClient.StoreGroup(ctx, group)
+	handler.DBClient.AddUserToGroup(ctx, group, user)
+
+	t.Run("Mute conversations successfully", func(t *testing.T) {
+		assert.NoError(t, handler.MuteConversation(ctx, user.UserId, MuteRequest{ConversationId: peer.UserId}))
+		assert.NoError(t, handler.MuteConversation(ctx, user.UserId, MuteRequest{ConversationId: group.GroupId}))
+
+		resp, err := handler.GetMutedConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{peer.UserId, group.GroupId}, resp.Muted)
+	})
+
+	t.Run("already muted", func(t *testing.T) {
+		err := handler.MuteConversation(ctx, user.UserId, MuteRequest{ConversationId: peer.UserId})
+		assert.Error(t, err)
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+
+	t.Run("conversation not found", func(t *testing.T) {
+		err := handler.MuteConversation(ctx, user.UserId, MuteRequest{ConversationId: "test-group-missing"})
+		assert.Error(t, err)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("Unmute conversation successfully", func(t *testing.T) {
+		assert.NoError(t, handler.UnmuteConversation(ctx, user.UserId, peer.UserId))
+
+		resp, err := handler.GetMutedConversations(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{group.GroupId}, resp.Muted)
+	})
+
+	t.Run("not muted", func(t *testing.T) {
+		err := handler.UnmuteConversation(ctx, user.UserId, peer.UserId)
+		assert.Error(t, err)
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+
+	t.Run("non existing user", func(t *testing.T) {
+		err := handler.MuteConversation(ctx, "non-existing-user", MuteRequest{ConversationId: peer.UserId})
+		assert.Error(t, err)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+
+	t.Run("db error", func(t *testing.T) {
+		handler := UsersHandler{DBClient: db.NewMockDBClient()}
+		handler.DBClient.(*db.MockDBClient).Error = fmt.Errorf("some error")
+
+		err := handler.MuteConversation(ctx, "test-user-1", MuteRequest{ConversationId: "test-user-2"})
+		assert.Error(t, err)
+		assert.IsType(t, &InternalServerError{}, err)
+	})
+}
+
+func TestSettings(t *testing.T) {
+	ctx := context.Background()
+	handler := UsersHandler{DBClient: db.NewMockDBClient()}
+	user := User{UserId: fmt.Sprintf("test-user-%s", uuid.New().String())}
+	handler.DBClient.StoreUser(ctx, user)
+
+	t.Run("default settings", func(t *testing.T) {
+		settings, err := handler.GetSettings(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, BlockedMessagesShow, settings.BlockedGroupMessages)
+	})
+
+	t.Run("Update settings successfully", func(t *testing.T) {
+		settings, err := handler.UpdateSettings(ctx, user.UserId, Settings{BlockedGroupMessages: BlockedMessagesHide})
+		assert.NoError(t, err)
+		assert.Equal(t, BlockedMessagesHide, settings.BlockedGroupMessages)
+
+		settings, err = handler.GetSettings(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, BlockedMessagesHide, settings.BlockedGroupMessages)
+		view, err := handler.GetMessageView(ctx, user.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, BlockedMessagesHide, view.BlockedGroupMessages)
+	})
+
+	t.Run("missing settings are not changed", func(t *testing.T) {
+		settings, err := handler.UpdateSettings(ctx, user.UserId, Settings{})
+		assert.NoError(t, err)
+		assert.Equal(t, BlockedMessagesHide, settings.BlockedGroupMessages)
+	})
+
+	t.Run("invalid setting", func(t *testing.T) {
+		_, err := handler.UpdateSettings(ctx, user.UserId, Settings{BlockedGroupMessages: "invalid"})
+		assert.Error(t, err)
+		assert.IsType(t, &BadRequestError{}, err)
+	})
+
+	t.Run("non existing user", func(t *testing.T) {
+		_, err := handler.UpdateSettings(ctx, "non-existing-user", Settings{BlockedGroupMessages: BlockedMessagesHide})
+		assert.Error(t, err)
+		assert.IsType(t, &NotFoundError{}, err)
+	})
+}